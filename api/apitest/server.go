@@ -0,0 +1,446 @@
+// Package apitest provides a fake Cloudflare client API for tests.
+//
+// The fake keeps registrations, enrolled keys and license bindings in memory
+// and answers the same /reg endpoints api.Client and the package level api
+// functions talk to. Errors are reported as models.APIError bodies,
+// just like the real API does.
+package apitest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/Diniboy1123/usque/models"
+)
+
+// Error codes returned by the fake besides models.InvalidPublicKey.
+// They are specific to this package and not taken from the real API.
+const (
+	CodeBadRequest     = 1000
+	CodeInvalidLicense = 1002
+	CodeNotFound       = 1004
+	CodeRateLimited    = 1015
+	CodeUnauthorized   = 10000
+)
+
+// Endpoints handed out to every device.
+const (
+	EndpointV4 = "162.159.198.1:0"
+	EndpointV6 = "[2606:4700:103::1]:0"
+)
+
+// TeamOrganization is the organization of devices registered with a team
+// token.
+const TeamOrganization = "example-org"
+
+// ServiceTokenID and ServiceTokenSecret are the Access service token of the
+// organization. Registrations with another service token are refused.
+const (
+	ServiceTokenID     = "service-token.access"
+	ServiceTokenSecret = "service-token-secret"
+)
+
+// TeamPolicy is the Zero Trust policy of devices registered with a team
+// token, besides the tunnel protocol.
+var TeamPolicy = models.Policy{
+	ServiceMode: &models.ServiceMode{Mode: "warp"},
+	Exclude: []models.SplitTunnelEntry{
+		{Address: "10.0.0.0/8", Description: "private"},
+		{Address: "192.168.0.0/16", Description: "private"},
+		{Host: "intranet.example.com"},
+	},
+	FallbackDomains: []models.FallbackDomain{
+		{Suffix: "corp.example.com", DNSServer: []string{"10.0.0.53"}},
+	},
+}
+
+// DefaultTime is the timestamp stamped on created resources unless Server.Now is set.
+var DefaultTime = time.Date(2025, time.January, 2, 3, 4, 5, 0, time.UTC)
+
+var licenseFormat = regexp.MustCompile(`^[0-9A-Za-z]{8}-[0-9A-Za-z]{8}-[0-9A-Za-z]{8}$`)
+
+// Server is a fake Cloudflare client API listening on a loopback port.
+// Point api.APIURL (or the --api-url flag) at URL to use it.
+type Server struct {
+	*httptest.Server
+
+	// Now returns the time stamped on created and updated resources.
+	// Defaults to returning DefaultTime so output is reproducible.
+	Now func() time.Time
+
+	mu         sync.Mutex
+	nextID     int
+	peerPubKey string
+	devices    map[string]*device
+	accounts   map[string]*account
+	queued     []queuedError
+	requests   int
+}
+
+type device struct {
+	data      models.AccountData
+	accountID string
+}
+
+type account struct {
+	data    models.Account
+	devices []string
+}
+
+type queuedError struct {
+	method     string
+	status     int
+	retryAfter string
+	errs       []models.ErrorInfo
+}
+
+// NewServer starts a fake API server. The caller should call Close when finished.
+func NewServer() *Server {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(fmt.Sprintf("apitest: failed to generate peer key: %v", err))
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		panic(fmt.Sprintf("apitest: failed to marshal peer key: %v", err))
+	}
+
+	s := &Server{
+		Now:        func() time.Time { return DefaultTime },
+		peerPubKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+		devices:    make(map[string]*device),
+		accounts:   make(map[string]*account),
+	}
+
+	mux := http.NewServeMux()
+	prefix := "/" + internal.ApiVersion + "/reg"
+	mux.HandleFunc("POST "+prefix, s.handleRegister)
+	mux.HandleFunc("PATCH "+prefix+"/{id}", s.withDevice(s.handleEnroll))
+	mux.HandleFunc("GET "+prefix+"/{id}/account", s.withDevice(s.handleGetAccount))
+	mux.HandleFunc("PUT "+prefix+"/{id}/account", s.withDevice(s.handleSetLicense))
+	mux.HandleFunc("DELETE "+prefix+"/{id}/account", s.withDevice(s.handleResetLicense))
+	mux.HandleFunc("GET "+prefix+"/{id}/account/devices", s.withDevice(s.handleGetDevices))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, models.ErrorInfo{Code: CodeNotFound, Message: "No route for that URI"})
+	})
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests++
+		if q, ok := s.popError(r.Method); ok {
+			if q.retryAfter != "" {
+				w.Header().Set("Retry-After", q.retryAfter)
+			}
+			writeError(w, q.status, q.errs...)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	return s
+}
+
+// QueueError makes the next request with the given HTTP method fail with
+// status and an APIError body holding errs. Queued errors are consumed in
+// order.
+func (s *Server) QueueError(method string, status int, errs ...models.ErrorInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queued = append(s.queued, queuedError{method: method, status: status, errs: errs})
+}
+
+// QueueRateLimit makes the next request with the given HTTP method fail with
+// 429 Too Many Requests and a Retry-After header of retryAfter, rounded down
+// to whole seconds. It is consumed in order with the errors of QueueError.
+func (s *Server) QueueRateLimit(method string, retryAfter time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queued = append(s.queued, queuedError{
+		method:     method,
+		status:     http.StatusTooManyRequests,
+		retryAfter: strconv.Itoa(int(retryAfter / time.Second)),
+		errs:       []models.ErrorInfo{{Code: CodeRateLimited, Message: "Too many requests"}},
+	})
+}
+
+// Requests returns the number of requests served so far.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// Device returns the current state of a registered device.
+func (s *Server) Device(id string) (models.AccountData, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.devices[id]
+	if !ok {
+		return models.AccountData{}, false
+	}
+	return d.data, true
+}
+
+// PeerPublicKey returns the PEM-encoded endpoint key handed out to devices.
+func (s *Server) PeerPublicKey() string {
+	return s.peerPubKey
+}
+
+// License returns the license key of the account a device is bound to.
+func (s *Server) License(id string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.devices[id]
+	if !ok {
+		return ""
+	}
+	return s.accounts[d.accountID].data.License
+}
+
+func (s *Server) popError(method string) (queuedError, bool) {
+	for i, q := range s.queued {
+		if q.method == method {
+			s.queued = append(s.queued[:i], s.queued[i+1:]...)
+			return q, true
+		}
+	}
+	return queuedError{}, false
+}
+
+func (s *Server) now() string {
+	return s.Now().UTC().Format(time.RFC3339Nano)
+}
+
+func (s *Server) newAccount() *account {
+	s.nextID++
+	a := &account{data: models.Account{
+		ID:          fmt.Sprintf("account-%d", s.nextID),
+		AccountType: "free",
+		Created:     s.now(),
+		Updated:     s.now(),
+		Role:        "parent",
+		License:     fmt.Sprintf("%08d-%08d-%08d", s.nextID, s.nextID, s.nextID),
+	}}
+	s.accounts[a.data.ID] = a
+	return a
+}
+
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var reg models.Registration
+	if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInfo{Code: CodeBadRequest, Message: "Invalid request body"})
+		return
+	}
+	if reg.Tos == "" || reg.Key == "" {
+		writeError(w, http.StatusBadRequest, models.ErrorInfo{Code: CodeBadRequest, Message: "Missing key or tos"})
+		return
+	}
+
+	team := r.Header.Get("CF-Access-Jwt-Assertion") != ""
+	if id := r.Header.Get("CF-Access-Client-Id"); id != "" {
+		if id != ServiceTokenID || r.Header.Get("CF-Access-Client-Secret") != ServiceTokenSecret {
+			writeError(w, http.StatusForbidden, models.ErrorInfo{Code: CodeUnauthorized, Message: "Invalid service token"})
+			return
+		}
+		team = true
+	}
+
+	acc := s.newAccount()
+	s.nextID++
+	d := &device{accountID: acc.data.ID, data: models.AccountData{
+		ID:      fmt.Sprintf("device-%d", s.nextID),
+		Type:    "Android",
+		Model:   reg.Model,
+		Key:     reg.Key,
+		KeyType: reg.KeyType,
+		TunType: reg.TunType,
+		Created: s.now(),
+		Updated: s.now(),
+		Tos:     reg.Tos,
+		Locale:  reg.Locale,
+		Enabled: true,
+		Token:   fmt.Sprintf("token-%d", s.nextID),
+		Policy:  models.Policy{TunnelProtocol: reg.TunType},
+	}}
+	if team {
+		acc.data.AccountType = "team"
+		acc.data.Organization = TeamOrganization
+		acc.data.License = ""
+		d.data.Policy = TeamPolicy
+		d.data.Policy.TunnelProtocol = reg.TunType
+	}
+	d.data.Config.ClientID = base64.StdEncoding.EncodeToString([]byte{byte(s.nextID)})
+	d.data.Config.Interface.Addresses.V4 = "172.16.0.2"
+	d.data.Config.Interface.Addresses.V6 = fmt.Sprintf("2606:4700:110:8000::%x", s.nextID)
+	peer := models.Peer{PublicKey: s.peerPubKey}
+	peer.Endpoint.V4 = EndpointV4
+	peer.Endpoint.V6 = EndpointV6
+	peer.Endpoint.Host = "engage.cloudflareclient.com:2408"
+	d.data.Config.Peers = []models.Peer{peer}
+
+	s.devices[d.data.ID] = d
+	acc.devices = append(acc.devices, d.data.ID)
+
+	writeJSON(w, s.accountData(d, true))
+}
+
+// withDevice authenticates the bearer token against the device in the path.
+func (s *Server) withDevice(next func(http.ResponseWriter, *http.Request, *device)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d, ok := s.devices[r.PathValue("id")]
+		if !ok || r.Header.Get("Authorization") != "Bearer "+d.data.Token {
+			writeError(w, http.StatusUnauthorized, models.ErrorInfo{Code: CodeUnauthorized, Message: "Authentication error"})
+			return
+		}
+		next(w, r, d)
+	}
+}
+
+func (s *Server) handleEnroll(w http.ResponseWriter, r *http.Request, d *device) {
+	var update models.DeviceUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInfo{Code: CodeBadRequest, Message: "Invalid request body"})
+		return
+	}
+	if !validMasqueKey(update.Key) || update.KeyType != internal.KeyTypeMasque {
+		writeError(w, http.StatusBadRequest, models.ErrorInfo{Code: models.InvalidPublicKey, Message: "Invalid public key"})
+		return
+	}
+
+	d.data.Key = update.Key
+	d.data.KeyType = update.KeyType
+	d.data.TunType = update.TunType
+	d.data.Policy.TunnelProtocol = update.TunType
+	if update.Name != "" {
+		d.data.Name = update.Name
+	}
+	d.data.Updated = s.now()
+
+	writeJSON(w, s.accountData(d, false))
+}
+
+func (s *Server) handleGetAccount(w http.ResponseWriter, r *http.Request, d *device) {
+	writeJSON(w, s.accounts[d.accountID].data)
+}
+
+func (s *Server) handleSetLicense(w http.ResponseWriter, r *http.Request, d *device) {
+	var req models.Account
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, models.ErrorInfo{Code: CodeBadRequest, Message: "Invalid request body"})
+		return
+	}
+	if !licenseFormat.MatchString(req.License) {
+		writeError(w, http.StatusBadRequest, models.ErrorInfo{Code: CodeInvalidLicense, Message: "Invalid license"})
+		return
+	}
+
+	var target *account
+	for _, a := range s.accounts {
+		if a.data.License == req.License {
+			target = a
+			break
+		}
+	}
+	if target == nil {
+		writeError(w, http.StatusNotFound, models.ErrorInfo{Code: CodeInvalidLicense, Message: "License not found"})
+		return
+	}
+
+	s.moveDevice(d, target)
+	writeJSON(w, target.data)
+}
+
+func (s *Server) handleResetLicense(w http.ResponseWriter, r *http.Request, d *device) {
+	s.moveDevice(d, s.newAccount())
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleGetDevices(w http.ResponseWriter, r *http.Request, d *device) {
+	devices := models.Devices{}
+	for _, id := range s.accounts[d.accountID].devices {
+		other := s.devices[id]
+		devices = append(devices, models.Device{
+			ID:        other.data.ID,
+			Type:      other.data.Type,
+			Model:     other.data.Model,
+			Name:      other.data.Name,
+			Created:   other.data.Created,
+			Activated: other.data.Updated,
+			Active:    other.data.Enabled,
+			Role:      s.accounts[other.accountID].data.Role,
+		})
+	}
+	writeJSON(w, devices)
+}
+
+// moveDevice rebinds d to target, the way applying a license key does.
+func (s *Server) moveDevice(d *device, target *account) {
+	if d.accountID == target.data.ID {
+		return
+	}
+	old := s.accounts[d.accountID]
+	for i, id := range old.devices {
+		if id == d.data.ID {
+			old.devices = append(old.devices[:i], old.devices[i+1:]...)
+			break
+		}
+	}
+	if len(old.devices) == 0 {
+		delete(s.accounts, old.data.ID)
+	}
+	d.accountID = target.data.ID
+	target.devices = append(target.devices, d.data.ID)
+	target.data.Updated = s.now()
+}
+
+// accountData returns the device as seen by the API, with the token only
+// included in registration responses.
+func (s *Server) accountData(d *device, withToken bool) models.AccountData {
+	data := d.data
+	data.Account = s.accounts[d.accountID].data
+	if !withToken {
+		data.Token = ""
+	}
+	return data
+}
+
+// validMasqueKey reports whether key is a base64 DER-encoded P-256 public key.
+func validMasqueKey(key string) bool {
+	der, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return false
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return false
+	}
+	ecPub, ok := pub.(*ecdsa.PublicKey)
+	return ok && ecPub.Curve == elliptic.P256()
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, errs ...models.ErrorInfo) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if errs == nil {
+		errs = []models.ErrorInfo{}
+	}
+	_ = json.NewEncoder(w).Encode(models.APIError{Success: false, Errors: errs})
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	connectip "github.com/Diniboy1123/connect-ip-go"
+)
+
+// addressAssignTimeout bounds how long the OnConnect hook of a new HTTP/3
+// connection waits for the server's ADDRESS_ASSIGN and ROUTE_ADVERTISEMENT
+// capsules, so that it carries them. Packets flow in the meantime. HTTP/2
+// connections do not support these capsules.
+const addressAssignTimeout = time.Second
+
+// advertisedRoutes wraps ipConn.Routes to return the routes as prefixes.
+// Restrictions of a route to an IP protocol are not reported.
+func advertisedRoutes(ipConn *connectip.Conn) func(ctx context.Context) ([]netip.Prefix, error) {
+	return func(ctx context.Context) ([]netip.Prefix, error) {
+		ranges, err := ipConn.Routes(ctx)
+		if err != nil {
+			return nil, err
+		}
+		routes := []netip.Prefix{}
+		for _, r := range ranges {
+			routes = append(routes, r.Prefixes()...)
+		}
+		return routes, nil
+	}
+}
+
+// watchAssignment calls next, e.g. ipConn.LocalPrefixes, in a loop and sends
+// its results to updates until ctx is done or the connection is closed.
+func watchAssignment(ctx context.Context, next func(ctx context.Context) ([]netip.Prefix, error), updates chan<- []netip.Prefix) {
+	for {
+		prefixes, err := next(ctx)
+		if err != nil {
+			return
+		}
+		select {
+		case updates <- prefixes:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// addressOf returns the address of the first prefix of the given family.
+func addressOf(prefixes []netip.Prefix, ipv6 bool) (netip.Addr, bool) {
+	for _, p := range prefixes {
+		if p.Addr().Is6() == ipv6 {
+			return p.Addr(), true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// formatPrefixes joins prefixes with spaces.
+func formatPrefixes(prefixes []netip.Prefix) string {
+	s := make([]string, len(prefixes))
+	for i, p := range prefixes {
+		s[i] = p.String()
+	}
+	return strings.Join(s, " ")
+}
+
+// sourceAddr is the source address of the echo prober, replaced when the
+// server assigns another address of its family.
+type sourceAddr struct {
+	mu   sync.Mutex
+	addr netip.Addr
+}
+
+func (s *sourceAddr) get() netip.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addr
+}
+
+// assigned switches to the assigned address of the same family unless the
+// current one is among addresses.
+func (s *sourceAddr) assigned(addresses []netip.Prefix) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range addresses {
+		if p.Contains(s.addr) {
+			return
+		}
+	}
+	if addr, ok := addressOf(addresses, s.addr.Is6()); ok {
+		s.addr = addr
+	}
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// DefaultMaxReconnectDelay is the default of
+// MaintainTunnelConfig.MaxReconnectDelay.
+const DefaultMaxReconnectDelay = time.Minute
+
+// ErrAccessDenied is returned when the endpoint rejects the client
+// certificate, e.g. because the key was revoked or never enrolled.
+var ErrAccessDenied = errors.New("login failed! Please double-check if your tls key and cert is enrolled in the Cloudflare Access service")
+
+// ErrFailureBudgetExhausted is returned by Tunnel.Run once
+// MaintainTunnelConfig.FailureBudget consecutive attempts failed.
+var ErrFailureBudgetExhausted = errors.New("failure budget exhausted")
+
+// PermanentError wraps a tunnel error retrying won't fix, such as
+// ErrAccessDenied or a CONNECT-IP request rejected with a 4xx status.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// classifyTunnelError wraps err in a *PermanentError if retrying won't fix it.
+// The endpoint rejecting the client key is only permanent if rekeyed is
+// false: right after a key rotation, the handshake may have presented the
+// key the rotation replaced.
+func classifyTunnelError(err error, rekeyed bool) error {
+	if err == nil || errors.As(err, new(*PermanentError)) {
+		return err
+	}
+	if (errors.Is(err, ErrAccessDenied) || isClientCertRejected(err)) && !rekeyed {
+		return &PermanentError{Err: err}
+	}
+	return err
+}
+
+// clientCertAlerts are the TLS alerts with which an endpoint may reject our
+// certificate: bad_certificate, as api.Server sends for unknown keys,
+// unsupported_certificate, certificate_unknown, unknown_ca and access_denied.
+var clientCertAlerts = []tls.AlertError{42, 43, 46, 48, 49}
+
+// isClientCertRejected reports whether the endpoint refused the handshake
+// because of our certificate. Over QUIC the alert arrives as a CRYPTO_ERROR
+// closing the connection, over TLS on TCP as a "remote error" of the
+// connection.
+func isClientCertRejected(err error) bool {
+	var transportErr *quic.TransportError
+	if errors.As(err, &transportErr) {
+		return transportErr.Remote && slices.ContainsFunc(clientCertAlerts, func(alert tls.AlertError) bool {
+			return transportErr.ErrorCode == 0x100+quic.TransportErrorCode(alert)
+		})
+	}
+	var alert tls.AlertError
+	if errors.As(err, &alert) {
+		return slices.Contains(clientCertAlerts, alert)
+	}
+	// crypto/tls doesn't export the alert type of received alerts
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "remote error" && slices.ContainsFunc(clientCertAlerts, func(alert tls.AlertError) bool {
+		return opErr.Err.Error() == alert.Error()
+	})
+}
+
+// connectStatusError returns the error for a CONNECT-IP response other than
+// 200. Client errors other than 429 are permanent.
+func connectStatusError(rsp *http.Response) error {
+	err := fmt.Errorf("tunnel connection failed: %s", rsp.Status)
+	if rsp.StatusCode >= 400 && rsp.StatusCode < 500 && rsp.StatusCode != http.StatusTooManyRequests {
+		return &PermanentError{Err: err}
+	}
+	return err
+}
+
+// jitteredBackoff returns base doubled attempt times, capped at limit, with up
+// to 50% jitter so that many clients don't retry in lockstep.
+func jitteredBackoff(base, limit time.Duration, attempt int) time.Duration {
+	delay := base << attempt
+	if delay <= 0 || delay > limit || attempt >= 63 {
+		delay = limit
+	}
+	if half := int64(delay / 2); half > 0 {
+		delay = delay/2 + time.Duration(rand.Int64N(half+1))
+	}
+	return delay
+}
@@ -0,0 +1,407 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/Diniboy1123/usque/models"
+)
+
+// Defaults used by NewClient.
+const (
+	DefaultMaxRetries     = 3
+	DefaultRetryBackoff   = 500 * time.Millisecond
+	DefaultMaxRetryDelay  = 30 * time.Second
+	DefaultRequestTimeout = 30 * time.Second
+)
+
+// Sentinel errors matched by StatusError through errors.Is.
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrNotFound     = errors.New("not found")
+	ErrRateLimited  = errors.New("rate limited")
+)
+
+// StatusError is returned when the API answers with a status other than 200.
+//
+// It unwraps to the *models.APIError decoded from the body, if any, and
+// matches ErrUnauthorized, ErrNotFound and ErrRateLimited with errors.Is
+// depending on the status code.
+type StatusError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	// RetryAfter is the delay requested by the server with a Retry-After header.
+	RetryAfter time.Duration
+	// APIError is the decoded error body, nil if the body was not an API error.
+	APIError *models.APIError
+}
+
+func (e *StatusError) Error() string {
+	if e.APIError != nil && len(e.APIError.Errors) > 0 {
+		return e.APIError.Error()
+	}
+	return fmt.Sprintf("%s %s: unexpected status %d %s", e.Method, e.Path, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+func (e *StatusError) Unwrap() error {
+	if e.APIError == nil {
+		return nil
+	}
+	return e.APIError
+}
+
+func (e *StatusError) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// temporary reports whether repeating the request may succeed.
+func (e *StatusError) temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// Client is a Cloudflare client API client acting on behalf of one device.
+//
+// A zero Client is not usable, create one with NewClient. Fields may be
+// adjusted before the first request but not concurrently with requests.
+type Client struct {
+	// BaseURL is the API base URL without the version, e.g. https://api.cloudflareclient.com.
+	BaseURL string
+	// HTTPClient sends the requests.
+	HTTPClient *http.Client
+	// DeviceID is the device registration ID. Set by Register.
+	DeviceID string
+	// Token is the device access token. Set by Register.
+	Token string
+
+	// MaxRetries is how often a failed request is repeated. Idempotent
+	// requests are retried on network errors and 5xx responses, every
+	// request is retried on 429.
+	MaxRetries int
+	// RetryBackoff is the delay before the first retry, doubling (with
+	// jitter) on each further attempt.
+	RetryBackoff time.Duration
+	// MaxRetryDelay caps the backoff. A Retry-After longer than this is not
+	// waited for; the *StatusError is returned instead.
+	MaxRetryDelay time.Duration
+	// RequestTimeout bounds each attempt. Zero means no timeout.
+	RequestTimeout time.Duration
+}
+
+// NewClient creates a Client for a device using APIURL, HTTPClient and the
+// default retry settings. deviceID and token may be empty before Register.
+//
+// Parameters:
+//   - deviceID: string - The device registration ID.
+//   - token: string - The device registration access token.
+//
+// Returns:
+//   - *Client: The API client.
+func NewClient(deviceID, token string) *Client {
+	return &Client{
+		BaseURL:        APIURL,
+		HTTPClient:     HTTPClient,
+		DeviceID:       deviceID,
+		Token:          token,
+		MaxRetries:     DefaultMaxRetries,
+		RetryBackoff:   DefaultRetryBackoff,
+		MaxRetryDelay:  DefaultMaxRetryDelay,
+		RequestTimeout: DefaultRequestTimeout,
+	}
+}
+
+// Register registers a new device with a random WireGuard key and serial,
+// mimicking the Android app. On success the client's DeviceID and Token are
+// set to the new registration. Calling it implies accepting the Terms of
+// Service.
+//
+// Parameters:
+//   - ctx: context.Context - The request context.
+//   - model: string - The device model string to register. (e.g., "PC")
+//   - locale: string - The user's locale. (e.g., "en_US")
+//   - jwt: string - Team token to register, optional.
+//
+// Returns:
+//   - *models.AccountData: The account data of the new registration.
+//   - error: An error if registration fails.
+func (c *Client) Register(ctx context.Context, model, locale, jwt string) (*models.AccountData, error) {
+	return c.RegisterTeam(ctx, model, locale, TeamAuth{JWT: jwt})
+}
+
+// RegisterTeam is Register authenticated as a member of a Zero Trust
+// organization, with a user's token or a service token. A zero auth
+// registers a consumer device.
+//
+// Parameters:
+//   - ctx: context.Context - The request context.
+//   - model: string - The device model string to register. (e.g., "PC")
+//   - locale: string - The user's locale. (e.g., "en_US")
+//   - auth: TeamAuth - The credentials of the organization member.
+//
+// Returns:
+//   - *models.AccountData: The account data of the new registration.
+//   - error: An error if registration fails.
+func (c *Client) RegisterTeam(ctx context.Context, model, locale string, auth TeamAuth) (*models.AccountData, error) {
+	wgKey, err := internal.GenerateRandomWgPubkey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate wg key: %v", err)
+	}
+	serial, err := internal.GenerateRandomAndroidSerial()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial: %v", err)
+	}
+
+	data := models.Registration{
+		Key:       wgKey,
+		InstallID: "",
+		FcmToken:  "",
+		Tos:       internal.TimeAsCfString(time.Now()),
+		Model:     model,
+		Serial:    serial,
+		OsVersion: "",
+		KeyType:   internal.KeyTypeWg,
+		TunType:   internal.TunTypeWg,
+		Locale:    locale,
+	}
+
+	var accountData models.AccountData
+	// not idempotent, a retried registration would create a second device
+	if err := c.do(ctx, http.MethodPost, "/reg", auth.header(), data, false, &accountData); err != nil {
+		return nil, err
+	}
+
+	c.DeviceID = accountData.ID
+	c.Token = accountData.Token
+	return &accountData, nil
+}
+
+// EnrollKey sets the device's MASQUE public key and optionally renames it.
+//
+// Parameters:
+//   - ctx: context.Context - The request context.
+//   - pubKey: []byte - The new MASQUE public key in PKIX DER format.
+//   - deviceName: string - The new name of the device, optional.
+//
+// Returns:
+//   - *models.AccountData: The updated account data.
+//   - error: An error if the enrollment fails.
+func (c *Client) EnrollKey(ctx context.Context, pubKey []byte, deviceName string) (*models.AccountData, error) {
+	deviceUpdate := models.DeviceUpdate{
+		Key:     base64.StdEncoding.EncodeToString(pubKey),
+		KeyType: internal.KeyTypeMasque,
+		TunType: internal.TunTypeMasque,
+		Name:    deviceName,
+	}
+
+	var accountData models.AccountData
+	// setting the same key twice has the same effect, so retrying is safe
+	if err := c.do(ctx, http.MethodPatch, "/reg/"+c.DeviceID, c.authHeader(), deviceUpdate, true, &accountData); err != nil {
+		return nil, err
+	}
+	return &accountData, nil
+}
+
+// GetAccount retrieves the account the device is bound to.
+//
+// Parameters:
+//   - ctx: context.Context - The request context.
+//
+// Returns:
+//   - *models.Account: The account information.
+//   - error: An error if the request fails.
+func (c *Client) GetAccount(ctx context.Context) (*models.Account, error) {
+	var account models.Account
+	if err := c.do(ctx, http.MethodGet, "/reg/"+c.DeviceID+"/account", c.authHeader(), nil, true, &account); err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// UpdateLicenceKey binds the device to the account owning licenceKey.
+//
+// Parameters:
+//   - ctx: context.Context - The request context.
+//   - licenceKey: string - The license key to bind to.
+//
+// Returns:
+//   - error: An error if the update fails or the license key is invalid.
+func (c *Client) UpdateLicenceKey(ctx context.Context, licenceKey string) error {
+	header := c.authHeader()
+	header.Set("Content-Type", "application/json")
+	return c.do(ctx, http.MethodPut, "/reg/"+c.DeviceID+"/account", header, models.Account{License: licenceKey}, true, nil)
+}
+
+// DeleteLicenceKey unbinds the device from its license key.
+//
+// Parameters:
+//   - ctx: context.Context - The request context.
+//
+// Returns:
+//   - error: An error if the removal fails.
+func (c *Client) DeleteLicenceKey(ctx context.Context) error {
+	return c.do(ctx, http.MethodDelete, "/reg/"+c.DeviceID+"/account", c.authHeader(), nil, true, nil)
+}
+
+// GetDevices lists the devices bound to the same account.
+//
+// Parameters:
+//   - ctx: context.Context - The request context.
+//
+// Returns:
+//   - *models.Devices: The devices of the account.
+//   - error: An error if the request fails.
+func (c *Client) GetDevices(ctx context.Context) (*models.Devices, error) {
+	var devices models.Devices
+	if err := c.do(ctx, http.MethodGet, "/reg/"+c.DeviceID+"/account/devices", c.authHeader(), nil, true, &devices); err != nil {
+		return nil, err
+	}
+	return &devices, nil
+}
+
+func (c *Client) authHeader() http.Header {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+c.Token)
+	return header
+}
+
+// do sends a request to path below the versioned base URL, retrying as
+// configured, and decodes a 200 response into out unless out is nil.
+func (c *Client) do(ctx context.Context, method, path string, header http.Header, in any, idempotent bool, out any) error {
+	var body []byte
+	if in != nil {
+		var err error
+		body, err = json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("failed to marshal json: %v", err)
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := c.doOnce(ctx, method, path, header, body, out)
+		if err == nil {
+			return nil
+		}
+		if attempt >= c.MaxRetries || ctx.Err() != nil {
+			return err
+		}
+
+		delay := c.backoff(attempt)
+		var statusErr *StatusError
+		switch {
+		case errors.As(err, &statusErr):
+			if !statusErr.temporary() || (!idempotent && statusErr.StatusCode != http.StatusTooManyRequests) {
+				return err
+			}
+			if statusErr.RetryAfter > 0 {
+				if statusErr.RetryAfter > c.MaxRetryDelay {
+					return err
+				}
+				delay = statusErr.RetryAfter
+			}
+		case !idempotent:
+			// the request may have been processed before the connection broke
+			return err
+		}
+
+		if sleepErr := sleepCtx(ctx, delay); sleepErr != nil {
+			return err
+		}
+	}
+}
+
+func (c *Client) doOnce(ctx context.Context, method, path string, header http.Header, body []byte, out any) error {
+	if c.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.RequestTimeout)
+		defer cancel()
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+"/"+internal.ApiVersion+path, reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	for k, v := range internal.Headers {
+		req.Header.Set(k, v)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		statusErr := &StatusError{
+			Method:     method,
+			Path:       path,
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+		var apiErr models.APIError
+		if json.Unmarshal(respBody, &apiErr) == nil && len(apiErr.Errors) > 0 {
+			statusErr.APIError = &apiErr
+		}
+		return statusErr
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	return nil
+}
+
+// backoff returns the delay before retry number attempt+1.
+func (c *Client) backoff(attempt int) time.Duration {
+	return jitteredBackoff(c.RetryBackoff, c.MaxRetryDelay, attempt)
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
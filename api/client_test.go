@@ -0,0 +1,116 @@
+package api_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/api/apitest"
+	"github.com/Diniboy1123/usque/models"
+)
+
+// newTestClient registers a device on a fresh fake API and returns a client
+// for it with short retry delays.
+func newTestClient(t *testing.T) (*api.Client, *apitest.Server) {
+	t.Helper()
+	srv := apitest.NewServer()
+	t.Cleanup(srv.Close)
+
+	c := api.NewClient("", "")
+	c.BaseURL = srv.URL
+	c.RetryBackoff = time.Millisecond
+	c.MaxRetryDelay = 2 * time.Second
+	if _, err := c.Register(context.Background(), "PC", "en_US", ""); err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	return c, srv
+}
+
+func TestClientRetriesIdempotentRequests(t *testing.T) {
+	c, srv := newTestClient(t)
+	srv.QueueError(http.MethodGet, http.StatusServiceUnavailable)
+	srv.QueueError(http.MethodGet, http.StatusBadGateway)
+
+	before := srv.Requests()
+	if _, err := c.GetAccount(context.Background()); err != nil {
+		t.Fatalf("GetAccount failed: %v", err)
+	}
+	if got := srv.Requests() - before; got != 3 {
+		t.Errorf("got %d requests, want 3", got)
+	}
+}
+
+func TestClientDoesNotRetryRegister(t *testing.T) {
+	c, srv := newTestClient(t)
+	srv.QueueError(http.MethodPost, http.StatusServiceUnavailable,
+		models.ErrorInfo{Code: apitest.CodeBadRequest, Message: "Try again later"})
+
+	before := srv.Requests()
+	_, err := c.Register(context.Background(), "PC", "en_US", "")
+	var statusErr *api.StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got error %v, want a 503 StatusError", err)
+	}
+	var apiErr *models.APIError
+	if !errors.As(err, &apiErr) || !apiErr.HasErrorCode(apitest.CodeBadRequest) {
+		t.Errorf("error %v does not unwrap to the API error", err)
+	}
+	if got := srv.Requests() - before; got != 1 {
+		t.Errorf("got %d requests, want 1", got)
+	}
+}
+
+func TestClientHonoursRetryAfter(t *testing.T) {
+	c, srv := newTestClient(t)
+	srv.QueueRateLimit(http.MethodPost, time.Second)
+
+	start := time.Now()
+	if _, err := c.Register(context.Background(), "PC", "en_US", ""); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %v, before Retry-After passed", elapsed)
+	}
+
+	// a Retry-After beyond MaxRetryDelay is reported instead of waited for
+	srv.QueueRateLimit(http.MethodGet, time.Minute)
+	_, err := c.GetDevices(context.Background())
+	var statusErr *api.StatusError
+	if !errors.Is(err, api.ErrRateLimited) || !errors.As(err, &statusErr) || statusErr.RetryAfter != time.Minute {
+		t.Fatalf("got error %v, want rate limit error with a one minute Retry-After", err)
+	}
+}
+
+func TestClientContextCancel(t *testing.T) {
+	c, srv := newTestClient(t)
+	c.RetryBackoff = time.Hour
+	c.MaxRetryDelay = time.Hour
+	srv.QueueError(http.MethodDelete, http.StatusInternalServerError)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- c.DeleteLicenceKey(ctx) }()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("DeleteLicenceKey succeeded although the context expired during backoff")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("DeleteLicenceKey did not return after the context expired")
+	}
+}
+
+func TestClientUnauthorized(t *testing.T) {
+	c, _ := newTestClient(t)
+	c.Token = "revoked"
+
+	_, err := c.GetAccount(context.Background())
+	if !errors.Is(err, api.ErrUnauthorized) {
+		t.Fatalf("got error %v, want ErrUnauthorized", err)
+	}
+}
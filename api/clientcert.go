@@ -0,0 +1,96 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/Diniboy1123/usque/internal"
+)
+
+// Defaults of the certificates minted by a CertMinter.
+const (
+	DefaultCertLifetime  = 24 * time.Hour
+	DefaultCertClockSkew = time.Hour
+)
+
+// CertMinter mints the self-signed certificate of a key for every TLS
+// handshake, so that processes running for longer than a certificate's
+// lifetime never present an expired one. Clients use it through Attach,
+// servers, which peers pin by their key, through GetCertificate.
+type CertMinter struct {
+	lifetime  time.Duration
+	clockSkew time.Duration
+	key       atomic.Pointer[ecdsa.PrivateKey]
+}
+
+// NewCertMinter creates a CertMinter for privKey.
+//
+// Parameters:
+//   - privKey: *ecdsa.PrivateKey - The key to present.
+//   - lifetime: time.Duration - How long minted certificates are valid, DefaultCertLifetime if not positive.
+//   - clockSkew: time.Duration - How far before the handshake the certificates are valid from, so that endpoints whose clock is behind accept them. Negative means DefaultCertClockSkew.
+//
+// Returns:
+//   - *CertMinter: The minter.
+func NewCertMinter(privKey *ecdsa.PrivateKey, lifetime, clockSkew time.Duration) *CertMinter {
+	if lifetime <= 0 {
+		lifetime = DefaultCertLifetime
+	}
+	if clockSkew < 0 {
+		clockSkew = DefaultCertClockSkew
+	}
+	m := &CertMinter{lifetime: lifetime, clockSkew: clockSkew}
+	m.key.Store(privKey)
+	return m
+}
+
+// Key returns the key certificates are minted for.
+func (m *CertMinter) Key() *ecdsa.PrivateKey {
+	return m.key.Load()
+}
+
+// SetKey replaces the key of later certificates.
+//
+// Parameters:
+//   - privKey: *ecdsa.PrivateKey - The new key.
+func (m *CertMinter) SetKey(privKey *ecdsa.PrivateKey) {
+	m.key.Store(privKey)
+}
+
+// Attach makes tlsConfig present certificates minted by m, replacing its
+// Certificates. It must be called before tlsConfig is used.
+//
+// Parameters:
+//   - tlsConfig: *tls.Config - A configuration of PrepareTlsConfig.
+func (m *CertMinter) Attach(tlsConfig *tls.Config) {
+	tlsConfig.Certificates = nil
+	tlsConfig.GetClientCertificate = m.GetClientCertificate
+}
+
+// GetClientCertificate mints a certificate of the current key, valid from
+// the clock skew before now for the lifetime. It has the signature of
+// tls.Config.GetClientCertificate.
+func (m *CertMinter) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return m.mint()
+}
+
+// GetCertificate mints a certificate like GetClientCertificate. It has the
+// signature of tls.Config.GetCertificate.
+func (m *CertMinter) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return m.mint()
+}
+
+// mint creates a certificate of the current key, valid from the clock skew
+// before now for the lifetime.
+func (m *CertMinter) mint() (*tls.Certificate, error) {
+	privKey := m.key.Load()
+	now := time.Now()
+	cert, err := internal.GenerateCertValidity(privKey, now.Add(-m.clockSkew), now.Add(m.lifetime))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate cert: %v", err)
+	}
+	return &tls.Certificate{Certificate: cert, PrivateKey: privKey}, nil
+}
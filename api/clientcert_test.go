@@ -0,0 +1,55 @@
+package api_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+)
+
+func TestCertMinter(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	minter := api.NewCertMinter(key, time.Hour, 5*time.Minute)
+
+	mint := func() *x509.Certificate {
+		t.Helper()
+		cert, err := minter.GetClientCertificate(&tls.CertificateRequestInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	before := time.Now().Truncate(time.Second)
+	cert := mint()
+	if !cert.PublicKey.(*ecdsa.PublicKey).Equal(&key.PublicKey) {
+		t.Errorf("minted certificate is not of the key")
+	}
+	if notBefore := before.Add(-5 * time.Minute); cert.NotBefore.Before(notBefore) || cert.NotBefore.After(notBefore.Add(time.Second)) {
+		t.Errorf("got NotBefore %s, want the clock skew before %s", cert.NotBefore, before)
+	}
+	if lifetime := cert.NotAfter.Sub(cert.NotBefore); lifetime != time.Hour+5*time.Minute {
+		t.Errorf("got validity of %s, want the lifetime after the handshake", lifetime)
+	}
+
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	minter.SetKey(newKey)
+	if !mint().PublicKey.(*ecdsa.PublicKey).Equal(&newKey.PublicKey) {
+		t.Errorf("minted certificate is not of the new key")
+	}
+}
@@ -1,22 +1,27 @@
 package api
 
 import (
-	"bytes"
-	"encoding/base64"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
 	"net/http"
-	"time"
 
 	"github.com/Diniboy1123/usque/internal"
 	"github.com/Diniboy1123/usque/models"
 )
 
+// APIURL is the base URL of the Cloudflare client API. It may be changed to
+// point the API functions at a different server, such as apitest.Server.
+// It is the default BaseURL of clients created by NewClient.
+var APIURL = internal.ApiUrl
+
+// HTTPClient is the default HTTP client of clients created by NewClient.
+var HTTPClient = http.DefaultClient
+
 // Register creates a new user account by registering a WireGuard public key and generating a random Android-like device identifier.
 // The WireGuard private key isn't stored anywhere, therefore it won't be usable. It's sole purpose is to mimic the Android app's registration process.
 //
 // This function sends a POST request to the API to register a new user and returns the created account data.
+// Use Client.Register for control over the context and retries.
 //
 // Parameters:
 //   - model: string - The device model string to register. (e.g., "PC")
@@ -35,15 +40,23 @@ import (
 //	    log.Fatalf("Registration failed: %v", err)
 //	}
 func Register(model, locale, jwt string, acceptTos bool) (*models.AccountData, error) {
-	wgKey, err := internal.GenerateRandomWgPubkey()
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate wg key: %v", err)
-	}
-	serial, err := internal.GenerateRandomAndroidSerial()
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate serial: %v", err)
-	}
+	return RegisterTeam(model, locale, TeamAuth{JWT: jwt}, acceptTos)
+}
 
+// RegisterTeam is Register authenticated as a member of a Zero Trust
+// organization, with a user's token or a service token.
+// Use Client.RegisterTeam for control over the context and retries.
+//
+// Parameters:
+//   - model: string - The device model string to register. (e.g., "PC")
+//   - locale: string - The user's locale. (e.g., "en-US")
+//   - auth: TeamAuth - The credentials of the organization member.
+//   - acceptTos: bool - Whether the user accepts the Terms of Service (TOS). If false, the user will be prompted to accept.
+//
+// Returns:
+//   - models.AccountData: The account data returned from the registration process.
+//   - error:              An error if registration fails at any step.
+func RegisterTeam(model, locale string, auth TeamAuth, acceptTos bool) (*models.AccountData, error) {
 	if !acceptTos {
 		fmt.Print("You must accept the Terms of Service (https://www.cloudflare.com/application/terms/) to register. Do you agree? (y/n): ")
 		var response string
@@ -55,62 +68,7 @@ func Register(model, locale, jwt string, acceptTos bool) (*models.AccountData, e
 		}
 	}
 
-	data := models.Registration{
-		Key:       wgKey,
-		InstallID: "",
-		FcmToken:  "",
-		Tos:       internal.TimeAsCfString(time.Now()),
-		Model:     model,
-		Serial:    serial,
-		OsVersion: "",
-		KeyType:   internal.KeyTypeWg,
-		TunType:   internal.TunTypeWg,
-		Locale:    locale,
-	}
-
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal json: %v", err)
-	}
-
-	req, err := http.NewRequest("POST", internal.ApiUrl+"/"+internal.ApiVersion+"/reg", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
-	}
-
-	for k, v := range internal.Headers {
-		req.Header.Set(k, v)
-	}
-
-	if jwt != "" {
-		req.Header.Set("CF-Access-Jwt-Assertion", jwt)
-	}
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %v", err)
-	}
-	defer func() { _ = resp.Body.Close() }()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %v", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		var apiErr models.APIError
-		if err := json.Unmarshal(body, &apiErr); err != nil {
-			return nil, fmt.Errorf("failed to parse error response: %v", err)
-		}
-		return nil, &apiErr
-	}
-
-	var accountData models.AccountData
-	if err := json.Unmarshal(body, &accountData); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %v", err)
-	}
-
-	return &accountData, nil
+	return NewClient("", "").RegisterTeam(context.Background(), model, locale, auth)
 }
 
 // EnrollKey updates an existing user account with a new MASQUE public key.
@@ -134,56 +92,7 @@ func Register(model, locale, jwt string, acceptTos bool) (*models.AccountData, e
 //	    log.Fatalf("Key enrollment failed: %v", err)
 //	}
 func EnrollKey(deviceId string, deviceToken string, pubKey []byte, deviceName string) (*models.AccountData, error) {
-	deviceUpdate := models.DeviceUpdate{
-		Key:     base64.StdEncoding.EncodeToString(pubKey),
-		KeyType: internal.KeyTypeMasque,
-		TunType: internal.TunTypeMasque,
-	}
-
-	if deviceName != "" {
-		deviceUpdate.Name = deviceName
-	}
-
-	jsonData, err := json.Marshal(deviceUpdate)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal json: %v", err)
-	}
-
-	req, err := http.NewRequest("PATCH", internal.ApiUrl+"/"+internal.ApiVersion+"/reg/"+deviceId, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
-	}
-
-	for k, v := range internal.Headers {
-		req.Header.Set(k, v)
-	}
-	req.Header.Set("Authorization", "Bearer "+deviceToken)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %v", err)
-	}
-	defer func() { _ = resp.Body.Close() }()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %v", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		var apiErr models.APIError
-		if err := json.Unmarshal(body, &apiErr); err != nil {
-			return nil, fmt.Errorf("failed to parse error response: %v", err)
-		}
-		return nil, &apiErr
-	}
-
-	var accountData models.AccountData
-	if err := json.Unmarshal(body, &accountData); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %v", err)
-	}
-
-	return &accountData, nil
+	return NewClient(deviceId, deviceToken).EnrollKey(context.Background(), pubKey, deviceName)
 }
 
 // GetAccount retrieves the account information associated with the device.
@@ -199,41 +108,7 @@ func EnrollKey(deviceId string, deviceToken string, pubKey []byte, deviceName st
 //   - *models.Account: The account information including license key and account status
 //   - error:           An error if the request fails or account is not found
 func GetAccount(deviceId string, deviceToken string) (*models.Account, error) {
-	req, err := http.NewRequest(http.MethodGet, internal.ApiUrl+"/"+internal.ApiVersion+"/reg/"+deviceId+"/account", nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
-	}
-
-	for k, v := range internal.Headers {
-		req.Header.Set(k, v)
-	}
-	req.Header.Set("Authorization", "Bearer "+deviceToken)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %v", err)
-	}
-	defer func() { _ = resp.Body.Close() }()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %v", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		var apiErr models.APIError
-		if err := json.Unmarshal(body, &apiErr); err != nil {
-			return nil, fmt.Errorf("failed to parse error response: %v", err)
-		}
-		return nil, &apiErr
-	}
-
-	var respData models.Account
-	if err := json.Unmarshal(body, &respData); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %v", err)
-	}
-
-	return &respData, nil
+	return NewClient(deviceId, deviceToken).GetAccount(context.Background())
 }
 
 // UpdateLicenceKey updates the license key associated with a device.
@@ -249,41 +124,7 @@ func GetAccount(deviceId string, deviceToken string) (*models.Account, error) {
 // Returns:
 //   - error: An error if the update fails or the license key is invalid
 func UpdateLicenceKey(deviceId string, deviceToken string, licenceKey string) error {
-	deviceUpdate := models.Account{
-		License: licenceKey,
-	}
-
-	jsonData, err := json.Marshal(deviceUpdate)
-	if err != nil {
-		return fmt.Errorf("failed to marshal json: %v", err)
-	}
-
-	req, err := http.NewRequest(http.MethodPut, internal.ApiUrl+"/"+internal.ApiVersion+"/reg/"+deviceId+"/account", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return fmt.Errorf("failed to create request: %v", err)
-	}
-
-	for k, v := range internal.Headers {
-		req.Header.Set(k, v)
-	}
-	req.Header.Set("Authorization", "Bearer "+deviceToken)
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send request: %v", err)
-	}
-	defer func() { _ = resp.Body.Close() }()
-
-	if resp.StatusCode != http.StatusOK {
-		var apiErr models.APIError
-		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil {
-			return fmt.Errorf("failed to parse error response: %v", err)
-		}
-		return &apiErr
-	}
-
-	return nil
+	return NewClient(deviceId, deviceToken).UpdateLicenceKey(context.Background(), licenceKey)
 }
 
 // DeleteLicenceKey removes the license key associated with the device.
@@ -299,31 +140,7 @@ func UpdateLicenceKey(deviceId string, deviceToken string, licenceKey string) er
 // Returns:
 //   - error: An error if the removal fails
 func DeleteLicenceKey(deviceId string, deviceToken string) error {
-	req, err := http.NewRequest(http.MethodDelete, internal.ApiUrl+"/"+internal.ApiVersion+"/reg/"+deviceId+"/account", nil)
-	if err != nil {
-		return fmt.Errorf("failed to create request: %v", err)
-	}
-
-	for k, v := range internal.Headers {
-		req.Header.Set(k, v)
-	}
-	req.Header.Set("Authorization", "Bearer "+deviceToken)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send request: %v", err)
-	}
-	defer func() { _ = resp.Body.Close() }()
-
-	if resp.StatusCode != http.StatusOK {
-		var apiErr models.APIError
-		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil {
-			return fmt.Errorf("failed to parse error response: %v", err)
-		}
-		return &apiErr
-	}
-
-	return nil
+	return NewClient(deviceId, deviceToken).DeleteLicenceKey(context.Background())
 }
 
 // GetDevices retrieves a list of all devices associated with the same license key.
@@ -339,39 +156,5 @@ func DeleteLicenceKey(deviceId string, deviceToken string) error {
 //   - *models.Devices: A list of devices associated with the license key
 //   - error:           An error if the request fails
 func GetDevices(deviceId string, deviceToken string) (*models.Devices, error) {
-	req, err := http.NewRequest(http.MethodGet, internal.ApiUrl+"/"+internal.ApiVersion+"/reg/"+deviceId+"/account/devices", nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
-	}
-
-	for k, v := range internal.Headers {
-		req.Header.Set(k, v)
-	}
-	req.Header.Set("Authorization", "Bearer "+deviceToken)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %v", err)
-	}
-	defer func() { _ = resp.Body.Close() }()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %v", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		var apiErr models.APIError
-		if err := json.Unmarshal(body, &apiErr); err != nil {
-			return nil, fmt.Errorf("failed to parse error response: %v", err)
-		}
-		return nil, &apiErr
-	}
-
-	var respData models.Devices
-	if err := json.Unmarshal(body, &respData); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %v", err)
-	}
-
-	return &respData, nil
+	return NewClient(deviceId, deviceToken).GetDevices(context.Background())
 }
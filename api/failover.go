@@ -0,0 +1,200 @@
+package api
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+)
+
+// DefaultFailoverAfter is the default of MaintainTunnelConfig.FailoverAfter.
+const DefaultFailoverAfter = 2
+
+// TunnelEndpoint is a candidate endpoint of MaintainTunnel.
+type TunnelEndpoint struct {
+	// Endpoint is the address to connect to.
+	Endpoint net.Addr
+	// AltEndpoint is an optional address of the other family raced against
+	// Endpoint, see MaintainTunnelConfig.AltEndpoint.
+	AltEndpoint net.Addr
+	// Ports are further ports the endpoint accepts, see
+	// MaintainTunnelConfig.Ports.
+	Ports []int
+	// TLSConfig pins the endpoint's public key. If nil,
+	// MaintainTunnelConfig.TLSConfig is used.
+	TLSConfig *tls.Config
+}
+
+// tunnelCandidate is a TunnelEndpoint remembering its last winning address
+// and port.
+type tunnelCandidate struct {
+	endpoints *endpointPreference
+	tlsConfig *tls.Config
+}
+
+func newTunnelCandidate(e TunnelEndpoint, tlsConfig *tls.Config) *tunnelCandidate {
+	if e.TLSConfig != nil {
+		tlsConfig = e.TLSConfig
+	}
+	return &tunnelCandidate{endpoints: newEndpointPreference(e.Endpoint, e.AltEndpoint).withPorts(e.Ports), tlsConfig: tlsConfig}
+}
+
+// attempts returns the number of consecutive failures after which the
+// candidate is given up on: FailoverAfter, but at least one per port.
+func (c *tunnelCandidate) attempts(failoverAfter int) int {
+	return max(failoverAfter, c.endpoints.portCount())
+}
+
+// transportSelector picks the transport and endpoints of each connection
+// attempt. It rotates through the failover endpoints and implements the
+// HTTP/3 to HTTP/2 fallback.
+type transportSelector struct {
+	cfg      *MaintainTunnelConfig
+	useHTTP2 bool
+	// failures counts consecutive failed attempts on the current transport
+	failures int
+	// candidates are the endpoints of the configured transport, current
+	// is the one in use and currentFailures its consecutive failed attempts
+	candidates      []*tunnelCandidate
+	current         int
+	currentFailures int
+	// fallback is the HTTP/2 fallback endpoint, nil if disabled
+	fallback *tunnelCandidate
+}
+
+func newTransportSelector(cfg *MaintainTunnelConfig) *transportSelector {
+	t := &transportSelector{cfg: cfg, useHTTP2: cfg.UseHTTP2}
+	t.candidates = append(t.candidates, newTunnelCandidate(TunnelEndpoint{Endpoint: cfg.Endpoint, AltEndpoint: cfg.AltEndpoint, Ports: cfg.Ports}, cfg.TLSConfig))
+	for _, e := range cfg.FailoverEndpoints {
+		t.candidates = append(t.candidates, newTunnelCandidate(e, cfg.TLSConfig))
+	}
+	for i, c := range t.candidates {
+		if cfg.StartEndpoint != "" && c.endpoints.prefer(cfg.StartEndpoint) {
+			t.current = i
+			break
+		}
+	}
+	if !cfg.UseHTTP2 && cfg.H2FallbackEndpoint != nil {
+		t.fallback = newTunnelCandidate(TunnelEndpoint{Endpoint: cfg.H2FallbackEndpoint, AltEndpoint: cfg.H2FallbackAltEndpoint}, cfg.TLSConfig)
+	}
+	return t
+}
+
+// fallingBack reports whether HTTP/2 is in use as a fallback for HTTP/3.
+func (t *transportSelector) fallingBack() bool {
+	return t.fallback != nil && t.useHTTP2
+}
+
+// candidate returns the endpoint to connect to next.
+func (t *transportSelector) candidate() *tunnelCandidate {
+	if t.fallingBack() {
+		return t.fallback
+	}
+	return t.candidates[t.current]
+}
+
+// h3Candidate returns the HTTP/3 endpoint to probe while falling back.
+func (t *transportSelector) h3Candidate() *tunnelCandidate {
+	return t.candidates[t.current]
+}
+
+// id returns "h3" or "h2" for the transport of the next attempt.
+func (t *transportSelector) id() string {
+	if t.useHTTP2 {
+		return "h2"
+	}
+	return "h3"
+}
+
+func (t *transportSelector) name() string {
+	if t.useHTTP2 {
+		return "HTTP/2"
+	}
+	return "HTTP/3"
+}
+
+// failed records a failed connection attempt. A timed out handshake moves
+// on to the next port of the endpoint. After FailoverAfter consecutive
+// failures, or one per port if there are more ports, the next endpoint is
+// tried. Once every endpoint had its attempts, but no earlier than after
+// H2FallbackAfter failures, the transport is switched. A failing fallback
+// switches back to HTTP/3 the same way, as the network may have changed in
+// the meantime.
+func (t *transportSelector) failed(err error) {
+	t.failures++
+	if isHandshakeTimeout(err) {
+		if port, ok := t.candidate().endpoints.hop(); ok {
+			log.Printf("Handshake timed out. Trying port %d next...", port)
+		}
+	}
+	if !t.fallingBack() {
+		t.currentFailures++
+		if attempts := t.candidates[t.current].attempts(t.cfg.FailoverAfter); len(t.candidates) > 1 && t.currentFailures >= attempts {
+			t.current = (t.current + 1) % len(t.candidates)
+			t.currentFailures = 0
+			log.Printf("Endpoint failed %d times in a row. Failing over to %s...", attempts, formatEndpoints(t.candidates[t.current].endpoints.ordered()))
+		}
+	}
+
+	if t.fallback == nil {
+		return
+	}
+	threshold := t.cfg.H2FallbackAfter
+	if !t.useHTTP2 {
+		attempts := 0
+		for _, c := range t.candidates {
+			attempts += c.attempts(t.cfg.FailoverAfter)
+		}
+		threshold = max(threshold, attempts)
+	}
+	if t.failures < threshold {
+		return
+	}
+	t.failures = 0
+	t.currentFailures = 0
+	t.useHTTP2 = !t.useHTTP2
+	if t.useHTTP2 {
+		log.Printf("HTTP/3 failed %d times in a row. Falling back to HTTP/2...", threshold)
+	} else {
+		log.Printf("HTTP/2 fallback failed %d times in a row. Trying HTTP/3 again...", threshold)
+	}
+}
+
+// probeFailed records a failed HTTP/3 probe, moving on to the next port if
+// the handshake timed out.
+func (t *transportSelector) probeFailed(err error) {
+	if !isHandshakeTimeout(err) {
+		return
+	}
+	if port, ok := t.h3Candidate().endpoints.hop(); ok {
+		log.Printf("Handshake timed out. Probing port %d next...", port)
+	}
+}
+
+// connected records a successful connection, remembering its endpoint.
+func (t *transportSelector) connected(conn *tunnelConn) {
+	t.failures = 0
+	t.currentFailures = 0
+	t.useHTTP2 = conn.useHTTP2
+	conn.candidate.endpoints.won(conn.endpoint)
+	if t.cfg.OnEndpointUp != nil {
+		t.cfg.OnEndpointUp(conn.endpoint)
+	}
+}
+
+// hookEnv returns the hook environment for event on conn.
+func (t *transportSelector) hookEnv(event string, conn *tunnelConn) map[string]string {
+	env := cloneHookEnv(t.cfg.HookEnv)
+	env["USQUE_EVENT"] = event
+	env["USQUE_ENDPOINT"] = conn.endpoint.String()
+	env["USQUE_TRANSPORT"] = conn.transport()
+	if addr, ok := addressOf(conn.addresses, false); ok {
+		env["USQUE_IPV4"] = addr.String()
+	}
+	if addr, ok := addressOf(conn.addresses, true); ok {
+		env["USQUE_IPV6"] = addr.String()
+	}
+	if conn.routes != nil {
+		env["USQUE_ROUTES"] = formatPrefixes(conn.routes)
+	}
+	return env
+}
@@ -0,0 +1,273 @@
+package api
+
+import (
+	"crypto/tls"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// DefaultSessionCacheSize is the number of TLS sessions kept by the
+// SessionCache of PrepareTlsConfig.
+const DefaultSessionCacheSize = 64
+
+// HandshakeStats counts the QUIC handshakes of a SessionCache.
+type HandshakeStats struct {
+	// Full counts handshakes without session resumption.
+	Full int
+	// Resumed counts handshakes resuming an earlier TLS session, including
+	// those that used 0-RTT.
+	Resumed int
+	// ZeroRTT counts resumed handshakes whose 0-RTT data was accepted.
+	ZeroRTT int
+	// HelloRetries counts handshakes the endpoint asked to retry with
+	// another key share.
+	HelloRetries int
+}
+
+// SessionCache is a TLS client session cache shared by all connections
+// dialed with a tls.Config, so that reconnects resume the previous session
+// and use 0-RTT where the endpoint allows it. It also learns the key
+// exchange the endpoint asked for with a HelloRetryRequest, so that later
+// handshakes only offer that one and send its key share right away.
+type SessionCache struct {
+	tls.ClientSessionCache
+
+	mu     sync.Mutex
+	curve  tls.CurveID
+	no0RTT bool
+	stats  HandshakeStats
+	// gen is prefixed to the session keys, so that Forget hides the
+	// sessions stored before until they are evicted.
+	gen int
+	// rekeyed is when rekey last replaced the client key.
+	rekeyed time.Time
+}
+
+// NewSessionCache creates a SessionCache holding up to capacity sessions.
+//
+// Parameters:
+//   - capacity: int - The maximum number of sessions, DefaultSessionCacheSize if not positive.
+//
+// Returns:
+//   - *SessionCache: The empty cache.
+func NewSessionCache(capacity int) *SessionCache {
+	if capacity <= 0 {
+		capacity = DefaultSessionCacheSize
+	}
+	return &SessionCache{ClientSessionCache: tls.NewLRUClientSessionCache(capacity)}
+}
+
+// Stats returns the handshakes counted so far.
+func (c *SessionCache) Stats() HandshakeStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Get implements tls.ClientSessionCache, skipping sessions stored before the
+// last Forget.
+func (c *SessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	c.mu.Lock()
+	gen := c.gen
+	c.mu.Unlock()
+	return c.ClientSessionCache.Get(generationKey(gen, sessionKey))
+}
+
+// Put implements tls.ClientSessionCache.
+func (c *SessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	c.mu.Lock()
+	gen := c.gen
+	c.mu.Unlock()
+	c.ClientSessionCache.Put(generationKey(gen, sessionKey), cs)
+}
+
+// Forget drops the cached sessions, e.g. after the client certificate
+// changed, as resuming them would authenticate with the old one.
+func (c *SessionCache) Forget() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+}
+
+// rekeyedAt returns when rekey last replaced the client key of c.
+func (c *SessionCache) rekeyedAt() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rekeyed
+}
+
+// rekey runs setKey, which replaces the client key, and forgets the
+// sessions of caches at once. No handshake dialed through handshakeSessions
+// can mint a certificate meanwhile, so each one tags its sessions with the
+// key it actually presented. caches must be distinct.
+func rekey(caches []*SessionCache, setKey func()) {
+	for _, c := range caches {
+		c.mu.Lock()
+	}
+	setKey()
+	now := time.Now()
+	for _, c := range caches {
+		c.gen++
+		c.rekeyed = now
+		c.mu.Unlock()
+	}
+}
+
+// generationKey returns the key sessionKey is stored at in generation gen.
+func generationKey(gen int, sessionKey string) string {
+	if gen == 0 {
+		return sessionKey
+	}
+	return strconv.Itoa(gen) + "/" + sessionKey
+}
+
+// handshakeSessions is the session cache of a single handshake. It stores
+// the sessions of the handshake in the generation of the key it
+// authenticated with: the one of the session it resumed, or the one current
+// when it minted its certificate. A handshake that presented the key a
+// rotation just replaced thus never stores a session later handshakes
+// would resume.
+type handshakeSessions struct {
+	cache *SessionCache
+	// gen is guarded by cache.mu.
+	gen int
+}
+
+// Get implements tls.ClientSessionCache.
+func (s *handshakeSessions) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	s.cache.mu.Lock()
+	s.gen = s.cache.gen
+	gen := s.gen
+	s.cache.mu.Unlock()
+	return s.cache.ClientSessionCache.Get(generationKey(gen, sessionKey))
+}
+
+// Put implements tls.ClientSessionCache.
+func (s *handshakeSessions) Put(sessionKey string, cs *tls.ClientSessionState) {
+	s.cache.mu.Lock()
+	gen := s.gen
+	s.cache.mu.Unlock()
+	s.cache.ClientSessionCache.Put(generationKey(gen, sessionKey), cs)
+}
+
+// getClientCertificate wraps the GetClientCertificate of a handshake, so
+// that the certificate is minted along with the generation of its key.
+func (s *handshakeSessions) getClientCertificate(get func(*tls.CertificateRequestInfo) (*tls.Certificate, error)) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		s.cache.mu.Lock()
+		defer s.cache.mu.Unlock()
+		s.gen = s.cache.gen
+		return get(info)
+	}
+}
+
+// withHandshakeSessions returns a clone of tlsConfig for a single handshake
+// whose sessions are tagged by handshakeSessions, or tlsConfig itself if it
+// has no SessionCache.
+func withHandshakeSessions(tlsConfig *tls.Config) *tls.Config {
+	cache := sessionCacheOf(tlsConfig)
+	if cache == nil {
+		return tlsConfig
+	}
+	cache.mu.Lock()
+	sessions := &handshakeSessions{cache: cache, gen: cache.gen}
+	cache.mu.Unlock()
+
+	cfg := tlsConfig.Clone()
+	cfg.ClientSessionCache = sessions
+	if cfg.GetClientCertificate != nil {
+		cfg.GetClientCertificate = sessions.getClientCertificate(cfg.GetClientCertificate)
+	}
+	return cfg
+}
+
+// add returns the sum of s and o.
+func (s HandshakeStats) add(o HandshakeStats) HandshakeStats {
+	return HandshakeStats{
+		Full:         s.Full + o.Full,
+		Resumed:      s.Resumed + o.Resumed,
+		ZeroRTT:      s.ZeroRTT + o.ZeroRTT,
+		HelloRetries: s.HelloRetries + o.HelloRetries,
+	}
+}
+
+// describeHandshake summarizes a completed handshake for logs.
+func describeHandshake(state quic.ConnectionState) string {
+	desc := "full handshake"
+	switch {
+	case state.Used0RTT:
+		desc = "resumed with 0-RTT"
+	case state.TLS.DidResume:
+		desc = "resumed"
+	}
+	if state.TLS.HelloRetryRequest {
+		desc += " after HelloRetryRequest"
+	}
+	return desc
+}
+
+// sessionCacheOf returns the SessionCache of tlsConfig, if it has one.
+func sessionCacheOf(tlsConfig *tls.Config) *SessionCache {
+	cache, _ := tlsConfig.ClientSessionCache.(*SessionCache)
+	return cache
+}
+
+// handshakeConfig returns the configuration for the next handshake with
+// tlsConfig, tagging its sessions like withHandshakeSessions, and whether
+// to attempt 0-RTT. Once the endpoint asked for another key share, it only
+// offers the curve it picked, as Go sends a share for the first preferred
+// curve alone and reordering would still leave the others offered.
+// Otherwise the curves of tlsConfig are kept, including the default ones
+// and their hybrid key exchanges.
+func (c *SessionCache) handshakeConfig(tlsConfig *tls.Config) (*tls.Config, bool) {
+	cfg := withHandshakeSessions(tlsConfig)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.curve == 0 || slices.Equal(tlsConfig.CurvePreferences, []tls.CurveID{c.curve}) {
+		return cfg, !c.no0RTT
+	}
+	if len(tlsConfig.CurvePreferences) > 0 && !slices.Contains(tlsConfig.CurvePreferences, c.curve) {
+		return cfg, !c.no0RTT
+	}
+	cfg.CurvePreferences = []tls.CurveID{c.curve}
+	return cfg, !c.no0RTT
+}
+
+// forgetCurve drops the learned curve after a failed handshake, in case the
+// endpoint no longer supports it.
+func (c *SessionCache) forgetCurve() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.curve = 0
+}
+
+// record counts a completed handshake and learns from it. early reports
+// whether it was dialed with 0-RTT.
+func (c *SessionCache) record(state quic.ConnectionState, early bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case state.Used0RTT:
+		c.stats.Resumed++
+		c.stats.ZeroRTT++
+	case state.TLS.DidResume:
+		c.stats.Resumed++
+	default:
+		c.stats.Full++
+	}
+	if state.TLS.HelloRetryRequest {
+		c.stats.HelloRetries++
+	}
+	if early && state.TLS.DidResume && !state.Used0RTT {
+		// the endpoint issued tickets allowing 0-RTT, but rejected it
+		c.no0RTT = true
+	}
+	if state.TLS.HelloRetryRequest && state.TLS.CurveID != 0 {
+		c.curve = state.TLS.CurveID
+	}
+}
@@ -0,0 +1,85 @@
+package api_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/internal"
+)
+
+func TestSessionCacheAvoidsHelloRetry(t *testing.T) {
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := internal.GenerateCert(serverKey, &serverKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev := newChanDevice()
+	defer close(dev.closed)
+	server, err := api.NewServer(api.ServerConfig{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{{Certificate: serverCert, PrivateKey: serverKey}},
+			// no share for it is sent by default, like Cloudflare's endpoints
+			CurvePreferences: []tls.CurveID{tls.CurveP256},
+		},
+		Clients: []api.ServerClient{{
+			Name:      "test",
+			PublicKey: &clientKey.PublicKey,
+			Addresses: []netip.Prefix{netip.MustParsePrefix("10.0.0.2/32")},
+		}},
+		Device: dev,
+		MTU:    1280,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = server.Close() }()
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.ServeHTTP3(udpConn) }()
+
+	tlsConfig, err := api.PrepareTlsConfig(clientKey, &serverKey.PublicKey, nil, internal.ConnectSNI, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := tlsConfig.ClientSessionCache.(*api.SessionCache)
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	for i := 1; i <= 3; i++ {
+		clientUDP, tr, ipConn, _, err := api.ConnectTunnel(ctx, tlsConfig, internal.DefaultQuicConfig(time.Second, 0), internal.ConnectURI, udpConn.LocalAddr(), false)
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		_ = ipConn.Close()
+		_ = tr.Close()
+		_ = clientUDP.Close()
+
+		// handshakes are counted in the background
+		for got := cache.Stats(); got.Full+got.Resumed < i; got = cache.Stats() {
+			if ctx.Err() != nil {
+				t.Fatalf("handshakes %+v, want %d", got, i)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if got := cache.Stats(); got.HelloRetries != 1 {
+		t.Errorf("handshakes %+v, want a HelloRetryRequest on the first only", got)
+	}
+}
@@ -0,0 +1,179 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHappyEyeballsDelay is the head start an endpoint gets before the
+// next one is tried, the "Connection Attempt Delay" of RFC 8305.
+const DefaultHappyEyeballsDelay = 250 * time.Millisecond
+
+// raceResult is the outcome of one raceDial attempt.
+type raceResult[T any] struct {
+	index  int
+	conn   T
+	cancel context.CancelFunc
+	err    error
+}
+
+// raceDial connects to endpoints RFC 8305 style: the attempts are started in
+// order, each one delay after the previous, or right away when the previous
+// attempt failed. The first attempt to succeed wins and the others are
+// cancelled; connections of late winners are passed to discard.
+//
+// Every attempt runs with its own context derived from ctx. The winner's
+// context is left running, as the connection may depend on it, and its
+// cancel function is returned for the caller to call once the connection is
+// closed.
+//
+// Parameters:
+//   - ctx: context.Context - The context bounding all attempts.
+//   - endpoints: []net.Addr - The endpoints in order of preference.
+//   - delay: time.Duration - The head start of each attempt.
+//   - dial: func - Connects to a single endpoint.
+//   - discard: func - Closes a connection that lost the race.
+//
+// Returns:
+//   - T: The winning connection.
+//   - int: The index of the winning endpoint.
+//   - context.CancelFunc: Cancels the context of the winning attempt.
+//   - error: The errors of all attempts if none succeeded.
+func raceDial[T any](ctx context.Context, endpoints []net.Addr, delay time.Duration, dial func(ctx context.Context, endpoint net.Addr) (T, error), discard func(T)) (T, int, context.CancelFunc, error) {
+	var zero T
+	if len(endpoints) == 0 {
+		return zero, -1, nil, errors.New("no endpoints to dial")
+	}
+	if len(endpoints) == 1 {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		conn, err := dial(attemptCtx, endpoints[0])
+		if err != nil {
+			cancel()
+			return zero, -1, nil, err
+		}
+		return conn, 0, cancel, nil
+	}
+
+	results := make(chan raceResult[T], len(endpoints))
+	cancels := make([]context.CancelFunc, len(endpoints))
+	start := func(i int) {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		cancels[i] = cancel
+		go func() {
+			conn, err := dial(attemptCtx, endpoints[i])
+			results <- raceResult[T]{index: i, conn: conn, cancel: cancel, err: err}
+		}()
+	}
+
+	start(0)
+	next, pending := 1, 1
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var errs []error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if next < len(endpoints) {
+				start(next)
+				next++
+				pending++
+				timer.Reset(delay)
+			}
+		case res := <-results:
+			pending--
+			if res.err != nil {
+				res.cancel()
+				errs = append(errs, res.err)
+				if next < len(endpoints) {
+					start(next)
+					next++
+					pending++
+					timer.Reset(delay)
+				}
+				continue
+			}
+
+			for i, cancel := range cancels {
+				if cancel != nil && i != res.index {
+					cancel()
+				}
+			}
+			// collect the losers in the background, some may still succeed
+			go func(pending int) {
+				for range pending {
+					late := <-results
+					if late.err == nil {
+						discard(late.conn)
+					}
+					late.cancel()
+				}
+			}(pending)
+			return res.conn, res.index, res.cancel, nil
+		}
+	}
+	return zero, -1, nil, errors.Join(errs...)
+}
+
+// endpointPreference remembers which endpoint of a set won the last race,
+// so that reconnects try it first, and which of the ports the endpoints
+// accept is in use.
+type endpointPreference struct {
+	mu        sync.Mutex
+	endpoints []net.Addr
+	// ports the endpoints accept, the one at index port is in use
+	ports []int
+	port  int
+}
+
+// newEndpointPreference creates a preference over the non-nil endpoints,
+// initially preferring them in the given order.
+func newEndpointPreference(endpoints ...net.Addr) *endpointPreference {
+	p := &endpointPreference{}
+	for _, endpoint := range endpoints {
+		if endpoint != nil {
+			p.endpoints = append(p.endpoints, endpoint)
+		}
+	}
+	return p
+}
+
+// ordered returns the endpoints on the current port, the last winner first.
+func (p *endpointPreference) ordered() []net.Addr {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.ports) == 0 {
+		return append([]net.Addr(nil), p.endpoints...)
+	}
+	endpoints := make([]net.Addr, len(p.endpoints))
+	for i, endpoint := range p.endpoints {
+		endpoints[i] = withPort(endpoint, p.ports[p.port])
+	}
+	return endpoints
+}
+
+// won moves endpoint, as returned by ordered, to the front.
+func (p *endpointPreference) won(endpoint net.Addr) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, e := range p.endpoints {
+		if sameHost(e, endpoint) {
+			copy(p.endpoints[1:i+1], p.endpoints[:i])
+			p.endpoints[0] = e
+			return
+		}
+	}
+}
+
+// formatEndpoints joins endpoints for logging.
+func formatEndpoints(endpoints []net.Addr) string {
+	names := make([]string, len(endpoints))
+	for i, endpoint := range endpoints {
+		names[i] = endpoint.String()
+	}
+	return strings.Join(names, " and ")
+}
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DefaultKeyRotationRetry is the delay before a failed key rotation is
+// retried.
+const DefaultKeyRotationRetry = time.Minute
+
+// keyRotationGrace is how long after a key rotation the endpoint rejecting
+// the client certificate is retried like any other failure. Handshakes
+// started before may still have presented the old key, which is no longer
+// enrolled by then.
+const keyRotationGrace = 30 * time.Second
+
+// KeyRotationConfig configures a KeyRotator.
+type KeyRotationConfig struct {
+	// Client enrolls the new keys of its device.
+	Client *Client
+	// Minter presents the currently enrolled key, which rotations replace.
+	Minter *CertMinter
+	// Save persists a new key once it is enrolled, e.g. in the config. Its
+	// errors are returned by Rotate, but the key is used regardless, as the
+	// old one is no longer enrolled.
+	Save func(privKey *ecdsa.PrivateKey) error
+	// Interval is the time between scheduled rotations. Zero only rotates
+	// when Run is triggered.
+	Interval time.Duration
+	// RetryDelay is the delay before a failed rotation is retried by Run.
+	// Defaults to DefaultKeyRotationRetry.
+	RetryDelay time.Duration
+}
+
+// KeyRotator replaces the MASQUE key of a device while its tunnels run.
+//
+// The TLS configurations it is attached to present the current key of its
+// CertMinter, so connections made after a rotation authenticate with the
+// new key, while established ones keep running until they are closed.
+type KeyRotator struct {
+	cfg KeyRotationConfig
+
+	mu     sync.Mutex
+	caches []*SessionCache
+}
+
+// NewKeyRotator creates a KeyRotator.
+//
+// Parameters:
+//   - cfg: KeyRotationConfig - The device client, the minter of the current key and the schedule.
+//
+// Returns:
+//   - *KeyRotator: The rotator. Attach it to TLS configurations before they are used.
+//   - error: An error if the client or minter is missing.
+func NewKeyRotator(cfg KeyRotationConfig) (*KeyRotator, error) {
+	if cfg.Client == nil || cfg.Minter == nil {
+		return nil, fmt.Errorf("key rotation needs a client and a certificate minter")
+	}
+	if cfg.RetryDelay <= 0 {
+		cfg.RetryDelay = DefaultKeyRotationRetry
+	}
+	return &KeyRotator{cfg: cfg}, nil
+}
+
+// Attach makes tlsConfig present the current key of r through its
+// CertMinter, replacing its Certificates. It must be called before
+// tlsConfig is used.
+//
+// Parameters:
+//   - tlsConfig: *tls.Config - A configuration of PrepareTlsConfig.
+func (r *KeyRotator) Attach(tlsConfig *tls.Config) {
+	r.cfg.Minter.Attach(tlsConfig)
+	if cache := sessionCacheOf(tlsConfig); cache != nil {
+		r.mu.Lock()
+		if !slices.Contains(r.caches, cache) {
+			r.caches = append(r.caches, cache)
+		}
+		r.mu.Unlock()
+	}
+}
+
+// Rotate generates a key, enrolls it and presents it in later handshakes.
+// Cached TLS sessions are forgotten at the same time, as resuming them
+// would authenticate with the old key, and sessions of handshakes that
+// presented the old key are not stored afterwards.
+//
+// Parameters:
+//   - ctx: context.Context - The context of the enrollment request.
+//
+// Returns:
+//   - error: An error if the key was not enrolled, or if it was but could not be saved.
+func (r *KeyRotator) Rotate(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %v", err)
+	}
+	pubKey, err := x509.MarshalPKIXPublicKey(&privKey.PublicKey)
+	if err != nil {
+		return fmt.Errorf("failed to marshal public key: %v", err)
+	}
+
+	if _, err := r.cfg.Client.EnrollKey(ctx, pubKey, ""); err != nil {
+		return fmt.Errorf("failed to enroll key: %w", err)
+	}
+	rekey(r.caches, func() { r.cfg.Minter.SetKey(privKey) })
+
+	if r.cfg.Save != nil {
+		if err := r.cfg.Save(privKey); err != nil {
+			return fmt.Errorf("key enrolled and in use, but not saved: %w", err)
+		}
+	}
+	return nil
+}
+
+// Run rotates the key every KeyRotationConfig.Interval and whenever trigger
+// receives, until ctx is done. Failed rotations are logged and retried
+// after KeyRotationConfig.RetryDelay.
+//
+// Parameters:
+//   - ctx: context.Context - Stops rotating when done.
+//   - trigger: <-chan struct{} - Requests a rotation on demand, may be nil.
+func (r *KeyRotator) Run(ctx context.Context, trigger <-chan struct{}) {
+	var tick <-chan time.Time
+	if r.cfg.Interval > 0 {
+		ticker := time.NewTicker(r.cfg.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+		case <-trigger:
+		case <-retry:
+		}
+
+		retry = nil
+		if err := r.Rotate(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Failed to rotate the device key, retrying in %s: %v", r.cfg.RetryDelay, err)
+			retry = time.After(r.cfg.RetryDelay)
+			continue
+		}
+		log.Printf("Rotated the device key, new connections use it")
+	}
+}
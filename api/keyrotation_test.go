@@ -0,0 +1,233 @@
+package api_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/api/masquetest"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestKeyRotatorRotate(t *testing.T) {
+	c, srv := newTestClient(t)
+	oldKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var saved *ecdsa.PrivateKey
+	rotator, err := api.NewKeyRotator(api.KeyRotationConfig{
+		Client: c,
+		Minter: api.NewCertMinter(oldKey, 0, -1),
+		Save: func(privKey *ecdsa.PrivateKey) error {
+			saved = privKey
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := api.PrepareTlsConfig(oldKey, &oldKey.PublicKey, nil, internal.ConnectSNI, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotator.Attach(tlsConfig)
+
+	presented := func() *ecdsa.PrivateKey {
+		t.Helper()
+		cert, err := tlsConfig.GetClientCertificate(&tls.CertificateRequestInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.PrivateKey.(*ecdsa.PrivateKey)
+	}
+	if !presented().Equal(oldKey) {
+		t.Fatalf("the current key is not presented before rotating")
+	}
+
+	if err := rotator.Rotate(context.Background()); err != nil {
+		t.Fatalf("failed to rotate: %v", err)
+	}
+	if saved == nil || saved.Equal(oldKey) {
+		t.Fatalf("no new key was saved")
+	}
+	if !presented().Equal(saved) {
+		t.Errorf("new handshakes do not present the saved key")
+	}
+
+	pubKey, err := x509.MarshalPKIXPublicKey(&saved.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device, _ := srv.Device(c.DeviceID); device.Key != base64.StdEncoding.EncodeToString(pubKey) {
+		t.Errorf("the saved key is not enrolled")
+	}
+}
+
+func TestKeyRotatorRotateDuringHandshake(t *testing.T) {
+	c, _ := newTestClient(t)
+	cfg := l4TestConfig(t)
+	oldKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var newKey *ecdsa.PrivateKey
+	rotator, err := api.NewKeyRotator(api.KeyRotationConfig{
+		Client: c,
+		Minter: api.NewCertMinter(oldKey, 0, -1),
+		Save: func(privKey *ecdsa.PrivateKey) error {
+			newKey = privKey
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotator.Attach(cfg.TLSConfig)
+
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := internal.GenerateCert(serverKey, &serverKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first handshake is held once the endpoint got its certificate
+	verifying := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	presented := make(chan *ecdsa.PublicKey, 2)
+	server := &http3.Server{
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{{Certificate: serverCert, PrivateKey: serverKey}},
+			ClientAuth:   tls.RequireAnyClientCert,
+			VerifyPeerCertificate: func([][]byte, [][]*x509.Certificate) error {
+				once.Do(func() {
+					close(verifying)
+					<-release
+				})
+				return nil
+			},
+		}),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			presented <- r.TLS.PeerCertificates[0].PublicKey.(*ecdsa.PublicKey)
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+	go func() { _ = server.Serve(udpConn) }()
+	t.Cleanup(func() { _ = server.Close() })
+	cfg.Endpoint = udpConn.LocalAddr().(*net.UDPAddr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dial := func() {
+		t.Helper()
+		proxy, err := api.NewL4Proxy(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := proxy.DialContext(ctx, "192.0.2.1:80")
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		_ = conn.Close()
+	}
+
+	dialed := make(chan struct{})
+	go func() {
+		defer close(dialed)
+		dial()
+	}()
+	select {
+	case <-verifying:
+	case <-ctx.Done():
+		t.Fatal("the handshake did not reach the endpoint")
+	}
+	if err := rotator.Rotate(ctx); err != nil {
+		t.Fatalf("failed to rotate: %v", err)
+	}
+	close(release)
+	<-dialed
+	if got := <-presented; !got.Equal(&oldKey.PublicKey) {
+		t.Fatalf("the held handshake did not present the old key")
+	}
+
+	// the held handshake stores its session ticket in the background
+	cache := cfg.TLSConfig.ClientSessionCache.(*api.SessionCache)
+	for got := cache.Stats(); got.Full < 1; got = cache.Stats() {
+		if ctx.Err() != nil {
+			t.Fatalf("handshakes %+v, want 1", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	dial()
+	if got := <-presented; !got.Equal(&newKey.PublicKey) {
+		t.Errorf("the next connection resumed the session of the old key")
+	}
+}
+
+func TestTunnelRetriesKeyRejectedAfterRotation(t *testing.T) {
+	peer := newPeer(t)
+	// the peer rejects any key but its own, like the endpoint rejects the
+	// one a rotation replaced until the handshake presents the new one
+	forEachTransport(t, func(t *testing.T, useHTTP2 bool) {
+		c, _ := newTestClient(t)
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rotator, err := api.NewKeyRotator(api.KeyRotationConfig{Client: c, Minter: api.NewCertMinter(key, 0, -1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := tunnelConfig(t, peer, masquetest.NewMemDevice(), useHTTP2)
+		cfg.TLSConfig = cfg.TLSConfig.Clone()
+		cfg.TLSConfig.ClientSessionCache = api.NewSessionCache(0)
+		rotator.Attach(cfg.TLSConfig)
+		if err := rotator.Rotate(context.Background()); err != nil {
+			t.Fatalf("failed to rotate: %v", err)
+		}
+		cfg.StopOnPermanentError = true
+		events := make(chan api.TunnelEvent, 1000)
+		cfg.OnEvent = func(ev api.TunnelEvent) { events <- ev }
+		runTunnel(t, cfg)
+
+		timeout := time.After(testTimeout)
+		for {
+			select {
+			case ev := <-events:
+				switch ev.State {
+				case api.TunnelBackoff:
+					if errors.As(ev.Err, new(*api.PermanentError)) {
+						t.Errorf("rejection right after the rotation is permanent: %v", ev.Err)
+					}
+					return
+				case api.TunnelFailed:
+					t.Fatalf("tunnel gave up right after the rotation: %v", ev.Err)
+				}
+			case <-timeout:
+				t.Fatal("no backoff after the rejection")
+			}
+		}
+	})
+}
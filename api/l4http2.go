@@ -0,0 +1,269 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Diniboy1123/usque/internal"
+	quic "github.com/quic-go/quic-go"
+)
+
+// errUDPNeedsHTTP3 is returned by DialUDP while streams use HTTP/2, which
+// has no datagrams.
+var errUDPNeedsHTTP3 = errors.New("UDP is only proxied over HTTP/3")
+
+// l4Fallback tracks the HTTP/3 to HTTP/2 fallback of an L4Proxy.
+type l4Fallback struct {
+	after    int
+	interval time.Duration
+
+	mu       sync.Mutex
+	active   bool
+	failures int
+	// since is the time of the switch to HTTP/2 or of the last probe
+	since   time.Time
+	probing bool
+}
+
+func newL4Fallback(after int, interval time.Duration) *l4Fallback {
+	if after <= 0 {
+		after = DefaultH2FallbackAfter
+	}
+	if interval <= 0 {
+		interval = DefaultH3ProbeInterval
+	}
+	return &l4Fallback{after: after, interval: interval}
+}
+
+// usingHTTP2 reports whether new streams use HTTP/2. While falling back,
+// it starts a probe of HTTP/3 once the probe interval passed.
+func (p *L4Proxy) usingHTTP2() bool {
+	if p.forceHTTP2 {
+		return true
+	}
+	f := p.fallback
+	if f == nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.active {
+		return false
+	}
+	if !f.probing && time.Since(f.since) >= f.interval {
+		f.probing = true
+		go p.probeHTTP3()
+	}
+	return true
+}
+
+// h3Failed records a failed HTTP/3 connection attempt, falling back to
+// HTTP/2 after H2FallbackAfter of them, but at least one per port.
+func (p *L4Proxy) h3Failed() {
+	f := p.fallback
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.active {
+		return
+	}
+	f.failures++
+	threshold := max(f.after, p.endpoints.portCount())
+	if f.failures < threshold {
+		return
+	}
+	f.active, f.failures, f.since = true, 0, time.Now()
+	log.Printf("HTTP/3 failed %d times in a row. Falling back to HTTP/2...", threshold)
+}
+
+// h3Connected records an established HTTP/3 connection.
+func (p *L4Proxy) h3Connected() {
+	f := p.fallback
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	f.failures = 0
+	f.mu.Unlock()
+}
+
+// probeHTTP3 connects over HTTP/3 while falling back, and switches back to
+// it if that works. Streams already open over HTTP/2 keep running.
+func (p *L4Proxy) probeHTTP3() {
+	ctx, cancel := context.WithTimeout(context.Background(), p.connectTimeout)
+	defer cancel()
+	client, err := p.acquireClientConn(ctx)
+	if err == nil {
+		client.release()
+	}
+
+	f := p.fallback
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.probing = false
+	f.since = time.Now()
+	if err != nil {
+		log.Printf("HTTP/3 is still unavailable: %v", err)
+		return
+	}
+	f.active = false
+	log.Println("HTTP/3 is reachable again. Switching back from HTTP/2...")
+}
+
+// dialHTTP2 opens a CONNECT stream to target over HTTP/2. Streams share
+// the connections pooled by the HTTP/2 client.
+func (p *L4Proxy) dialHTTP2(ctx context.Context, target string) (*l4TCPConn, error) {
+	pr, pw := io.Pipe()
+	// the URL selects the pooled connection to the endpoint, the authority
+	// the target
+	req, err := http.NewRequestWithContext(ctx, http.MethodConnect, internal.ConnectURI, pr)
+	if err != nil {
+		_ = pw.Close()
+		return nil, err
+	}
+	req.Host = target
+	req.ContentLength = -1
+	setPostQuantumHeader(req.Header, p.tlsConfig)
+
+	// the request context must outlive dialing, as it bounds the stream
+	streamCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, cancel)
+	response, err := p.h2Client.Do(req.WithContext(streamCtx))
+	stop()
+	if err != nil {
+		cancel()
+		_ = pw.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("failed to send CONNECT over HTTP/2: %w", err)
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		cancel()
+		_ = pw.Close()
+		_ = response.Body.Close()
+		return nil, fmt.Errorf("CONNECT rejected with status %d", response.StatusCode)
+	}
+	return &l4TCPConn{stream: newL4H2Stream(pw, response.Body, cancel), remote: l4Addr(target)}, nil
+}
+
+// l4H2Stream is the l4Stream of an HTTP/2 CONNECT request, writing to its
+// body and reading from the response's.
+type l4H2Stream struct {
+	requestBody  *io.PipeWriter
+	responseBody io.ReadCloser
+	cancel       context.CancelFunc
+
+	mu            sync.Mutex
+	readDeadline  *time.Timer
+	writeDeadline *time.Timer
+	expired       bool
+}
+
+func newL4H2Stream(requestBody *io.PipeWriter, responseBody io.ReadCloser, cancel context.CancelFunc) *l4H2Stream {
+	return &l4H2Stream{requestBody: requestBody, responseBody: responseBody, cancel: cancel}
+}
+
+func (s *l4H2Stream) Read(b []byte) (int, error) {
+	n, err := s.responseBody.Read(b)
+	if err != nil && s.isExpired() {
+		return n, os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+func (s *l4H2Stream) Write(b []byte) (int, error) {
+	n, err := s.requestBody.Write(b)
+	if err != nil && s.isExpired() {
+		return n, os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+// Close ends the request body, half-closing the stream.
+func (s *l4H2Stream) Close() error {
+	return s.requestBody.Close()
+}
+
+// CancelRead closes the response body, which resets the stream once the
+// request body has ended too.
+func (s *l4H2Stream) CancelRead(quic.StreamErrorCode) {
+	_ = s.responseBody.Close()
+	s.mu.Lock()
+	s.stopTimers()
+	s.mu.Unlock()
+	s.cancel()
+}
+
+func (s *l4H2Stream) SetDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readDeadline = s.setTimer(s.readDeadline, t)
+	s.writeDeadline = s.setTimer(s.writeDeadline, t)
+	return nil
+}
+
+// SetReadDeadline sets the read deadline. Unlike on a net.Conn, the stream
+// is torn down when it passes, as reads of an HTTP/2 body cannot be
+// interrupted otherwise.
+func (s *l4H2Stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readDeadline = s.setTimer(s.readDeadline, t)
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline, tearing down the stream when it
+// passes like SetReadDeadline.
+func (s *l4H2Stream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeDeadline = s.setTimer(s.writeDeadline, t)
+	return nil
+}
+
+// setTimer replaces timer by one expiring the stream at t, nil if t is
+// zero. s.mu must be held.
+func (s *l4H2Stream) setTimer(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	if t.IsZero() || s.expired {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), s.expire)
+}
+
+// stopTimers stops the deadline timers. s.mu must be held.
+func (s *l4H2Stream) stopTimers() {
+	for _, timer := range []*time.Timer{s.readDeadline, s.writeDeadline} {
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (s *l4H2Stream) expire() {
+	s.mu.Lock()
+	s.expired = true
+	s.stopTimers()
+	s.mu.Unlock()
+	_ = s.requestBody.CloseWithError(os.ErrDeadlineExceeded)
+	_ = s.responseBody.Close()
+	s.cancel()
+}
+
+func (s *l4H2Stream) isExpired() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.expired
+}
@@ -0,0 +1,124 @@
+package api_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/internal"
+	quic "github.com/quic-go/quic-go"
+)
+
+// connectH2Echo serves CONNECT over HTTP/2 on loopback, echoing the stream
+// back, and returns its address and the authority of the last request.
+func connectH2Echo(t *testing.T) (*net.TCPAddr, <-chan string) {
+	t.Helper()
+	targets := make(chan string, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		targets <- r.Host
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		buf := make([]byte, 1024)
+		for {
+			n, err := r.Body.Read(buf)
+			if n > 0 {
+				_, _ = w.Write(buf[:n])
+				w.(http.Flusher).Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server.Listener.Addr().(*net.TCPAddr), targets
+}
+
+// l4Echo dials target through proxy and checks that the stream is echoed.
+func l4Echo(t *testing.T, proxy *api.L4Proxy, targets <-chan string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := proxy.DialContext(ctx, "192.0.2.1:80")
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if target := <-targets; target != "192.0.2.1:80" {
+		t.Errorf("requested %s", target)
+	}
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("read %q, want the echoed stream", buf)
+	}
+}
+
+// l4TestConfig returns an L4ProxyConfig with a fresh client key, skipping
+// endpoint verification.
+func l4TestConfig(t *testing.T) api.L4ProxyConfig {
+	t.Helper()
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := api.PrepareTlsConfig(clientKey, nil, nil, internal.L4ConnectSNI, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return api.L4ProxyConfig{TLSConfig: tlsConfig}
+}
+
+func TestL4ProxyHTTP2(t *testing.T) {
+	endpoint, targets := connectH2Echo(t)
+
+	cfg := l4TestConfig(t)
+	cfg.H2Endpoint = endpoint
+	cfg.UseHTTP2 = true
+	proxy, err := api.NewL4Proxy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l4Echo(t, proxy, targets)
+}
+
+func TestL4ProxyFallsBackToHTTP2(t *testing.T) {
+	endpoint, targets := connectH2Echo(t)
+	// a UDP port that never answers, like a network dropping QUIC
+	blackhole, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = blackhole.Close() })
+
+	cfg := l4TestConfig(t)
+	cfg.Endpoint = blackhole.LocalAddr().(*net.UDPAddr)
+	cfg.QUICConfig = &quic.Config{HandshakeIdleTimeout: 200 * time.Millisecond}
+	cfg.H2Endpoint = endpoint
+	cfg.H2FallbackAfter = 1
+	proxy, err := api.NewL4Proxy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l4Echo(t, proxy, targets)
+}
@@ -0,0 +1,289 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// acquire counts a stream opened on c.
+func (c *l4HTTP3Client) acquire() {
+	c.streams.Add(1)
+}
+
+// release uncounts a stream of c once it is closed.
+func (c *l4HTTP3Client) release() {
+	c.streams.Add(-1)
+}
+
+// abort closes a stream of c that failed to be set up.
+func (c *l4HTTP3Client) abort(stream *http3.RequestStream) {
+	_ = stream.Close()
+	c.release()
+}
+
+// alive reports whether the QUIC connection of c is still open.
+func (c *l4HTTP3Client) alive() bool {
+	return c.quicConn.Context().Err() == nil
+}
+
+// l4PendingDial is a connection of the pool being dialed into its slot.
+// Callers choosing the slot meanwhile wait for it instead of dialing
+// another one.
+type l4PendingDial struct {
+	done   chan struct{}
+	client *l4HTTP3Client
+	err    error
+	// streams counts the waiting callers, which become streams of client.
+	// p.connMu must be held.
+	streams int32
+}
+
+// leastLoaded returns the slot of the pool new streams go to: the live or
+// pending connection with the fewest streams, or an empty slot if all of
+// them have more than none. Connections that died, e.g. of an idle timeout,
+// are removed from their slot. p.connMu must be held.
+func (p *L4Proxy) leastLoaded() int {
+	best, bestLoad, bestRank := -1, int32(0), 0
+	for i, c := range p.clients {
+		if c != nil && !c.alive() {
+			closeL4HTTP3(c.udpConn, c.quicConn)
+			p.clients[i] = nil
+			c = nil
+		}
+		// at equal load, an open connection beats a pending one, which
+		// beats dialing a new one
+		var load int32
+		rank := 0
+		switch {
+		case c != nil:
+			load, rank = c.streams.Load(), 2
+		case p.dialing[i] != nil:
+			load, rank = p.dialing[i].streams, 1
+		}
+		if best < 0 || load < bestLoad || (load == bestLoad && rank > bestRank) {
+			best, bestLoad, bestRank = i, load, rank
+		}
+	}
+	return best
+}
+
+// acquireClientConn returns the least loaded connection of the pool,
+// dialing it if its slot is empty, with a stream acquired on it. The
+// stream is counted right away, even while the connection is dialed, so
+// that concurrent callers spread over the pool.
+func (p *L4Proxy) acquireClientConn(ctx context.Context) (*l4HTTP3Client, error) {
+	p.connMu.Lock()
+	slot := p.leastLoaded()
+	if client := p.clients[slot]; client != nil {
+		client.acquire()
+		p.connMu.Unlock()
+		return client, nil
+	}
+	pending, owner := p.pendingDial(slot)
+	pending.streams++
+	p.connMu.Unlock()
+
+	if owner {
+		// the dial is shared by the callers waiting for it, so it must not
+		// fail because the one that started it gave up
+		go p.dialSlot(slot, pending)
+	}
+	return p.awaitDial(ctx, pending)
+}
+
+// pendingDial returns the dial in progress into slot, or reserves the slot
+// for a new one, which the caller must then run with dialSlot.
+// p.connMu must be held.
+func (p *L4Proxy) pendingDial(slot int) (pending *l4PendingDial, owner bool) {
+	if pending := p.dialing[slot]; pending != nil {
+		return pending, false
+	}
+	pending = &l4PendingDial{done: make(chan struct{})}
+	p.dialing[slot] = pending
+	return pending, true
+}
+
+// awaitDial waits for pending and returns its connection, with the stream
+// counted by the caller acquired on it.
+func (p *L4Proxy) awaitDial(ctx context.Context, pending *l4PendingDial) (*l4HTTP3Client, error) {
+	select {
+	case <-pending.done:
+	case <-ctx.Done():
+		p.connMu.Lock()
+		select {
+		case <-pending.done:
+			// the stream was already moved to the connection
+			p.connMu.Unlock()
+			if pending.err == nil {
+				pending.client.release()
+			}
+		default:
+			pending.streams--
+			p.connMu.Unlock()
+		}
+		return nil, ctx.Err()
+	}
+	if pending.err != nil {
+		return nil, pending.err
+	}
+	return pending.client, nil
+}
+
+// dialSlot dials pending, the reserved connection of slot, and stores it in
+// the slot along with the streams of the callers waiting for it. The dial
+// is bounded by the connect timeout rather than by the context of any
+// caller, each of which only stops waiting on its own.
+func (p *L4Proxy) dialSlot(slot int, pending *l4PendingDial) {
+	timeout := p.connectTimeout
+	if timeout <= 0 {
+		timeout = defaultL4ConnectTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	client, err := p.dialClient(ctx)
+
+	p.connMu.Lock()
+	current := p.clients[slot]
+	if err == nil {
+		client.streams.Add(pending.streams)
+		p.clients[slot] = client
+	} else {
+		current = nil
+	}
+	pending.client, pending.err = client, err
+	p.dialing[slot] = nil
+	close(pending.done)
+	p.connMu.Unlock()
+
+	// only a connection that died is replaced
+	if current != nil {
+		closeL4HTTP3(current.udpConn, current.quicConn)
+	}
+}
+
+// dialClient dials a new connection of the pool.
+func (p *L4Proxy) dialClient(ctx context.Context) (*l4HTTP3Client, error) {
+	endpoints := p.endpoints.ordered()
+	dialed, winner, cancel, err := raceDial(ctx, endpoints, p.racingDelay, func(ctx context.Context, endpoint net.Addr) (*l4HTTP3Client, error) {
+		udpConn, quicConn, err := dialQUIC(ctx, p.tlsConfig, p.quicConfig, endpoint.(*net.UDPAddr))
+		if err != nil {
+			return nil, err
+		}
+		if err := awaitHandshake(ctx, quicConn); err != nil {
+			closeL4HTTP3(udpConn, quicConn)
+			return nil, err
+		}
+		return &l4HTTP3Client{udpConn: udpConn, quicConn: quicConn}, nil
+	}, func(c *l4HTTP3Client) { closeL4HTTP3(c.udpConn, c.quicConn) })
+	if err != nil {
+		if isHandshakeTimeout(err) {
+			if port, ok := p.endpoints.hop(); ok {
+				log.Printf("Handshake timed out. Trying port %d next...", port)
+			}
+		}
+		if !errors.Is(err, context.Canceled) {
+			p.h3Failed()
+		}
+		return nil, err
+	}
+	p.h3Connected()
+	// quic-go only uses the dial context for the handshake
+	cancel()
+	p.endpoints.won(endpoints[winner])
+
+	dialed.clientConn = (&http3.Transport{EnableDatagrams: p.udpTemplate != nil}).NewClientConn(dialed.quicConn)
+	return dialed, nil
+}
+
+// awaitHandshake waits for the handshake of conn, which dialQUIC may return
+// early for 0-RTT. Proxied streams can carry non-idempotent requests, so
+// they must not be sent as early data, which an attacker could replay. If
+// the endpoint rejected 0-RTT, conn is switched to its 1-RTT streams,
+// which no stream was opened on yet.
+func awaitHandshake(ctx context.Context, conn *quic.Conn) error {
+	if handshakeComplete(conn) {
+		return nil
+	}
+	select {
+	case <-conn.HandshakeComplete():
+	case <-conn.Context().Done():
+		return context.Cause(conn.Context())
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if !conn.ConnectionState().Used0RTT {
+		if _, err := conn.NextConnection(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeClientConnIfCurrent closes expected and empties its slot, unless it
+// was replaced already.
+func (p *L4Proxy) closeClientConnIfCurrent(expected *l4HTTP3Client) {
+	if expected == nil {
+		return
+	}
+
+	p.connMu.Lock()
+	for i, c := range p.clients {
+		if c == expected {
+			p.clients[i] = nil
+			p.connMu.Unlock()
+			closeL4HTTP3(expected.udpConn, expected.quicConn)
+			return
+		}
+	}
+	p.connMu.Unlock()
+}
+
+// Prewarm dials every connection of the pool that is not open yet, so the
+// first proxied connections skip the handshakes. It does nothing while
+// streams use HTTP/2.
+//
+// Parameters:
+//   - ctx: context.Context - Bounds the wait for the handshakes, which go on in the background if it ends.
+//
+// Returns:
+//   - error: The errors of the connections that failed, which are dialed again when needed.
+func (p *L4Proxy) Prewarm(ctx context.Context) error {
+	if p == nil || p.tlsConfig == nil {
+		return fmt.Errorf("missing TLS config")
+	}
+	if p.usingHTTP2() {
+		return nil
+	}
+
+	// slots dialed by callers already are left to them
+	p.connMu.Lock()
+	dials := make(map[int]*l4PendingDial)
+	for i, c := range p.clients {
+		if c == nil || !c.alive() {
+			if pending, owner := p.pendingDial(i); owner {
+				dials[i] = pending
+			}
+		}
+	}
+	p.connMu.Unlock()
+
+	for slot, pending := range dials {
+		go p.dialSlot(slot, pending)
+	}
+	var errs []error
+	for _, pending := range dials {
+		select {
+		case <-pending.done:
+			errs = append(errs, pending.err)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,228 @@
+package api_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestL4ProxyPool(t *testing.T) {
+	endpoint, _ := connectUDPEcho(t)
+
+	cfg := l4TestConfig(t)
+	cfg.Endpoint = endpoint
+	cfg.EnableUDP = true
+	cfg.Connections = 2
+	proxy, err := api.NewL4Proxy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := proxy.Prewarm(ctx); err != nil {
+		t.Fatalf("failed to prewarm: %v", err)
+	}
+
+	dial := func() net.Conn {
+		t.Helper()
+		conn, err := proxy.DialUDP(ctx, "192.0.2.1:53")
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		return conn
+	}
+	first, second := dial(), dial()
+	if first.LocalAddr().String() == second.LocalAddr().String() {
+		t.Fatalf("both flows use the connection from %s", first.LocalAddr())
+	}
+	_ = first.Close()
+	if third := dial(); third.LocalAddr().String() != first.LocalAddr().String() {
+		t.Errorf("flow uses the busy connection from %s, want the idle one from %s", third.LocalAddr(), first.LocalAddr())
+	}
+}
+
+func TestL4ProxyPoolDialsOncePerSlot(t *testing.T) {
+	endpoint, _ := connectUDPEcho(t)
+
+	cfg := l4TestConfig(t)
+	cfg.Endpoint = endpoint
+	cfg.EnableUDP = true
+	cfg.Connections = 2
+	proxy, err := api.NewL4Proxy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// concurrent flows on a cold pool wait for the pending dials
+	var mu sync.Mutex
+	local := make(map[string]bool)
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := proxy.DialUDP(ctx, "192.0.2.1:53")
+			if err != nil {
+				t.Errorf("failed to dial: %v", err)
+				return
+			}
+			t.Cleanup(func() { _ = conn.Close() })
+			mu.Lock()
+			local[conn.LocalAddr().String()] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if len(local) != 2 {
+		t.Errorf("flows use %d connections, want 2", len(local))
+	}
+
+	// handshakes are counted in the background
+	cache := cfg.TLSConfig.ClientSessionCache.(*api.SessionCache)
+	time.Sleep(100 * time.Millisecond)
+	if got := cache.Stats(); got.Full+got.Resumed != 2 {
+		t.Errorf("handshakes %+v, want one per connection", got)
+	}
+}
+
+func TestL4ProxyPoolDialOutlivesItsCaller(t *testing.T) {
+	endpoint, _ := connectUDPEcho(t)
+
+	cfg := l4TestConfig(t)
+	cfg.Endpoint = endpoint
+	cfg.EnableUDP = true
+	// hold the handshake until the caller that started it gave up
+	entered, resume := make(chan struct{}), make(chan struct{})
+	getCert := cfg.TLSConfig.GetClientCertificate
+	cfg.TLSConfig.GetClientCertificate = func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		close(entered)
+		<-resume
+		return getCert(info)
+	}
+	proxy, err := api.NewL4Proxy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ownerCtx, cancelOwner := context.WithCancel(context.Background())
+	ownerErr := make(chan error, 1)
+	go func() {
+		_, err := proxy.DialUDP(ownerCtx, "192.0.2.1:53")
+		ownerErr <- err
+	}()
+	<-entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	waiter := make(chan error, 1)
+	go func() {
+		conn, err := proxy.DialUDP(ctx, "192.0.2.1:53")
+		if err == nil {
+			_ = conn.Close()
+		}
+		waiter <- err
+	}()
+	// let the waiter join the pending dial
+	time.Sleep(100 * time.Millisecond)
+
+	cancelOwner()
+	select {
+	case err := <-ownerErr:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("cancelled caller returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("cancelled caller still waits for the handshake")
+	}
+	close(resume)
+	if err := <-waiter; err != nil {
+		t.Errorf("waiter failed with the error of the cancelled caller: %v", err)
+	}
+}
+
+func TestL4ProxyPoolWaitsForHandshake(t *testing.T) {
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := internal.GenerateCert(serverKey, &serverKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type connKey struct{}
+	early := make(chan bool, 2)
+	server := &http3.Server{
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{{Certificate: serverCert, PrivateKey: serverKey}},
+			ClientAuth:   tls.RequireAnyClientCert,
+		}),
+		QUICConfig: &quic.Config{Allow0RTT: true},
+		ConnContext: func(ctx context.Context, c *quic.Conn) context.Context {
+			return context.WithValue(ctx, connKey{}, c)
+		},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Value(connKey{}).(*quic.Conn).HandshakeComplete():
+				early <- false
+			default:
+				early <- true
+			}
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+	go func() { _ = server.Serve(udpConn) }()
+	t.Cleanup(func() { _ = server.Close() })
+
+	cfg := l4TestConfig(t)
+	cfg.Endpoint = udpConn.LocalAddr().(*net.UDPAddr)
+	cache := cfg.TLSConfig.ClientSessionCache.(*api.SessionCache)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for i := 1; i <= 2; i++ {
+		proxy, err := api.NewL4Proxy(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := proxy.DialContext(ctx, "192.0.2.1:80")
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		_ = conn.Close()
+		if <-early {
+			t.Errorf("connection %d was requested in 0-RTT data", i)
+		}
+
+		// handshakes are counted in the background, after which the
+		// session ticket allowing 0-RTT is stored
+		for got := cache.Stats(); got.Full+got.Resumed < i; got = cache.Stats() {
+			if ctx.Err() != nil {
+				t.Fatalf("handshakes %+v, want %d", got, i)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got := cache.Stats(); got.ZeroRTT != 1 {
+		t.Errorf("handshakes %+v, want the second one to use 0-RTT", got)
+	}
+}
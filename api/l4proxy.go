@@ -8,11 +8,15 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/Diniboy1123/usque/internal"
 	quic "github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
+	"github.com/yosida95/uritemplate/v3"
 )
 
 const (
@@ -36,21 +40,76 @@ type L4ProxyConfig struct {
 	OnDisconnect      func(target string)
 	ConnectTimeout    time.Duration
 	ConnectRetryCount int
+	// AltEndpoint is an optional endpoint of the other address family,
+	// raced against Endpoint like MaintainTunnelConfig.AltEndpoint.
+	AltEndpoint *net.UDPAddr
+	// HappyEyeballsDelay is the head start of the preferred endpoint when
+	// racing. Defaults to DefaultHappyEyeballsDelay.
+	HappyEyeballsDelay time.Duration
+	// Ports are further ports the endpoints accept, tried in turn when a
+	// handshake times out like MaintainTunnelConfig.Ports.
+	Ports []int
+	// EnableUDP enables DialUDP, negotiating HTTP datagrams on the QUIC
+	// connection.
+	EnableUDP bool
+	// ConnectUDPTemplate is the CONNECT-UDP URI template used by DialUDP.
+	// Defaults to internal.ConnectUDPURI.
+	ConnectUDPTemplate string
+	// H2Endpoint is the *net.TCPAddr of the endpoint dialed over HTTP/2,
+	// which proxy environment variables apply to. Unless UseHTTP2 is set,
+	// it enables the automatic fallback once HTTP/3 failed H2FallbackAfter
+	// times in a row.
+	H2Endpoint *net.TCPAddr
+	// UseHTTP2 opens every stream over HTTP/2 to H2Endpoint, Endpoint is
+	// not used and may be nil.
+	UseHTTP2 bool
+	// H2FallbackAfter is the number of consecutive failed HTTP/3 connection
+	// attempts after which HTTP/2 is used. Defaults to
+	// DefaultH2FallbackAfter, and is at least one per port.
+	H2FallbackAfter int
+	// H3ProbeInterval is how often HTTP/3 is re-probed while the fallback is
+	// in use. Defaults to DefaultH3ProbeInterval.
+	H3ProbeInterval time.Duration
+	// Connections is the number of QUIC connections streams are spread
+	// over, each with its own congestion controller and stream limit. New
+	// streams go to the connection with the fewest open ones, connections
+	// are dialed when needed or by Prewarm. Defaults to 1.
+	Connections int
+	// Rules route the connections of DialContext and DialUDP, only those
+	// using the tunnel open streams. Host names are resolved with
+	// DNSResolver for the cidr rules, and never match them without one.
+	// Nil tunnels everything.
+	Rules *Rules
+	// SplitTunnel, if set, dials the destinations bypassing the tunnel
+	// directly, after the Rules chose the tunnel. Host names are resolved
+	// with DNSResolver to check them against it, even without
+	// ResolveLocally. Without one, names it tunnels fail to resolve.
+	SplitTunnel *SplitTunnel
 }
 
-// L4Proxy opens one HTTP/3 CONNECT stream for each proxied TCP connection.
+// L4Proxy opens one HTTP/3 CONNECT stream for each proxied TCP connection,
+// and one CONNECT-UDP stream for each proxied UDP flow. TCP connections may
+// also be proxied over HTTP/2 CONNECT streams.
 type L4Proxy struct {
 	tlsConfig         *tls.Config
 	quicConfig        *quic.Config
-	endpoint          *net.UDPAddr
+	endpoints         *endpointPreference
+	racingDelay       time.Duration
 	dnsResolver       DNSResolver
 	resolveLocally    bool
 	onConnect         func(target string)
 	onDisconnect      func(target string)
 	connectTimeout    time.Duration
 	connectRetryCount int
+	udpTemplate       *uritemplate.Template
+	h2Client          *http.Client
+	forceHTTP2        bool
+	fallback          *l4Fallback
 	connMu            sync.Mutex
-	client            *l4HTTP3Client
+	clients           []*l4HTTP3Client
+	dialing           []*l4PendingDial
+	rules             *Rules
+	splitTunnel       *SplitTunnel
 	dialFn            func(context.Context, string) (*l4TCPConn, error)
 }
 
@@ -58,6 +117,8 @@ type l4HTTP3Client struct {
 	udpConn    *net.UDPConn
 	quicConn   *quic.Conn
 	clientConn *http3.ClientConn
+	// streams is the number of open streams, see acquire and release
+	streams atomic.Int32
 }
 
 // NewL4Proxy creates an L4 proxy dialer from a configuration struct.
@@ -65,7 +126,11 @@ func NewL4Proxy(cfg L4ProxyConfig) (*L4Proxy, error) {
 	if cfg.TLSConfig == nil {
 		return nil, fmt.Errorf("missing TLS config")
 	}
-	if cfg.Endpoint == nil {
+	if cfg.UseHTTP2 {
+		if cfg.H2Endpoint == nil {
+			return nil, fmt.Errorf("missing HTTP/2 TCP endpoint")
+		}
+	} else if cfg.Endpoint == nil {
 		return nil, fmt.Errorf("missing HTTP/3 UDP endpoint")
 	}
 	if cfg.ResolveLocally && cfg.DNSResolver == nil {
@@ -77,28 +142,119 @@ func NewL4Proxy(cfg L4ProxyConfig) (*L4Proxy, error) {
 	if cfg.ConnectRetryCount <= 0 {
 		cfg.ConnectRetryCount = defaultL4ConnectRetryCount
 	}
+	if cfg.Connections <= 0 {
+		cfg.Connections = 1
+	}
+	if cfg.HappyEyeballsDelay <= 0 {
+		cfg.HappyEyeballsDelay = DefaultHappyEyeballsDelay
+	}
+	var endpoints *endpointPreference
+	if cfg.Endpoint != nil {
+		endpoints = newEndpointPreference(cfg.Endpoint)
+		if cfg.AltEndpoint != nil {
+			endpoints = newEndpointPreference(cfg.Endpoint, cfg.AltEndpoint)
+		}
+		endpoints.withPorts(cfg.Ports)
+	}
+
+	var udpTemplate *uritemplate.Template
+	if cfg.EnableUDP {
+		if cfg.ConnectUDPTemplate == "" {
+			cfg.ConnectUDPTemplate = internal.ConnectUDPURI
+		}
+		var err error
+		udpTemplate, err = uritemplate.New(cfg.ConnectUDPTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CONNECT-UDP template: %w", err)
+		}
+		if cfg.QUICConfig == nil {
+			cfg.QUICConfig = &quic.Config{}
+		} else {
+			cfg.QUICConfig = cfg.QUICConfig.Clone()
+		}
+		cfg.QUICConfig.EnableDatagrams = true
+	}
 
 	proxy := &L4Proxy{
 		tlsConfig:         cfg.TLSConfig,
 		quicConfig:        cfg.QUICConfig,
-		endpoint:          cfg.Endpoint,
+		endpoints:         endpoints,
+		racingDelay:       cfg.HappyEyeballsDelay,
 		dnsResolver:       cfg.DNSResolver,
 		resolveLocally:    cfg.ResolveLocally,
 		onConnect:         cfg.OnConnect,
 		onDisconnect:      cfg.OnDisconnect,
 		connectTimeout:    cfg.ConnectTimeout,
 		connectRetryCount: cfg.ConnectRetryCount,
+		udpTemplate:       udpTemplate,
+		forceHTTP2:        cfg.UseHTTP2,
+		clients:           make([]*l4HTTP3Client, cfg.Connections),
+		dialing:           make([]*l4PendingDial, cfg.Connections),
+		rules:             cfg.Rules,
+		splitTunnel:       cfg.SplitTunnel,
+	}
+	if cfg.H2Endpoint != nil {
+		h2Client, err := newHTTP2Client(cfg.TLSConfig, cfg.H2Endpoint, internal.ConnectURI)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create HTTP/2 client: %w", err)
+		}
+		proxy.h2Client = h2Client
+		if !cfg.UseHTTP2 {
+			proxy.fallback = newL4Fallback(cfg.H2FallbackAfter, cfg.H3ProbeInterval)
+		}
 	}
 	proxy.dialFn = proxy.dial
 	return proxy, nil
 }
 
-// DialContext connects target over an L4 MASQUE HTTP/3 CONNECT stream.
+// DialContext connects target over an L4 MASQUE HTTP/3 CONNECT stream, or
+// an HTTP/2 one if configured or falling back. With Rules or a SplitTunnel,
+// the target may be dialed directly, through a profile, or blocked instead.
 func (p *L4Proxy) DialContext(ctx context.Context, target string) (net.Conn, error) {
+	return p.route(func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return p.dialStream(ctx, addr)
+	})(ctx, "tcp", target)
+}
+
+// route wraps dial, which opens a stream, with the split tunnel and the
+// rules.
+func (p *L4Proxy) route(dial DialFunc) DialFunc {
+	if p == nil {
+		return dial
+	}
+	if p.splitTunnel != nil {
+		dial = p.splitTunnel.Dialer(dial, p.lookup)
+	}
+	if p.rules != nil {
+		dial = p.rules.Dialer(dial, p.lookup)
+	}
+	return dial
+}
+
+// lookup resolves host for the split tunnel and the rules with the
+// DNSResolver. Without one it fails rather than leaking the name to the
+// system resolver, so host names never match cidr rules.
+func (p *L4Proxy) lookup(ctx context.Context, host string) (netip.Addr, error) {
+	if p.dnsResolver == nil {
+		return netip.Addr{}, fmt.Errorf("missing DNS resolver to resolve %s", host)
+	}
+	ip, err := p.dnsResolver.Resolve(ctx, host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.Addr{}, fmt.Errorf("invalid address %v for %s", ip, host)
+	}
+	return addr.Unmap(), nil
+}
+
+// dialStream connects target over a CONNECT stream.
+func (p *L4Proxy) dialStream(ctx context.Context, target string) (net.Conn, error) {
 	if p == nil || p.tlsConfig == nil {
 		return nil, fmt.Errorf("missing TLS config")
 	}
-	if p.endpoint == nil {
+	if p.endpoints == nil && p.h2Client == nil {
 		return nil, fmt.Errorf("missing HTTP/3 UDP endpoint")
 	}
 	target, err := p.resolveTarget(ctx, target)
@@ -165,51 +321,73 @@ func (p *L4Proxy) resolveTarget(ctx context.Context, target string) (string, err
 }
 
 func (p *L4Proxy) dial(ctx context.Context, target string) (*l4TCPConn, error) {
-	h3Client, err := p.getOrCreateClientConn(ctx)
-	if err != nil {
-		return nil, err
+	if p.usingHTTP2() {
+		return p.dialHTTP2(ctx, target)
 	}
+	return p.dialHTTP3(ctx, target)
+}
 
-	stream, err := h3Client.clientConn.OpenRequestStream(ctx)
+func (p *L4Proxy) dialHTTP3(ctx context.Context, target string) (*l4TCPConn, error) {
+	stream, h3Client, err := p.openRequestStream(ctx)
 	if err != nil {
-		if !shouldReconnectOnOpenStreamError(ctx, err) {
-			return nil, err
-		}
-		// The cached HTTP/3 connection might be stale; reconnect once and retry.
-		p.closeClientConnIfCurrent(h3Client)
-		h3Client, err = p.getOrCreateClientConn(ctx)
-		if err != nil {
-			return nil, err
-		}
-		stream, err = h3Client.clientConn.OpenRequestStream(ctx)
-		if err != nil {
-			if shouldReconnectOnOpenStreamError(ctx, err) {
-				p.closeClientConnIfCurrent(h3Client)
-			}
-			return nil, err
-		}
+		return nil, err
 	}
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodConnect, "https://"+target, nil)
 	if err != nil {
-		_ = stream.Close()
+		h3Client.abort(stream)
 		return nil, err
 	}
 	req.Host = target
+	setPostQuantumHeader(req.Header, p.tlsConfig)
 	if err := stream.SendRequestHeader(req); err != nil {
-		_ = stream.Close()
+		h3Client.abort(stream)
 		return nil, err
 	}
 	response, err := stream.ReadResponse()
 	if err != nil {
-		_ = stream.Close()
+		h3Client.abort(stream)
 		return nil, err
 	}
 	if response.StatusCode < 200 || response.StatusCode > 299 {
-		_ = stream.Close()
+		h3Client.abort(stream)
 		return nil, fmt.Errorf("CONNECT rejected with status %d", response.StatusCode)
 	}
-	return &l4TCPConn{stream: stream, local: h3Client.udpConn.LocalAddr(), remote: l4Addr(target)}, nil
+	return &l4TCPConn{stream: stream, local: h3Client.udpConn.LocalAddr(), remote: l4Addr(target), release: h3Client.release}, nil
+}
+
+// openRequestStream opens a request stream on the least loaded HTTP/3
+// connection of the pool, reconnecting once if it turns out to be stale.
+// The stream counts towards the load of the returned connection until it
+// is released.
+func (p *L4Proxy) openRequestStream(ctx context.Context) (*http3.RequestStream, *l4HTTP3Client, error) {
+	h3Client, err := p.acquireClientConn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stream, err := h3Client.clientConn.OpenRequestStream(ctx)
+	if err != nil {
+		h3Client.release()
+		if !shouldReconnectOnOpenStreamError(ctx, err) {
+			return nil, nil, err
+		}
+		// The cached HTTP/3 connection might be stale; reconnect once and retry.
+		p.closeClientConnIfCurrent(h3Client)
+		h3Client, err = p.acquireClientConn(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		stream, err = h3Client.clientConn.OpenRequestStream(ctx)
+		if err != nil {
+			h3Client.release()
+			if shouldReconnectOnOpenStreamError(ctx, err) {
+				p.closeClientConnIfCurrent(h3Client)
+			}
+			return nil, nil, err
+		}
+	}
+	return stream, h3Client, nil
 }
 
 func shouldReconnectOnOpenStreamError(ctx context.Context, err error) bool {
@@ -225,60 +403,6 @@ func shouldReconnectOnOpenStreamError(ctx context.Context, err error) bool {
 	return true
 }
 
-func (p *L4Proxy) getOrCreateClientConn(ctx context.Context) (*l4HTTP3Client, error) {
-	p.connMu.Lock()
-	if p.client != nil {
-		client := p.client
-		p.connMu.Unlock()
-		return client, nil
-	}
-	p.connMu.Unlock()
-
-	udpConn, err := listenUDPForEndpoint(p.endpoint)
-	if err != nil {
-		return nil, err
-	}
-	quicConn, err := quic.Dial(ctx, udpConn, p.endpoint, p.tlsConfig, p.quicConfig)
-	if err != nil {
-		_ = udpConn.Close()
-		return nil, err
-	}
-
-	newClient := &l4HTTP3Client{
-		udpConn:    udpConn,
-		quicConn:   quicConn,
-		clientConn: (&http3.Transport{}).NewClientConn(quicConn),
-	}
-
-	p.connMu.Lock()
-	if p.client != nil {
-		current := p.client
-		p.connMu.Unlock()
-		closeL4HTTP3(newClient.udpConn, newClient.quicConn)
-		return current, nil
-	}
-	p.client = newClient
-	p.connMu.Unlock()
-
-	return newClient, nil
-}
-
-func (p *L4Proxy) closeClientConnIfCurrent(expected *l4HTTP3Client) {
-	if expected == nil {
-		return
-	}
-
-	p.connMu.Lock()
-	if p.client != expected {
-		p.connMu.Unlock()
-		return
-	}
-	p.client = nil
-	p.connMu.Unlock()
-
-	closeL4HTTP3(expected.udpConn, expected.quicConn)
-}
-
 func listenUDPForEndpoint(endpoint *net.UDPAddr) (*net.UDPConn, error) {
 	if endpoint.IP.To4() == nil {
 		return net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv6zero})
@@ -301,6 +425,8 @@ type l4TCPConn struct {
 	remote  net.Addr
 	once    sync.Once
 	onClose func()
+	// release is called on Close, if set
+	release func()
 }
 
 type l4Stream interface {
@@ -343,6 +469,9 @@ func (c *l4TCPConn) Close() error {
 	c.once.Do(func() {
 		err = c.CloseWrite()
 		_ = c.CloseRead()
+		if c.release != nil {
+			c.release()
+		}
 		if c.onClose != nil {
 			c.onClose()
 		}
@@ -0,0 +1,99 @@
+package api_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestL4ProxyPostQuantumHeader(t *testing.T) {
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := internal.GenerateCert(serverKey, &serverKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := make(chan string, 1)
+	server := &http3.Server{
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{{Certificate: serverCert, PrivateKey: serverKey}},
+			ClientAuth:   tls.RequireAnyClientCert,
+		}),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			headers <- r.Header.Get("pq-enabled")
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+	go func() { _ = server.Serve(udpConn) }()
+	t.Cleanup(func() { _ = server.Close() })
+
+	for _, pq := range []bool{false, true} {
+		cfg := l4TestConfig(t)
+		cfg.Endpoint = udpConn.LocalAddr().(*net.UDPAddr)
+		want := "false"
+		if pq {
+			api.EnablePostQuantum(cfg.TLSConfig)
+			want = "true"
+		}
+		proxy, err := api.NewL4Proxy(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		conn, err := proxy.DialContext(ctx, "192.0.2.1:80")
+		cancel()
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		_ = conn.Close()
+		if got := <-headers; got != want {
+			t.Errorf("requested with pq-enabled %q, want %s", got, want)
+		}
+	}
+}
+
+func TestL4ProxyRulesWithoutResolver(t *testing.T) {
+	endpoint, targets := connectH2Echo(t)
+	rules, err := api.ParseRules(strings.NewReader("direct cidr=127.0.0.0/8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := l4TestConfig(t)
+	cfg.H2Endpoint = endpoint
+	cfg.UseHTTP2 = true
+	cfg.Rules = rules
+	proxy, err := api.NewL4Proxy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the name is not resolved by the system to match the cidr rule
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := proxy.DialContext(ctx, "localhost:80")
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	_ = conn.Close()
+	if target := <-targets; target != "localhost:80" {
+		t.Errorf("requested %s", target)
+	}
+}
@@ -0,0 +1,249 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+	"github.com/yosida95/uritemplate/v3"
+)
+
+// connectUDPProtocol is the RFC 9298 extended CONNECT protocol token.
+const connectUDPProtocol = "connect-udp"
+
+// errUDPDisabled is returned by DialUDP unless L4ProxyConfig.EnableUDP is set.
+var errUDPDisabled = errors.New("UDP is not enabled on this L4 proxy")
+
+// DialUDP connects to target over an HTTP/3 CONNECT-UDP (RFC 9298) stream
+// on the QUIC connection shared with the TCP streams. Every Write on the
+// returned connection sends one UDP payload as an HTTP datagram and every
+// Read returns one. Like DialContext, it follows the Rules and the
+// SplitTunnel.
+//
+// Parameters:
+//   - ctx: context.Context - Bounds establishing the stream.
+//   - target: string - The host and port to send datagrams to.
+//
+// Returns:
+//   - net.Conn: The connected UDP flow.
+//   - error: An error if UDP is not enabled, streams use HTTP/2, the endpoint does not support HTTP datagrams or rejects the request.
+func (p *L4Proxy) DialUDP(ctx context.Context, target string) (net.Conn, error) {
+	return p.route(func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return p.dialUDPStream(ctx, addr)
+	})(ctx, "udp", target)
+}
+
+// dialUDPStream connects target over a CONNECT-UDP stream.
+func (p *L4Proxy) dialUDPStream(ctx context.Context, target string) (net.Conn, error) {
+	if p == nil || p.tlsConfig == nil {
+		return nil, fmt.Errorf("missing TLS config")
+	}
+	if p.udpTemplate == nil {
+		return nil, errUDPDisabled
+	}
+	if p.usingHTTP2() {
+		return nil, errUDPNeedsHTTP3
+	}
+	target, err := p.resolveTarget(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target %q: %w", target, err)
+	}
+
+	timeout := p.connectTimeout
+	if timeout <= 0 {
+		timeout = defaultL4ConnectTimeout
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	stream, h3Client, err := p.openRequestStream(dialCtx)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-h3Client.clientConn.ReceivedSettings():
+	case <-dialCtx.Done():
+		h3Client.abort(stream)
+		return nil, dialCtx.Err()
+	}
+	if !h3Client.clientConn.Settings().EnableDatagrams {
+		h3Client.abort(stream)
+		return nil, errors.New("endpoint does not support HTTP datagrams")
+	}
+
+	values := uritemplate.Values{}
+	values.Set("target_host", uritemplate.String(host))
+	values.Set("target_port", uritemplate.String(port))
+	rawURL, err := p.udpTemplate.Expand(values)
+	if err != nil {
+		h3Client.abort(stream)
+		return nil, fmt.Errorf("failed to expand CONNECT-UDP template: %w", err)
+	}
+	req, err := http.NewRequestWithContext(dialCtx, http.MethodConnect, rawURL, nil)
+	if err != nil {
+		h3Client.abort(stream)
+		return nil, err
+	}
+	req.Proto = connectUDPProtocol
+	req.Header.Set("Capsule-Protocol", "?1")
+	setPostQuantumHeader(req.Header, p.tlsConfig)
+	if err := stream.SendRequestHeader(req); err != nil {
+		h3Client.abort(stream)
+		return nil, err
+	}
+	response, err := stream.ReadResponse()
+	if err != nil {
+		h3Client.abort(stream)
+		return nil, err
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		h3Client.abort(stream)
+		return nil, fmt.Errorf("CONNECT-UDP rejected with status %d", response.StatusCode)
+	}
+
+	closeCtx, closeFn := context.WithCancel(context.Background())
+	conn := &l4UDPConn{
+		stream:  stream,
+		client:  h3Client,
+		local:   h3Client.udpConn.LocalAddr(),
+		remote:  l4UDPAddr(target),
+		closed:  closeCtx,
+		closeFn: closeFn,
+	}
+	if p.onConnect != nil {
+		p.onConnect(target)
+	}
+	conn.onClose = func() {
+		if p.onDisconnect != nil {
+			p.onDisconnect(target)
+		}
+	}
+	return conn, nil
+}
+
+// l4UDPConn is a UDP flow proxied over a CONNECT-UDP stream.
+type l4UDPConn struct {
+	stream *http3.RequestStream
+	client *l4HTTP3Client
+	local  net.Addr
+	remote net.Addr
+
+	closed  context.Context
+	closeFn context.CancelFunc
+	once    sync.Once
+	onClose func()
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// Read returns the payload of the next datagram, dropping datagrams with a
+// context ID other than 0, which carries UDP payloads.
+func (c *l4UDPConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+
+	ctx := c.closed
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	for {
+		data, err := c.stream.ReceiveDatagram(ctx)
+		if err != nil {
+			switch {
+			case c.closed.Err() != nil:
+				return 0, net.ErrClosed
+			case errors.Is(err, context.DeadlineExceeded):
+				return 0, os.ErrDeadlineExceeded
+			}
+			return 0, err
+		}
+		contextID, n, err := quicvarint.Parse(data)
+		if err != nil || contextID != 0 {
+			continue
+		}
+		return copy(b, data[n:]), nil
+	}
+}
+
+// Write sends b as the payload of one datagram.
+func (c *l4UDPConn) Write(b []byte) (int, error) {
+	if c.closed.Err() != nil {
+		return 0, net.ErrClosed
+	}
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	if !deadline.IsZero() && time.Now().After(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	data := make([]byte, 0, 1+len(b))
+	data = quicvarint.Append(data, 0)
+	data = append(data, b...)
+	if err := c.stream.SendDatagram(data); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *l4UDPConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		c.closeFn()
+		c.stream.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+		err = c.stream.Close()
+		c.client.release()
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return err
+}
+
+func (c *l4UDPConn) LocalAddr() net.Addr  { return c.local }
+func (c *l4UDPConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *l4UDPConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.mu.Unlock()
+	return nil
+}
+
+// SetReadDeadline sets the deadline of later reads, it does not interrupt
+// a blocked one.
+func (c *l4UDPConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *l4UDPConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+type l4UDPAddr string
+
+func (a l4UDPAddr) Network() string { return "masque-l4-udp" }
+func (a l4UDPAddr) String() string  { return string(a) }
@@ -0,0 +1,148 @@
+package api_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// connectUDPEcho serves CONNECT-UDP on loopback, echoing every datagram
+// back, and returns its address and the target of the first request.
+func connectUDPEcho(t *testing.T) (*net.UDPAddr, <-chan string) {
+	t.Helper()
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := internal.GenerateCert(serverKey, &serverKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targets := make(chan string, 1)
+	server := &http3.Server{
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{{Certificate: serverCert, PrivateKey: serverKey}},
+			ClientAuth:   tls.RequireAnyClientCert,
+		}),
+		EnableDatagrams: true,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodConnect || r.Proto != "connect-udp" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			select {
+			case targets <- r.URL.Path:
+			default:
+			}
+			w.Header().Set("Capsule-Protocol", "?1")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+
+			stream := w.(http3.HTTPStreamer).HTTPStream()
+			for {
+				data, err := stream.ReceiveDatagram(r.Context())
+				if err != nil {
+					return
+				}
+				if err := stream.SendDatagram(data); err != nil {
+					return
+				}
+			}
+		}),
+	}
+	go func() { _ = server.Serve(udpConn) }()
+	t.Cleanup(func() { _ = server.Close() })
+	return udpConn.LocalAddr().(*net.UDPAddr), targets
+}
+
+func TestL4ProxyDialUDP(t *testing.T) {
+	endpoint, targets := connectUDPEcho(t)
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := api.PrepareTlsConfig(clientKey, nil, nil, internal.L4ConnectSNI, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := api.NewL4Proxy(api.L4ProxyConfig{
+		TLSConfig: tlsConfig,
+		Endpoint:  endpoint,
+		EnableUDP: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := proxy.DialUDP(ctx, "192.0.2.1:53")
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if target := <-targets; target != "/.well-known/masque/udp/192.0.2.1/53/" {
+		t.Errorf("requested %s", target)
+	}
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Errorf("read %q, want the echoed datagram", buf[:n])
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("read after the deadline returned %v", err)
+	}
+}
+
+func TestL4ProxyDialUDPDisabled(t *testing.T) {
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := api.PrepareTlsConfig(clientKey, nil, nil, internal.L4ConnectSNI, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := api.NewL4Proxy(api.L4ProxyConfig{
+		TLSConfig: tlsConfig,
+		Endpoint:  &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := proxy.DialUDP(context.Background(), "192.0.2.1:53"); err == nil {
+		t.Errorf("dialed UDP without EnableUDP")
+	}
+}
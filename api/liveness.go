@@ -0,0 +1,311 @@
+package api
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	connectip "github.com/Diniboy1123/connect-ip-go"
+)
+
+// Defaults of LivenessConfig.
+const (
+	DefaultLivenessInterval   = 10 * time.Second
+	DefaultLivenessMaxMissed  = 3
+	DefaultClockJumpThreshold = 10 * time.Second
+)
+
+// clockCheckInterval is how often the wall clock is compared against the
+// monotonic clock. It bounds how long a resumed tunnel keeps its stale
+// connection.
+const clockCheckInterval = time.Second
+
+var (
+	// ErrLivenessTimeout is the reason of a TunnelDisconnected event when
+	// LivenessConfig.MaxMissed probes in a row went unanswered.
+	ErrLivenessTimeout = errors.New("liveness probes went unanswered")
+	// ErrClockJump is the reason of a TunnelDisconnected event when the wall
+	// clock jumped, usually because the system was suspended.
+	ErrClockJump = errors.New("wall clock jumped")
+)
+
+// LivenessConfig configures active health checks of an established tunnel,
+// which catch sessions that look alive while their datagrams are black-holed,
+// e.g. after NAT rebinding.
+type LivenessConfig struct {
+	// Target enables probing with ICMP echo requests sent to it through the
+	// tunnel. Replies are consumed and not written to the device.
+	Target netip.Addr
+	// Source is the tunnel address the echo requests are sent from. It must
+	// be of the same family as Target.
+	Source netip.Addr
+	// Probe, if set, is used instead of the ICMP echo, e.g. an
+	// HTTPLivenessProbe. It must return once ctx is done.
+	Probe func(ctx context.Context) error
+	// Interval is the time between probes and the time a probe may take.
+	// Defaults to DefaultLivenessInterval.
+	Interval time.Duration
+	// MaxMissed is the number of failed probes in a row after which the
+	// connection is torn down. Defaults to DefaultLivenessMaxMissed.
+	MaxMissed int
+	// ClockJumpThreshold is how far the wall clock may run ahead of or
+	// behind the monotonic clock before the connection is torn down at once,
+	// as the system was most likely suspended. A positive threshold is
+	// checked even without probes. Defaults to DefaultClockJumpThreshold if
+	// probes are configured and to disabled otherwise, negative disables it.
+	ClockJumpThreshold time.Duration
+}
+
+// enabled reports whether probes are configured.
+func (c *LivenessConfig) enabled() bool {
+	return c.Probe != nil || c.Target.IsValid()
+}
+
+// HTTPLivenessProbe returns a LivenessConfig.Probe requesting url with dial,
+// which must connect through the tunnel, e.g. a netstack's DialContext. Any
+// response counts as alive.
+//
+// Parameters:
+//   - url: string - The URL to request.
+//   - dial: func(ctx context.Context, network, addr string) (net.Conn, error) - Dials through the tunnel.
+//
+// Returns:
+//   - func(ctx context.Context) error: The probe.
+func HTTPLivenessProbe(url string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context) error {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:       dial,
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+		if err != nil {
+			return err
+		}
+		rsp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		_, _ = io.Copy(io.Discard, rsp.Body)
+		return rsp.Body.Close()
+	}
+}
+
+// monitorLiveness runs probe every cfg.Interval until ctx is done and sends
+// ErrLivenessTimeout to errChan once cfg.MaxMissed probes in a row failed.
+func monitorLiveness(ctx context.Context, cfg *LivenessConfig, probe func(ctx context.Context) error, errChan chan<- error) {
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		probeCtx, cancel := context.WithTimeout(ctx, cfg.Interval)
+		err := probe(probeCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			missed = 0
+			continue
+		}
+		missed++
+		log.Printf("Liveness probe failed (%d/%d): %v", missed, cfg.MaxMissed, err)
+		if missed >= cfg.MaxMissed {
+			errChan <- fmt.Errorf("%w: %d in a row", ErrLivenessTimeout, missed)
+			return
+		}
+	}
+}
+
+// echoProber probes with ICMP echo requests written straight into a
+// CONNECT-IP session.
+type echoProber struct {
+	ipConn *connectip.Conn
+	source sourceAddr
+	target netip.Addr
+	id     uint16
+	// seq is the sequence number of the outstanding request
+	seq     atomic.Uint32
+	replies chan uint16
+}
+
+func newEchoProber(cfg *LivenessConfig, ipConn *connectip.Conn) *echoProber {
+	return &echoProber{
+		ipConn:  ipConn,
+		source:  sourceAddr{addr: cfg.Source},
+		target:  cfg.Target,
+		id:      uint16(rand.N(1 << 16)),
+		replies: make(chan uint16, 1),
+	}
+}
+
+// probe sends an echo request and waits for its reply.
+func (p *echoProber) probe(ctx context.Context) error {
+	seq := uint16(p.seq.Add(1))
+	if _, err := p.ipConn.WritePacket(echoRequest(p.source.get(), p.target, p.id, seq)); err != nil {
+		return fmt.Errorf("failed to send echo request: %w", err)
+	}
+	for {
+		select {
+		case got := <-p.replies:
+			if got == seq {
+				return nil
+			}
+		case <-ctx.Done():
+			return fmt.Errorf("no echo reply from %s", p.target)
+		}
+	}
+}
+
+// consume reports whether pkt is an echo reply to p, which is then not
+// forwarded to the device.
+func (p *echoProber) consume(pkt []byte) bool {
+	seq, ok := parseEchoReply(pkt, p.target, p.id)
+	if !ok {
+		return false
+	}
+	select {
+	case p.replies <- seq:
+	default:
+	}
+	return true
+}
+
+// echoRequest builds an IPv4 ICMP or an ICMPv6 echo request.
+func echoRequest(src, dst netip.Addr, id, seq uint16) []byte {
+	const payloadLen = 8
+	if src.Is4() {
+		pkt := make([]byte, 20+8+payloadLen)
+		pkt[0] = 0x45 // version 4, 5 word header
+		binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+		pkt[8] = 64 // TTL
+		pkt[9] = 1  // ICMP
+		copy(pkt[12:16], src.AsSlice())
+		copy(pkt[16:20], dst.AsSlice())
+		binary.BigEndian.PutUint16(pkt[10:12], ^foldChecksum(onesSum(0, pkt[:20])))
+
+		icmp := pkt[20:]
+		icmp[0] = 8 // echo request
+		binary.BigEndian.PutUint16(icmp[4:6], id)
+		binary.BigEndian.PutUint16(icmp[6:8], seq)
+		binary.BigEndian.PutUint16(icmp[2:4], ^foldChecksum(onesSum(0, icmp)))
+		return pkt
+	}
+
+	pkt := make([]byte, 40+8+payloadLen)
+	pkt[0] = 0x60 // version 6
+	binary.BigEndian.PutUint16(pkt[4:6], 8+payloadLen)
+	pkt[6] = 58 // ICMPv6
+	pkt[7] = 64 // hop limit
+	copy(pkt[8:24], src.AsSlice())
+	copy(pkt[24:40], dst.AsSlice())
+
+	icmp := pkt[40:]
+	icmp[0] = 128 // echo request
+	binary.BigEndian.PutUint16(icmp[4:6], id)
+	binary.BigEndian.PutUint16(icmp[6:8], seq)
+	// the pseudo header: addresses, upper-layer length and next header
+	sum := onesSum(0, pkt[8:40])
+	sum += uint32(len(icmp)) + 58
+	binary.BigEndian.PutUint16(icmp[2:4], ^foldChecksum(onesSum(sum, icmp)))
+	return pkt
+}
+
+// parseEchoReply returns the sequence number of pkt if it is an echo reply
+// from target with the given identifier.
+func parseEchoReply(pkt []byte, target netip.Addr, id uint16) (uint16, bool) {
+	var src netip.Addr
+	var icmp []byte
+	switch {
+	case len(pkt) >= 20 && pkt[0]>>4 == 4:
+		ihl := int(pkt[0]&0x0f) * 4
+		if pkt[9] != 1 || len(pkt) < ihl+8 {
+			return 0, false
+		}
+		src = netip.AddrFrom4([4]byte(pkt[12:16]))
+		icmp = pkt[ihl:]
+		if icmp[0] != 0 { // echo reply
+			return 0, false
+		}
+	case len(pkt) >= 48 && pkt[0]>>4 == 6:
+		if pkt[6] != 58 {
+			return 0, false
+		}
+		src = netip.AddrFrom16([16]byte(pkt[8:24]))
+		icmp = pkt[40:]
+		if icmp[0] != 129 { // echo reply
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+	if src != target || binary.BigEndian.Uint16(icmp[4:6]) != id {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(icmp[6:8]), true
+}
+
+func onesSum(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
+
+func foldChecksum(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return uint16(sum)
+}
+
+// clockWatch detects jumps of the wall clock against the monotonic clock,
+// which does not advance while the system is suspended.
+type clockWatch struct {
+	threshold time.Duration
+	last      time.Time
+}
+
+// newClockWatch returns nil if threshold is negative.
+func newClockWatch(threshold time.Duration) *clockWatch {
+	if threshold < 0 {
+		return nil
+	}
+	return &clockWatch{threshold: threshold, last: time.Now()}
+}
+
+// jumped returns how far the wall clock jumped since the last call if that
+// exceeds the threshold, zero otherwise.
+func (w *clockWatch) jumped() time.Duration {
+	now := time.Now()
+	// Round(0) strips the monotonic reading, leaving the wall clock
+	jump := now.Round(0).Sub(w.last.Round(0)) - now.Sub(w.last)
+	w.last = now
+	if jump.Abs() > w.threshold {
+		return jump
+	}
+	return 0
+}
@@ -10,6 +10,8 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 
 	connectip "github.com/Diniboy1123/connect-ip-go"
@@ -25,7 +27,7 @@ import (
 // Parameters:
 //   - privKey: *ecdsa.PrivateKey - The private key to use for TLS authentication.
 //   - peerPubKey: *ecdsa.PublicKey - The endpoint's public key to pin to.
-//   - cert: [][]byte - The certificate chain to use for TLS authentication.
+//   - cert: [][]byte - The certificate chain to use for TLS authentication. If nil, a certificate is minted for every handshake, see NewCertMinter.
 //   - sni: string - The Server Name Indication (SNI) to use.
 //   - insecure: bool - When true, skip endpoint public key pinning.
 //
@@ -42,18 +44,27 @@ func PrepareTlsConfig(privKey *ecdsa.PrivateKey, peerPubKey *ecdsa.PublicKey, ce
 		},
 		ServerName: sni,
 		NextProtos: []string{http3.NextProtoH3},
+		// shared by all connections dialed with this config, so reconnects
+		// resume the session and skip the HelloRetryRequest below
+		ClientSessionCache: NewSessionCache(DefaultSessionCacheSize),
 		// WARN: SNI is usually not for the endpoint, so we must skip verification
 		InsecureSkipVerify: true,
 		// To avoid the Hello Retry Requests you would uncomment this, but I prefer to keep Go defaults, maybe
 		// Cloudflare adds support for more curves in the future and I don't want to hardcode it here
 		// NOTE: If I add more than one, Go will still use one share it picks and it was never P-256 for me
-		// so kept it doing HRRs for now.
+		// so kept it doing HRRs for now. The SessionCache learns the curve
+		// the endpoint asked for and only offers that one afterwards, so
+		// only the first handshake does one.
 		// I couldn't get the official client to work with HTTP/2, so couldn't check its behavior.
 		/*CurvePreferences: []tls.CurveID{
 			tls.CurveP256,
 		},*/
 	}
 
+	if cert == nil {
+		NewCertMinter(privKey, 0, -1).Attach(tlsConfig)
+	}
+
 	if !insecure {
 		// we pin to the endpoint public key
 		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
@@ -88,6 +99,31 @@ func PrepareTlsConfig(privKey *ecdsa.PrivateKey, peerPubKey *ecdsa.PublicKey, ce
 	return tlsConfig, nil
 }
 
+// EnablePostQuantum restricts the key exchange of tlsConfig to the hybrid
+// X25519MLKEM768, protecting the tunnel against harvest-now-decrypt-later
+// attacks. Handshakes with endpoints not supporting it fail instead of
+// falling back to a classical key exchange.
+//
+// Parameters:
+//   - tlsConfig: *tls.Config - The TLS configuration to modify, before it is used.
+func EnablePostQuantum(tlsConfig *tls.Config) {
+	tlsConfig.CurvePreferences = []tls.CurveID{tls.X25519MLKEM768}
+}
+
+// isPostQuantum reports whether tlsConfig only offers post-quantum key
+// exchanges, see EnablePostQuantum.
+func isPostQuantum(tlsConfig *tls.Config) bool {
+	return len(tlsConfig.CurvePreferences) > 0 && !slices.ContainsFunc(tlsConfig.CurvePreferences, func(id tls.CurveID) bool {
+		return id != tls.X25519MLKEM768
+	})
+}
+
+// setPostQuantumHeader sets the pq-enabled header of a MASQUE request to
+// whether tlsConfig only offers post-quantum key exchanges.
+func setPostQuantumHeader(header http.Header, tlsConfig *tls.Config) {
+	header.Set("pq-enabled", strconv.FormatBool(isPostQuantum(tlsConfig)))
+}
+
 // ConnectTunnel establishes a Connect-IP tunnel with the provided endpoint.
 // When useHTTP2 is false it dials over QUIC/HTTP3; when true it dials over TCP/HTTP2.
 // Requires modified connect-ip-go for now to support Cloudflare's non RFC compliant implementation.
@@ -107,83 +143,151 @@ func PrepareTlsConfig(privKey *ecdsa.PrivateKey, peerPubKey *ecdsa.PublicKey, ce
 //   - *http.Response: The response from the Connect-IP handshake.
 //   - error: An error if the connection setup fails.
 func ConnectTunnel(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.Config, connectUri string, endpoint net.Addr, useHTTP2 bool) (*net.UDPConn, *http3.Transport, *connectip.Conn, *http.Response, error) {
+	udpConn, _, tr, ipConn, rsp, err := connectTunnel(ctx, tlsConfig, quicConfig, connectUri, endpoint, useHTTP2)
+	return udpConn, tr, ipConn, rsp, err
+}
+
+// connectTunnel is ConnectTunnel that additionally returns the QUIC
+// connection of HTTP/3 sessions, which can be migrated to another path.
+func connectTunnel(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.Config, connectUri string, endpoint net.Addr, useHTTP2 bool) (*net.UDPConn, *quic.Conn, *http3.Transport, *connectip.Conn, *http.Response, error) {
 	template := uritemplate.MustNew(connectUri)
 	additionalHeaders := http.Header{
 		"User-Agent": []string{""},
 	}
+	setPostQuantumHeader(additionalHeaders, tlsConfig)
 
 	if useHTTP2 {
 		h2Endpoint, ok := endpoint.(*net.TCPAddr)
 		if !ok || h2Endpoint == nil {
-			return nil, nil, nil, nil, errors.New("missing HTTP/2 TCP endpoint")
+			return nil, nil, nil, nil, nil, errors.New("missing HTTP/2 TCP endpoint")
 		}
 
 		h2Headers := additionalHeaders.Clone()
 		h2Headers.Set("cf-connect-proto", "cf-connect-ip")
-		// TODO: support PQC
-		h2Headers.Set("pq-enabled", "false")
 
 		h2Client, err := newHTTP2Client(tlsConfig, h2Endpoint, connectUri)
 		if err != nil {
-			return nil, nil, nil, nil, fmt.Errorf("failed to create HTTP/2 client: %w", err)
+			return nil, nil, nil, nil, nil, fmt.Errorf("failed to create HTTP/2 client: %w", err)
 		}
 
 		ipConn, rsp, err := connectip.DialH2(ctx, h2Client, template, h2Headers)
 		if err != nil {
 			if strings.Contains(err.Error(), "tls: access denied") {
-				return nil, nil, nil, nil, errors.New("login failed! Please double-check if your tls key and cert is enrolled in the Cloudflare Access service")
+				return nil, nil, nil, nil, nil, ErrAccessDenied
 			}
-			return nil, nil, nil, nil, fmt.Errorf("failed to dial connect-ip over HTTP/2: %w", err)
+			return nil, nil, nil, nil, nil, fmt.Errorf("failed to dial connect-ip over HTTP/2: %w", err)
 		}
-		return nil, nil, ipConn, rsp, nil
+		return nil, nil, nil, ipConn, rsp, nil
 	}
 
 	quicEndpoint, ok := endpoint.(*net.UDPAddr)
 	if !ok || quicEndpoint == nil {
-		return nil, nil, nil, nil, errors.New("missing HTTP/3 UDP endpoint")
+		return nil, nil, nil, nil, nil, errors.New("missing HTTP/3 UDP endpoint")
 	}
 
 	var lastErr error
 	for attempt := 0; attempt < 2; attempt++ {
-		udpConn, tr, ipConn, rsp, err := connectTunnelHTTP3(ctx, tlsConfig, quicConfig, template, additionalHeaders, quicEndpoint)
+		udpConn, conn, tr, ipConn, rsp, err := connectTunnelHTTP3(ctx, tlsConfig, quicConfig, template, additionalHeaders, quicEndpoint)
 		if err == nil {
-			return udpConn, tr, ipConn, rsp, nil
+			return udpConn, conn, tr, ipConn, rsp, nil
 		}
 		if strings.Contains(err.Error(), "tls: access denied") {
-			return nil, nil, nil, nil, errors.New("login failed! Please double-check if your tls key and cert is enrolled in the Cloudflare Access service")
+			return nil, nil, nil, nil, nil, ErrAccessDenied
 		}
 		lastErr = err
 		if !isRetryableHTTP3ConnectFailure(err) {
 			break
 		}
 	}
-	return nil, nil, nil, nil, fmt.Errorf("failed to dial connect-ip: %w", lastErr)
+	return nil, nil, nil, nil, nil, fmt.Errorf("failed to dial connect-ip: %w", lastErr)
 }
 
-func connectTunnelHTTP3(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.Config, template *uritemplate.Template, additionalHeaders http.Header, endpoint *net.UDPAddr) (*net.UDPConn, *http3.Transport, *connectip.Conn, *http.Response, error) {
-	var udpConn *net.UDPConn
-	var err error
-	if endpoint.IP.To4() == nil {
-		udpConn, err = net.ListenUDP("udp", &net.UDPAddr{
-			IP:   net.IPv6zero,
-			Port: 0,
-		})
-	} else {
-		udpConn, err = net.ListenUDP("udp", &net.UDPAddr{
-			IP:   net.IPv4zero,
-			Port: 0,
-		})
+func connectTunnelHTTP3(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.Config, template *uritemplate.Template, additionalHeaders http.Header, endpoint *net.UDPAddr) (*net.UDPConn, *quic.Conn, *http3.Transport, *connectip.Conn, *http.Response, error) {
+	udpConn, conn, err := dialQUIC(ctx, tlsConfig, quicConfig, endpoint)
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
 	}
+
+	// a connection returned before its handshake completed uses 0-RTT
+	early := !handshakeComplete(conn)
+	tr, ipConn, rsp, err := dialConnectIP(ctx, conn, template, additionalHeaders)
 	if err != nil {
-		return udpConn, nil, nil, nil, err
+		if early && handshakeComplete(conn) && !conn.ConnectionState().Used0RTT {
+			// the streams opened meanwhile, and with them the HTTP/3
+			// session, were lost
+			err = fmt.Errorf("%w: %w", quic.Err0RTTRejected, err)
+		}
+		_ = conn.CloseWithError(0, "connect-ip dial failed")
+		_ = udpConn.Close()
+		return nil, nil, nil, nil, nil, err
 	}
 
-	conn, err := quic.Dial(ctx, udpConn, endpoint, tlsConfig, quicConfig)
+	return udpConn, conn, tr, ipConn, rsp, nil
+}
+
+// dialQUIC starts a QUIC handshake with endpoint from a new UDP socket of
+// the endpoint's address family. Closing the socket stops its transport.
+//
+// If tlsConfig has a SessionCache, the handshake only offers the curve an
+// earlier one was asked for with a HelloRetryRequest, and uses 0-RTT when
+// resuming a session that allows it.
+// The connection is then returned before the handshake completed; use
+// HandshakeComplete to wait for it.
+func dialQUIC(ctx context.Context, tlsConfig *tls.Config, quicConfig *quic.Config, endpoint *net.UDPAddr) (*net.UDPConn, *quic.Conn, error) {
+	udpConn, err := listenUDPForEndpoint(endpoint)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cache := sessionCacheOf(tlsConfig)
+	early := false
+	if cache != nil {
+		tlsConfig, early = cache.handshakeConfig(tlsConfig)
+	}
+
+	// unlike quic.Dial, a Transport uses connection IDs, which the paths
+	// added by migrations must share
+	tr := &quic.Transport{Conn: udpConn}
+	var conn *quic.Conn
+	if early {
+		conn, err = tr.DialEarly(ctx, endpoint, tlsConfig, quicConfig)
+	} else {
+		conn, err = tr.Dial(ctx, endpoint, tlsConfig, quicConfig)
+	}
 	if err != nil {
 		_ = udpConn.Close()
-		return nil, nil, nil, nil, err
+		if cache != nil {
+			cache.forgetCurve()
+		}
+		return nil, nil, err
+	}
+
+	if cache != nil {
+		go func() {
+			select {
+			case <-conn.HandshakeComplete():
+				cache.record(conn.ConnectionState(), early)
+			case <-conn.Context().Done():
+				cache.forgetCurve()
+			}
+		}()
+	}
+	return udpConn, conn, nil
+}
+
+// handshakeComplete reports whether the handshake of conn completed.
+func handshakeComplete(conn *quic.Conn) bool {
+	select {
+	case <-conn.HandshakeComplete():
+		return true
+	default:
+		return false
 	}
+}
 
+// dialConnectIP sends the CONNECT-IP request over an established QUIC
+// connection. The transport is closed if the request fails.
+func dialConnectIP(ctx context.Context, conn *quic.Conn, template *uritemplate.Template, additionalHeaders http.Header) (*http3.Transport, *connectip.Conn, *http.Response, error) {
 	tr := &http3.Transport{
 		EnableDatagrams: true,
 		AdditionalSettings: map[uint64]uint64{
@@ -200,18 +304,19 @@ func connectTunnelHTTP3(ctx context.Context, tlsConfig *tls.Config, quicConfig *
 	ipConn, rsp, err := connectip.Dial(ctx, hconn, template, "cf-connect-ip", additionalHeaders, true)
 	if err != nil {
 		_ = tr.Close()
-		_ = conn.CloseWithError(0, "connect-ip dial failed")
-		_ = udpConn.Close()
-		return nil, nil, nil, nil, err
+		return nil, nil, nil, err
 	}
-
-	return udpConn, tr, ipConn, rsp, nil
+	return tr, ipConn, rsp, nil
 }
 
 func isRetryableHTTP3ConnectFailure(err error) bool {
 	if err == nil {
 		return false
 	}
+	if errors.Is(err, quic.Err0RTTRejected) {
+		// the next attempt does a full handshake
+		return true
+	}
 	msg := err.Error()
 	return strings.Contains(msg, "failed to read response") &&
 		strings.Contains(msg, "PROTOCOL_VIOLATION")
@@ -243,7 +348,7 @@ func newHTTP2Client(baseTLSConfig *tls.Config, endpoint *net.TCPAddr, connectURI
 					return nil, err
 				}
 
-				tlsConn := tls.Client(conn, tlsConfig)
+				tlsConn := tls.Client(conn, withHandshakeSessions(tlsConfig))
 				if err := tlsConn.HandshakeContext(ctx); err != nil {
 					_ = conn.Close()
 					return nil, err
@@ -283,7 +388,7 @@ func newHTTP2Client(baseTLSConfig *tls.Config, endpoint *net.TCPAddr, connectURI
 				return nil, err
 			}
 
-			tlsConn := tls.Client(conn, dialTLSConfig)
+			tlsConn := tls.Client(conn, withHandshakeSessions(dialTLSConfig))
 			if err := tlsConn.HandshakeContext(ctx); err != nil {
 				_ = conn.Close()
 				return nil, err
@@ -0,0 +1,109 @@
+package masquetest
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+)
+
+// memDeviceQueueLen is the number of packets buffered in each direction.
+const memDeviceQueueLen = 256
+
+// MemDevice is an in-memory api.TunnelDevice.
+//
+// Packets queued with Inject are returned by ReadPacket, as if an
+// application had sent them into a TUN device. Packets passed to WritePacket
+// are delivered on Packets, as if the TUN device had received them.
+type MemDevice struct {
+	in        chan []byte
+	out       chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMemDevice creates an empty MemDevice.
+func NewMemDevice() *MemDevice {
+	return &MemDevice{
+		in:     make(chan []byte, memDeviceQueueLen),
+		out:    make(chan []byte, memDeviceQueueLen),
+		closed: make(chan struct{}),
+	}
+}
+
+// ReadPacket blocks until a packet is injected or the device is closed.
+func (d *MemDevice) ReadPacket(buf []byte) (int, error) {
+	return d.read(nil, buf)
+}
+
+// read is ReadPacket that additionally gives up when stop is closed.
+func (d *MemDevice) read(stop <-chan struct{}, buf []byte) (int, error) {
+	select {
+	case pkt := <-d.in:
+		if len(pkt) > len(buf) {
+			return 0, io.ErrShortBuffer
+		}
+		return copy(buf, pkt), nil
+	case <-d.closed:
+		return 0, os.ErrClosed
+	case <-stop:
+		return 0, os.ErrClosed
+	}
+}
+
+// WritePacket delivers a copy of pkt to Packets. It blocks while the queue
+// is full, so tests are expected to drain Packets.
+func (d *MemDevice) WritePacket(pkt []byte) error {
+	select {
+	case d.out <- append([]byte(nil), pkt...):
+		return nil
+	case <-d.closed:
+		return os.ErrClosed
+	}
+}
+
+// Inject queues pkt to be returned by a future ReadPacket call.
+func (d *MemDevice) Inject(pkt []byte) error {
+	select {
+	case d.in <- append([]byte(nil), pkt...):
+		return nil
+	case <-d.closed:
+		return os.ErrClosed
+	}
+}
+
+// Packets returns the channel packets written to the device are delivered on.
+func (d *MemDevice) Packets() <-chan []byte {
+	return d.out
+}
+
+// Next waits for the next packet written to the device.
+func (d *MemDevice) Next(ctx context.Context) ([]byte, error) {
+	select {
+	case pkt := <-d.out:
+		return pkt, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close unblocks all pending and future reads and writes with os.ErrClosed.
+func (d *MemDevice) Close() error {
+	d.closeOnce.Do(func() { close(d.closed) })
+	return nil
+}
+
+// stoppableDevice exposes a MemDevice to a single server instance, so that
+// stopping the server unblocks its reader without closing the device.
+type stoppableDevice struct {
+	dev  *MemDevice
+	stop <-chan struct{}
+}
+
+func (s *stoppableDevice) ReadPacket(buf []byte) (int, error) {
+	return s.dev.read(s.stop, buf)
+}
+
+func (s *stoppableDevice) WritePacket(pkt []byte) error {
+	return s.dev.WritePacket(pkt)
+}
@@ -0,0 +1,60 @@
+package masquetest
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+// ipProtoUDP is the IP protocol number stamped on packets built by IPPacket.
+const ipProtoUDP = 17
+
+// IPPacket builds a minimal IPv4 or IPv6 packet from src to dst carrying
+// payload, depending on the address family of src. Both addresses must be of
+// the same family. The payload is not interpreted, so it does not need to be
+// a valid UDP datagram.
+func IPPacket(src, dst netip.Addr, payload []byte) []byte {
+	if src.Is4() {
+		pkt := make([]byte, 20+len(payload))
+		pkt[0] = 0x45 // version 4, 5 word header
+		binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+		pkt[8] = 64 // TTL
+		pkt[9] = ipProtoUDP
+		copy(pkt[12:16], src.AsSlice())
+		copy(pkt[16:20], dst.AsSlice())
+		binary.BigEndian.PutUint16(pkt[10:12], ipv4Checksum(pkt[:20]))
+		copy(pkt[20:], payload)
+		return pkt
+	}
+
+	pkt := make([]byte, 40+len(payload))
+	pkt[0] = 0x60 // version 6
+	binary.BigEndian.PutUint16(pkt[4:6], uint16(len(payload)))
+	pkt[6] = ipProtoUDP
+	pkt[7] = 64 // hop limit
+	copy(pkt[8:24], src.AsSlice())
+	copy(pkt[24:40], dst.AsSlice())
+	copy(pkt[40:], payload)
+	return pkt
+}
+
+// Payload returns the bytes following the IP header of a packet built by IPPacket.
+func Payload(pkt []byte) []byte {
+	if len(pkt) >= 20 && pkt[0]>>4 == 4 {
+		return pkt[int(pkt[0]&0x0f)*4:]
+	}
+	if len(pkt) >= 40 && pkt[0]>>4 == 6 {
+		return pkt[40:]
+	}
+	return nil
+}
+
+func ipv4Checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i : i+2]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
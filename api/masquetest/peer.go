@@ -0,0 +1,268 @@
+// Package masquetest provides an in-process MASQUE CONNECT-IP peer and an
+// in-memory tunnel device for testing code built on top of package api,
+// much like net/http/httptest does for HTTP handlers.
+package masquetest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/internal"
+)
+
+// PeerMTU is the MTU the peer reads its device with.
+const PeerMTU = 1280
+
+// Peer is a MASQUE CONNECT-IP endpoint listening on loopback, serving HTTP/3
+// on a UDP port and HTTP/2 on a TCP port. It accepts a single client whose
+// TLS configuration is returned by ClientTLSConfig.
+//
+// Peer can be stopped and started again on the same ports to simulate the
+// endpoint going away.
+type Peer struct {
+	// Device is the peer's side of the tunnel. Packets sent by the client
+	// arrive on Device.Packets, packets injected with Device.Inject are
+	// routed to the client owning their destination address.
+	Device *MemDevice
+	// ClientIPv4 is the tunnel IPv4 address owned by the client.
+	ClientIPv4 netip.Addr
+	// ClientIPv6 is the tunnel IPv6 address owned by the client.
+	ClientIPv6 netip.Addr
+
+	serverKey  *ecdsa.PrivateKey
+	serverCert [][]byte
+	clientKey  *ecdsa.PrivateKey
+	udpAddr    *net.UDPAddr
+	tcpAddr    *net.TCPAddr
+
+	http3Blocked atomic.Bool
+
+	headerMu sync.Mutex
+	header   http.Header
+
+	mu      sync.Mutex
+	running bool
+	server  *api.Server
+	udpConn net.PacketConn
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewPeer creates and starts a Peer on random loopback ports.
+// The caller should call Close when finished.
+func NewPeer() (*Peer, error) {
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate server key: %v", err)
+	}
+	serverCert, err := internal.GenerateCert(serverKey, &serverKey.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate server cert: %v", err)
+	}
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate client key: %v", err)
+	}
+
+	p := &Peer{
+		Device:     NewMemDevice(),
+		ClientIPv4: netip.MustParseAddr("172.16.0.2"),
+		ClientIPv6: netip.MustParseAddr("fd00:5553:5155::2"),
+		serverKey:  serverKey,
+		serverCert: serverCert,
+		clientKey:  clientKey,
+	}
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on UDP: %v", err)
+	}
+	tcpListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		_ = udpConn.Close()
+		return nil, fmt.Errorf("failed to listen on TCP: %v", err)
+	}
+	p.udpAddr = udpConn.LocalAddr().(*net.UDPAddr)
+	p.tcpAddr = tcpListener.Addr().(*net.TCPAddr)
+
+	if err := p.serve(udpConn, tcpListener); err != nil {
+		_ = udpConn.Close()
+		_ = tcpListener.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// Endpoint returns the HTTP/3 endpoint of the peer.
+func (p *Peer) Endpoint() *net.UDPAddr {
+	return p.udpAddr
+}
+
+// H2Endpoint returns the HTTP/2 endpoint of the peer.
+func (p *Peer) H2Endpoint() *net.TCPAddr {
+	return p.tcpAddr
+}
+
+// ClientTLSConfig returns a TLS configuration authenticating as the peer's
+// client and pinning the peer's public key, as api.PrepareTlsConfig would
+// build from a registered config.
+func (p *Peer) ClientTLSConfig() (*tls.Config, error) {
+	return api.PrepareTlsConfig(p.clientKey, &p.serverKey.PublicKey, nil, internal.ConnectSNI, false)
+}
+
+// TunnelConfig returns a MaintainTunnelConfig connecting dev to the peer,
+// with short delays suitable for tests.
+func (p *Peer) TunnelConfig(dev api.TunnelDevice, useHTTP2 bool) (api.MaintainTunnelConfig, error) {
+	tlsConfig, err := p.ClientTLSConfig()
+	if err != nil {
+		return api.MaintainTunnelConfig{}, err
+	}
+	var endpoint net.Addr = p.udpAddr
+	if useHTTP2 {
+		endpoint = p.tcpAddr
+	}
+	return api.MaintainTunnelConfig{
+		TLSConfig:       tlsConfig,
+		KeepalivePeriod: time.Second,
+		Endpoint:        endpoint,
+		Device:          dev,
+		MTU:             PeerMTU,
+		ReconnectDelay:  50 * time.Millisecond,
+		AlwaysReconnect: true,
+		UseHTTP2:        useHTTP2,
+	}, nil
+}
+
+// Stop shuts the peer down, disconnecting the client and closing both ports.
+// Connection attempts fail until Start is called.
+func (p *Peer) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.running {
+		return
+	}
+	p.running = false
+
+	close(p.stop)
+	_ = p.server.Close()
+	_ = p.udpConn.Close()
+	p.wg.Wait()
+}
+
+// Start restarts a stopped peer on its previous ports.
+func (p *Peer) Start() error {
+	udpConn, err := net.ListenUDP("udp", p.udpAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on UDP: %v", err)
+	}
+	tcpListener, err := net.ListenTCP("tcp", p.tcpAddr)
+	if err != nil {
+		_ = udpConn.Close()
+		return fmt.Errorf("failed to listen on TCP: %v", err)
+	}
+	if err := p.serve(udpConn, tcpListener); err != nil {
+		_ = udpConn.Close()
+		_ = tcpListener.Close()
+		return err
+	}
+	return nil
+}
+
+// BlockHTTP3 makes the HTTP/3 port silently drop all packets while blocked
+// is true, like a network filtering UDP. HTTP/2 is not affected.
+func (p *Peer) BlockHTTP3(blocked bool) {
+	p.http3Blocked.Store(blocked)
+}
+
+// RequestHeader returns the headers of the last CONNECT-IP request the peer
+// received, over either transport, or nil before the first one.
+func (p *Peer) RequestHeader() http.Header {
+	p.headerMu.Lock()
+	defer p.headerMu.Unlock()
+	return p.header.Clone()
+}
+
+// Close stops the peer and closes its device.
+func (p *Peer) Close() {
+	p.Stop()
+	_ = p.Device.Close()
+}
+
+func (p *Peer) serve(udpConn net.PacketConn, tcpListener net.Listener) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.running {
+		return fmt.Errorf("peer is already running")
+	}
+
+	stop := make(chan struct{})
+	server, err := api.NewServer(api.ServerConfig{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{{Certificate: p.serverCert, PrivateKey: p.serverKey}},
+		},
+		Clients: []api.ServerClient{{
+			Name:      "masquetest",
+			PublicKey: &p.clientKey.PublicKey,
+			Addresses: []netip.Prefix{
+				netip.PrefixFrom(p.ClientIPv4, 32),
+				netip.PrefixFrom(p.ClientIPv6, 128),
+			},
+		}},
+		Device: &stoppableDevice{dev: p.Device, stop: stop},
+		MTU:    PeerMTU,
+		OnRequest: func(_ *api.ServerClient, r *http.Request) {
+			p.headerMu.Lock()
+			p.header = r.Header.Clone()
+			p.headerMu.Unlock()
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create server: %v", err)
+	}
+
+	p.running = true
+	p.server = server
+	p.udpConn = udpConn
+	p.stop = stop
+
+	p.wg.Add(3)
+	go func() {
+		defer p.wg.Done()
+		_ = server.ServeHTTP3(&blockablePacketConn{PacketConn: udpConn, blocked: &p.http3Blocked})
+	}()
+	go func() {
+		defer p.wg.Done()
+		_ = server.ServeHTTP2(tcpListener)
+	}()
+	go func() {
+		defer p.wg.Done()
+		_ = server.Run(context.Background())
+	}()
+	return nil
+}
+
+// blockablePacketConn drops every received packet while blocked is set.
+type blockablePacketConn struct {
+	net.PacketConn
+	blocked *atomic.Bool
+}
+
+func (c *blockablePacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil || !c.blocked.Load() {
+			return n, addr, err
+		}
+	}
+}
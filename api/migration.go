@@ -0,0 +1,60 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// networkSettleDelay is how long network changes must stop coming in
+	// before the connection is migrated, as a single change is reported as a
+	// burst of address and route updates.
+	networkSettleDelay = 500 * time.Millisecond
+	// migrationTimeout bounds probing the new path.
+	migrationTimeout = 5 * time.Second
+)
+
+// errMigrationUnsupported is returned when migrating HTTP/2 connections.
+var errMigrationUnsupported = errors.New("only HTTP/3 connections can migrate")
+
+// migrate moves the QUIC connection to a freshly bound UDP socket, so that
+// packets leave with the source address of the current default route. The
+// connection keeps using the old path if migration fails.
+//
+// It must not run concurrently with close.
+func (c *tunnelConn) migrate(ctx context.Context) error {
+	if c.quicConn == nil {
+		return errMigrationUnsupported
+	}
+	udpConn, err := listenUDPForEndpoint(c.endpoint.(*net.UDPAddr))
+	if err != nil {
+		return fmt.Errorf("failed to bind new socket: %w", err)
+	}
+	path, err := c.quicConn.AddPath(&quic.Transport{Conn: udpConn})
+	if err != nil {
+		_ = udpConn.Close()
+		return fmt.Errorf("failed to add path: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, migrationTimeout)
+	defer cancel()
+	if err := path.Probe(ctx); err != nil {
+		_ = path.Close()
+		_ = udpConn.Close()
+		return fmt.Errorf("failed to probe new path: %w", err)
+	}
+	if err := path.Switch(); err != nil {
+		_ = path.Close()
+		_ = udpConn.Close()
+		return fmt.Errorf("failed to switch to new path: %w", err)
+	}
+
+	c.retiredConns = append(c.retiredConns, c.udpConn)
+	c.udpConn = udpConn
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package api
+
+import (
+	"context"
+	"errors"
+)
+
+// WatchNetworkChanges reports changes of the host's addresses and routes.
+// It is only supported on Linux.
+func WatchNetworkChanges(ctx context.Context) (<-chan struct{}, error) {
+	return nil, errors.New("watching network changes is only supported on Linux")
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/vishvananda/netlink"
+)
+
+// WatchNetworkChanges reports changes of the host's addresses and routes,
+// which may change the source address of the tunnel's packets, until ctx is
+// done. Bursts of changes are coalesced; the channel is never closed.
+//
+// Parameters:
+//   - ctx: context.Context - The context bounding the watch.
+//
+// Returns:
+//   - <-chan struct{}: Receives after changes, suitable for MaintainTunnelConfig.NetworkChanges.
+//   - error: An error if the netlink subscriptions fail.
+func WatchNetworkChanges(ctx context.Context) (<-chan struct{}, error) {
+	done := make(chan struct{})
+	onError := func(err error) {
+		log.Printf("Network change subscription failed: %v", err)
+	}
+
+	addrs := make(chan netlink.AddrUpdate, 16)
+	if err := netlink.AddrSubscribeWithOptions(addrs, done, netlink.AddrSubscribeOptions{ErrorCallback: onError}); err != nil {
+		close(done)
+		return nil, fmt.Errorf("failed to subscribe to address changes: %v", err)
+	}
+	routes := make(chan netlink.RouteUpdate, 16)
+	if err := netlink.RouteSubscribeWithOptions(routes, done, netlink.RouteSubscribeOptions{ErrorCallback: onError}); err != nil {
+		close(done)
+		go drainUpdates(addrs)
+		return nil, fmt.Errorf("failed to subscribe to route changes: %v", err)
+	}
+
+	changes := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+	go func() {
+		defer func() {
+			close(done)
+			// the subscriptions close their channels once they noticed
+			go drainUpdates(addrs)
+			go drainUpdates(routes)
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-addrs:
+				if !ok {
+					return
+				}
+				notify()
+			case _, ok := <-routes:
+				if !ok {
+					return
+				}
+				notify()
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// drainUpdates discards updates until the subscription closes ch, so that
+// it is not blocked sending.
+func drainUpdates[T any](ch <-chan T) {
+	for range ch {
+	}
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+)
+
+// withPorts makes the preference cycle through ports in addition to the
+// port of its first endpoint, which is tried first. Duplicates are ignored.
+func (p *endpointPreference) withPorts(ports []int) *endpointPreference {
+	if len(p.endpoints) == 0 || len(ports) == 0 {
+		return p
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ports = []int{addrPort(p.endpoints[0])}
+	for _, port := range ports {
+		if port > 0 && port <= 65535 && !slices.Contains(p.ports, port) {
+			p.ports = append(p.ports, port)
+		}
+	}
+	if len(p.ports) == 1 {
+		p.ports = nil
+	}
+	return p
+}
+
+// portCount returns the number of ports cycled through, at least 1.
+func (p *endpointPreference) portCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return max(len(p.ports), 1)
+}
+
+// hop switches to the next port, wrapping around after the last. It
+// reports false if there is only a single port.
+func (p *endpointPreference) hop() (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.ports) == 0 {
+		return 0, false
+	}
+	p.port = (p.port + 1) % len(p.ports)
+	return p.ports[p.port], true
+}
+
+// prefer makes the endpoint with the address addr, as returned by
+// net.Addr.String, on any of the ports the current one. It reports false if
+// no endpoint matches.
+func (p *endpointPreference) prefer(addr string) bool {
+	p.mu.Lock()
+	ports := append([]int(nil), p.ports...)
+	endpoints := append([]net.Addr(nil), p.endpoints...)
+	p.mu.Unlock()
+
+	if len(ports) == 0 {
+		ports = []int{-1}
+	}
+	for i, port := range ports {
+		for _, endpoint := range endpoints {
+			if port >= 0 {
+				endpoint = withPort(endpoint, port)
+			}
+			if endpoint.String() == addr {
+				p.mu.Lock()
+				p.port = i
+				p.mu.Unlock()
+				p.won(endpoint)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// withPort returns a copy of a UDP or TCP endpoint with a different port.
+// Other addresses are returned unchanged.
+func withPort(endpoint net.Addr, port int) net.Addr {
+	switch addr := endpoint.(type) {
+	case *net.UDPAddr:
+		return &net.UDPAddr{IP: addr.IP, Port: port, Zone: addr.Zone}
+	case *net.TCPAddr:
+		return &net.TCPAddr{IP: addr.IP, Port: port, Zone: addr.Zone}
+	}
+	return endpoint
+}
+
+// addrPort returns the port of a UDP or TCP endpoint, 0 otherwise.
+func addrPort(endpoint net.Addr) int {
+	switch addr := endpoint.(type) {
+	case *net.UDPAddr:
+		return addr.Port
+	case *net.TCPAddr:
+		return addr.Port
+	}
+	return 0
+}
+
+// sameHost reports whether two endpoints share the IP, ignoring the port.
+func sameHost(a, b net.Addr) bool {
+	switch a := a.(type) {
+	case *net.UDPAddr:
+		b, ok := b.(*net.UDPAddr)
+		return ok && a.IP.Equal(b.IP) && a.Zone == b.Zone
+	case *net.TCPAddr:
+		b, ok := b.(*net.TCPAddr)
+		return ok && a.IP.Equal(b.IP) && a.Zone == b.Zone
+	}
+	return a == b
+}
+
+// isHandshakeTimeout reports whether a connection attempt failed because
+// the endpoint did not answer in time, as when a port is filtered.
+func isHandshakeTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
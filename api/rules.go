@@ -0,0 +1,395 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Diniboy1123/usque/internal"
+	"golang.org/x/net/proxy"
+)
+
+// ErrBlocked is returned when dialing a destination that a block rule
+// matches.
+var ErrBlocked = internal.ErrBlocked
+
+// RouteAction is what a Rule does with the connections it matches.
+type RouteAction int
+
+const (
+	// RouteTunnel sends connections through the tunnel.
+	RouteTunnel RouteAction = iota
+	// RouteDirect dials connections from the host, bypassing the tunnel.
+	RouteDirect
+	// RouteBlock refuses connections with ErrBlocked.
+	RouteBlock
+	// RouteProfile sends connections through a profile of the Rules.
+	RouteProfile
+)
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	First uint16
+	Last  uint16
+}
+
+// Rule routes the connections it matches. A connection matches if it
+// matches every non-empty list of the rule, by any of its entries, so a rule
+// without any list matches every connection.
+type Rule struct {
+	Action RouteAction
+	// Profile is the name of the profile of RouteProfile.
+	Profile string
+	// Domains match host names equal to or below one of them.
+	Domains []string
+	// Keywords match host names containing one of them.
+	Keywords []string
+	// Prefixes match destination addresses. Host names are resolved with the
+	// lookup of Match to match them, and never match without one.
+	Prefixes []netip.Prefix
+	// Ports match destination ports.
+	Ports []PortRange
+	// Clients match the address of the proxy client, see
+	// internal.WithClientAddr.
+	Clients []netip.Prefix
+}
+
+// Rules route the connections of the proxy frontends. The first matching
+// rule applies, connections no rule matches use the tunnel.
+type Rules struct {
+	Rules []Rule
+	// Profiles dial the connections of RouteProfile rules by name, e.g.
+	// through another proxy.
+	Profiles map[string]DialFunc
+}
+
+// LoadRules reads a rules file, see ParseRules.
+//
+// Parameters:
+//   - path: string - The path of the rules file.
+//
+// Returns:
+//   - *Rules: The rules.
+//   - error: An error if the file cannot be read or is invalid.
+func LoadRules(path string) (*Rules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open rules file: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+	return ParseRules(f)
+}
+
+// ParseRules parses rules, one per line. A line starts with its action,
+// "tunnel", "direct", "block" or the name of a profile, followed by
+// matchers like "domain=example.com,example.org". The matchers are domain,
+// keyword, cidr, port (a port or range like 8000-8999) and client (an
+// address or CIDR). A line "profile <name> <url>" defines a profile dialing
+// through a SOCKS5 proxy, e.g. "profile corp socks5://127.0.0.1:1081".
+// Empty lines and lines starting with # are ignored.
+//
+// Parameters:
+//   - r: io.Reader - The rules.
+//
+// Returns:
+//   - *Rules: The rules.
+//   - error: An error naming the line of an invalid rule.
+func ParseRules(r io.Reader) (*Rules, error) {
+	rules := &Rules{Profiles: make(map[string]DialFunc)}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] == "profile" {
+			if err := rules.addProfile(fields[1:]); err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			continue
+		}
+		rule, err := parseRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		rules.Rules = append(rules.Rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, rule := range rules.Rules {
+		if _, ok := rules.Profiles[rule.Profile]; rule.Action == RouteProfile && !ok {
+			return nil, fmt.Errorf("unknown action or profile %q", rule.Profile)
+		}
+	}
+	return rules, nil
+}
+
+// addProfile adds the profile of the fields of a profile line.
+func (rs *Rules) addProfile(fields []string) error {
+	if len(fields) != 2 {
+		return fmt.Errorf("expected profile <name> <url>")
+	}
+	name := fields[0]
+	if parseAction(name) != RouteProfile {
+		return fmt.Errorf("profile name %q is an action", name)
+	}
+	u, err := url.Parse(fields[1])
+	if err != nil {
+		return fmt.Errorf("invalid profile URL: %w", err)
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return fmt.Errorf("unsupported profile URL scheme %q, expected socks5", u.Scheme)
+	}
+	dialer, err := proxy.FromURL(u, proxy.Direct)
+	if err != nil {
+		return fmt.Errorf("invalid profile URL: %w", err)
+	}
+	contextDialer := dialer.(proxy.ContextDialer)
+	rs.Profiles[name] = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if !strings.HasPrefix(network, "tcp") {
+			return nil, fmt.Errorf("profile %s only carries TCP", name)
+		}
+		return contextDialer.DialContext(ctx, network, addr)
+	}
+	return nil
+}
+
+// parseAction returns the action named name, RouteProfile for any other
+// name.
+func parseAction(name string) RouteAction {
+	switch name {
+	case "tunnel":
+		return RouteTunnel
+	case "direct":
+		return RouteDirect
+	case "block":
+		return RouteBlock
+	default:
+		return RouteProfile
+	}
+}
+
+// parseRule parses the fields of a rule line.
+func parseRule(fields []string) (Rule, error) {
+	rule := Rule{Action: parseAction(fields[0])}
+	if rule.Action == RouteProfile {
+		rule.Profile = fields[0]
+	}
+	for _, field := range fields[1:] {
+		if strings.HasPrefix(field, "#") {
+			break
+		}
+		matcher, values, ok := strings.Cut(field, "=")
+		if !ok || values == "" {
+			return Rule{}, fmt.Errorf("invalid matcher %q, expected <matcher>=<values>", field)
+		}
+		for _, value := range strings.Split(values, ",") {
+			if err := rule.addMatch(matcher, value); err != nil {
+				return Rule{}, err
+			}
+		}
+	}
+	return rule, nil
+}
+
+// addMatch adds value to the list of matcher.
+func (r *Rule) addMatch(matcher, value string) error {
+	switch matcher {
+	case "domain":
+		domain := normalizeDomain(strings.TrimPrefix(value, "*"))
+		if domain == "" {
+			return fmt.Errorf("invalid domain %q", value)
+		}
+		r.Domains = append(r.Domains, domain)
+	case "keyword":
+		// an empty keyword would match every host
+		if value == "" {
+			return fmt.Errorf("invalid keyword %q", value)
+		}
+		r.Keywords = append(r.Keywords, strings.ToLower(value))
+	case "cidr", "client":
+		prefix, err := parsePrefix(value)
+		if err != nil {
+			return err
+		}
+		if matcher == "cidr" {
+			r.Prefixes = append(r.Prefixes, prefix)
+		} else {
+			r.Clients = append(r.Clients, prefix)
+		}
+	case "port":
+		ports, err := parsePortRange(value)
+		if err != nil {
+			return err
+		}
+		r.Ports = append(r.Ports, ports)
+	default:
+		return fmt.Errorf("unknown matcher %q", matcher)
+	}
+	return nil
+}
+
+// parsePrefix parses a CIDR or a single address.
+func parsePrefix(value string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(value); err == nil {
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid address or CIDR %q", value)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// parsePortRange parses a port or a range like 8000-8999.
+func parsePortRange(value string) (PortRange, error) {
+	first, last, isRange := strings.Cut(value, "-")
+	if !isRange {
+		last = first
+	}
+	from, err := strconv.ParseUint(first, 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port %q", value)
+	}
+	to, err := strconv.ParseUint(last, 10, 16)
+	if err != nil || to < from {
+		return PortRange{}, fmt.Errorf("invalid port range %q", value)
+	}
+	return PortRange{First: uint16(from), Last: uint16(to)}, nil
+}
+
+// destination is a connection being routed. The address of a host name is
+// only resolved once a rule needs it.
+type destination struct {
+	host     string
+	port     uint16
+	client   netip.Addr
+	hasIP    bool
+	ip       netip.Addr
+	resolved bool
+	lookup   func(ctx context.Context, host string) (netip.Addr, error)
+}
+
+// addr returns the address of d, resolving its host name with its lookup if
+// needed.
+func (d *destination) addr(ctx context.Context) (netip.Addr, bool) {
+	if !d.resolved {
+		d.resolved = true
+		if d.lookup != nil {
+			ip, err := d.lookup(ctx, d.host)
+			d.ip, d.hasIP = ip.Unmap(), err == nil
+		}
+	}
+	return d.ip, d.hasIP
+}
+
+// matches reports whether r matches d.
+func (r *Rule) matches(ctx context.Context, d *destination) bool {
+	if len(r.Ports) > 0 && !matchesAny(r.Ports, func(p PortRange) bool { return p.First <= d.port && d.port <= p.Last }) {
+		return false
+	}
+	if len(r.Clients) > 0 && (!d.client.IsValid() || !matchesAny(r.Clients, func(p netip.Prefix) bool { return p.Contains(d.client) })) {
+		return false
+	}
+	if len(r.Domains) > 0 && !matchesAny(r.Domains, func(domain string) bool { return matchesDomain(d.host, domain) }) {
+		return false
+	}
+	if len(r.Keywords) > 0 && !matchesAny(r.Keywords, func(keyword string) bool { return strings.Contains(d.host, keyword) }) {
+		return false
+	}
+	if len(r.Prefixes) > 0 {
+		ip, ok := d.addr(ctx)
+		if !ok || !matchesAny(r.Prefixes, func(p netip.Prefix) bool { return p.Contains(ip) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesAny reports whether match is true for any entry of list.
+func matchesAny[T any](list []T, match func(T) bool) bool {
+	for _, entry := range list {
+		if match(entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns the rule for a connection to addr, a host and port, from
+// the client carried by ctx, if any. Connections no rule matches get a
+// RouteTunnel rule. Host names are only resolved, with lookup, for rules
+// matching addresses, so that they don't leak to the host network.
+//
+// Parameters:
+//   - ctx: context.Context - Carries the client address and bounds host name lookups.
+//   - addr: string - The destination.
+//   - lookup: func(ctx context.Context, host string) (netip.Addr, error) - Resolves through the tunnel, nil to never match host names by address.
+//
+// Returns:
+//   - Rule: The matching rule.
+//   - error: An error if addr is invalid.
+func (rs *Rules) Match(ctx context.Context, addr string, lookup func(ctx context.Context, host string) (netip.Addr, error)) (Rule, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return Rule{}, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return Rule{}, fmt.Errorf("invalid port %q", portStr)
+	}
+
+	d := &destination{port: uint16(port), lookup: lookup}
+	d.client, _ = internal.ClientAddr(ctx)
+	if ip, err := netip.ParseAddr(host); err == nil {
+		d.ip, d.hasIP, d.resolved = ip.Unmap(), true, true
+	} else {
+		d.host = normalizeDomain(host)
+	}
+
+	for _, rule := range rs.Rules {
+		if rule.matches(ctx, d) {
+			return rule, nil
+		}
+	}
+	return Rule{Action: RouteTunnel}, nil
+}
+
+// Dialer wraps tunnelDial, which dials through the tunnel, so that
+// connections are routed by the rules. Host names are resolved with lookup
+// to match them against cidr rules, see Match.
+//
+// Parameters:
+//   - tunnelDial: DialFunc - Dials through the tunnel.
+//   - lookup: func(ctx context.Context, host string) (netip.Addr, error) - Resolves through the tunnel.
+//
+// Returns:
+//   - DialFunc: The routing dialer.
+func (rs *Rules) Dialer(tunnelDial DialFunc, lookup func(ctx context.Context, host string) (netip.Addr, error)) DialFunc {
+	var direct net.Dialer
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		rule, err := rs.Match(ctx, addr, lookup)
+		if err != nil {
+			return nil, err
+		}
+		switch rule.Action {
+		case RouteDirect:
+			return direct.DialContext(ctx, network, addr)
+		case RouteBlock:
+			return nil, fmt.Errorf("%s: %w", addr, ErrBlocked)
+		case RouteProfile:
+			return rs.Profiles[rule.Profile](ctx, network, addr)
+		default:
+			return tunnelDial(ctx, network, addr)
+		}
+	}
+}
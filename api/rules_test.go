@@ -0,0 +1,130 @@
+package api_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/internal"
+)
+
+const testRules = `
+# corporate domains bypass the tunnel
+profile corp socks5://127.0.0.1:1081
+
+direct domain=corp.example.com,*.intranet
+block  keyword=doubleclick
+block  port=25,465-587
+corp   client=192.168.1.0/24 port=443 # only HTTPS of the office
+direct cidr=10.0.0.0/8
+tunnel
+`
+
+func TestRulesMatch(t *testing.T) {
+	rules, err := api.ParseRules(strings.NewReader(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// resolves through the tunnel, only knowing an internal name
+	var lookups []string
+	lookup := func(ctx context.Context, host string) (netip.Addr, error) {
+		lookups = append(lookups, host)
+		if host == "db.corp.invalid" {
+			return netip.MustParseAddr("10.2.3.4"), nil
+		}
+		return netip.Addr{}, errors.New("no such host")
+	}
+
+	office := internal.WithClientAddr(context.Background(), netip.MustParseAddr("192.168.1.20"))
+	for _, tc := range []struct {
+		ctx     context.Context
+		addr    string
+		action  api.RouteAction
+		profile string
+	}{
+		{context.Background(), "corp.example.com:443", api.RouteDirect, ""},
+		{context.Background(), "git.CORP.example.com:22", api.RouteDirect, ""},
+		{context.Background(), "wiki.intranet.:80", api.RouteDirect, ""},
+		{context.Background(), "notcorp.example.com:443", api.RouteTunnel, ""},
+		{context.Background(), "ad.doubleclick.net:443", api.RouteBlock, ""},
+		{context.Background(), "192.0.2.1:25", api.RouteBlock, ""},
+		{context.Background(), "192.0.2.1:500", api.RouteBlock, ""},
+		{office, "example.org:443", api.RouteProfile, "corp"},
+		{office, "example.org:80", api.RouteTunnel, ""},
+		{context.Background(), "example.org:443", api.RouteTunnel, ""},
+		{context.Background(), "[::ffff:10.1.2.3]:80", api.RouteDirect, ""},
+		{context.Background(), "db.corp.invalid:5432", api.RouteDirect, ""},
+	} {
+		rule, err := rules.Match(tc.ctx, tc.addr, lookup)
+		if err != nil {
+			t.Errorf("failed to match %s: %v", tc.addr, err)
+			continue
+		}
+		if rule.Action != tc.action || rule.Profile != tc.profile {
+			t.Errorf("%s matched action %d of profile %q, want %d of %q", tc.addr, rule.Action, rule.Profile, tc.action, tc.profile)
+		}
+	}
+	// only names reaching the cidr rule are resolved
+	if want := []string{"notcorp.example.com", "example.org", "example.org", "db.corp.invalid"}; !slices.Equal(lookups, want) {
+		t.Errorf("resolved %v, want %v", lookups, want)
+	}
+
+	// without a lookup, names never match by address
+	if rule, err := rules.Match(context.Background(), "db.corp.invalid:5432", nil); err != nil || rule.Action != api.RouteTunnel {
+		t.Errorf("unresolved name matched action %d: %v", rule.Action, err)
+	}
+}
+
+func TestParseRulesInvalid(t *testing.T) {
+	for _, rules := range []string{
+		"direct domain",
+		"direct color=red",
+		"block port=99999",
+		"block port=90-80",
+		"direct cidr=10.0.0.0/33",
+		"direct keyword=corp,",
+		"block keyword=a,,b",
+		"direct domain=example.com,",
+		"corp domain=example.com",
+		"profile corp http://127.0.0.1:8080",
+		"profile direct socks5://127.0.0.1:1081",
+	} {
+		if _, err := api.ParseRules(strings.NewReader(rules)); err == nil {
+			t.Errorf("parsed invalid rules %q", rules)
+		}
+	}
+}
+
+func TestRulesDialer(t *testing.T) {
+	rules, err := api.ParseRules(strings.NewReader("direct domain=localhost\nblock cidr=192.0.2.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tunneled []string
+	dial := rules.Dialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		tunneled = append(tunneled, addr)
+		return nil, errTunnelDial
+	}, nil)
+
+	port := localListener(t)
+	conn, err := dial(context.Background(), "tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("failed to dial directly: %v", err)
+	}
+	_ = conn.Close()
+	if _, err := dial(context.Background(), "tcp", "192.0.2.1:443"); !errors.Is(err, api.ErrBlocked) {
+		t.Errorf("blocked address was dialed: %v", err)
+	}
+	if _, err := dial(context.Background(), "tcp", "198.51.100.1:443"); !errors.Is(err, errTunnelDial) {
+		t.Errorf("other address was not dialed through the tunnel: %v", err)
+	}
+	if want := []string{"198.51.100.1:443"}; !slices.Equal(tunneled, want) {
+		t.Errorf("dialed %v through the tunnel, want %v", tunneled, want)
+	}
+}
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/quic-go/quic-go"
+	"github.com/yosida95/uritemplate/v3"
+)
+
+const (
+	// DefaultScanAttempts is the default of ScanConfig.Attempts.
+	DefaultScanAttempts = 3
+	// DefaultScanConcurrency is the default of ScanConfig.Concurrency.
+	DefaultScanConcurrency = 32
+	// DefaultScanTimeout is the default of ScanConfig.Timeout.
+	DefaultScanTimeout = 3 * time.Second
+)
+
+// ScanConfig configures ScanEndpoints.
+type ScanConfig struct {
+	// TLSConfig authenticates the client and pins the endpoints' public key.
+	// Its ClientSessionCache is not used, so that every attempt measures a
+	// full handshake instead of resuming a session of another endpoint.
+	TLSConfig *tls.Config
+	// QUICConfig is used for the handshakes; its HandshakeIdleTimeout is
+	// overridden by Timeout.
+	QUICConfig *quic.Config
+	// ConnectURI is the CONNECT-IP URI template. Defaults to
+	// internal.ConnectURI.
+	ConnectURI string
+	// Endpoints are the HTTP/3 endpoints to probe.
+	Endpoints []*net.UDPAddr
+	// Attempts is the number of handshakes per endpoint. Defaults to
+	// DefaultScanAttempts.
+	Attempts int
+	// Concurrency is the number of endpoints probed at once. Defaults to
+	// DefaultScanConcurrency.
+	Concurrency int
+	// Timeout bounds every attempt. Defaults to DefaultScanTimeout.
+	Timeout time.Duration
+	// QUICOnly skips the CONNECT-IP request and only measures the QUIC
+	// handshake.
+	QUICOnly bool
+	// OnResult, if set, is called with the result of every endpoint as soon
+	// as it is done, e.g. to report progress. Calls are serialized.
+	OnResult func(ScanResult)
+}
+
+// ScanResult is the outcome of probing a single endpoint.
+type ScanResult struct {
+	Endpoint  *net.UDPAddr
+	Attempts  int
+	Successes int
+	// Handshake is the mean QUIC handshake latency of successful attempts.
+	Handshake time.Duration
+	// Connect is the mean latency until CONNECT-IP was established,
+	// including the QUIC handshake. Zero when QUICOnly is set.
+	Connect time.Duration
+	// Err is the error of the last failed attempt, if any.
+	Err error
+}
+
+// SuccessRate returns the fraction of successful attempts.
+func (r ScanResult) SuccessRate() float64 {
+	if r.Attempts == 0 {
+		return 0
+	}
+	return float64(r.Successes) / float64(r.Attempts)
+}
+
+// ScanEndpoints probes endpoints concurrently with QUIC and CONNECT-IP
+// handshakes and ranks them by success rate, then by handshake latency.
+//
+// Parameters:
+//   - ctx: context.Context - The context bounding the scan.
+//   - cfg: ScanConfig - The scan configuration.
+//
+// Returns:
+//   - []ScanResult: The results of all probed endpoints, best first. When ctx
+//     is cancelled, endpoints not probed yet are missing.
+func ScanEndpoints(ctx context.Context, cfg ScanConfig) []ScanResult {
+	if cfg.ConnectURI == "" {
+		cfg.ConnectURI = internal.ConnectURI
+	}
+	if cfg.Attempts <= 0 {
+		cfg.Attempts = DefaultScanAttempts
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = DefaultScanConcurrency
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultScanTimeout
+	}
+	// sessions are keyed by the server name, which all endpoints share
+	cfg.TLSConfig = cfg.TLSConfig.Clone()
+	cfg.TLSConfig.ClientSessionCache = nil
+	quicConfig := &quic.Config{EnableDatagrams: true}
+	if cfg.QUICConfig != nil {
+		quicConfig = cfg.QUICConfig.Clone()
+	}
+	quicConfig.HandshakeIdleTimeout = cfg.Timeout
+	template := uritemplate.MustNew(cfg.ConnectURI)
+
+	var mu sync.Mutex
+	var results []ScanResult
+	endpoints := make(chan *net.UDPAddr)
+	var wg sync.WaitGroup
+	for range min(cfg.Concurrency, len(cfg.Endpoints)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for endpoint := range endpoints {
+				res := scanEndpoint(ctx, &cfg, quicConfig, template, endpoint)
+				if res.Attempts == 0 {
+					continue
+				}
+				mu.Lock()
+				results = append(results, res)
+				if cfg.OnResult != nil {
+					cfg.OnResult(res)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for _, endpoint := range cfg.Endpoints {
+		select {
+		case endpoints <- endpoint:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(endpoints)
+	wg.Wait()
+
+	RankScanResults(results)
+	return results
+}
+
+// RankScanResults sorts results best first: by success rate, then by
+// handshake latency.
+func RankScanResults(results []ScanResult) {
+	slices.SortStableFunc(results, func(a, b ScanResult) int {
+		if ra, rb := a.SuccessRate(), b.SuccessRate(); ra != rb {
+			if ra > rb {
+				return -1
+			}
+			return 1
+		}
+		if c := cmp.Compare(a.Handshake, b.Handshake); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Endpoint.String(), b.Endpoint.String())
+	})
+}
+
+// scanEndpoint runs the attempts against a single endpoint one after another.
+func scanEndpoint(ctx context.Context, cfg *ScanConfig, quicConfig *quic.Config, template *uritemplate.Template, endpoint *net.UDPAddr) ScanResult {
+	res := ScanResult{Endpoint: endpoint}
+	var handshakes, connects time.Duration
+	for range cfg.Attempts {
+		if ctx.Err() != nil {
+			break
+		}
+		handshake, connect, err := probeEndpoint(ctx, cfg, quicConfig, template, endpoint)
+		if ctx.Err() != nil {
+			// the attempt was cut short, it says nothing about the endpoint
+			break
+		}
+		res.Attempts++
+		if err != nil {
+			res.Err = err
+			continue
+		}
+		res.Successes++
+		handshakes += handshake
+		connects += connect
+	}
+	if res.Successes > 0 {
+		res.Handshake = handshakes / time.Duration(res.Successes)
+		res.Connect = connects / time.Duration(res.Successes)
+	}
+	return res
+}
+
+// probeEndpoint performs a single QUIC handshake, followed by a CONNECT-IP
+// request unless cfg.QUICOnly is set, and tears the connection down again.
+func probeEndpoint(ctx context.Context, cfg *ScanConfig, quicConfig *quic.Config, template *uritemplate.Template, endpoint *net.UDPAddr) (time.Duration, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	udpConn, conn, err := dialQUIC(ctx, cfg.TLSConfig, quicConfig, endpoint)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() { _ = udpConn.Close() }()
+	defer func() { _ = conn.CloseWithError(0, "scan done") }()
+	handshake := time.Since(start)
+	if cfg.QUICOnly {
+		return handshake, 0, nil
+	}
+
+	tr, ipConn, rsp, err := dialConnectIP(ctx, conn, template, http.Header{"User-Agent": []string{""}})
+	if err != nil {
+		return 0, 0, err
+	}
+	connect := time.Since(start)
+	_ = ipConn.Close()
+	_ = tr.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("tunnel connection failed: %s", rsp.Status)
+	}
+	return handshake, connect, nil
+}
@@ -0,0 +1,81 @@
+package api_test
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+)
+
+func TestScanEndpointsRanksWorkingFirst(t *testing.T) {
+	peer := newPeer(t)
+	tlsConfig, err := peer.ClientTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := blackhole(t, false).(*net.UDPAddr)
+
+	var reported int
+	results := api.ScanEndpoints(context.Background(), api.ScanConfig{
+		TLSConfig: tlsConfig,
+		Endpoints: []*net.UDPAddr{dead, peer.Endpoint()},
+		Attempts:  2,
+		Timeout:   300 * time.Millisecond,
+		OnResult:  func(api.ScanResult) { reported++ },
+	})
+
+	if len(results) != 2 || reported != 2 {
+		t.Fatalf("got %d results and %d reports, want 2", len(results), reported)
+	}
+	best, worst := results[0], results[1]
+	if best.Endpoint != peer.Endpoint() || best.Successes != 2 || best.Handshake <= 0 || best.Connect < best.Handshake {
+		t.Errorf("unexpected best result %+v", best)
+	}
+	if worst.Endpoint != dead || worst.Successes != 0 || worst.Attempts != 2 || worst.Err == nil {
+		t.Errorf("unexpected worst result %+v", worst)
+	}
+}
+
+func TestScanEndpointsDoesNotResume(t *testing.T) {
+	peer := newPeer(t)
+	tlsConfig, err := peer.ClientTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var full, resumed int
+	tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if cs.DidResume {
+			resumed++
+		} else {
+			full++
+		}
+		return nil
+	}
+	// two endpoints sharing the server name, like Cloudflare's
+	other := *peer.Endpoint()
+
+	results := api.ScanEndpoints(context.Background(), api.ScanConfig{
+		TLSConfig:   tlsConfig,
+		Endpoints:   []*net.UDPAddr{peer.Endpoint(), &other},
+		Attempts:    2,
+		Concurrency: 1,
+	})
+
+	for _, res := range results {
+		if res.Successes != 2 {
+			t.Fatalf("unexpected result %+v", res)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if full != 4 || resumed != 0 {
+		t.Errorf("%d full and %d resumed handshakes, want 4 full ones", full, resumed)
+	}
+}
@@ -0,0 +1,584 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"sync"
+
+	connectip "github.com/Diniboy1123/connect-ip-go"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+	"github.com/yosida95/uritemplate/v3"
+)
+
+const (
+	// connectIPProtocol is the RFC 9484 extended CONNECT protocol token.
+	connectIPProtocol = "connect-ip"
+	// cfConnectIPProtocol is the token Cloudflare (and therefore our client) uses.
+	cfConnectIPProtocol = "cf-connect-ip"
+	// h2DatagramCapsuleType is the capsule type carrying raw IP packets over HTTP/2.
+	h2DatagramCapsuleType = 0
+)
+
+// ServerClient describes a client that is allowed to connect to a Server.
+type ServerClient struct {
+	// Name is a human readable label used in logs.
+	Name string
+	// PublicKey is the client's pinned ECDSA public key.
+	PublicKey *ecdsa.PublicKey
+	// Addresses are the tunnel addresses owned by the client. Packets with a
+	// source address outside these prefixes are dropped, and packets from the
+	// device towards any address in them are delivered to the client. When
+	// prefixes of several clients overlap, the longest one wins.
+	Addresses []netip.Prefix
+}
+
+// ServerConfig configures a new Server.
+type ServerConfig struct {
+	// TLSConfig must hold the server certificate, or mint it with
+	// GetCertificate, e.g. of a CertMinter, so that it never expires while
+	// the server runs. Client authentication is configured by NewServer.
+	TLSConfig *tls.Config
+	// QUICConfig is used by ServeHTTP3. When nil, internal.DefaultQuicConfig is used.
+	QUICConfig *quic.Config
+	// Clients lists the clients allowed to connect.
+	Clients []ServerClient
+	// Device receives packets from clients and returns their replies.
+	Device TunnelDevice
+	// MTU is the maximum size of packets read from Device.
+	MTU int
+	// ConnectURI is the CONNECT-IP URI template clients use. Defaults to internal.ConnectURI.
+	ConnectURI string
+	// Routes are advertised to HTTP/3 clients. Defaults to 0.0.0.0/0 and ::/0.
+	Routes []netip.Prefix
+	// OnRequest, if set, is called with every CONNECT-IP request of an
+	// authenticated client before it is served, e.g. to log its headers.
+	OnRequest func(client *ServerClient, r *http.Request)
+}
+
+// Server is a CONNECT-IP (RFC 9484) server speaking both HTTP/3 and HTTP/2.
+//
+// Clients authenticate with self-signed ECDSA certificates whose public keys
+// must match one of the configured ServerClient entries, mirroring how the
+// Cloudflare endpoint pins enrolled device keys. Packets from clients are
+// written to the configured TunnelDevice and packets read from the device are
+// routed back to the client owning the destination address.
+type Server struct {
+	tlsConfig  *tls.Config
+	quicConfig *quic.Config
+	clients    []ServerClient
+	device     TunnelDevice
+	mtu        int
+	template   *uritemplate.Template
+	routes     []connectip.IPRoute
+	onRequest  func(client *ServerClient, r *http.Request)
+
+	mu        sync.RWMutex
+	sessions  map[netip.Prefix]*serverSession
+	closed    bool
+	h3Servers []*http3.Server
+	h2Servers []*http.Server
+}
+
+// serverSession is a single connected client.
+type serverSession struct {
+	client *ServerClient
+	// writePacket delivers a packet read from the device to the client.
+	writePacket func(pkt []byte) error
+	close       func()
+}
+
+// tlsConnContextKey stores the *tls.Conn of an HTTP/2 connection in the
+// request context. net/http leaves Request.TLS unset for HTTP/2 CONNECT
+// requests, so the handler recovers the peer certificate from there.
+type tlsConnContextKey struct{}
+
+// NewServer creates a Server from a configuration struct.
+func NewServer(cfg ServerConfig) (*Server, error) {
+	if cfg.TLSConfig == nil || (len(cfg.TLSConfig.Certificates) == 0 && cfg.TLSConfig.GetCertificate == nil) {
+		return nil, errors.New("missing server certificate")
+	}
+	if cfg.Device == nil {
+		return nil, errors.New("missing tunnel device")
+	}
+	if cfg.MTU <= 0 {
+		return nil, errors.New("MTU must be greater than 0")
+	}
+	if cfg.ConnectURI == "" {
+		cfg.ConnectURI = internal.ConnectURI
+	}
+	template, err := uritemplate.New(cfg.ConnectURI)
+	if err != nil {
+		return nil, fmt.Errorf("invalid connect URI: %w", err)
+	}
+	if len(cfg.Routes) == 0 {
+		cfg.Routes = []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+	}
+	for _, client := range cfg.Clients {
+		if client.PublicKey == nil {
+			return nil, fmt.Errorf("client %q has no public key", client.Name)
+		}
+	}
+
+	s := &Server{
+		quicConfig: cfg.QUICConfig,
+		clients:    slices.Clone(cfg.Clients),
+		device:     cfg.Device,
+		mtu:        cfg.MTU,
+		template:   template,
+		routes:     prefixesToRoutes(cfg.Routes),
+		onRequest:  cfg.OnRequest,
+		sessions:   make(map[netip.Prefix]*serverSession),
+	}
+	if s.quicConfig == nil {
+		s.quicConfig = internal.DefaultQuicConfig(0, 0)
+	}
+
+	s.tlsConfig = cfg.TLSConfig.Clone()
+	s.tlsConfig.ClientAuth = tls.RequireAnyClientCert
+	s.tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("missing client certificate")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		if s.clientForCert(cert) == nil {
+			return errors.New("client public key is not authorized")
+		}
+		return nil
+	}
+
+	return s, nil
+}
+
+// prefixesToRoutes converts prefixes to CONNECT-IP route advertisements covering all protocols.
+func prefixesToRoutes(prefixes []netip.Prefix) []connectip.IPRoute {
+	routes := make([]connectip.IPRoute, 0, len(prefixes))
+	for _, p := range prefixes {
+		p = p.Masked()
+		routes = append(routes, connectip.IPRoute{StartIP: p.Addr(), EndIP: lastAddrInPrefix(p)})
+	}
+	// route advertisements must be sorted by address family and start address
+	slices.SortFunc(routes, func(a, b connectip.IPRoute) int { return a.StartIP.Compare(b.StartIP) })
+	return routes
+}
+
+// lastAddrInPrefix returns the highest address contained in p.
+func lastAddrInPrefix(p netip.Prefix) netip.Addr {
+	b := p.Addr().AsSlice()
+	for bit := p.Bits(); bit < len(b)*8; bit++ {
+		b[bit/8] |= 0x80 >> (bit % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// clientForCert returns the configured client whose key matches the certificate.
+func (s *Server) clientForCert(cert *x509.Certificate) *ServerClient {
+	pubKey, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil
+	}
+	for i := range s.clients {
+		if s.clients[i].PublicKey.Equal(pubKey) {
+			return &s.clients[i]
+		}
+	}
+	return nil
+}
+
+// clientForRequest authenticates r based on its TLS peer certificate.
+func (s *Server) clientForRequest(r *http.Request) *ServerClient {
+	state := r.TLS
+	if state == nil {
+		if conn, ok := r.Context().Value(tlsConnContextKey{}).(*tls.Conn); ok {
+			cs := conn.ConnectionState()
+			state = &cs
+		}
+	}
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	return s.clientForCert(state.PeerCertificates[0])
+}
+
+// ServeHTTP3 accepts CONNECT-IP over HTTP/3 on conn until the server is closed.
+func (s *Server) ServeHTTP3(conn net.PacketConn) error {
+	h3 := &http3.Server{
+		TLSConfig:       http3.ConfigureTLSConfig(s.tlsConfig),
+		QUICConfig:      s.quicConfig,
+		EnableDatagrams: true,
+		AdditionalSettings: map[uint64]uint64{
+			// see connectTunnelHTTP3, mirrored for symmetry
+			0x276: 1,
+		},
+		Handler: http.HandlerFunc(s.handleHTTP3),
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return http.ErrServerClosed
+	}
+	s.h3Servers = append(s.h3Servers, h3)
+	s.mu.Unlock()
+
+	return h3.Serve(conn)
+}
+
+// ServeHTTP2 accepts CONNECT-IP over HTTP/2 on l until the server is closed.
+// The listener must be a plain TCP listener, TLS is terminated by the server.
+func (s *Server) ServeHTTP2(l net.Listener) error {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP2(true)
+	h2 := &http.Server{
+		Handler:   http.HandlerFunc(s.handleHTTP2),
+		TLSConfig: s.tlsConfig.Clone(),
+		Protocols: protocols,
+		ErrorLog:  log.New(io.Discard, "", 0),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, tlsConnContextKey{}, c)
+		},
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = l.Close()
+		return http.ErrServerClosed
+	}
+	s.h2Servers = append(s.h2Servers, h2)
+	s.mu.Unlock()
+
+	return h2.ServeTLS(l, "", "")
+}
+
+// Run forwards packets read from the device to the owning client sessions.
+// It returns when ctx is cancelled or the device fails.
+func (s *Server) Run(ctx context.Context) error {
+	buf := make([]byte, s.mtu)
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		n, err := s.device.ReadPacket(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("failed to read from device: %w", err)
+		}
+		dst, ok := packetDestination(buf[:n])
+		if !ok {
+			continue
+		}
+
+		session := s.sessionFor(dst)
+		if session == nil {
+			continue
+		}
+		if err := session.writePacket(buf[:n]); err != nil {
+			log.Printf("server: failed to deliver packet to %s: %v", session.client.Name, err)
+		}
+	}
+}
+
+// Close stops all listeners and disconnects every client.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	h3Servers, h2Servers := s.h3Servers, s.h2Servers
+	sessions := make([]*serverSession, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.sessions = make(map[netip.Prefix]*serverSession)
+	s.mu.Unlock()
+
+	var errs []error
+	for _, h3 := range h3Servers {
+		errs = append(errs, h3.Close())
+	}
+	for _, h2 := range h2Servers {
+		errs = append(errs, h2.Close())
+	}
+	for _, session := range sessions {
+		session.close()
+	}
+	return errors.Join(errs...)
+}
+
+// register makes session the owner of its client's addresses, evicting any
+// previous session of the same client.
+func (s *Server) register(session *serverSession) {
+	var stale []*serverSession
+	s.mu.Lock()
+	for _, prefix := range session.client.Addresses {
+		prefix = prefix.Masked()
+		if old := s.sessions[prefix]; old != nil && old != session && !slices.Contains(stale, old) {
+			stale = append(stale, old)
+		}
+		s.sessions[prefix] = session
+	}
+	s.mu.Unlock()
+
+	for _, old := range stale {
+		log.Printf("server: client %s reconnected, closing previous session", session.client.Name)
+		old.close()
+	}
+}
+
+// unregister removes session, unless it has already been replaced.
+func (s *Server) unregister(session *serverSession) {
+	s.mu.Lock()
+	for _, prefix := range session.client.Addresses {
+		prefix = prefix.Masked()
+		if s.sessions[prefix] == session {
+			delete(s.sessions, prefix)
+		}
+	}
+	s.mu.Unlock()
+}
+
+// sessionFor returns the session owning the longest registered prefix
+// containing dst, or nil if there is none.
+func (s *Server) sessionFor(dst netip.Addr) *serverSession {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for bits := dst.BitLen(); bits >= 0; bits-- {
+		prefix, err := dst.Prefix(bits)
+		if err != nil {
+			return nil
+		}
+		if session := s.sessions[prefix]; session != nil {
+			return session
+		}
+	}
+	return nil
+}
+
+// forwardFromClient validates and writes a client packet to the device.
+func (s *Server) forwardFromClient(client *ServerClient, pkt []byte) {
+	src, ok := packetSource(pkt)
+	if !ok || !slices.ContainsFunc(client.Addresses, func(p netip.Prefix) bool { return p.Contains(src) }) {
+		return
+	}
+	if err := s.device.WritePacket(pkt); err != nil {
+		log.Printf("server: failed to write packet from %s to device: %v", client.Name, err)
+	}
+}
+
+func (s *Server) handleHTTP3(w http.ResponseWriter, r *http.Request) {
+	client := s.clientForRequest(r)
+	if client == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if s.onRequest != nil {
+		s.onRequest(client, r)
+	}
+
+	var req *connectip.Request
+	var err error
+	for _, proto := range []string{cfConnectIPProtocol, connectIPProtocol} {
+		req, err = connectip.ParseRequest(r, s.template, proto)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		var perr *connectip.RequestParseError
+		if errors.As(err, &perr) {
+			w.WriteHeader(perr.HTTPStatus)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	conn, err := (&connectip.Proxy{}).Proxy(w, req)
+	if err != nil {
+		log.Printf("server: failed to proxy %s: %v", client.Name, err)
+		return
+	}
+	defer func() { _ = conn.Close() }()
+
+	if err := conn.AssignAddresses(r.Context(), client.Addresses); err != nil {
+		log.Printf("server: failed to assign addresses to %s: %v", client.Name, err)
+		return
+	}
+	if err := conn.AdvertiseRoute(r.Context(), s.routes); err != nil {
+		log.Printf("server: failed to advertise routes to %s: %v", client.Name, err)
+		return
+	}
+
+	session := &serverSession{
+		client: client,
+		writePacket: func(pkt []byte) error {
+			icmp, err := conn.WritePacket(pkt)
+			if err != nil {
+				return err
+			}
+			if len(icmp) > 0 {
+				return s.device.WritePacket(icmp)
+			}
+			return nil
+		},
+		close: func() { _ = conn.Close() },
+	}
+	s.register(session)
+	defer s.unregister(session)
+
+	log.Printf("server: client %s connected over HTTP/3 from %s", client.Name, r.RemoteAddr)
+	for {
+		pkt, err := conn.ReadPacketZeroCopy(true)
+		if err != nil {
+			log.Printf("server: client %s disconnected: %v", client.Name, err)
+			return
+		}
+		s.forwardFromClient(client, pkt)
+	}
+}
+
+func (s *Server) handleHTTP2(w http.ResponseWriter, r *http.Request) {
+	client := s.clientForRequest(r)
+	if client == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if s.onRequest != nil {
+		s.onRequest(client, r)
+	}
+	if r.Method != http.MethodConnect {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if proto := r.Header.Get("cf-connect-proto"); proto != cfConnectIPProtocol {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	if host := s.template.Raw(); !sameAuthority(r.Host, host) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	var writeMu sync.Mutex
+	defer func() {
+		// w must not be used once the handler returns, wait for in-flight writes
+		writeMu.Lock()
+		cancel()
+		writeMu.Unlock()
+	}()
+
+	session := &serverSession{
+		client: client,
+		writePacket: func(pkt []byte) error {
+			frame := make([]byte, 0, 2*quicvarint.Len(uint64(len(pkt)))+len(pkt))
+			frame = quicvarint.Append(frame, h2DatagramCapsuleType)
+			frame = quicvarint.Append(frame, uint64(len(pkt)))
+			frame = append(frame, pkt...)
+
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			if ctx.Err() != nil {
+				return net.ErrClosed
+			}
+			if _, err := w.Write(frame); err != nil {
+				return err
+			}
+			return rc.Flush()
+		},
+		close: cancel,
+	}
+	s.register(session)
+	defer s.unregister(session)
+
+	log.Printf("server: client %s connected over HTTP/2 from %s", client.Name, r.RemoteAddr)
+
+	go func() {
+		<-ctx.Done()
+		_ = r.Body.Close()
+	}()
+
+	reader := quicvarint.NewReader(r.Body)
+	for {
+		capsuleType, err := quicvarint.Read(reader)
+		if err != nil {
+			break
+		}
+		length, err := quicvarint.Read(reader)
+		if err != nil {
+			break
+		}
+		if length > uint64(s.mtu)*4 {
+			break
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			break
+		}
+		if capsuleType != h2DatagramCapsuleType {
+			continue
+		}
+		s.forwardFromClient(client, payload)
+	}
+	log.Printf("server: client %s disconnected", client.Name)
+}
+
+// sameAuthority reports whether host matches the authority of rawURL, treating
+// a missing port as 443.
+func sameAuthority(host, rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	want := authorityWithDefaultPort(u, "443")
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "443")
+	}
+	return host == want
+}
+
+// packetSource returns the source address of an IP packet.
+func packetSource(pkt []byte) (netip.Addr, bool) {
+	switch {
+	case len(pkt) >= 20 && pkt[0]>>4 == 4:
+		return netip.AddrFrom4([4]byte(pkt[12:16])), true
+	case len(pkt) >= 40 && pkt[0]>>4 == 6:
+		return netip.AddrFrom16([16]byte(pkt[8:24])), true
+	}
+	return netip.Addr{}, false
+}
+
+// packetDestination returns the destination address of an IP packet.
+func packetDestination(pkt []byte) (netip.Addr, bool) {
+	switch {
+	case len(pkt) >= 20 && pkt[0]>>4 == 4:
+		return netip.AddrFrom4([4]byte(pkt[16:20])), true
+	case len(pkt) >= 40 && pkt[0]>>4 == 6:
+		return netip.AddrFrom16([16]byte(pkt[24:40])), true
+	}
+	return netip.Addr{}, false
+}
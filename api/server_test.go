@@ -0,0 +1,252 @@
+package api_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/internal"
+)
+
+// chanDevice is a TunnelDevice passing packets over channels.
+type chanDevice struct {
+	inject  chan []byte
+	written chan []byte
+	closed  chan struct{}
+}
+
+func newChanDevice() *chanDevice {
+	return &chanDevice{inject: make(chan []byte, 8), written: make(chan []byte, 8), closed: make(chan struct{})}
+}
+
+func (d *chanDevice) ReadPacket(buf []byte) (int, error) {
+	select {
+	case pkt := <-d.inject:
+		return copy(buf, pkt), nil
+	case <-d.closed:
+		return 0, io.EOF
+	}
+}
+
+func (d *chanDevice) WritePacket(pkt []byte) error {
+	d.written <- bytes.Clone(pkt)
+	return nil
+}
+
+// ipv4Packet builds an IPv4 packet from src to dst carrying payload.
+func ipv4Packet(src, dst netip.Addr, payload []byte) []byte {
+	pkt := make([]byte, 20+len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[8] = 64
+	pkt[9] = 17
+	copy(pkt[12:16], src.AsSlice())
+	copy(pkt[16:20], dst.AsSlice())
+	var sum uint32
+	for i := 0; i < 20; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(pkt[i : i+2]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	binary.BigEndian.PutUint16(pkt[10:12], ^uint16(sum))
+	copy(pkt[20:], payload)
+	return pkt
+}
+
+func TestServerHTTP3(t *testing.T) {
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := internal.GenerateCert(clientKey, &clientKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientAddr := netip.MustParseAddr("10.0.0.2")
+	remoteAddr := netip.MustParseAddr("192.0.2.1")
+	dev := newChanDevice()
+	server, err := api.NewServer(api.ServerConfig{
+		// minted for every handshake, like the server command does
+		TLSConfig: &tls.Config{GetCertificate: api.NewCertMinter(serverKey, 0, -1).GetCertificate},
+		Clients: []api.ServerClient{{
+			Name:      "test",
+			PublicKey: &clientKey.PublicKey,
+			Addresses: []netip.Prefix{netip.PrefixFrom(clientAddr, 32)},
+		}},
+		Device: dev,
+		MTU:    1280,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- server.ServeHTTP3(udpConn) }()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go func() { _ = server.Run(ctx) }()
+	defer close(dev.closed)
+
+	tlsConfig, err := api.PrepareTlsConfig(clientKey, &serverKey.PublicKey, clientCert, internal.ConnectSNI, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientUDP, tr, ipConn, _, err := api.ConnectTunnel(ctx, tlsConfig, internal.DefaultQuicConfig(time.Second, 0), internal.ConnectURI, udpConn.LocalAddr(), false)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer func() {
+		_ = ipConn.Close()
+		_ = tr.Close()
+		_ = clientUDP.Close()
+	}()
+	prefixes, err := ipConn.LocalPrefixes(ctx)
+	if err != nil || len(prefixes) != 1 || prefixes[0].Addr() != clientAddr {
+		t.Fatalf("assigned %v (%v), want %s", prefixes, err, clientAddr)
+	}
+
+	if _, err := ipConn.WritePacket(ipv4Packet(clientAddr, remoteAddr, []byte("ping"))); err != nil {
+		t.Fatalf("failed to send packet: %v", err)
+	}
+	select {
+	case pkt := <-dev.written:
+		if !bytes.HasSuffix(pkt, []byte("ping")) {
+			t.Errorf("device got %x, want the client's packet", pkt)
+		}
+	case <-ctx.Done():
+		t.Fatal("packet did not reach the device")
+	}
+
+	dev.inject <- ipv4Packet(remoteAddr, clientAddr, []byte("pong"))
+	buf := make([]byte, 1280)
+	n, err := ipConn.ReadPacket(buf, true)
+	if err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	if !bytes.HasSuffix(buf[:n], []byte("pong")) {
+		t.Errorf("client got %x, want the reply", buf[:n])
+	}
+
+	if err := server.Close(); err != nil {
+		t.Errorf("failed to close: %v", err)
+	}
+	select {
+	case <-served:
+	case <-ctx.Done():
+		t.Fatal("ServeHTTP3 did not return after Close")
+	}
+
+	// serving on a closed server must not leak the listener
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ServeHTTP2(l); !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("ServeHTTP2 after Close returned %v", err)
+	}
+	_ = l.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("listener still open after ServeHTTP2 returned: %v", err)
+	}
+}
+
+func TestServerPrefixAddress(t *testing.T) {
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := internal.GenerateCert(clientKey, &clientKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the client owns a whole /30 and uses an address other than its first
+	clientAddr := netip.MustParseAddr("10.0.0.2")
+	remoteAddr := netip.MustParseAddr("192.0.2.1")
+	dev := newChanDevice()
+	server, err := api.NewServer(api.ServerConfig{
+		TLSConfig: &tls.Config{GetCertificate: api.NewCertMinter(serverKey, 0, -1).GetCertificate},
+		Clients: []api.ServerClient{{
+			Name:      "test",
+			PublicKey: &clientKey.PublicKey,
+			Addresses: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/30")},
+		}},
+		Device: dev,
+		MTU:    1280,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.ServeHTTP3(udpConn) }()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go func() { _ = server.Run(ctx) }()
+	defer close(dev.closed)
+
+	tlsConfig, err := api.PrepareTlsConfig(clientKey, &serverKey.PublicKey, clientCert, internal.ConnectSNI, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientUDP, tr, ipConn, _, err := api.ConnectTunnel(ctx, tlsConfig, internal.DefaultQuicConfig(time.Second, 0), internal.ConnectURI, udpConn.LocalAddr(), false)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer func() {
+		_ = ipConn.Close()
+		_ = tr.Close()
+		_ = clientUDP.Close()
+	}()
+	if _, err := ipConn.WritePacket(ipv4Packet(clientAddr, remoteAddr, []byte("ping"))); err != nil {
+		t.Fatalf("failed to send packet: %v", err)
+	}
+	select {
+	case <-dev.written:
+	case <-ctx.Done():
+		t.Fatal("packet did not reach the device")
+	}
+
+	// the reply is dropped unless the whole prefix routes to the client
+	go func() {
+		<-ctx.Done()
+		_ = ipConn.Close()
+	}()
+	dev.inject <- ipv4Packet(remoteAddr, clientAddr, []byte("pong"))
+	buf := make([]byte, 1280)
+	n, err := ipConn.ReadPacket(buf, true)
+	if err != nil {
+		t.Fatalf("failed to read reply to %s: %v", clientAddr, err)
+	}
+	if !bytes.HasSuffix(buf[:n], []byte("pong")) {
+		t.Errorf("client got %x, want the reply", buf[:n])
+	}
+}
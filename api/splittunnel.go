@@ -0,0 +1,186 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/Diniboy1123/usque/internal"
+)
+
+// DialFunc dials addr, a host and port, on network.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// SplitTunnel decides which destinations use the tunnel, following the split
+// tunnel include or exclude list of a Zero Trust policy. Destinations that
+// do not use the tunnel are dialed directly from the host.
+type SplitTunnel struct {
+	// Include makes the listed destinations the only ones using the tunnel,
+	// instead of the only ones bypassing it.
+	Include bool
+	// Prefixes are the listed addresses.
+	Prefixes []netip.Prefix
+	// Domains are the listed hosts, each matching itself and its
+	// subdomains.
+	Domains []string
+	// FallbackDomains are resolved outside the tunnel.
+	FallbackDomains []FallbackDomain
+}
+
+// FallbackDomain is a domain suffix resolved by other DNS servers than the
+// tunnel's.
+type FallbackDomain struct {
+	// Suffix matches itself and its subdomains.
+	Suffix string
+	// Servers are queried over the host, the system resolver is used if
+	// empty.
+	Servers []netip.Addr
+}
+
+// NewSplitTunnel creates a SplitTunnel from a list of addresses, CIDRs and
+// hosts, where "*.example.com" and ".example.com" mean "example.com".
+//
+// Parameters:
+//   - include: bool - Whether entries are the only destinations using the tunnel rather than the ones bypassing it.
+//   - entries: []string - The listed destinations.
+//   - fallbackDomains: []FallbackDomain - Domains resolved outside the tunnel.
+//
+// Returns:
+//   - *SplitTunnel: The split tunnel.
+//   - error: An error if an entry is neither an address nor a host.
+func NewSplitTunnel(include bool, entries []string, fallbackDomains []FallbackDomain) (*SplitTunnel, error) {
+	s := &SplitTunnel{Include: include, FallbackDomains: fallbackDomains}
+	for _, entry := range entries {
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			s.Prefixes = append(s.Prefixes, prefix.Masked())
+			continue
+		}
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			s.Prefixes = append(s.Prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		domain := normalizeDomain(strings.TrimPrefix(entry, "*"))
+		if domain == "" || strings.ContainsAny(domain, "/ ") {
+			return nil, fmt.Errorf("invalid split tunnel entry %q", entry)
+		}
+		s.Domains = append(s.Domains, domain)
+	}
+	for i := range s.FallbackDomains {
+		s.FallbackDomains[i].Suffix = normalizeDomain(s.FallbackDomains[i].Suffix)
+	}
+	return s, nil
+}
+
+// TunnelsAddr reports whether traffic to addr uses the tunnel.
+func (s *SplitTunnel) TunnelsAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range s.Prefixes {
+		if p.Contains(addr) {
+			return s.Include
+		}
+	}
+	return !s.Include
+}
+
+// tunnelsHost reports whether traffic to host uses the tunnel if it is
+// listed, and whether it is.
+func (s *SplitTunnel) tunnelsHost(host string) (tunneled, listed bool) {
+	for _, domain := range s.Domains {
+		if matchesDomain(host, domain) {
+			return s.Include, true
+		}
+	}
+	return !s.Include, false
+}
+
+// fallbackDomain returns the fallback domain host belongs to, if any.
+func (s *SplitTunnel) fallbackDomain(host string) (FallbackDomain, bool) {
+	for _, domain := range s.FallbackDomains {
+		if matchesDomain(host, domain.Suffix) {
+			return domain, true
+		}
+	}
+	return FallbackDomain{}, false
+}
+
+// Dialer wraps tunnelDial, which dials through the tunnel, so that
+// destinations bypassing the tunnel are dialed directly. Hosts are resolved
+// with lookup, which resolves through the tunnel, when their traffic is
+// likely to use the tunnel, and with the system resolver otherwise, so that
+// the address can be checked against Prefixes.
+//
+// Parameters:
+//   - tunnelDial: DialFunc - Dials through the tunnel.
+//   - lookup: func(ctx context.Context, host string) (netip.Addr, error) - Resolves through the tunnel.
+//
+// Returns:
+//   - DialFunc: The split dialer.
+func (s *SplitTunnel) Dialer(tunnelDial DialFunc, lookup func(ctx context.Context, host string) (netip.Addr, error)) DialFunc {
+	var direct net.Dialer
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		ip, err := netip.ParseAddr(host)
+		if err != nil {
+			host = normalizeDomain(host)
+			tunneled, listed := s.tunnelsHost(host)
+			if fallback, ok := s.fallbackDomain(host); ok {
+				ip, err = fallback.lookup(ctx, host)
+			} else if listed && !tunneled {
+				return direct.DialContext(ctx, network, addr)
+			} else if tunneled {
+				ip, err = lookup(ctx, host)
+			} else {
+				ip, err = lookupHost(ctx, net.DefaultResolver, host)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve %s: %w", host, err)
+			}
+			if listed && tunneled {
+				return tunnelDial(ctx, network, net.JoinHostPort(ip.String(), port))
+			}
+		}
+
+		addr = net.JoinHostPort(ip.Unmap().String(), port)
+		if s.TunnelsAddr(ip) {
+			return tunnelDial(ctx, network, addr)
+		}
+		return direct.DialContext(ctx, network, addr)
+	}
+}
+
+// lookup resolves host with the servers of d.
+func (d FallbackDomain) lookup(ctx context.Context, host string) (netip.Addr, error) {
+	resolver := net.DefaultResolver
+	if len(d.Servers) > 0 {
+		resolver = internal.NewStaticResolver(d.Servers)
+	}
+	return lookupHost(ctx, resolver, host)
+}
+
+// lookupHost returns the first address of host.
+func lookupHost(ctx context.Context, resolver *net.Resolver, host string) (netip.Addr, error) {
+	addrs, err := resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if len(addrs) == 0 {
+		return netip.Addr{}, fmt.Errorf("no address for %s", host)
+	}
+	return addrs[0].Unmap(), nil
+}
+
+// normalizeDomain lower-cases domain and strips leading and trailing dots.
+func normalizeDomain(domain string) string {
+	return strings.Trim(strings.ToLower(domain), ".")
+}
+
+// matchesDomain reports whether host is domain or one of its subdomains.
+func matchesDomain(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
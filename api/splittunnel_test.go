@@ -0,0 +1,139 @@
+package api_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/Diniboy1123/usque/api"
+)
+
+var errTunnelDial = errors.New("dialed through the tunnel")
+
+// splitDialer returns the dialer of split, whose tunnel dials fail with
+// errTunnelDial after recording the address, and resolve every host to
+// 192.0.2.7.
+func splitDialer(split *api.SplitTunnel, tunneled *[]string) api.DialFunc {
+	return split.Dialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		*tunneled = append(*tunneled, addr)
+		return nil, errTunnelDial
+	}, func(ctx context.Context, host string) (netip.Addr, error) {
+		return netip.MustParseAddr("192.0.2.7"), nil
+	})
+}
+
+// localListener returns the port of a loopback listener dialed directly.
+func localListener(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port
+}
+
+func TestSplitTunnelExclude(t *testing.T) {
+	split, err := api.NewSplitTunnel(false, []string{"10.0.0.0/8", "127.0.0.1", "*.localhost", "localhost"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if split.TunnelsAddr(netip.MustParseAddr("10.1.2.3")) {
+		t.Errorf("excluded address uses the tunnel")
+	}
+	if !split.TunnelsAddr(netip.MustParseAddr("1.1.1.1")) {
+		t.Errorf("other address bypasses the tunnel")
+	}
+
+	port := localListener(t)
+	var tunneled []string
+	dial := splitDialer(split, &tunneled)
+	for _, addr := range []string{"127.0.0.1:" + port, "localhost:" + port} {
+		conn, err := dial(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Errorf("failed to dial excluded %s directly: %v", addr, err)
+			continue
+		}
+		_ = conn.Close()
+	}
+	if _, err := dial(context.Background(), "tcp", "example.org:443"); !errors.Is(err, errTunnelDial) {
+		t.Errorf("other host was not dialed through the tunnel: %v", err)
+	}
+	if want := []string{"192.0.2.7:443"}; !slices.Equal(tunneled, want) {
+		t.Errorf("dialed %v through the tunnel, want the address resolved through it", tunneled)
+	}
+}
+
+func TestSplitTunnelInclude(t *testing.T) {
+	split, err := api.NewSplitTunnel(true, []string{"192.0.2.0/24", "example.org"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port := localListener(t)
+	var tunneled []string
+	dial := splitDialer(split, &tunneled)
+	conn, err := dial(context.Background(), "tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("failed to dial host that is not included directly: %v", err)
+	}
+	_ = conn.Close()
+
+	for _, addr := range []string{"192.0.2.1:80", "www.example.org:443"} {
+		if _, err := dial(context.Background(), "tcp", addr); !errors.Is(err, errTunnelDial) {
+			t.Errorf("included %s was not dialed through the tunnel: %v", addr, err)
+		}
+	}
+	if want := []string{"192.0.2.1:80", "192.0.2.7:443"}; !slices.Equal(tunneled, want) {
+		t.Errorf("dialed %v through the tunnel, want %v", tunneled, want)
+	}
+}
+
+func TestNewSplitTunnelRejectsInvalidEntries(t *testing.T) {
+	if _, err := api.NewSplitTunnel(false, []string{"10.0.0.0/33"}, nil); err == nil {
+		t.Errorf("invalid CIDR was accepted")
+	}
+}
+
+func TestL4ProxySplitTunnel(t *testing.T) {
+	endpoint, targets := connectH2Echo(t)
+	split, err := api.NewSplitTunnel(false, []string{"127.0.0.1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := l4TestConfig(t)
+	cfg.H2Endpoint = endpoint
+	cfg.UseHTTP2 = true
+	cfg.SplitTunnel = split
+	proxy, err := api.NewL4Proxy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// excluded destinations are dialed directly
+	conn, err := proxy.DialContext(context.Background(), "127.0.0.1:"+localListener(t))
+	if err != nil {
+		t.Fatalf("failed to dial excluded address directly: %v", err)
+	}
+	_ = conn.Close()
+	select {
+	case target := <-targets:
+		t.Errorf("excluded address was requested as %s", target)
+	default:
+	}
+	l4Echo(t, proxy, targets)
+}
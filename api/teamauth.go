@@ -0,0 +1,192 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// TeamAuth holds the credentials registering a device to a Zero Trust
+// organization. JWT takes precedence over the service token.
+type TeamAuth struct {
+	// JWT is the token a user gets by logging in to the organization, e.g.
+	// through TeamLogin.
+	JWT string
+	// ClientID and ClientSecret are an Access service token of the
+	// organization, enrolling devices without a user.
+	ClientID     string
+	ClientSecret string
+}
+
+// header returns the registration headers carrying a.
+func (a TeamAuth) header() http.Header {
+	header := http.Header{}
+	switch {
+	case a.JWT != "":
+		header.Set("CF-Access-Jwt-Assertion", a.JWT)
+	case a.ClientID != "":
+		header.Set("CF-Access-Client-Id", a.ClientID)
+		header.Set("CF-Access-Client-Secret", a.ClientSecret)
+	}
+	return header
+}
+
+// TeamLoginURL returns the page where users of a Zero Trust organization log
+// in to enroll a device.
+//
+// Parameters:
+//   - team: string - The team name of the organization, optionally followed by ".cloudflareaccess.com".
+//
+// Returns:
+//   - string: The login URL.
+func TeamLoginURL(team string) string {
+	return "https://" + strings.TrimSuffix(team, ".cloudflareaccess.com") + ".cloudflareaccess.com/warp"
+}
+
+// TeamLogin receives the token of a user logging in to a Zero Trust
+// organization in a browser.
+//
+// After login, the organization's page links to
+// com.cloudflare.warp://<team>.cloudflareaccess.com/auth?token=<jwt>, which
+// the official client would open. Browsers hand that scheme to the
+// application registered for it, which can pass the link on with
+// ForwardTeamLogin. Otherwise the user has to pass it on: TeamLogin serves
+// the same /auth path below CallbackURL, so the link works with everything
+// before /auth replaced by it. CallbackURL also serves a form taking the
+// link or token pasted into it.
+//
+// CallbackURL contains a random state only known to the user, so that other
+// pages open in the browser cannot submit a token of their own.
+type TeamLogin struct {
+	// URL is the login page of the organization.
+	URL string
+	// CallbackURL is the base URL of the local listener, including the
+	// state.
+	CallbackURL string
+
+	state string
+	srv   *http.Server
+	token chan string
+}
+
+// ListenTeamLogin starts the callback listener of a browser login.
+//
+// Parameters:
+//   - team: string - The team name of the organization.
+//   - addr: string - The local address to listen on, e.g. "127.0.0.1:0".
+//
+// Returns:
+//   - *TeamLogin: The login waiting for its token. Close it when done.
+//   - error: An error if listening fails.
+func ListenTeamLogin(team, addr string) (*TeamLogin, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for the login callback: %w", err)
+	}
+
+	state := rand.Text()
+	l := &TeamLogin{
+		URL:         TeamLoginURL(team),
+		CallbackURL: "http://" + ln.Addr().String() + "/" + state,
+		state:       state,
+		token:       make(chan string, 1),
+	}
+	// requests without the state are not found
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /"+state+"/auth", l.handleAuth)
+	mux.HandleFunc("GET /"+state, l.handleForm)
+	mux.HandleFunc("GET /"+state+"/{$}", l.handleForm)
+	l.srv = &http.Server{Handler: mux}
+	go func() { _ = l.srv.Serve(ln) }()
+	return l, nil
+}
+
+// Token waits for the token of the login.
+//
+// Parameters:
+//   - ctx: context.Context - Cancels waiting.
+//
+// Returns:
+//   - string: The token, to be used as TeamAuth.JWT.
+//   - error: The context error if ctx is done first.
+func (l *TeamLogin) Token(ctx context.Context) (string, error) {
+	select {
+	case token := <-l.token:
+		return token, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// Close stops the callback listener.
+func (l *TeamLogin) Close() error {
+	return l.srv.Close()
+}
+
+func (l *TeamLogin) handleAuth(w http.ResponseWriter, r *http.Request) {
+	token := callbackToken(r.URL.Query().Get("token"))
+	if token == "" {
+		http.Error(w, "No token in the request, open the link of the login page or paste it at "+l.CallbackURL, http.StatusBadRequest)
+		return
+	}
+	select {
+	case l.token <- token:
+	default:
+		// a token was already received, e.g. the page was reloaded
+	}
+	_, _ = fmt.Fprintln(w, "Login received, you may close this page.")
+}
+
+func (l *TeamLogin) handleForm(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = fmt.Fprintf(w, `<!DOCTYPE html>
+<title>usque login</title>
+<p>Log in at <a href="%[1]s">%[1]s</a>, then paste the link of the success page or its token:</p>
+<form action="/%[2]s/auth"><input name="token" size="80" autofocus> <button>Register</button></form>
+`, html.EscapeString(l.URL), l.state)
+}
+
+// ForwardTeamLogin passes the link of the success page of a browser login
+// on to its TeamLogin, e.g. from the handler of the com.cloudflare.warp
+// scheme.
+//
+// Parameters:
+//   - ctx: context.Context - The context of the request.
+//   - callbackURL: string - The TeamLogin.CallbackURL of the login, including its state.
+//   - link: string - The link of the success page, or its token.
+//
+// Returns:
+//   - error: An error if link has no token or the login did not accept it.
+func ForwardTeamLogin(ctx context.Context, callbackURL, link string) error {
+	if callbackToken(link) == "" {
+		return fmt.Errorf("no token in %s", link)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(callbackURL, "/")+"/auth?token="+url.QueryEscape(link), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach the login: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("login rejected the token: %s", resp.Status)
+	}
+	return nil
+}
+
+// callbackToken extracts the token of s, a token or a link carrying it in
+// its token query parameter.
+func callbackToken(s string) string {
+	s = strings.TrimSpace(s)
+	if u, err := url.Parse(s); err == nil && u.Scheme != "" {
+		return u.Query().Get("token")
+	}
+	return s
+}
@@ -0,0 +1,114 @@
+package api_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/api/apitest"
+)
+
+func TestRegisterTeamServiceToken(t *testing.T) {
+	srv := apitest.NewServer()
+	t.Cleanup(srv.Close)
+	c := api.NewClient("", "")
+	c.BaseURL = srv.URL
+
+	auth := api.TeamAuth{ClientID: apitest.ServiceTokenID, ClientSecret: apitest.ServiceTokenSecret}
+	data, err := c.RegisterTeam(context.Background(), "PC", "en_US", auth)
+	if err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	if data.Account.Organization != apitest.TeamOrganization {
+		t.Errorf("got organization %q, want %q", data.Account.Organization, apitest.TeamOrganization)
+	}
+
+	auth.ClientSecret = "wrong"
+	if _, err := c.RegisterTeam(context.Background(), "PC", "en_US", auth); !errors.Is(err, api.ErrUnauthorized) {
+		t.Errorf("got error %v with a wrong secret, want ErrUnauthorized", err)
+	}
+}
+
+func TestTeamLogin(t *testing.T) {
+	login, err := api.ListenTeamLogin("example-org", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = login.Close() }()
+	if want := "https://example-org.cloudflareaccess.com/warp"; login.URL != want {
+		t.Errorf("got login URL %s, want %s", login.URL, want)
+	}
+
+	resp, err := http.Get(login.CallbackURL + "/auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d without a token, want 400", resp.StatusCode)
+	}
+
+	// a page not knowing the state cannot submit a token
+	callback, err := url.Parse(login.CallbackURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.Get("http://" + callback.Host + "/auth?token=forged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d without the state, want 404", resp.StatusCode)
+	}
+
+	// the link of the success page, pasted into the form
+	link := "com.cloudflare.warp://example-org.cloudflareaccess.com/auth?token=user-token"
+	resp, err = http.Get(login.CallbackURL + "/auth?token=" + url.QueryEscape(link))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d, want 200", resp.StatusCode)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if token, err := login.Token(ctx); err != nil || token != "user-token" {
+		t.Errorf("got token %q and error %v, want user-token", token, err)
+	}
+}
+
+func TestForwardTeamLogin(t *testing.T) {
+	login, err := api.ListenTeamLogin("example-org", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = login.Close() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := api.ForwardTeamLogin(ctx, login.CallbackURL, "com.cloudflare.warp://example-org.cloudflareaccess.com/auth"); err == nil {
+		t.Errorf("forwarded a link without a token")
+	}
+	callback, err := url.Parse(login.CallbackURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := api.ForwardTeamLogin(ctx, "http://"+callback.Host+"/wrong-state", "forged"); err == nil {
+		t.Errorf("forwarded a token without the state")
+	}
+
+	link := "com.cloudflare.warp://example-org.cloudflareaccess.com/auth?token=user-token"
+	if err := api.ForwardTeamLogin(ctx, login.CallbackURL, link); err != nil {
+		t.Fatalf("failed to forward the link: %v", err)
+	}
+	if token, err := login.Token(ctx); err != nil || token != "user-token" {
+		t.Errorf("got token %q and error %v, want user-token", token, err)
+	}
+}
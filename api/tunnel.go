@@ -7,11 +7,17 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	connectip "github.com/Diniboy1123/connect-ip-go"
 	"github.com/Diniboy1123/usque/internal"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
 	"github.com/songgao/water"
 	"golang.zx2c4.com/wireguard/tun"
 )
@@ -159,6 +165,12 @@ const pumpShutdownGrace = 2 * time.Second
 // byte before packets lets connect-ip-go send outbound datagrams in place.
 const datagramContextIDHeadroom = 1
 
+// Defaults of the HTTP/3 to HTTP/2 fallback in MaintainTunnel.
+const (
+	DefaultH2FallbackAfter = 3
+	DefaultH3ProbeInterval = 5 * time.Minute
+)
+
 // MaintainTunnelConfig contains runtime settings for tunnel maintenance.
 type MaintainTunnelConfig struct {
 	TLSConfig         *tls.Config
@@ -167,9 +179,75 @@ type MaintainTunnelConfig struct {
 	Endpoint          net.Addr
 	Device            TunnelDevice
 	MTU               int
-	ReconnectDelay    time.Duration
-	AlwaysReconnect   bool
-	UseHTTP2          bool
+	// ReconnectDelay is the delay after losing a connection and the initial
+	// delay after a failed attempt, doubled on every further failure up to
+	// MaxReconnectDelay. Delays are jittered by up to 50%.
+	ReconnectDelay  time.Duration
+	AlwaysReconnect bool
+	UseHTTP2        bool
+	// MaxReconnectDelay caps the backoff and is the delay after permanent
+	// errors. Defaults to DefaultMaxReconnectDelay.
+	MaxReconnectDelay time.Duration
+	// FailureBudget is the number of consecutive failed attempts after which
+	// Run gives up with ErrFailureBudgetExhausted. Zero retries forever.
+	FailureBudget int
+	// StopOnPermanentError makes Run give up on the first error retrying
+	// won't fix, see PermanentError, instead of retrying at
+	// MaxReconnectDelay.
+	StopOnPermanentError bool
+	// AltEndpoint is an optional endpoint of the other address family, of
+	// the same type as Endpoint. Both are raced RFC 8305 style, and the one
+	// that completes the handshake first is used and tried first on
+	// reconnects.
+	AltEndpoint net.Addr
+	// HappyEyeballsDelay is the head start of the preferred endpoint when
+	// racing. Defaults to DefaultHappyEyeballsDelay.
+	HappyEyeballsDelay time.Duration
+	// H2FallbackEndpoint enables the automatic transport fallback when
+	// UseHTTP2 is false. It is the *net.TCPAddr dialed over HTTP/2 once
+	// HTTP/3 failed H2FallbackAfter times in a row.
+	H2FallbackEndpoint net.Addr
+	// H2FallbackAltEndpoint is the AltEndpoint of H2FallbackEndpoint.
+	H2FallbackAltEndpoint net.Addr
+	// H2FallbackAfter is the number of consecutive failed attempts after
+	// which the transport is switched. Defaults to DefaultH2FallbackAfter.
+	H2FallbackAfter int
+	// H3ProbeInterval is how often HTTP/3 is re-probed while the fallback is
+	// in use. Defaults to DefaultH3ProbeInterval.
+	H3ProbeInterval time.Duration
+	// Ports are further ports Endpoint and AltEndpoint accept. When a
+	// handshake times out, e.g. because the port is filtered, the next port
+	// is tried; the port that worked is kept for reconnects.
+	Ports []int
+	// FailoverEndpoints are further endpoints of the same type as Endpoint,
+	// each with its own TLS configuration. After FailoverAfter consecutive
+	// failed attempts MaintainTunnel moves on to the next one, wrapping
+	// around after the last. The HTTP/2 fallback only kicks in once every
+	// endpoint had its attempts.
+	FailoverEndpoints []TunnelEndpoint
+	// FailoverAfter is the number of consecutive failed attempts after which
+	// the next endpoint is tried. Defaults to DefaultFailoverAfter.
+	FailoverAfter int
+	// StartEndpoint is the address, as returned by net.Addr.String, of the
+	// endpoint to try first. It is usually the one last passed to
+	// OnEndpointUp. Ignored when no endpoint matches.
+	StartEndpoint string
+	// OnEndpointUp is called with the endpoint of every established
+	// connection, e.g. to persist it. It must not block.
+	OnEndpointUp func(endpoint net.Addr)
+	// HandshakeTimeout bounds the QUIC handshake of HTTP/3 attempts, which
+	// decides how quickly blocked UDP is noticed. Zero uses quic-go's default.
+	HandshakeTimeout time.Duration
+	// NetworkChanges, e.g. from WatchNetworkChanges, signals that the
+	// host's addresses or routes changed. HTTP/3 connections are then
+	// migrated to a new socket, and only reestablished if that fails.
+	NetworkChanges <-chan struct{}
+	// Liveness configures active health checks of established connections
+	// and the detection of suspend and resume.
+	Liveness LivenessConfig
+	// OnEvent is called synchronously on every state change of the tunnel,
+	// e.g. to forward it to a channel. It must not block.
+	OnEvent func(TunnelEvent)
 	// OnConnect is a path to an executable run after every successful tunnel
 	// connect. It is exec'd directly (no shell, no args) and runs fire-and-forget.
 	OnConnect string
@@ -177,8 +255,11 @@ type MaintainTunnelConfig struct {
 	// It is exec'd directly (no shell, no args) and runs fire-and-forget.
 	OnDisconnect string
 	// HookEnv is a set of USQUE_* environment variables layered on top of the
-	// parent process env for OnConnect / OnDisconnect invocations. USQUE_EVENT
-	// and USQUE_ENDPOINT are set by MaintainTunnel itself.
+	// parent process env for OnConnect / OnDisconnect invocations. USQUE_EVENT,
+	// USQUE_ENDPOINT and USQUE_TRANSPORT ("h3" or "h2") are set by
+	// MaintainTunnel itself, as are USQUE_IPV4, USQUE_IPV6 and USQUE_ROUTES
+	// when the server assigned addresses or advertised routes. Over HTTP/3,
+	// OnConnect waits up to a second for them.
 	HookEnv map[string]string
 }
 
@@ -216,36 +297,121 @@ func sleepCtx(ctx context.Context, d time.Duration) error {
 // any ICMP reply), and the other forwarding from the IP connection to the device.
 // If an error occurs in either loop, the connection is closed and a reconnect is attempted.
 //
+// When cfg.H2FallbackEndpoint is set, HTTP/3 is tried first and HTTP/2 is used after
+// cfg.H2FallbackAfter consecutive failed attempts. While on HTTP/2, HTTP/3 is re-probed
+// every cfg.H3ProbeInterval and the tunnel moves back to it once the probe succeeds.
+//
+// MaintainTunnel is a shorthand for NewTunnel(cfg).Run(ctx); use a Tunnel to
+// query its Status while it runs.
+//
 // Parameters:
 //   - ctx: context.Context - The context for the connection.
 //   - cfg: MaintainTunnelConfig - Tunnel maintenance runtime configuration.
 func MaintainTunnel(ctx context.Context, cfg MaintainTunnelConfig) {
+	_ = NewTunnel(cfg).Run(ctx)
+}
+
+// NewTunnel validates cfg and creates a Tunnel maintained by Run.
+// Invalid endpoints are fatal, as they are programming errors.
+//
+// Parameters:
+//   - cfg: MaintainTunnelConfig - Tunnel maintenance runtime configuration.
+//
+// Returns:
+//   - *Tunnel: The tunnel, in state TunnelStopped until Run is called.
+func NewTunnel(cfg MaintainTunnelConfig) *Tunnel {
 	if cfg.UseHTTP2 {
-		if _, ok := cfg.Endpoint.(*net.TCPAddr); !ok {
-			log.Fatalf("MaintainTunnel: HTTP/2 mode requires a *net.TCPAddr endpoint, got %T", cfg.Endpoint)
+		requireEndpointType[*net.TCPAddr]("HTTP/2 mode", cfg.Endpoint, false)
+		requireEndpointType[*net.TCPAddr]("HTTP/2 mode", cfg.AltEndpoint, true)
+		for _, e := range cfg.FailoverEndpoints {
+			requireEndpointType[*net.TCPAddr]("HTTP/2 mode", e.Endpoint, false)
+			requireEndpointType[*net.TCPAddr]("HTTP/2 mode", e.AltEndpoint, true)
 		}
 	} else {
-		if _, ok := cfg.Endpoint.(*net.UDPAddr); !ok {
-			log.Fatalf("MaintainTunnel: HTTP/3 mode requires a *net.UDPAddr endpoint, got %T", cfg.Endpoint)
+		requireEndpointType[*net.UDPAddr]("HTTP/3 mode", cfg.Endpoint, false)
+		requireEndpointType[*net.UDPAddr]("HTTP/3 mode", cfg.AltEndpoint, true)
+		for _, e := range cfg.FailoverEndpoints {
+			requireEndpointType[*net.UDPAddr]("HTTP/3 mode", e.Endpoint, false)
+			requireEndpointType[*net.UDPAddr]("HTTP/3 mode", e.AltEndpoint, true)
+		}
+		requireEndpointType[*net.TCPAddr]("HTTP/2 fallback", cfg.H2FallbackEndpoint, true)
+		requireEndpointType[*net.TCPAddr]("HTTP/2 fallback", cfg.H2FallbackAltEndpoint, true)
+	}
+	if cfg.H2FallbackAfter <= 0 {
+		cfg.H2FallbackAfter = DefaultH2FallbackAfter
+	}
+	if cfg.H3ProbeInterval <= 0 {
+		cfg.H3ProbeInterval = DefaultH3ProbeInterval
+	}
+	if cfg.HappyEyeballsDelay <= 0 {
+		cfg.HappyEyeballsDelay = DefaultHappyEyeballsDelay
+	}
+	if cfg.FailoverAfter <= 0 {
+		cfg.FailoverAfter = DefaultFailoverAfter
+	}
+	if cfg.MaxReconnectDelay <= 0 {
+		cfg.MaxReconnectDelay = DefaultMaxReconnectDelay
+	}
+	cfg.MaxReconnectDelay = max(cfg.MaxReconnectDelay, cfg.ReconnectDelay)
+	if cfg.Liveness.Probe == nil && cfg.Liveness.Target.IsValid() &&
+		(!cfg.Liveness.Source.IsValid() || cfg.Liveness.Source.Is4() != cfg.Liveness.Target.Is4()) {
+		log.Fatalf("MaintainTunnel: liveness target %s requires a source address of the same family, got %s", cfg.Liveness.Target, cfg.Liveness.Source)
+	}
+	if cfg.Liveness.Interval <= 0 {
+		cfg.Liveness.Interval = DefaultLivenessInterval
+	}
+	if cfg.Liveness.MaxMissed <= 0 {
+		cfg.Liveness.MaxMissed = DefaultLivenessMaxMissed
+	}
+	if cfg.Liveness.ClockJumpThreshold == 0 {
+		cfg.Liveness.ClockJumpThreshold = -1
+		if cfg.Liveness.enabled() {
+			cfg.Liveness.ClockJumpThreshold = DefaultClockJumpThreshold
 		}
 	}
 
+	return &Tunnel{cfg: cfg, status: TunnelStatus{State: TunnelStopped, Since: time.Now()}}
+}
+
+// Run maintains the tunnel like MaintainTunnel until ctx is cancelled, or
+// until it gives up because cfg.FailureBudget is exhausted or, with
+// cfg.StopOnPermanentError, a permanent error occurred. It must only be
+// called once.
+//
+// Parameters:
+//   - ctx: context.Context - The context for the connection.
+//
+// Returns:
+//   - error: ctx.Err() once cancelled, otherwise why the tunnel gave up.
+func (t *Tunnel) Run(ctx context.Context) (err error) {
+	cfg := t.cfg
+	defer func() { t.emit(TunnelEvent{State: TunnelStopped, Err: err}) }()
+
 	packetBufferPool := NewNetBuffer(cfg.MTU + datagramContextIDHeadroom)
+	transport := newTransportSelector(&cfg)
+
+	// adopted is an HTTP/3 connection established by a successful probe,
+	// used instead of dialing on the next cycle
+	var adopted *tunnelConn
 
 	for {
 		if ctx.Err() != nil {
-			return
+			if adopted != nil {
+				adopted.close()
+			}
+			return ctx.Err()
 		}
 
-		if !cfg.AlwaysReconnect {
+		if !cfg.AlwaysReconnect && adopted == nil {
 			log.Println("Tunnel idle. Waiting for outbound activity before reconnecting...")
+			t.emit(TunnelEvent{State: TunnelIdle})
 			buf := packetBufferPool.Get()
 			n, err := cfg.Device.ReadPacket(buf[datagramContextIDHeadroom:])
 			if err != nil {
 				packetBufferPool.Put(buf)
 				log.Printf("Failed to read from TUN device while waiting for activity: %v", err)
-				if sleepErr := sleepCtx(ctx, cfg.ReconnectDelay); sleepErr != nil {
-					return
+				if err := t.backoff(ctx, fmt.Errorf("failed to read from TUN device: %w", err)); err != nil {
+					return err
 				}
 				continue
 			}
@@ -253,60 +419,103 @@ func MaintainTunnel(ctx context.Context, cfg MaintainTunnelConfig) {
 			log.Printf("Detected outbound activity (%d bytes). Reconnecting...", n)
 		}
 
-		log.Printf("Establishing MASQUE connection to %s", cfg.Endpoint)
-		udpConn, tr, ipConn, rsp, err := ConnectTunnel(
-			ctx,
-			cfg.TLSConfig,
-			internal.DefaultQuicConfig(cfg.KeepalivePeriod, cfg.InitialPacketSize),
-			internal.ConnectURI,
-			cfg.Endpoint,
-			cfg.UseHTTP2,
-		)
-		if err != nil {
-			log.Printf("Failed to connect tunnel: %v", err)
-			if ipConn != nil {
-				_ = ipConn.Close()
-			}
-			if tr != nil {
-				_ = tr.Close()
-			}
-			if udpConn != nil {
-				_ = udpConn.Close()
-			}
-			if sleepErr := sleepCtx(ctx, cfg.ReconnectDelay); sleepErr != nil {
-				return
-			}
-			continue
-		}
-		if rsp.StatusCode != 200 {
-			log.Printf("Tunnel connection failed: %s", rsp.Status)
-			_ = ipConn.Close()
-			if tr != nil {
-				_ = tr.Close()
-			}
-			if udpConn != nil {
-				_ = udpConn.Close()
+		conn := adopted
+		adopted = nil
+		if conn == nil {
+			candidate := transport.candidate()
+			endpoints := candidate.endpoints.ordered()
+			log.Printf("Establishing MASQUE connection to %s over %s", formatEndpoints(endpoints), transport.name())
+			t.emit(TunnelEvent{State: TunnelConnecting, Endpoint: endpoints[0], Transport: transport.id()})
+			var rsp *http.Response
+			var err error
+			conn, rsp, err = dialTunnel(ctx, &cfg, candidate, transport.useHTTP2)
+			if err != nil {
+				log.Printf("Failed to connect tunnel: %v", err)
+				transport.failed(err)
+				if err := t.backoff(ctx, err); err != nil {
+					return err
+				}
+				continue
 			}
-			if sleepErr := sleepCtx(ctx, cfg.ReconnectDelay); sleepErr != nil {
-				return
+			if rsp.StatusCode != 200 {
+				log.Printf("Tunnel connection failed: %s", rsp.Status)
+				conn.close()
+				if err := t.backoff(ctx, connectStatusError(rsp)); err != nil {
+					return err
+				}
+				continue
 			}
-			continue
 		}
+		transport.connected(conn)
+		ipConn := conn.ipConn
+		useHTTP2 := conn.useHTTP2
 
-		log.Println("Connected to MASQUE server")
+		var details []string
+		if conn.quicConn != nil {
+			details = append(details, describeHandshake(conn.quicConn.ConnectionState()))
+		}
+		if conn.keyExchange != 0 {
+			details = append(details, conn.keyExchange.String())
+		}
+		if len(details) > 0 {
+			log.Printf("Connected to MASQUE server at %s (%s)", conn.endpoint, strings.Join(details, ", "))
+		} else {
+			log.Printf("Connected to MASQUE server at %s", conn.endpoint)
+		}
+		t.emit(TunnelEvent{State: TunnelConnected, Endpoint: conn.endpoint, Transport: conn.transport(), KeyExchange: conn.keyExchange, Addresses: conn.addresses, Routes: conn.routes})
 
+		// over HTTP/3 the connect hook waits for the addresses and routes
+		// of the server, which arrive after the connection
+		var connectHook <-chan time.Time
 		if cfg.OnConnect != "" {
-			env := cloneHookEnv(cfg.HookEnv)
-			env["USQUE_EVENT"] = "connect"
-			env["USQUE_ENDPOINT"] = cfg.Endpoint.String()
-			RunHook(cfg.OnConnect, env)
+			if useHTTP2 {
+				RunHook(cfg.OnConnect, transport.hookEnv("connect", conn))
+			} else {
+				connectHook = time.After(addressAssignTimeout)
+			}
+		}
+		runConnectHook := func() {
+			connectHook = nil
+			RunHook(cfg.OnConnect, transport.hookEnv("connect", conn))
 		}
 
-		errChan := make(chan error, 2)
+		errChan := make(chan error, 3)
 		pumpCtx, cancelPumps := context.WithCancel(ctx)
 		var wg sync.WaitGroup
 		var readMu sync.Mutex
 
+		var echo *echoProber
+		if cfg.Liveness.enabled() {
+			probe := cfg.Liveness.Probe
+			if probe == nil {
+				echo = newEchoProber(&cfg.Liveness, ipConn)
+				echo.source.assigned(conn.addresses)
+				probe = echo.probe
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				monitorLiveness(pumpCtx, &cfg.Liveness, probe, errChan)
+			}()
+		}
+
+		// the server may assign other addresses or advertise other routes
+		// at any time
+		var addressUpdates, routeUpdates chan []netip.Prefix
+		if !useHTTP2 {
+			addressUpdates = make(chan []netip.Prefix)
+			routeUpdates = make(chan []netip.Prefix)
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				watchAssignment(pumpCtx, ipConn.LocalPrefixes, addressUpdates)
+			}()
+			go func() {
+				defer wg.Done()
+				watchAssignment(pumpCtx, advertisedRoutes(ipConn), routeUpdates)
+			}()
+		}
+
 		wg.Add(2)
 
 		go func() {
@@ -357,7 +566,7 @@ func MaintainTunnel(ctx context.Context, cfg MaintainTunnelConfig) {
 			for {
 				packet, err := ipConn.ReadPacketZeroCopy(true)
 				if err != nil {
-					if cfg.UseHTTP2 {
+					if useHTTP2 {
 						errChan <- fmt.Errorf("connection closed while reading from IP connection: %w", err)
 						return
 					}
@@ -368,6 +577,9 @@ func MaintainTunnel(ctx context.Context, cfg MaintainTunnelConfig) {
 					log.Printf("Error reading from IP connection: %v, continuing...", err)
 					continue
 				}
+				if echo != nil && echo.consume(packet) {
+					continue
+				}
 				if err := cfg.Device.WritePacket(packet); err != nil {
 					errChan <- fmt.Errorf("failed to write to TUN device: %w", err)
 					return
@@ -375,19 +587,143 @@ func MaintainTunnel(ctx context.Context, cfg MaintainTunnelConfig) {
 			}
 		}()
 
-		err = <-errChan
-		log.Printf("Tunnel connection lost: %v. Reconnecting...", err)
+		// while on the HTTP/2 fallback, HTTP/3 is probed in the background
+		var probeTimer <-chan time.Time
+		var probeDone chan probeResult
+		if transport.fallingBack() {
+			probeTimer = time.After(cfg.H3ProbeInterval)
+		}
 
+		// suspend and resume is noticed by the wall clock jumping
+		var clockTicker *time.Ticker
+		var clockTick <-chan time.Time
+		clock := newClockWatch(cfg.Liveness.ClockJumpThreshold)
+		if clock != nil {
+			clockTicker = time.NewTicker(clockCheckInterval)
+			clockTick = clockTicker.C
+		}
+
+		// network changes are followed by a migration once they settle
+		var settle <-chan time.Time
+		var migrateDone chan error
+
+		// lost is why the connection is torn down
+		var lost error
+	supervise:
+		for {
+			select {
+			case <-clockTick:
+				if jump := clock.jumped(); jump != 0 {
+					log.Printf("Wall clock jumped by %s, the system was likely suspended. Reconnecting...", jump.Round(time.Second))
+					lost = fmt.Errorf("%w by %s", ErrClockJump, jump.Round(time.Second))
+					break supervise
+				}
+			case err := <-errChan:
+				log.Printf("Tunnel connection lost: %v. Reconnecting...", err)
+				lost = err
+				break supervise
+			case addresses := <-addressUpdates:
+				if slices.Equal(addresses, conn.addresses) {
+					continue
+				}
+				log.Printf("Server assigned addresses %s", formatPrefixes(addresses))
+				conn.addresses = addresses
+				if echo != nil {
+					echo.source.assigned(addresses)
+				}
+				t.emit(TunnelEvent{State: TunnelReassigned, Endpoint: conn.endpoint, Transport: conn.transport(), Addresses: conn.addresses, Routes: conn.routes})
+				if connectHook != nil && conn.routes != nil {
+					runConnectHook()
+				}
+			case routes := <-routeUpdates:
+				if slices.Equal(routes, conn.routes) {
+					continue
+				}
+				log.Printf("Server advertised routes %s", formatPrefixes(routes))
+				conn.routes = routes
+				t.emit(TunnelEvent{State: TunnelReassigned, Endpoint: conn.endpoint, Transport: conn.transport(), Addresses: conn.addresses, Routes: conn.routes})
+				if connectHook != nil && conn.addresses != nil {
+					runConnectHook()
+				}
+			case <-connectHook:
+				runConnectHook()
+			case <-cfg.NetworkChanges:
+				if conn.quicConn != nil {
+					settle = time.After(networkSettleDelay)
+				}
+			case <-settle:
+				if migrateDone != nil {
+					// the network changed again during the migration
+					settle = time.After(networkSettleDelay)
+					continue
+				}
+				settle = nil
+				log.Println("Network changed, migrating connection to a new socket...")
+				migrateDone = make(chan error, 1)
+				go func() { migrateDone <- conn.migrate(pumpCtx) }()
+			case err := <-migrateDone:
+				migrateDone = nil
+				if err != nil {
+					log.Printf("Failed to migrate connection: %v. Reconnecting...", err)
+					lost = fmt.Errorf("failed to migrate connection after network change: %w", err)
+					break supervise
+				}
+				log.Printf("Migrated connection to %s", conn.endpoint)
+				t.migrated()
+			case <-ctx.Done():
+				// neither pump watches ctx while blocked, tear down from here
+				log.Println("Tunnel shutting down")
+				lost = ctx.Err()
+				break supervise
+			case <-probeTimer:
+				probeTimer = nil
+				probeDone = make(chan probeResult, 1)
+				go probeHTTP3(pumpCtx, &cfg, transport.h3Candidate(), probeDone)
+			case res := <-probeDone:
+				probeDone = nil
+				if res.err != nil {
+					log.Printf("HTTP/3 is still unavailable: %v", res.err)
+					transport.probeFailed(res.err)
+					probeTimer = time.After(cfg.H3ProbeInterval)
+					continue
+				}
+				log.Println("HTTP/3 is reachable again. Switching back from HTTP/2...")
+				adopted = res.conn
+				lost = ErrHTTP3Reachable
+				break supervise
+			}
+		}
+		if clockTicker != nil {
+			clockTicker.Stop()
+		}
+		if connectHook != nil {
+			// every disconnect hook follows a connect hook
+			runConnectHook()
+		}
+
+		t.emit(TunnelEvent{State: TunnelDisconnected, Endpoint: conn.endpoint, Transport: conn.transport(), Err: lost})
 		if cfg.OnDisconnect != "" {
-			env := cloneHookEnv(cfg.HookEnv)
-			env["USQUE_EVENT"] = "disconnect"
-			env["USQUE_ENDPOINT"] = cfg.Endpoint.String()
-			RunHook(cfg.OnDisconnect, env)
+			RunHook(cfg.OnDisconnect, transport.hookEnv("disconnect", conn))
 		}
 
 		cancelPumps()
 		_ = ipConn.Close()
 
+		if migrateDone != nil {
+			// the connection must not be closed while migrating
+			<-migrateDone
+		}
+		if probeDone != nil {
+			// a probe that completed before the cancel is as good as a redial
+			if res := <-probeDone; res.err == nil {
+				log.Println("HTTP/3 is reachable again. Switching back from HTTP/2...")
+				adopted = res.conn
+			}
+		}
+		if adopted != nil {
+			transport.useHTTP2 = false
+		}
+
 		done := make(chan struct{})
 		go func() {
 			wg.Wait()
@@ -399,14 +735,131 @@ func MaintainTunnel(ctx context.Context, cfg MaintainTunnelConfig) {
 			log.Printf("Pump shutdown grace of %s expired; a stale TUN reader may still be parked (readMu will serialize next cycle)", pumpShutdownGrace)
 		}
 
-		if tr != nil {
-			_ = tr.Close()
+		conn.close()
+		if adopted != nil {
+			// the new connection is already up, no need to back off
+			continue
 		}
-		if udpConn != nil {
-			_ = udpConn.Close()
+		if err := t.backoff(ctx, lost); err != nil {
+			return err
 		}
-		if sleepErr := sleepCtx(ctx, cfg.ReconnectDelay); sleepErr != nil {
-			return
+	}
+}
+
+// requireEndpointType exits if endpoint is not a T, or nil while not optional.
+func requireEndpointType[T net.Addr](mode string, endpoint net.Addr, optional bool) {
+	if endpoint == nil && optional {
+		return
+	}
+	if _, ok := endpoint.(T); !ok {
+		var want T
+		log.Fatalf("MaintainTunnel: %s requires a %T endpoint, got %T", mode, want, endpoint)
+	}
+}
+
+// tunnelConn is an established CONNECT-IP session and the resources backing it.
+type tunnelConn struct {
+	endpoint  net.Addr
+	candidate *tunnelCandidate
+	useHTTP2  bool
+	udpConn   *net.UDPConn
+	quicConn  *quic.Conn
+	tr        *http3.Transport
+	ipConn    *connectip.Conn
+	// keyExchange is the negotiated TLS key exchange group
+	keyExchange tls.CurveID
+	// addresses and routes are the last ones assigned and advertised by
+	// the server
+	addresses []netip.Prefix
+	routes    []netip.Prefix
+	// retiredConns are the sockets of paths migrated away from. quic-go
+	// tears the connection down when they are closed, so they are kept
+	// open until it is.
+	retiredConns []*net.UDPConn
+	// cancel ends the context the connection was dialed with
+	cancel context.CancelFunc
+}
+
+// transport returns "h3" or "h2".
+func (c *tunnelConn) transport() string {
+	if c.useHTTP2 {
+		return "h2"
+	}
+	return "h3"
+}
+
+// close releases the session and its transport.
+func (c *tunnelConn) close() {
+	_ = c.ipConn.Close()
+	if c.tr != nil {
+		_ = c.tr.Close()
+	}
+	if c.udpConn != nil {
+		_ = c.udpConn.Close()
+	}
+	for _, udpConn := range c.retiredConns {
+		_ = udpConn.Close()
+	}
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
+
+// dialTunnel races the endpoints of candidate with the given transport and
+// returns the first connection established. It must be closed by the caller
+// even if the response status is not 200.
+func dialTunnel(ctx context.Context, cfg *MaintainTunnelConfig, candidate *tunnelCandidate, useHTTP2 bool) (*tunnelConn, *http.Response, error) {
+	quicConfig := internal.DefaultQuicConfig(cfg.KeepalivePeriod, cfg.InitialPacketSize)
+	if cfg.HandshakeTimeout > 0 {
+		quicConfig.HandshakeIdleTimeout = cfg.HandshakeTimeout
+	}
+
+	type dialed struct {
+		conn *tunnelConn
+		rsp  *http.Response
+	}
+	d, _, cancel, err := raceDial(ctx, candidate.endpoints.ordered(), cfg.HappyEyeballsDelay, func(ctx context.Context, endpoint net.Addr) (dialed, error) {
+		udpConn, quicConn, tr, ipConn, rsp, err := connectTunnel(ctx, candidate.tlsConfig, quicConfig, internal.ConnectURI, endpoint, useHTTP2)
+		if err != nil {
+			if ipConn != nil {
+				_ = ipConn.Close()
+			}
+			if tr != nil {
+				_ = tr.Close()
+			}
+			if udpConn != nil {
+				_ = udpConn.Close()
+			}
+			return dialed{}, err
+		}
+		conn := &tunnelConn{endpoint: endpoint, candidate: candidate, useHTTP2: useHTTP2, udpConn: udpConn, quicConn: quicConn, tr: tr, ipConn: ipConn}
+		if rsp.TLS != nil {
+			conn.keyExchange = rsp.TLS.CurveID
+		} else if quicConn != nil {
+			conn.keyExchange = quicConn.ConnectionState().TLS.CurveID
 		}
+		return dialed{conn: conn, rsp: rsp}, nil
+	}, func(d dialed) { d.conn.close() })
+	if err != nil {
+		return nil, nil, err
+	}
+	d.conn.cancel = cancel
+	return d.conn, d.rsp, nil
+}
+
+type probeResult struct {
+	conn *tunnelConn
+	err  error
+}
+
+// probeHTTP3 tries to establish an HTTP/3 session and reports the outcome on
+// done. A successful session is handed over even if ctx is cancelled
+// meanwhile, since the server may already have dropped the previous one.
+func probeHTTP3(ctx context.Context, cfg *MaintainTunnelConfig, candidate *tunnelCandidate, done chan<- probeResult) {
+	conn, rsp, err := dialTunnel(ctx, cfg, candidate, false)
+	if err == nil && rsp.StatusCode != 200 {
+		conn.close()
+		conn, err = nil, fmt.Errorf("unexpected response: %s", rsp.Status)
 	}
+	done <- probeResult{conn: conn, err: err}
 }
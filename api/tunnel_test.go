@@ -0,0 +1,907 @@
+package api_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/api/masquetest"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// remoteIPv4 and remoteIPv6 stand in for internet hosts behind the peer.
+var (
+	remoteIPv4 = netip.MustParseAddr("192.0.2.1")
+	remoteIPv6 = netip.MustParseAddr("2001:db8::1")
+)
+
+const testTimeout = 10 * time.Second
+
+func newPeer(t *testing.T) *masquetest.Peer {
+	t.Helper()
+	peer, err := masquetest.NewPeer()
+	if err != nil {
+		t.Fatalf("failed to start peer: %v", err)
+	}
+	t.Cleanup(peer.Close)
+	return peer
+}
+
+func tunnelConfig(t *testing.T, peer *masquetest.Peer, dev api.TunnelDevice, useHTTP2 bool) api.MaintainTunnelConfig {
+	t.Helper()
+	cfg, err := peer.TunnelConfig(dev, useHTTP2)
+	if err != nil {
+		t.Fatalf("failed to build tunnel config: %v", err)
+	}
+	return cfg
+}
+
+// runTunnel starts MaintainTunnel in the background. The returned channel is
+// closed once it returns; the tunnel is cancelled when the test ends.
+func runTunnel(t *testing.T, cfg api.MaintainTunnelConfig) (context.CancelFunc, <-chan struct{}) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		api.MaintainTunnel(ctx, cfg)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(testTimeout):
+			t.Errorf("MaintainTunnel did not return after cancellation")
+		}
+	})
+	return cancel, done
+}
+
+// awaitTraffic sends probes from the client until one reaches the peer. Probes
+// sent while the tunnel is down are dropped, and the first packet read by a
+// pump of a lost connection is discarded, so a single probe is not enough.
+func awaitTraffic(t *testing.T, peer *masquetest.Peer, dev *masquetest.MemDevice) {
+	t.Helper()
+	deadline := time.After(testTimeout)
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for i := 0; ; i++ {
+		if err := dev.Inject(masquetest.IPPacket(peer.ClientIPv4, remoteIPv4, []byte(fmt.Sprintf("probe-%d", i)))); err != nil {
+			t.Fatalf("failed to inject probe: %v", err)
+		}
+		select {
+		case pkt := <-peer.Device.Packets():
+			if !bytes.HasPrefix(masquetest.Payload(pkt), []byte("probe-")) {
+				t.Fatalf("unexpected packet at peer: %q", masquetest.Payload(pkt))
+			}
+			// drain probes that were already in flight
+			for {
+				select {
+				case <-peer.Device.Packets():
+				case <-time.After(100 * time.Millisecond):
+					return
+				}
+			}
+		case <-ticker.C:
+		case <-deadline:
+			t.Fatalf("no traffic reached the peer within %s", testTimeout)
+		}
+	}
+}
+
+func expectPacket(t *testing.T, dev *masquetest.MemDevice, src, dst netip.Addr, payload string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	pkt, err := dev.Next(ctx)
+	if err != nil {
+		t.Fatalf("expected packet %q: %v", payload, err)
+	}
+	if got := string(masquetest.Payload(pkt)); got != payload {
+		t.Fatalf("got packet with payload %q, want %q", got, payload)
+	}
+	if gotSrc, gotDst := packetAddrs(pkt); gotSrc != src || gotDst != dst {
+		t.Fatalf("got packet %s -> %s, want %s -> %s", gotSrc, gotDst, src, dst)
+	}
+}
+
+func packetAddrs(pkt []byte) (netip.Addr, netip.Addr) {
+	if pkt[0]>>4 == 4 {
+		return netip.AddrFrom4([4]byte(pkt[12:16])), netip.AddrFrom4([4]byte(pkt[16:20]))
+	}
+	return netip.AddrFrom16([16]byte(pkt[8:24])), netip.AddrFrom16([16]byte(pkt[24:40]))
+}
+
+// hookRecorder returns a hook executable that appends its event, endpoint,
+// transport and USQUE_TEST_TAG to a file, and a function returning the recorded lines.
+func hookRecorder(t *testing.T) (string, func() []string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("hook recorder requires a POSIX shell")
+	}
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "events")
+	hookPath := filepath.Join(dir, "hook.sh")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$USQUE_EVENT $USQUE_ENDPOINT $USQUE_TRANSPORT $USQUE_TEST_TAG\" >> %q\n", logPath)
+	if err := os.WriteFile(hookPath, []byte(script), 0o755); err != nil {
+		t.Fatalf("failed to write hook: %v", err)
+	}
+	return hookPath, func() []string {
+		data, err := os.ReadFile(logPath)
+		if err != nil || len(data) == 0 {
+			return nil
+		}
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+}
+
+// waitForEvents waits until the recorder has seen n events of the given kind.
+func waitForEvents(t *testing.T, events func() []string, event string, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		var matched []string
+		for _, line := range events() {
+			if strings.HasPrefix(line, event+" ") {
+				matched = append(matched, line)
+			}
+		}
+		if len(matched) >= n {
+			return matched
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("saw %d %q events, want %d (all events: %v)", len(matched), event, n, events())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func forEachTransport(t *testing.T, fn func(t *testing.T, useHTTP2 bool)) {
+	t.Run("HTTP3", func(t *testing.T) { fn(t, false) })
+	t.Run("HTTP2", func(t *testing.T) { fn(t, true) })
+}
+
+func TestMaintainTunnelForwardsPackets(t *testing.T) {
+	forEachTransport(t, func(t *testing.T, useHTTP2 bool) {
+		peer := newPeer(t)
+		dev := masquetest.NewMemDevice()
+		runTunnel(t, tunnelConfig(t, peer, dev, useHTTP2))
+		awaitTraffic(t, peer, dev)
+		if pq := peer.RequestHeader().Get("pq-enabled"); pq != "false" {
+			t.Errorf("requested with pq-enabled %q, want false", pq)
+		}
+
+		for _, tc := range []struct{ local, remote netip.Addr }{
+			{peer.ClientIPv4, remoteIPv4},
+			{peer.ClientIPv6, remoteIPv6},
+		} {
+			if err := dev.Inject(masquetest.IPPacket(tc.local, tc.remote, []byte("request"))); err != nil {
+				t.Fatal(err)
+			}
+			expectPacket(t, peer.Device, tc.local, tc.remote, "request")
+
+			if err := peer.Device.Inject(masquetest.IPPacket(tc.remote, tc.local, []byte("response"))); err != nil {
+				t.Fatal(err)
+			}
+			expectPacket(t, dev, tc.remote, tc.local, "response")
+		}
+	})
+}
+
+func TestMaintainTunnelReconnects(t *testing.T) {
+	forEachTransport(t, func(t *testing.T, useHTTP2 bool) {
+		peer := newPeer(t)
+		dev := masquetest.NewMemDevice()
+		hook, events := hookRecorder(t)
+
+		cfg := tunnelConfig(t, peer, dev, useHTTP2)
+		cfg.OnConnect = hook
+		cfg.OnDisconnect = hook
+		cfg.HookEnv = map[string]string{"USQUE_TEST_TAG": "tag"}
+		runTunnel(t, cfg)
+
+		awaitTraffic(t, peer, dev)
+		transport := "h3"
+		if useHTTP2 {
+			transport = "h2"
+		}
+		connects := waitForEvents(t, events, "connect", 1)
+		wantLine := fmt.Sprintf("connect %s %s tag", cfg.Endpoint, transport)
+		if connects[0] != wantLine {
+			t.Fatalf("connect hook saw %q, want %q", connects[0], wantLine)
+		}
+
+		peer.Stop()
+		disconnects := waitForEvents(t, events, "disconnect", 1)
+		wantLine = fmt.Sprintf("disconnect %s %s tag", cfg.Endpoint, transport)
+		if disconnects[0] != wantLine {
+			t.Fatalf("disconnect hook saw %q, want %q", disconnects[0], wantLine)
+		}
+
+		// let a few connection attempts fail while the peer is down
+		time.Sleep(200 * time.Millisecond)
+		if err := peer.Start(); err != nil {
+			t.Fatal(err)
+		}
+		awaitTraffic(t, peer, dev)
+		waitForEvents(t, events, "connect", 2)
+
+		// The pumps of the lost connection must be gone by now: every packet
+		// has to be forwarded exactly once, in order.
+		for i := 0; i < 20; i++ {
+			if err := dev.Inject(masquetest.IPPacket(peer.ClientIPv4, remoteIPv4, []byte(fmt.Sprintf("seq-%d", i)))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < 20; i++ {
+			expectPacket(t, peer.Device, peer.ClientIPv4, remoteIPv4, fmt.Sprintf("seq-%d", i))
+		}
+	})
+}
+
+func TestMaintainTunnelHTTP2Fallback(t *testing.T) {
+	peer := newPeer(t)
+	peer.BlockHTTP3(true)
+	dev := masquetest.NewMemDevice()
+	hook, events := hookRecorder(t)
+
+	cfg := tunnelConfig(t, peer, dev, false)
+	cfg.H2FallbackEndpoint = peer.H2Endpoint()
+	cfg.H2FallbackAfter = 2
+	cfg.H3ProbeInterval = 200 * time.Millisecond
+	cfg.HandshakeTimeout = 200 * time.Millisecond
+	cfg.OnConnect = hook
+	cfg.OnDisconnect = hook
+	runTunnel(t, cfg)
+
+	awaitTraffic(t, peer, dev)
+	connects := waitForEvents(t, events, "connect", 1)
+	if want := fmt.Sprintf("connect %s h2", peer.H2Endpoint()); connects[0] != want {
+		t.Fatalf("connect hook saw %q, want %q", connects[0], want)
+	}
+
+	// failed probes must not disturb the HTTP/2 tunnel
+	time.Sleep(3 * cfg.H3ProbeInterval)
+	if got := events(); len(got) != 1 {
+		t.Fatalf("tunnel reconnected while HTTP/3 was blocked: %v", got)
+	}
+
+	peer.BlockHTTP3(false)
+	connects = waitForEvents(t, events, "connect", 2)
+	if want := fmt.Sprintf("connect %s h3", peer.Endpoint()); connects[1] != want {
+		t.Fatalf("connect hook saw %q, want %q", connects[1], want)
+	}
+	awaitTraffic(t, peer, dev)
+}
+
+// blackhole returns an endpoint of the given transport that never answers.
+func blackhole(t *testing.T, useHTTP2 bool) net.Addr {
+	t.Helper()
+	if useHTTP2 {
+		// the kernel completes the TCP handshake, but TLS never does
+		l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = l.Close() })
+		return l.Addr()
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn.LocalAddr()
+}
+
+// rejectingEndpoint returns an endpoint of the given transport that fails
+// every handshake with alert, and a client TLS config pinning its key.
+func rejectingEndpoint(t *testing.T, useHTTP2 bool, alert tls.AlertError) (net.Addr, *tls.Config) {
+	t.Helper()
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err := api.PrepareTlsConfig(clientKey, &serverKey.PublicKey, nil, internal.ConnectSNI, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if useHTTP2 {
+		// crypto/tls servers always send bad_certificate, so send the alert
+		// record in reply to the ClientHello by hand
+		l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = l.Close() })
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				_, _ = conn.Read(make([]byte, 4096))
+				_, _ = conn.Write([]byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, byte(alert)})
+				_ = conn.Close()
+			}
+		}()
+		return l.Addr(), clientConfig
+	}
+
+	// over QUIC the alert returned by VerifyPeerCertificate is sent
+	l, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		GetCertificate: api.NewCertMinter(serverKey, 0, -1).GetCertificate,
+		NextProtos:     []string{http3.NextProtoH3},
+		ClientAuth:     tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func([][]byte, [][]*x509.Certificate) error {
+			return alert
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	return l.Addr(), clientConfig
+}
+
+func TestMaintainTunnelRacesEndpoints(t *testing.T) {
+	forEachTransport(t, func(t *testing.T, useHTTP2 bool) {
+		peer := newPeer(t)
+		dev := masquetest.NewMemDevice()
+		hook, events := hookRecorder(t)
+
+		cfg := tunnelConfig(t, peer, dev, useHTTP2)
+		cfg.AltEndpoint = cfg.Endpoint
+		cfg.Endpoint = blackhole(t, useHTTP2)
+		cfg.OnConnect = hook
+		runTunnel(t, cfg)
+
+		start := time.Now()
+		awaitTraffic(t, peer, dev)
+		connects := waitForEvents(t, events, "connect", 1)
+		if !strings.HasPrefix(connects[0], fmt.Sprintf("connect %s ", cfg.AltEndpoint)) {
+			t.Fatalf("connect hook saw %q, want a connection to %s", connects[0], cfg.AltEndpoint)
+		}
+		// the QUIC handshake to the blackhole would only time out after 5s
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Fatalf("took %v to connect, the alternative endpoint was not raced", elapsed)
+		}
+	})
+}
+
+func TestMaintainTunnelFailsOver(t *testing.T) {
+	peer := newPeer(t)
+	dev := masquetest.NewMemDevice()
+
+	cfg := tunnelConfig(t, peer, dev, false)
+	cfg.FailoverEndpoints = []api.TunnelEndpoint{{Endpoint: cfg.Endpoint}}
+	cfg.Endpoint = blackhole(t, false)
+	cfg.HandshakeTimeout = 200 * time.Millisecond
+	up := make(chan net.Addr, 10)
+	cfg.OnEndpointUp = func(endpoint net.Addr) { up <- endpoint }
+	cancel, done := runTunnel(t, cfg)
+
+	awaitTraffic(t, peer, dev)
+	select {
+	case endpoint := <-up:
+		if endpoint.String() != peer.Endpoint().String() {
+			t.Fatalf("connected to %s, want %s", endpoint, peer.Endpoint())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnEndpointUp was not called")
+	}
+	cancel()
+	<-done
+
+	// starting with the last working endpoint skips the dead one
+	cfg.StartEndpoint = peer.Endpoint().String()
+	cfg.HandshakeTimeout = 5 * time.Second
+	runTunnel(t, cfg)
+	start := time.Now()
+	awaitTraffic(t, peer, dev)
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("took %v to connect, StartEndpoint was not tried first", elapsed)
+	}
+}
+
+func TestMaintainTunnelHopsPorts(t *testing.T) {
+	peer := newPeer(t)
+	dev := masquetest.NewMemDevice()
+
+	// the filtered port and the peer share the loopback address
+	cfg := tunnelConfig(t, peer, dev, false)
+	cfg.Endpoint = blackhole(t, false)
+	cfg.Ports = []int{peer.Endpoint().Port}
+	cfg.HandshakeTimeout = 200 * time.Millisecond
+	up := make(chan net.Addr, 10)
+	cfg.OnEndpointUp = func(endpoint net.Addr) { up <- endpoint }
+	runTunnel(t, cfg)
+
+	awaitTraffic(t, peer, dev)
+	select {
+	case endpoint := <-up:
+		if endpoint.String() != peer.Endpoint().String() {
+			t.Fatalf("connected to %s, want %s", endpoint, peer.Endpoint())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnEndpointUp was not called")
+	}
+
+	// reconnects stay on the port that worked
+	peer.Stop()
+	if err := peer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	awaitTraffic(t, peer, dev)
+	select {
+	case endpoint := <-up:
+		if endpoint.String() != peer.Endpoint().String() {
+			t.Fatalf("reconnected to %s, want %s", endpoint, peer.Endpoint())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnEndpointUp was not called after reconnecting")
+	}
+}
+
+// waitForState returns the next event of state, skipping others.
+func waitForState(t *testing.T, events <-chan api.TunnelEvent, state api.TunnelState) api.TunnelEvent {
+	t.Helper()
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case ev := <-events:
+			if ev.State == state {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("no %s event within %v", state, testTimeout)
+		}
+	}
+}
+
+func TestTunnelEvents(t *testing.T) {
+	forEachTransport(t, func(t *testing.T, useHTTP2 bool) {
+		peer := newPeer(t)
+		dev := masquetest.NewMemDevice()
+		transport := "h3"
+		if useHTTP2 {
+			transport = "h2"
+		}
+
+		events := make(chan api.TunnelEvent, 1000)
+		cfg := tunnelConfig(t, peer, dev, useHTTP2)
+		cfg.OnEvent = func(ev api.TunnelEvent) { events <- ev }
+		tunnel := api.NewTunnel(cfg)
+		if got := tunnel.Status().State; got != api.TunnelStopped {
+			t.Fatalf("new tunnel is %s, want stopped", got)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			tunnel.Run(ctx)
+		}()
+		t.Cleanup(func() {
+			cancel()
+			<-done
+		})
+
+		connecting := waitForState(t, events, api.TunnelConnecting)
+		if connecting.Endpoint != cfg.Endpoint || connecting.Transport != transport {
+			t.Errorf("connecting to %v over %s, want %v over %s", connecting.Endpoint, connecting.Transport, cfg.Endpoint, transport)
+		}
+		waitForState(t, events, api.TunnelConnected)
+		status := tunnel.Status()
+		if status.State != api.TunnelConnected || status.Endpoint.String() != cfg.Endpoint.String() || status.Transport != transport || status.Connects != 1 {
+			t.Errorf("unexpected status after connecting: %+v", status)
+		}
+
+		peer.Stop()
+		if lost := waitForState(t, events, api.TunnelDisconnected); lost.Err == nil {
+			t.Errorf("disconnected event without reason")
+		}
+		waitForState(t, events, api.TunnelBackoff)
+		if err := peer.Start(); err != nil {
+			t.Fatal(err)
+		}
+		waitForState(t, events, api.TunnelConnected)
+		if status := tunnel.Status(); status.Connects != 2 || status.LastError == nil {
+			t.Errorf("unexpected status after reconnecting: %+v", status)
+		}
+
+		cancel()
+		<-done
+		if stopped := waitForState(t, events, api.TunnelStopped); !errors.Is(stopped.Err, context.Canceled) {
+			t.Errorf("stopped with %v, want context.Canceled", stopped.Err)
+		}
+		if got := tunnel.Status().State; got != api.TunnelStopped {
+			t.Errorf("returned tunnel is %s, want stopped", got)
+		}
+	})
+}
+
+func TestTunnelGivesUp(t *testing.T) {
+	peer := newPeer(t)
+
+	t.Run("PermanentError", func(t *testing.T) {
+		// the peer rejects the certificate of a key it does not know with a
+		// bad_certificate alert, over QUIC and over TLS on TCP alike
+		forEachTransport(t, func(t *testing.T, useHTTP2 bool) {
+			cfg := tunnelConfig(t, peer, masquetest.NewMemDevice(), useHTTP2)
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.TLSConfig = cfg.TLSConfig.Clone()
+			api.NewCertMinter(key, 0, -1).Attach(cfg.TLSConfig)
+			cfg.StopOnPermanentError = true
+
+			err = runUntilGivingUp(t, cfg)
+			if !errors.As(err, new(*api.PermanentError)) {
+				t.Fatalf("Run returned %v, want a permanent error", err)
+			}
+		})
+	})
+
+	t.Run("UnknownCA", func(t *testing.T) {
+		// endpoints other than api.Server may reject the key with other alerts
+		forEachTransport(t, func(t *testing.T, useHTTP2 bool) {
+			cfg := tunnelConfig(t, peer, masquetest.NewMemDevice(), useHTTP2)
+			cfg.Endpoint, cfg.TLSConfig = rejectingEndpoint(t, useHTTP2, tls.AlertError(48))
+			cfg.StopOnPermanentError = true
+
+			err := runUntilGivingUp(t, cfg)
+			if !errors.As(err, new(*api.PermanentError)) {
+				t.Fatalf("Run returned %v, want a permanent error", err)
+			}
+		})
+	})
+
+	t.Run("FailureBudget", func(t *testing.T) {
+		cfg := tunnelConfig(t, peer, masquetest.NewMemDevice(), false)
+		cfg.Endpoint = blackhole(t, false)
+		cfg.HandshakeTimeout = 100 * time.Millisecond
+		cfg.FailureBudget = 3
+
+		err := runUntilGivingUp(t, cfg)
+		if !errors.Is(err, api.ErrFailureBudgetExhausted) {
+			t.Fatalf("Run returned %v, want ErrFailureBudgetExhausted", err)
+		}
+	})
+}
+
+// runUntilGivingUp runs a tunnel expected to give up on its own and checks
+// the events it reports on the way.
+func runUntilGivingUp(t *testing.T, cfg api.MaintainTunnelConfig) error {
+	t.Helper()
+	events := make(chan api.TunnelEvent, 1000)
+	cfg.OnEvent = func(ev api.TunnelEvent) { events <- ev }
+
+	done := make(chan error, 1)
+	go func() { done <- api.NewTunnel(cfg).Run(context.Background()) }()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("tunnel did not give up")
+	}
+
+	failed := waitForState(t, events, api.TunnelFailed)
+	stopped := waitForState(t, events, api.TunnelStopped)
+	if failed.Err != err || stopped.Err != err {
+		t.Errorf("events report %v and %v, Run returned %v", failed.Err, stopped.Err, err)
+	}
+	return err
+}
+
+func TestMaintainTunnelIdleWakeUp(t *testing.T) {
+	forEachTransport(t, func(t *testing.T, useHTTP2 bool) {
+		peer := newPeer(t)
+		dev := masquetest.NewMemDevice()
+		hook, events := hookRecorder(t)
+
+		cfg := tunnelConfig(t, peer, dev, useHTTP2)
+		cfg.AlwaysReconnect = false
+		cfg.OnConnect = hook
+		cfg.OnDisconnect = hook
+		runTunnel(t, cfg)
+
+		time.Sleep(300 * time.Millisecond)
+		if got := events(); len(got) != 0 {
+			t.Fatalf("tunnel connected without outbound activity: %v", got)
+		}
+
+		awaitTraffic(t, peer, dev)
+		waitForEvents(t, events, "connect", 1)
+
+		// after losing the connection the tunnel goes idle again
+		peer.Stop()
+		waitForEvents(t, events, "disconnect", 1)
+		if err := peer.Start(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(300 * time.Millisecond)
+		if got := waitForEvents(t, events, "connect", 1); len(got) != 1 {
+			t.Fatalf("tunnel reconnected without outbound activity: %v", events())
+		}
+
+		awaitTraffic(t, peer, dev)
+		waitForEvents(t, events, "connect", 2)
+	})
+}
+
+func TestMaintainTunnelReturnsOnCancel(t *testing.T) {
+	forEachTransport(t, func(t *testing.T, useHTTP2 bool) {
+		peer := newPeer(t)
+		dev := masquetest.NewMemDevice()
+		cancel, done := runTunnel(t, tunnelConfig(t, peer, dev, useHTTP2))
+		awaitTraffic(t, peer, dev)
+
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(testTimeout):
+			t.Fatal("MaintainTunnel did not return after cancellation")
+		}
+
+		// nothing may be forwarded once MaintainTunnel has returned
+		if err := dev.Inject(masquetest.IPPacket(peer.ClientIPv4, remoteIPv4, []byte("late"))); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case pkt := <-peer.Device.Packets():
+			t.Fatalf("packet %q forwarded after shutdown", masquetest.Payload(pkt))
+		case <-time.After(300 * time.Millisecond):
+		}
+	})
+}
+
+func TestTunnelLiveness(t *testing.T) {
+	forEachTransport(t, func(t *testing.T, useHTTP2 bool) {
+		peer := newPeer(t)
+		dev := masquetest.NewMemDevice()
+
+		// the peer answers echo requests to remoteIPv4 while answering is
+		// set, like a host behind it reachable until datagrams get dropped
+		var answering atomic.Bool
+		answering.Store(true)
+		go func() {
+			for pkt := range peer.Device.Packets() {
+				if answering.Load() {
+					if reply := echoReply(pkt); reply != nil {
+						_ = peer.Device.Inject(reply)
+					}
+				}
+			}
+		}()
+
+		events := make(chan api.TunnelEvent, 1000)
+		cfg := tunnelConfig(t, peer, dev, useHTTP2)
+		cfg.Liveness = api.LivenessConfig{
+			Target:    remoteIPv4,
+			Source:    peer.ClientIPv4,
+			Interval:  100 * time.Millisecond,
+			MaxMissed: 2,
+		}
+		cfg.OnEvent = func(ev api.TunnelEvent) { events <- ev }
+		runTunnel(t, cfg)
+
+		waitForState(t, events, api.TunnelConnected)
+		time.Sleep(5 * cfg.Liveness.Interval)
+		// the first assignment follows the connection
+		for len(events) > 0 {
+			if ev := <-events; ev.State != api.TunnelConnected && ev.State != api.TunnelReassigned {
+				t.Fatalf("answered probes caused a %s event: %v", ev.State, ev.Err)
+			}
+		}
+
+		answering.Store(false)
+		if lost := waitForState(t, events, api.TunnelDisconnected); !errors.Is(lost.Err, api.ErrLivenessTimeout) {
+			t.Fatalf("disconnected with %v, want ErrLivenessTimeout", lost.Err)
+		}
+		answering.Store(true)
+		waitForState(t, events, api.TunnelConnected)
+
+		// replies are consumed by the prober
+		select {
+		case pkt := <-dev.Packets():
+			t.Errorf("echo reply of %d bytes was written to the device", len(pkt))
+		default:
+		}
+	})
+}
+
+// echoReply turns an IPv4 ICMP echo request into its reply, or returns nil.
+func echoReply(pkt []byte) []byte {
+	if len(pkt) < 28 || pkt[0] != 0x45 || pkt[9] != 1 || pkt[20] != 8 {
+		return nil
+	}
+	reply := append([]byte(nil), pkt...)
+	copy(reply[12:16], pkt[16:20])
+	copy(reply[16:20], pkt[12:16])
+	icmp := reply[20:]
+	icmp[0] = 0
+	icmp[2], icmp[3] = 0, 0
+	var sum uint32
+	for i := 0; i+1 < len(icmp); i += 2 {
+		sum += uint32(icmp[i])<<8 | uint32(icmp[i+1])
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	icmp[2], icmp[3] = byte(^sum>>8), byte(^sum)
+	return reply
+}
+
+func TestTunnelMigratesOnNetworkChange(t *testing.T) {
+	peer := newPeer(t)
+	dev := masquetest.NewMemDevice()
+
+	events := make(chan api.TunnelEvent, 1000)
+	changes := make(chan struct{}, 1)
+	cfg := tunnelConfig(t, peer, dev, false)
+	cfg.NetworkChanges = changes
+	cfg.OnEvent = func(ev api.TunnelEvent) { events <- ev }
+	tunnel := api.NewTunnel(cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tunnel.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	waitForState(t, events, api.TunnelConnected)
+	awaitTraffic(t, peer, dev)
+
+	changes <- struct{}{}
+	deadline := time.Now().Add(testTimeout)
+	for tunnel.Status().Migrations == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("connection was not migrated: %+v", tunnel.Status())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	awaitTraffic(t, peer, dev)
+
+	for len(events) > 0 {
+		if ev := <-events; ev.State != api.TunnelConnected && ev.State != api.TunnelReassigned {
+			t.Fatalf("migration caused a %s event: %v", ev.State, ev.Err)
+		}
+	}
+	if status := tunnel.Status(); status.Connects != 1 {
+		t.Errorf("migration reconnected: %+v", status)
+	}
+}
+
+func TestTunnelResumesSessions(t *testing.T) {
+	peer := newPeer(t)
+	cfg := tunnelConfig(t, peer, masquetest.NewMemDevice(), false)
+
+	// both tunnels share cfg.TLSConfig and with it its session cache
+	var tunnel *api.Tunnel
+	for range 2 {
+		events := make(chan api.TunnelEvent, 1000)
+		cfg.OnEvent = func(ev api.TunnelEvent) { events <- ev }
+		tunnel = api.NewTunnel(cfg)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			tunnel.Run(ctx)
+		}()
+		waitForState(t, events, api.TunnelConnected)
+		cancel()
+		<-done
+	}
+
+	// handshakes are counted in the background
+	deadline := time.Now().Add(testTimeout)
+	for got := tunnel.Status().Handshakes; got.Full != 1 || got.Resumed != 1; got = tunnel.Status().Handshakes {
+		if time.Now().After(deadline) {
+			t.Fatalf("handshakes %+v, want one full and one resumed", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTunnelPostQuantum(t *testing.T) {
+	forEachTransport(t, func(t *testing.T, useHTTP2 bool) {
+		peer := newPeer(t)
+		cfg := tunnelConfig(t, peer, masquetest.NewMemDevice(), useHTTP2)
+		cfg.TLSConfig = cfg.TLSConfig.Clone()
+		api.EnablePostQuantum(cfg.TLSConfig)
+
+		events := make(chan api.TunnelEvent, 1000)
+		cfg.OnEvent = func(ev api.TunnelEvent) { events <- ev }
+		runTunnel(t, cfg)
+
+		if connected := waitForState(t, events, api.TunnelConnected); connected.KeyExchange != tls.X25519MLKEM768 {
+			t.Errorf("negotiated %v, want %v", connected.KeyExchange, tls.X25519MLKEM768)
+		}
+		if pq := peer.RequestHeader().Get("pq-enabled"); pq != "true" {
+			t.Errorf("requested with pq-enabled %q, want true", pq)
+		}
+	})
+}
+
+func TestTunnelAssignment(t *testing.T) {
+	peer := newPeer(t)
+	cfg := tunnelConfig(t, peer, masquetest.NewMemDevice(), false)
+	events := make(chan api.TunnelEvent, 1000)
+	cfg.OnEvent = func(ev api.TunnelEvent) { events <- ev }
+	var hookLog string
+	if runtime.GOOS != "windows" {
+		dir := t.TempDir()
+		hookLog = filepath.Join(dir, "connect")
+		cfg.OnConnect = filepath.Join(dir, "hook.sh")
+		script := fmt.Sprintf("#!/bin/sh\necho \"$USQUE_IPV4 $USQUE_ROUTES\" > %q\n", hookLog)
+		if err := os.WriteFile(cfg.OnConnect, []byte(script), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tunnel := api.NewTunnel(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = tunnel.Run(ctx) }()
+
+	// the capsules arrive after the connection, packets flow meanwhile
+	waitForState(t, events, api.TunnelConnected)
+	wantAddresses := []netip.Prefix{netip.PrefixFrom(peer.ClientIPv4, 32), netip.PrefixFrom(peer.ClientIPv6, 128)}
+	wantRoutes := []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+	for {
+		ev := waitForState(t, events, api.TunnelReassigned)
+		if slices.Equal(ev.Addresses, wantAddresses) && slices.Equal(ev.Routes, wantRoutes) {
+			break
+		}
+	}
+	if status := tunnel.Status(); !slices.Equal(status.Addresses, wantAddresses) || !slices.Equal(status.Routes, wantRoutes) {
+		t.Errorf("status has addresses %v and routes %v", status.Addresses, status.Routes)
+	}
+
+	// the connect hook waits for them
+	if hookLog == "" {
+		return
+	}
+	want := fmt.Sprintf("%s 0.0.0.0/0 ::/0\n", peer.ClientIPv4)
+	deadline := time.Now().Add(testTimeout)
+	for {
+		got, _ := os.ReadFile(hookLog)
+		if string(got) == want {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connect hook got %q, want %q", got, want)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,263 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrHTTP3Reachable is the reason of a TunnelDisconnected event when the
+// HTTP/2 fallback connection is replaced by a working HTTP/3 one.
+var ErrHTTP3Reachable = errors.New("HTTP/3 is reachable again")
+
+// TunnelState is the state of a Tunnel.
+type TunnelState int
+
+const (
+	// TunnelStopped means Run was not called yet or has returned.
+	TunnelStopped TunnelState = iota
+	// TunnelIdle means the tunnel waits for outbound activity before
+	// connecting, see MaintainTunnelConfig.AlwaysReconnect.
+	TunnelIdle
+	// TunnelConnecting means a connection attempt is in progress.
+	TunnelConnecting
+	// TunnelConnected means packets are being forwarded.
+	TunnelConnected
+	// TunnelDisconnected means the connection was just lost or closed.
+	TunnelDisconnected
+	// TunnelBackoff means the tunnel waits before the next attempt.
+	TunnelBackoff
+	// TunnelFailed means the tunnel gave up, see
+	// MaintainTunnelConfig.FailureBudget and StopOnPermanentError. It is
+	// followed by TunnelStopped.
+	TunnelFailed
+	// TunnelReassigned means the server assigned other addresses or
+	// advertised other routes while connected, including the first ones
+	// after TunnelConnected. It is only reported as an event, the tunnel
+	// stays TunnelConnected.
+	TunnelReassigned
+)
+
+// String returns the lower-case name of the state.
+func (s TunnelState) String() string {
+	switch s {
+	case TunnelStopped:
+		return "stopped"
+	case TunnelIdle:
+		return "idle"
+	case TunnelConnecting:
+		return "connecting"
+	case TunnelConnected:
+		return "connected"
+	case TunnelDisconnected:
+		return "disconnected"
+	case TunnelBackoff:
+		return "backoff"
+	case TunnelFailed:
+		return "failed"
+	case TunnelReassigned:
+		return "reassigned"
+	}
+	return "unknown"
+}
+
+// TunnelEvent reports a state change of a Tunnel.
+type TunnelEvent struct {
+	Time  time.Time
+	State TunnelState
+	// Endpoint is the endpoint connected to, lost, or, while connecting,
+	// tried first. Nil for the other states.
+	Endpoint net.Addr
+	// Transport is "h3" or "h2" when Endpoint is set.
+	Transport string
+	// Err is why the connection was lost for TunnelDisconnected, why the
+	// last attempt failed for TunnelBackoff, why the tunnel gave up for
+	// TunnelFailed, and what Run returns for TunnelStopped. Errors retrying
+	// won't fix are a *PermanentError.
+	Err error
+	// Delay is how long TunnelBackoff waits.
+	Delay time.Duration
+	// KeyExchange is the TLS key exchange group negotiated for
+	// TunnelConnected, e.g. tls.X25519MLKEM768.
+	KeyExchange tls.CurveID
+	// Addresses and Routes are the tunnel addresses the server assigned and
+	// the routes it advertised with CONNECT-IP capsules, for TunnelConnected
+	// and TunnelReassigned. They are nil if the server sent none yet: the
+	// capsules usually arrive after TunnelConnected, followed by a
+	// TunnelReassigned event, and never over HTTP/2.
+	Addresses []netip.Prefix
+	Routes    []netip.Prefix
+}
+
+// TunnelStatus is a snapshot of a Tunnel.
+type TunnelStatus struct {
+	State TunnelState
+	// Since is when State was entered.
+	Since time.Time
+	// Endpoint and Transport are those of the current or last connection
+	// or connection attempt.
+	Endpoint  net.Addr
+	Transport string
+	// KeyExchange is the TLS key exchange group of the last connection.
+	KeyExchange tls.CurveID
+	// Addresses and Routes are those assigned and advertised to the last
+	// connection.
+	Addresses []netip.Prefix
+	Routes    []netip.Prefix
+	// LastError is the last reason of a failed attempt or lost connection.
+	LastError error
+	// Connects counts the established connections.
+	Connects int
+	// Failures counts the failed attempts since the last connection.
+	Failures int
+	// Migrations counts the connections moved to a new path after network
+	// changes, see MaintainTunnelConfig.NetworkChanges.
+	Migrations int
+	// Handshakes counts the HTTP/3 handshakes with all endpoints whose
+	// TLSConfig has a SessionCache, as those of PrepareTlsConfig do.
+	Handshakes HandshakeStats
+}
+
+// Tunnel is a tunnel maintained like MaintainTunnel, whose state can be
+// observed through MaintainTunnelConfig.OnEvent and Status.
+type Tunnel struct {
+	cfg MaintainTunnelConfig
+
+	mu     sync.Mutex
+	status TunnelStatus
+}
+
+// Status returns a snapshot of the tunnel's state.
+func (t *Tunnel) Status() TunnelStatus {
+	t.mu.Lock()
+	status := t.status
+	t.mu.Unlock()
+
+	for _, cache := range t.sessionCaches() {
+		status.Handshakes = status.Handshakes.add(cache.Stats())
+	}
+	return status
+}
+
+// sessionCaches returns the distinct SessionCaches of the TLS
+// configurations of t.
+func (t *Tunnel) sessionCaches() []*SessionCache {
+	var caches []*SessionCache
+	addCache := func(tlsConfig *tls.Config) {
+		if tlsConfig == nil {
+			return
+		}
+		if cache := sessionCacheOf(tlsConfig); cache != nil && !slices.Contains(caches, cache) {
+			caches = append(caches, cache)
+		}
+	}
+	addCache(t.cfg.TLSConfig)
+	for _, e := range t.cfg.FailoverEndpoints {
+		addCache(e.TLSConfig)
+	}
+	return caches
+}
+
+// rekeyedRecently reports whether a key rotation replaced the client key
+// of t within keyRotationGrace.
+func (t *Tunnel) rekeyedRecently() bool {
+	for _, cache := range t.sessionCaches() {
+		if rekeyed := cache.rekeyedAt(); !rekeyed.IsZero() && time.Since(rekeyed) < keyRotationGrace {
+			return true
+		}
+	}
+	return false
+}
+
+// emit updates the status with ev and passes it to OnEvent.
+func (t *Tunnel) emit(ev TunnelEvent) {
+	ev.Time = time.Now()
+
+	t.mu.Lock()
+	if ev.State != TunnelReassigned {
+		t.status.State = ev.State
+		t.status.Since = ev.Time
+	}
+	if ev.Endpoint != nil {
+		t.status.Endpoint = ev.Endpoint
+		t.status.Transport = ev.Transport
+	}
+	switch ev.State {
+	case TunnelConnected:
+		t.status.KeyExchange = ev.KeyExchange
+		t.status.Addresses = ev.Addresses
+		t.status.Routes = ev.Routes
+		t.status.Connects++
+		t.status.Failures = 0
+	case TunnelReassigned:
+		t.status.Addresses = ev.Addresses
+		t.status.Routes = ev.Routes
+	case TunnelDisconnected, TunnelBackoff, TunnelFailed:
+		if ev.Err != nil {
+			t.status.LastError = ev.Err
+		}
+	}
+	t.mu.Unlock()
+
+	if t.cfg.OnEvent != nil {
+		t.cfg.OnEvent(ev)
+	}
+}
+
+// migrated counts a successful connection migration.
+func (t *Tunnel) migrated() {
+	t.mu.Lock()
+	t.status.Migrations++
+	t.mu.Unlock()
+}
+
+// backoff waits after a failed attempt or lost connection: ReconnectDelay
+// doubled for every further consecutive failure, or MaxReconnectDelay after
+// a permanent error. It returns the error to stop with instead if ctx was
+// cancelled or the tunnel gives up.
+func (t *Tunnel) backoff(ctx context.Context, reason error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	reason = classifyTunnelError(reason, t.rekeyedRecently())
+	permanent := errors.As(reason, new(*PermanentError))
+
+	t.mu.Lock()
+	lost := t.status.State == TunnelDisconnected
+	if !lost {
+		t.status.Failures++
+	}
+	failures := t.status.Failures
+	t.mu.Unlock()
+
+	var giveUp error
+	switch {
+	case permanent && t.cfg.StopOnPermanentError:
+		giveUp = reason
+	case !lost && t.cfg.FailureBudget > 0 && failures >= t.cfg.FailureBudget:
+		giveUp = fmt.Errorf("%w after %d attempts: %w", ErrFailureBudgetExhausted, failures, reason)
+	}
+	if giveUp != nil {
+		log.Printf("Giving up: %v", giveUp)
+		t.emit(TunnelEvent{State: TunnelFailed, Err: giveUp})
+		return giveUp
+	}
+
+	var delay time.Duration
+	switch {
+	case permanent:
+		delay = t.cfg.MaxReconnectDelay
+		log.Printf("Error is permanent, retrying in %s", delay)
+	case t.cfg.ReconnectDelay > 0:
+		delay = jitteredBackoff(t.cfg.ReconnectDelay, t.cfg.MaxReconnectDelay, max(failures-1, 0))
+	}
+	t.emit(TunnelEvent{State: TunnelBackoff, Err: reason, Delay: delay})
+	return sleepCtx(ctx, delay)
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/Diniboy1123/usque/config"
+)
+
+func TestAccountInfo(t *testing.T) {
+	e := newCLIEnv(t)
+	e.register()
+	out := e.mustRun("", "account", "info")
+	assertGolden(t, "account_info", out)
+}
+
+func TestAccountDevices(t *testing.T) {
+	e := newCLIEnv(t)
+	e.register("-n", "laptop")
+	out := e.mustRun("", "account", "devices")
+	assertGolden(t, "account_devices", out)
+}
+
+func TestAccountSetAndReset(t *testing.T) {
+	e := newCLIEnv(t)
+	// a second device whose license the first one joins
+	e.register("-n", "phone")
+	license := e.api.License(e.loadConfig().ID)
+	e.register("-n", "laptop")
+	id := e.loadConfig().ID
+
+	out := e.mustRun("", "account", "set", license)
+	assertGolden(t, "account_set", out)
+	if got := e.api.License(id); got != license {
+		t.Fatalf("device has license %q, want %q", got, license)
+	}
+
+	out = e.mustRun("", "account", "devices")
+	assertGolden(t, "account_set_devices", out)
+
+	out = e.mustRun("", "account", "reset")
+	assertGolden(t, "account_reset", out)
+	if got := e.api.License(id); got == license {
+		t.Fatalf("license still bound after reset")
+	}
+}
+
+func TestAccountSetInvalidLicense(t *testing.T) {
+	e := newCLIEnv(t)
+	e.register()
+	out, code := e.run("", "account", "set", "not-a-license")
+	if code != 1 {
+		t.Errorf("got exit code %d, want 1", code)
+	}
+	assertGolden(t, "account_set_invalid", out)
+}
+
+func TestAccountUnauthorized(t *testing.T) {
+	e := newCLIEnv(t)
+	e.register()
+	e.loadConfig()
+	config.AppConfig.AccessToken = "revoked"
+	if err := config.AppConfig.SaveConfig(e.config); err != nil {
+		t.Fatal(err)
+	}
+
+	out, code := e.run("", "account", "info")
+	if code != 1 {
+		t.Errorf("got exit code %d, want 1", code)
+	}
+	assertGolden(t, "account_unauthorized", out)
+}
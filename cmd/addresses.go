@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"log"
+	"net/netip"
+	"slices"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+)
+
+// onAddressesAssigned returns a MaintainTunnelConfig.OnEvent handler for the
+// addresses the server assigns. apply, if set, is called whenever they
+// change, e.g. to reconfigure the TUN device. It runs on its own goroutine,
+// as OnEvent must not block, and skips to the latest addresses if they
+// changed again meanwhile. Without it, a warning is logged when the
+// addresses of the config are no longer assigned, as packets from them go
+// unanswered.
+func onAddressesAssigned(apply func(addresses []netip.Prefix) error) func(api.TunnelEvent) {
+	var pending chan []netip.Prefix
+	if apply != nil {
+		pending = make(chan []netip.Prefix, 1)
+		go func() {
+			for addresses := range pending {
+				if err := apply(addresses); err != nil {
+					log.Printf("Failed to apply assigned addresses: %v", err)
+				}
+			}
+		}()
+	}
+
+	var last []netip.Prefix
+	return func(ev api.TunnelEvent) {
+		if ev.State != api.TunnelConnected && ev.State != api.TunnelReassigned {
+			return
+		}
+		if len(ev.Addresses) == 0 || slices.Equal(ev.Addresses, last) {
+			return
+		}
+		last = ev.Addresses
+
+		if pending != nil {
+			// events are delivered one at a time, so this never blocks
+			select {
+			case <-pending:
+			default:
+			}
+			pending <- ev.Addresses
+			return
+		}
+		for _, configured := range []string{config.AppConfig.IPv4, config.AppConfig.IPv6} {
+			addr, err := netip.ParseAddr(configured)
+			if err != nil || assigned(ev.Addresses, addr) {
+				continue
+			}
+			log.Printf("Warning: the server no longer assigns %s from the config, traffic from it will be dropped. Run enroll to update the config.", addr)
+		}
+	}
+}
+
+// assigned reports whether addr is in one of the prefixes, or whether no
+// prefix of its family was assigned at all.
+func assigned(prefixes []netip.Prefix, addr netip.Addr) bool {
+	found := false
+	for _, p := range prefixes {
+		if p.Addr().Is6() != addr.Is6() {
+			continue
+		}
+		if p.Contains(addr) {
+			return true
+		}
+		found = true
+	}
+	return !found
+}
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+)
+
+func TestOnAddressesAssignedDoesNotBlock(t *testing.T) {
+	applying, release := make(chan []netip.Prefix), make(chan struct{})
+	onEvent := onAddressesAssigned(func(addresses []netip.Prefix) error {
+		applying <- addresses
+		// a slow netlink call
+		<-release
+		return nil
+	})
+
+	first := []netip.Prefix{netip.MustParsePrefix("172.16.0.2/32")}
+	second := []netip.Prefix{netip.MustParsePrefix("172.16.0.3/32")}
+	third := []netip.Prefix{netip.MustParsePrefix("172.16.0.4/32")}
+	onEvent(api.TunnelEvent{State: api.TunnelConnected, Addresses: first})
+	if got := <-applying; !slices.Equal(got, first) {
+		t.Errorf("applied %v, want %v", got, first)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		onEvent(api.TunnelEvent{State: api.TunnelReassigned, Addresses: second})
+		onEvent(api.TunnelEvent{State: api.TunnelReassigned, Addresses: third})
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnEvent blocked while the addresses were applied")
+	}
+
+	// the addresses superseded meanwhile are skipped
+	close(release)
+	if got := <-applying; !slices.Equal(got, third) {
+		t.Errorf("applied %v next, want the latest %v", got, third)
+	}
+}
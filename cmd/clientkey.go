@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/spf13/cobra"
+)
+
+// addClientKeyFlags registers the flags of the client certificates and of
+// live key rotation.
+func addClientKeyFlags(cmd *cobra.Command) {
+	cmd.Flags().Duration("cert-lifetime", api.DefaultCertLifetime, "Validity of the client certificate, minted anew for every handshake")
+	cmd.Flags().Duration("cert-clock-skew", api.DefaultCertClockSkew, "How long before each handshake the client certificate is valid from, for endpoints whose clock is behind")
+	cmd.Flags().Duration("rotate-key-every", 0, "Enroll a new MASQUE key this often while running and save it to the config (0 disables)")
+	cmd.Flags().Bool("rotate-key-on-sighup", false, "Unix only: Enroll a new MASQUE key and save it to the config on SIGHUP")
+}
+
+// certMinter returns the minter of the client certificates of privKey
+// configured by the flags of addClientKeyFlags.
+func certMinter(cmd *cobra.Command, privKey *ecdsa.PrivateKey) (*api.CertMinter, error) {
+	lifetime, err := cmd.Flags().GetDuration("cert-lifetime")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cert lifetime: %v", err)
+	}
+	clockSkew, err := cmd.Flags().GetDuration("cert-clock-skew")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cert clock skew: %v", err)
+	}
+	if lifetime <= 0 || clockSkew < 0 {
+		return nil, fmt.Errorf("the cert lifetime must be positive and the clock skew must not be negative")
+	}
+	return api.NewCertMinter(privKey, lifetime, clockSkew), nil
+}
+
+// startKeyRotation rotates the key of minter in the background if the flags
+// of addClientKeyFlags ask for it. tlsConfig and the TLSConfig of the
+// failover endpoints must present the certificates of minter and not be in
+// use yet.
+func startKeyRotation(cmd *cobra.Command, minter *api.CertMinter, tlsConfig *tls.Config, failover []api.TunnelEndpoint) error {
+	interval, err := cmd.Flags().GetDuration("rotate-key-every")
+	if err != nil {
+		return fmt.Errorf("failed to get rotate-key-every: %v", err)
+	}
+	onSighup, err := cmd.Flags().GetBool("rotate-key-on-sighup")
+	if err != nil {
+		return fmt.Errorf("failed to get rotate-key-on-sighup flag: %v", err)
+	}
+	if interval <= 0 && !onSighup {
+		return nil
+	}
+
+	configPath, err := cmd.Flags().GetString("config")
+	if err != nil {
+		return fmt.Errorf("failed to get config path: %v", err)
+	}
+
+	rotator, err := api.NewKeyRotator(api.KeyRotationConfig{
+		Client: api.NewClient(config.AppConfig.ID, config.AppConfig.AccessToken),
+		Minter: minter,
+		Save: func(privKey *ecdsa.PrivateKey) error {
+			der, err := x509.MarshalECPrivateKey(privKey)
+			if err != nil {
+				return fmt.Errorf("failed to marshal private key: %v", err)
+			}
+			// the config is read by the commands meanwhile, only a copy
+			// is changed from this goroutine
+			saved := config.AppConfig
+			saved.PrivateKey = base64.StdEncoding.EncodeToString(der)
+			return saved.SaveConfig(configPath)
+		},
+		Interval: interval,
+	})
+	if err != nil {
+		return err
+	}
+	rotator.Attach(tlsConfig)
+	for _, e := range failover {
+		if e.TLSConfig != nil {
+			rotator.Attach(e.TLSConfig)
+		}
+	}
+
+	var trigger chan struct{}
+	if onSighup {
+		trigger = make(chan struct{}, 1)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGHUP)
+		go func() {
+			for range signals {
+				select {
+				case trigger <- struct{}{}:
+				default:
+					// a rotation is already pending
+				}
+			}
+		}()
+	}
+
+	if interval > 0 {
+		log.Printf("Rotating the device key every %s", interval)
+	}
+	go rotator.Run(context.Background(), trigger)
+	return nil
+}
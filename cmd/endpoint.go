@@ -0,0 +1,335 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/spf13/cobra"
+)
+
+var endpointCmd = &cobra.Command{
+	Use:   "endpoint",
+	Short: "Find and manage MASQUE endpoints",
+	Long:  "Find working MASQUE endpoints and manage the endpoints stored in the config.",
+}
+
+var endpointScanCmd = &cobra.Command{
+	Use:   "scan",
+	Short: "Probe candidate MASQUE endpoints",
+	Long: "Probes every address of the given CIDR ranges on every given port with QUIC and CONNECT-IP handshakes\n" +
+		"and ranks the endpoints by success rate and handshake latency. Without --cidr the /24 around\n" +
+		"endpoint_v4 of the config is scanned. Press Ctrl+C to stop early and rank what was probed so far.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !config.ConfigLoaded {
+			log.Fatalln("Config not loaded. Please register first.")
+		}
+
+		cidrs, err := cmd.Flags().GetStringArray("cidr")
+		if err != nil {
+			log.Fatalf("Failed to get CIDR ranges: %v", err)
+		}
+		if len(cidrs) == 0 {
+			if config.AppConfig.EndpointV4 == "" {
+				log.Fatalln("No --cidr given and no endpoint_v4 in config to scan around")
+			}
+			cidrs = []string{config.AppConfig.EndpointV4 + "/24"}
+		}
+
+		ports, err := cmd.Flags().GetIntSlice("port")
+		if err != nil {
+			log.Fatalf("Failed to get ports: %v", err)
+		}
+
+		maxEndpoints, err := cmd.Flags().GetInt("max-endpoints")
+		if err != nil {
+			log.Fatalf("Failed to get max endpoints: %v", err)
+		}
+
+		attempts, err := cmd.Flags().GetInt("attempts")
+		if err != nil {
+			log.Fatalf("Failed to get attempts: %v", err)
+		}
+
+		concurrency, err := cmd.Flags().GetInt("concurrency")
+		if err != nil {
+			log.Fatalf("Failed to get concurrency: %v", err)
+		}
+
+		timeout, err := cmd.Flags().GetDuration("timeout")
+		if err != nil {
+			log.Fatalf("Failed to get timeout: %v", err)
+		}
+
+		quicOnly, err := cmd.Flags().GetBool("quic-only")
+		if err != nil {
+			log.Fatalf("Failed to get quic-only flag: %v", err)
+		}
+
+		sni, err := masqueSNI(cmd)
+		if err != nil {
+			log.Fatalf("Failed to get SNI address: %v", err)
+		}
+
+		pq, err := cmd.Flags().GetBool("pq")
+		if err != nil {
+			log.Fatalf("Failed to get pq flag: %v", err)
+		}
+
+		top, err := cmd.Flags().GetInt("top")
+		if err != nil {
+			log.Fatalf("Failed to get top: %v", err)
+		}
+
+		asJSON, err := cmd.Flags().GetBool("json")
+		if err != nil {
+			log.Fatalf("Failed to get json flag: %v", err)
+		}
+
+		write, err := cmd.Flags().GetBool("write")
+		if err != nil {
+			log.Fatalf("Failed to get write flag: %v", err)
+		}
+
+		endpoints, err := scanTargets(cidrs, ports, maxEndpoints)
+		if err != nil {
+			log.Fatalf("Invalid scan targets: %v", err)
+		}
+
+		privKey, err := config.AppConfig.GetEcPrivateKey()
+		if err != nil {
+			log.Fatalf("Failed to get private key: %v", err)
+		}
+		peerPubKey, err := config.AppConfig.GetEcEndpointPublicKey()
+		if err != nil {
+			log.Fatalf("Failed to get public key: %v", err)
+		}
+		cert, err := internal.GenerateCert(privKey, &privKey.PublicKey)
+		if err != nil {
+			log.Fatalf("Failed to generate cert: %v", err)
+		}
+		tlsConfig, err := api.PrepareTlsConfig(privKey, peerPubKey, cert, sni, false)
+		if err != nil {
+			log.Fatalf("Failed to prepare TLS config: %v", err)
+		}
+		if pq {
+			api.EnablePostQuantum(tlsConfig)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+
+		log.Printf("Scanning %d endpoints with %d attempts each...", len(endpoints), attempts)
+		results := api.ScanEndpoints(ctx, api.ScanConfig{
+			TLSConfig:   tlsConfig,
+			QUICConfig:  internal.DefaultQuicConfig(0, 0),
+			Endpoints:   endpoints,
+			Attempts:    attempts,
+			Concurrency: concurrency,
+			Timeout:     timeout,
+			QUICOnly:    quicOnly,
+		})
+
+		var working []api.ScanResult
+		for _, res := range results {
+			if res.Successes > 0 {
+				working = append(working, res)
+			}
+		}
+		log.Printf("Scanned %d endpoints, %d working", len(results), len(working))
+
+		shown := results
+		if top > 0 && len(shown) > top {
+			shown = shown[:top]
+		}
+		if asJSON {
+			printScanResultsJSON(cmd, shown)
+		} else {
+			printScanResults(cmd, shown, quicOnly)
+		}
+
+		if !write {
+			return
+		}
+		if len(working) == 0 {
+			log.Fatalln("No working endpoint found, config left unchanged")
+		}
+		if top > 0 && len(working) > top {
+			working = working[:top]
+		}
+
+		configPath, err := cmd.Flags().GetString("config")
+		if err != nil {
+			log.Fatalf("Failed to get config path: %v", err)
+		}
+		applyScanResults(working)
+		if err := config.AppConfig.SaveConfig(configPath); err != nil {
+			log.Fatalf("Failed to save config: %v", err)
+		}
+		log.Printf("Saved %d endpoints to %s", len(working), configPath)
+	},
+}
+
+// scanTargets expands CIDR ranges, or single addresses, and ports into the
+// endpoints to scan.
+func scanTargets(cidrs []string, ports []int, limit int) ([]*net.UDPAddr, error) {
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("no ports given")
+	}
+
+	var endpoints []*net.UDPAddr
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(cidr)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid CIDR range %q: %v", cidr, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefix = prefix.Masked()
+
+		for addr := prefix.Addr(); addr.IsValid() && prefix.Contains(addr); addr = addr.Next() {
+			for _, port := range ports {
+				if port <= 0 || port > 65535 {
+					return nil, fmt.Errorf("invalid port %d", port)
+				}
+				if len(endpoints) >= limit {
+					return nil, fmt.Errorf("more than %d endpoints to scan, narrow the ranges or raise --max-endpoints", limit)
+				}
+				endpoints = append(endpoints, net.UDPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(port))))
+			}
+		}
+	}
+	return endpoints, nil
+}
+
+// formatScanError shortens errors for the table.
+func formatScanError(err error) string {
+	if err == nil {
+		return ""
+	}
+	msg := err.Error()
+	if len(msg) > 60 {
+		msg = msg[:57] + "..."
+	}
+	return msg
+}
+
+func formatLatency(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return d.Round(time.Millisecond / 10).String()
+}
+
+func printScanResults(cmd *cobra.Command, results []api.ScanResult, quicOnly bool) {
+	writer := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+	defer func() {
+		if err := writer.Flush(); err != nil {
+			log.Fatalf("Failed to flush output: %v\n", err)
+		}
+	}()
+
+	if quicOnly {
+		writeTabbedLine(writer, "ENDPOINT\tSUCCESS\tHANDSHAKE\tLAST ERROR\n")
+	} else {
+		writeTabbedLine(writer, "ENDPOINT\tSUCCESS\tHANDSHAKE\tCONNECT-IP\tLAST ERROR\n")
+	}
+	for _, res := range results {
+		success := fmt.Sprintf("%d/%d", res.Successes, res.Attempts)
+		if quicOnly {
+			writeTabbedLine(writer, "%s\t%s\t%s\t%s\n", res.Endpoint, success, formatLatency(res.Handshake), formatScanError(res.Err))
+		} else {
+			writeTabbedLine(writer, "%s\t%s\t%s\t%s\t%s\n", res.Endpoint, success, formatLatency(res.Handshake), formatLatency(res.Connect), formatScanError(res.Err))
+		}
+	}
+}
+
+type scanResultJSON struct {
+	Endpoint    string  `json:"endpoint"`
+	Attempts    int     `json:"attempts"`
+	Successes   int     `json:"successes"`
+	HandshakeMs float64 `json:"handshake_ms,omitempty"`
+	ConnectMs   float64 `json:"connect_ms,omitempty"`
+	Error       string  `json:"error,omitempty"`
+}
+
+func printScanResultsJSON(cmd *cobra.Command, results []api.ScanResult) {
+	out := make([]scanResultJSON, len(results))
+	for i, res := range results {
+		out[i] = scanResultJSON{
+			Endpoint:    res.Endpoint.String(),
+			Attempts:    res.Attempts,
+			Successes:   res.Successes,
+			HandshakeMs: float64(res.Handshake) / float64(time.Millisecond),
+			ConnectMs:   float64(res.Connect) / float64(time.Millisecond),
+		}
+		if res.Err != nil {
+			out[i].Error = res.Err.Error()
+		}
+	}
+
+	encoder := json.NewEncoder(cmd.OutOrStdout())
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(out); err != nil {
+		log.Fatalf("Failed to write output: %v", err)
+	}
+}
+
+// applyScanResults makes the best endpoint of each address family the
+// configured one and stores all working endpoints for failover, best first.
+func applyScanResults(working []api.ScanResult) {
+	var bestV4, bestV6 string
+	endpoints := make([]config.Endpoint, 0, len(working))
+	for _, res := range working {
+		e := config.Endpoint{Ports: []int{res.Endpoint.Port}}
+		if ip := res.Endpoint.IP.To4(); ip != nil {
+			e.V4 = ip.String()
+			if bestV4 == "" {
+				bestV4 = e.V4
+			}
+		} else {
+			e.V6 = res.Endpoint.IP.String()
+			if bestV6 == "" {
+				bestV6 = e.V6
+			}
+		}
+		endpoints = append(endpoints, e)
+	}
+
+	if bestV4 != "" {
+		config.AppConfig.EndpointV4 = bestV4
+	}
+	if bestV6 != "" {
+		config.AppConfig.EndpointV6 = bestV6
+	}
+	config.AppConfig.Endpoints = endpoints
+}
+
+func init() {
+	endpointScanCmd.Flags().StringArray("cidr", nil, "CIDR range or address to scan, can be given multiple times (default: the /24 around endpoint_v4)")
+	endpointScanCmd.Flags().IntSliceP("port", "p", []int{443}, "Ports to scan, comma separated or given multiple times")
+	endpointScanCmd.Flags().Int("max-endpoints", 4096, "Refuse to scan more endpoints than this")
+	endpointScanCmd.Flags().IntP("attempts", "n", api.DefaultScanAttempts, "Handshakes per endpoint")
+	endpointScanCmd.Flags().IntP("concurrency", "j", api.DefaultScanConcurrency, "Endpoints probed at once")
+	endpointScanCmd.Flags().Duration("timeout", api.DefaultScanTimeout, "Timeout of a single handshake")
+	endpointScanCmd.Flags().Bool("quic-only", false, "Only measure the QUIC handshake, skip the CONNECT-IP request")
+	endpointScanCmd.Flags().StringP("sni-address", "s", internal.ConnectSNI, sniHelp)
+	endpointScanCmd.Flags().Bool("pq", false, "Only accept endpoints supporting the post-quantum hybrid X25519MLKEM768 key exchange")
+	endpointScanCmd.Flags().Int("top", 10, "Show and write only the best N endpoints (0 for all)")
+	endpointScanCmd.Flags().Bool("json", false, "Print the results as JSON")
+	endpointScanCmd.Flags().BoolP("write", "w", false, "Write the working endpoints into the config, the best one as endpoint_v4/endpoint_v6")
+	endpointCmd.AddCommand(endpointScanCmd)
+	rootCmd.AddCommand(endpointCmd)
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/spf13/cobra"
+)
+
+// failoverEndpoints prepares the HTTP/3 endpoints of the config to fail over
+// to, each pinning its own public key and presenting the certificates of
+// minter.
+func failoverEndpoints(minter *api.CertMinter, sni string, insecure, pq, useIPv6, noHappyEyeballs bool, port int) ([]api.TunnelEndpoint, error) {
+	endpoints, err := config.FailoverEndpointsFromConfig(useIPv6, port)
+	if err != nil {
+		return nil, err
+	}
+
+	var tunnelEndpoints []api.TunnelEndpoint
+	for _, e := range endpoints {
+		tlsConfig, err := api.PrepareTlsConfig(minter.Key(), e.PubKey, nil, sni, insecure)
+		if err != nil {
+			return nil, fmt.Errorf("failed to prepare TLS config for %s: %v", e.Endpoint, err)
+		}
+		minter.Attach(tlsConfig)
+		if pq {
+			api.EnablePostQuantum(tlsConfig)
+		}
+		te := api.TunnelEndpoint{Endpoint: e.Endpoint, AltEndpoint: e.AltEndpoint, Ports: e.Ports, TLSConfig: tlsConfig}
+		if noHappyEyeballs {
+			te.AltEndpoint = nil
+		}
+		tunnelEndpoints = append(tunnelEndpoints, te)
+	}
+	if len(tunnelEndpoints) > 0 {
+		log.Printf("%d failover endpoints configured", len(tunnelEndpoints))
+	}
+	return tunnelEndpoints, nil
+}
+
+// endpointState returns the endpoint the last tunnel was established with and
+// a callback remembering the endpoint of each new one in the state file next
+// to the config.
+func endpointState(cmd *cobra.Command) (string, func(net.Addr)) {
+	configPath, err := cmd.Flags().GetString("config")
+	if err != nil || configPath == "" {
+		return "", nil
+	}
+	statePath := config.StatePath(configPath)
+
+	state, err := config.LoadState(statePath)
+	if err != nil {
+		log.Printf("Ignoring state file: %v", err)
+	}
+	if state.LastEndpoint != "" {
+		log.Printf("Starting with last working endpoint %s", state.LastEndpoint)
+	}
+
+	last := state.LastEndpoint
+	return state.LastEndpoint, func(endpoint net.Addr) {
+		if endpoint.String() == last {
+			return
+		}
+		last = endpoint.String()
+		if err := config.SaveState(statePath, config.State{LastEndpoint: last}); err != nil {
+			log.Printf("Failed to save state: %v", err)
+		}
+	}
+}
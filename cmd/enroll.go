@@ -3,6 +3,7 @@ package cmd
 import (
 	"crypto/x509"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
 
@@ -75,7 +76,8 @@ var enrollCmd = &cobra.Command{
 
 		accountData, err := api.EnrollKey(config.AppConfig.ID, config.AppConfig.AccessToken, publicKey, deviceName)
 		if err != nil {
-			if apiErr, ok := err.(models.APIError); ok && apiErr.HasErrorCode(models.InvalidPublicKey) {
+			var apiErr *models.APIError
+			if errors.As(err, &apiErr) && apiErr.HasErrorCode(models.InvalidPublicKey) {
 				fmt.Print("Invalid public key detected. Regenerate key? (y/n): ")
 
 				var response string
@@ -101,20 +103,25 @@ var enrollCmd = &cobra.Command{
 			h2v4 = config.DefaultEndpointH2V4
 		}
 
+		primary, endpoints, err := config.EndpointsFromPeers(accountData.Config.Peers)
+		if err != nil {
+			log.Fatalf("Failed to parse endpoints: %v", err)
+		}
+
 		config.AppConfig = config.Config{
-			PrivateKey: base64.StdEncoding.EncodeToString(privKeyBytes),
-			// TODO: proper endpoint parsing in utils
-			// strip :0
-			EndpointV4: accountData.Config.Peers[0].Endpoint.V4[:len(accountData.Config.Peers[0].Endpoint.V4)-2],
-			// strip [ from beginning and ]:0 from end
-			EndpointV6:     accountData.Config.Peers[0].Endpoint.V6[1 : len(accountData.Config.Peers[0].Endpoint.V6)-3],
+			PrivateKey:     base64.StdEncoding.EncodeToString(privKeyBytes),
+			EndpointV4:     primary.V4,
+			EndpointV6:     primary.V6,
 			EndpointH2V4:   h2v4,
 			EndpointH2V6:   config.AppConfig.EndpointH2V6,
-			EndpointPubKey: accountData.Config.Peers[0].PublicKey,
+			EndpointPubKey: primary.PubKey,
+			Ports:          primary.Ports,
+			Endpoints:      endpoints,
 			ID:             accountData.ID,
 			AccessToken:    config.AppConfig.AccessToken,
 			IPv4:           accountData.Config.Interface.Addresses.V4,
 			IPv6:           accountData.Config.Interface.Addresses.V6,
+			ZeroTrust:      config.ZeroTrustFromAccount(accountData),
 		}
 
 		if err := config.AppConfig.SaveConfig(configPath); err != nil {
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/Diniboy1123/usque/models"
+)
+
+func queueInvalidKey(e *cliEnv) {
+	e.api.QueueError(http.MethodPatch, http.StatusBadRequest,
+		models.ErrorInfo{Code: models.InvalidPublicKey, Message: "Invalid public key"})
+}
+
+func TestEnroll(t *testing.T) {
+	e := newCLIEnv(t)
+	e.register()
+	before := e.loadConfig()
+
+	out := e.mustRun("", "enroll", "-n", "desktop")
+	assertGolden(t, "enroll", out)
+
+	after := e.loadConfig()
+	if after.PrivateKey != before.PrivateKey {
+		t.Errorf("key changed without --regen-key")
+	}
+	e.assertEnrolledKey()
+	if device, _ := e.api.Device(after.ID); device.Name != "desktop" {
+		t.Errorf("got device name %q, want desktop", device.Name)
+	}
+}
+
+func TestEnrollRegenKey(t *testing.T) {
+	e := newCLIEnv(t)
+	e.register()
+	before := e.loadConfig()
+
+	out := e.mustRun("", "enroll", "-r")
+	assertGolden(t, "enroll_regen_key", out)
+
+	if e.loadConfig().PrivateKey == before.PrivateKey {
+		t.Errorf("key not regenerated")
+	}
+	e.assertEnrolledKey()
+}
+
+func TestEnrollInvalidKey(t *testing.T) {
+	t.Run("Declined", func(t *testing.T) {
+		e := newCLIEnv(t)
+		e.register()
+		before := e.loadConfig()
+		queueInvalidKey(e)
+
+		out, code := e.run("n\n", "enroll")
+		if code != 1 {
+			t.Errorf("got exit code %d, want 1", code)
+		}
+		assertGolden(t, "enroll_invalid_key_declined", out)
+		if !reflect.DeepEqual(e.loadConfig(), before) {
+			t.Errorf("config changed although enrollment was aborted")
+		}
+	})
+
+	t.Run("Regenerated", func(t *testing.T) {
+		e := newCLIEnv(t)
+		e.register()
+		before := e.loadConfig()
+		queueInvalidKey(e)
+
+		out := e.mustRun("y\n", "enroll")
+		assertGolden(t, "enroll_invalid_key_regenerated", out)
+		if e.loadConfig().PrivateKey == before.PrivateKey {
+			t.Errorf("key not regenerated")
+		}
+		e.assertEnrolledKey()
+	})
+}
+
+func TestEnrollWithoutConfig(t *testing.T) {
+	e := newCLIEnv(t)
+	out := e.mustRun("", "enroll")
+	assertGolden(t, "enroll_without_config", out)
+}
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -28,49 +29,9 @@ var httpProxyCmd = &cobra.Command{
 		}
 		log.Println("Hint: l4-http-proxy is faster for TCP-only HTTP proxy use cases.")
 
-		sni, err := cmd.Flags().GetString("sni-address")
+		tunnelConfig, err := buildTunnelConfig(cmd, "http-proxy")
 		if err != nil {
-			cmd.Printf("Failed to get SNI address: %v\n", err)
-			return
-		}
-
-		privKey, err := config.AppConfig.GetEcPrivateKey()
-		if err != nil {
-			cmd.Printf("Failed to get private key: %v\n", err)
-			return
-		}
-		peerPubKey, err := config.AppConfig.GetEcEndpointPublicKey()
-		if err != nil {
-			cmd.Printf("Failed to get public key: %v\n", err)
-			return
-		}
-
-		cert, err := internal.GenerateCert(privKey, &privKey.PublicKey)
-		if err != nil {
-			cmd.Printf("Failed to generate cert: %v\n", err)
-			return
-		}
-
-		insecure, err := cmd.Flags().GetBool("insecure")
-		if err != nil {
-			cmd.Printf("Failed to get insecure flag: %v\n", err)
-			return
-		}
-
-		tlsConfig, err := api.PrepareTlsConfig(privKey, peerPubKey, cert, sni, insecure)
-		if err != nil {
-			cmd.Printf("Failed to prepare TLS config: %v\n", err)
-			return
-		}
-
-		keepalivePeriod, err := cmd.Flags().GetDuration("keepalive-period")
-		if err != nil {
-			cmd.Printf("Failed to get keepalive period: %v\n", err)
-			return
-		}
-		initialPacketSize, err := cmd.Flags().GetUint16("initial-packet-size")
-		if err != nil {
-			cmd.Printf("Failed to get initial packet size: %v\n", err)
+			cmd.Println(err)
 			return
 		}
 
@@ -80,44 +41,12 @@ var httpProxyCmd = &cobra.Command{
 			return
 		}
 
-		port, err := cmd.Flags().GetString("port")
+		port, err := proxyPort(cmd)
 		if err != nil {
 			cmd.Printf("Failed to get port: %v\n", err)
 			return
 		}
 
-		connectPort, err := cmd.Flags().GetInt("connect-port")
-		if err != nil {
-			cmd.Printf("Failed to get connect port: %v\n", err)
-			return
-		}
-
-		useHTTP2, err := cmd.Flags().GetBool("http2")
-		if err != nil {
-			cmd.Printf("Failed to get HTTP/2 flag: %v\n", err)
-			return
-		}
-
-		useIPv6, err := cmd.Flags().GetBool("ipv6")
-		if err != nil {
-			cmd.Printf("Failed to get ipv6 flag: %v\n", err)
-			return
-		}
-
-		endpoint, err := config.SelectEndpointFromConfig(useHTTP2, useIPv6, connectPort)
-		if err != nil {
-			cmd.Printf("Failed to select endpoint: %v\n", err)
-			return
-		}
-
-		if insecure {
-			config.WarnInsecure()
-		}
-
-		if useHTTP2 {
-			config.LogHTTP2Endpoint(endpoint)
-		}
-
 		tunnelIPv4, err := cmd.Flags().GetBool("no-tunnel-ipv4")
 		if err != nil {
 			cmd.Printf("Failed to get no tunnel IPv4: %v\n", err)
@@ -186,15 +115,6 @@ var httpProxyCmd = &cobra.Command{
 			systemDNS = false
 		}
 
-		mtu, err := cmd.Flags().GetInt("mtu")
-		if err != nil {
-			cmd.Printf("Failed to get MTU: %v\n", err)
-			return
-		}
-		if mtu != 1280 {
-			log.Println("Warning: MTU is not the default 1280. This is not supported. Packet loss and other issues may occur.")
-		}
-
 		var username string
 		var password string
 		if u, err := cmd.Flags().GetString("username"); err == nil && u != "" {
@@ -204,42 +124,33 @@ var httpProxyCmd = &cobra.Command{
 			password = p
 		}
 
-		reconnectDelay, err := cmd.Flags().GetDuration("reconnect-delay")
-		if err != nil {
-			cmd.Printf("Failed to get reconnect delay: %v\n", err)
-			return
-		}
-
 		alwaysReconnect, err := cmd.Flags().GetBool("always-reconnect")
 		if err != nil {
 			cmd.Printf("Failed to get always-reconnect flag: %v\n", err)
 			return
 		}
 
-		onConnect, err := cmd.Flags().GetString("on-connect")
+		split, err := splitTunnel()
 		if err != nil {
-			cmd.Printf("Failed to get on-connect flag: %v\n", err)
+			cmd.Printf("Failed to apply split tunnel policy: %v\n", err)
 			return
 		}
+		logZeroTrust("http-proxy")
 
-		onDisconnect, err := cmd.Flags().GetString("on-disconnect")
+		rules, err := loadRules(cmd)
 		if err != nil {
-			cmd.Printf("Failed to get on-disconnect flag: %v\n", err)
+			cmd.Printf("Failed to load routing rules: %v\n", err)
 			return
 		}
 
-		hookEnv := map[string]string{
-			"USQUE_MODE": "http-proxy",
-			"USQUE_IPV4": config.AppConfig.IPv4,
-			"USQUE_IPV6": config.AppConfig.IPv6,
-		}
+		splitTunnelHookEnv(tunnelConfig.HookEnv)
 
 		var authHeader string
 		if username != "" && password != "" {
 			authHeader = "Basic " + internal.LoginToBase64(username, password)
 		}
 
-		tunDev, tunNet, err := netstack.CreateNetTUN(localAddresses, dnsAddrs, mtu)
+		tunDev, tunNet, err := netstack.CreateNetTUN(localAddresses, dnsAddrs, tunnelConfig.MTU)
 		if err != nil {
 			cmd.Printf("Failed to create virtual TUN device: %v\n", err)
 			return
@@ -247,21 +158,35 @@ var httpProxyCmd = &cobra.Command{
 		defer func() { _ = tunDev.Close() }()
 
 		resolver := internal.GetProxyResolver(localDNS, systemDNS, tunNet, dnsAddrs, dnsTimeout)
+		dial := api.DialFunc(tunNet.DialContext)
+		lookup := resolverLookup(resolver)
+		if split != nil {
+			// the split dialer resolves hosts itself, to match them against the policy
+			dial = split.Dialer(tunNet.DialContext, lookup)
+		}
+		if rules != nil {
+			// the rules match host names, so they are resolved after routing
+			if split == nil {
+				dial = resolvingDialer(dial, resolver)
+			}
+			dial = rules.Dialer(dial, lookup)
+		}
+		if split != nil || rules != nil {
+			resolver = nil
+		}
 
-		go api.MaintainTunnel(context.Background(), api.MaintainTunnelConfig{
-			TLSConfig:         tlsConfig,
-			KeepalivePeriod:   keepalivePeriod,
-			InitialPacketSize: initialPacketSize,
-			Endpoint:          endpoint,
-			Device:            api.NewNetstackAdapter(tunDev),
-			MTU:               mtu,
-			ReconnectDelay:    reconnectDelay,
-			AlwaysReconnect:   alwaysReconnect,
-			UseHTTP2:          useHTTP2,
-			OnConnect:         onConnect,
-			OnDisconnect:      onDisconnect,
-			HookEnv:           hookEnv,
-		})
+		liveness, err := livenessConfig(cmd, tunNet.DialContext)
+		if err != nil {
+			cmd.Printf("Failed to configure liveness probes: %v\n", err)
+			return
+		}
+
+		tunnelConfig.Device = api.NewNetstackAdapter(tunDev)
+		tunnelConfig.AlwaysReconnect = alwaysReconnect
+		tunnelConfig.Liveness = liveness
+		tunnelConfig.OnEvent = onAddressesAssigned(nil)
+		tunnelConfig.NetworkChanges = networkChanges(cmd, tunnelConfig.UseHTTP2)
+		go api.MaintainTunnel(context.Background(), tunnelConfig)
 
 		server := &http.Server{
 			Addr: net.JoinHostPort(bindAddress, port),
@@ -272,10 +197,11 @@ var httpProxyCmd = &cobra.Command{
 					return
 				}
 
+				r = withClientAddr(r)
 				if r.Method == http.MethodConnect {
-					handleHTTPSConnect(w, r, tunNet, resolver)
+					handleHTTPSConnect(w, r, dial, resolver)
 				} else {
-					handleHTTPProxy(w, r, tunNet, resolver)
+					handleHTTPProxy(w, r, dial, resolver)
 				}
 			}),
 		}
@@ -305,9 +231,9 @@ func authenticate(r *http.Request, expectedAuth string) bool {
 // Parameters:
 //   - w: http.ResponseWriter - The response writer for the HTTP request.
 //   - r: *http.Request - The incoming HTTP request.
-//   - tunNet: *netstack.Net - The netstack network interface.
-//   - resolver: *net.Resolver - The DNS resolver to use for the tunnel.
-func handleHTTPSConnect(w http.ResponseWriter, r *http.Request, tunNet *netstack.Net, resolver *net.Resolver) {
+//   - dial: api.DialFunc - Dials the destination, usually through the tunnel.
+//   - resolver: *net.Resolver - The DNS resolver to use for the tunnel, nil if dial resolves hosts itself.
+func handleHTTPSConnect(w http.ResponseWriter, r *http.Request, dial api.DialFunc, resolver *net.Resolver) {
 	ctx := r.Context()
 
 	host, port, err := net.SplitHostPort(r.Host)
@@ -328,7 +254,11 @@ func handleHTTPSConnect(w http.ResponseWriter, r *http.Request, tunNet *netstack
 		destAddr = r.Host
 	}
 
-	destConn, err := tunNet.DialContext(ctx, "tcp", destAddr)
+	destConn, err := dial(ctx, "tcp", destAddr)
+	if errors.Is(err, api.ErrBlocked) {
+		http.Error(w, "Destination blocked", http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Unable to connect to destination", http.StatusServiceUnavailable)
 		return
@@ -368,9 +298,9 @@ func handleHTTPSConnect(w http.ResponseWriter, r *http.Request, tunNet *netstack
 // Parameters:
 //   - w: http.ResponseWriter - The response writer for the HTTP request.
 //   - r: *http.Request - The incoming HTTP request.
-//   - tunNet: *netstack.Net - The netstack network interface.
-//   - resolver: *net.Resolver - The DNS resolver to use for the tunnel.
-func handleHTTPProxy(w http.ResponseWriter, r *http.Request, tunNet *netstack.Net, resolver *net.Resolver) {
+//   - dial: api.DialFunc - Dials the destination, usually through the tunnel.
+//   - resolver: *net.Resolver - The DNS resolver to use for the tunnel, nil if dial resolves hosts itself.
+func handleHTTPProxy(w http.ResponseWriter, r *http.Request, dial api.DialFunc, resolver *net.Resolver) {
 	client := &http.Client{
 		Transport: &http.Transport{
 			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -390,7 +320,7 @@ func handleHTTPProxy(w http.ResponseWriter, r *http.Request, tunNet *netstack.Ne
 					dialAddr = addr
 				}
 
-				return tunNet.DialContext(ctx, network, dialAddr)
+				return dial(ctx, network, dialAddr)
 			},
 		},
 	}
@@ -403,6 +333,10 @@ func handleHTTPProxy(w http.ResponseWriter, r *http.Request, tunNet *netstack.Ne
 	req.Header = r.Header.Clone()
 
 	resp, err := client.Do(req)
+	if errors.Is(err, api.ErrBlocked) {
+		http.Error(w, "Destination blocked", http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to reach destination", http.StatusServiceUnavailable)
 		return
@@ -435,20 +369,29 @@ func init() {
 	httpProxyCmd.Flags().IntP("connect-port", "P", 443, "Used port for MASQUE connection")
 	httpProxyCmd.Flags().StringArrayP("dns", "d", []string{"9.9.9.9", "149.112.112.112", "2620:fe::fe", "2620:fe::9"}, "DNS servers for the tunnel stack; with -l also used for proxy name lookups (unless --system-dns)")
 	httpProxyCmd.Flags().DurationP("dns-timeout", "t", 2*time.Second, "Timeout for DNS queries")
-	httpProxyCmd.Flags().BoolP("ipv6", "6", false, "Use IPv6 for MASQUE connection")
+	httpProxyCmd.Flags().BoolP("ipv6", "6", false, "Prefer IPv6 for MASQUE connection")
+	httpProxyCmd.Flags().Bool("no-happy-eyeballs", false, "Only use the address family chosen by --ipv6 instead of racing IPv4 and IPv6")
 	httpProxyCmd.Flags().BoolP("no-tunnel-ipv4", "F", false, "Disable IPv4 inside the MASQUE tunnel")
 	httpProxyCmd.Flags().BoolP("no-tunnel-ipv6", "S", false, "Disable IPv6 inside the MASQUE tunnel")
-	httpProxyCmd.Flags().StringP("sni-address", "s", internal.ConnectSNI, "SNI address to use for MASQUE connection")
+	httpProxyCmd.Flags().StringP("sni-address", "s", internal.ConnectSNI, sniHelp)
 	httpProxyCmd.Flags().DurationP("keepalive-period", "k", 30*time.Second, "Keepalive period for MASQUE connection")
 	httpProxyCmd.Flags().IntP("mtu", "m", 1280, "MTU for MASQUE connection")
 	httpProxyCmd.Flags().Uint16P("initial-packet-size", "i", 0, "Custom initial packet size for MASQUE connection (default: auto with PMTU discovery)")
-	httpProxyCmd.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Delay between reconnect attempts")
+	httpProxyCmd.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Initial delay between reconnect attempts, doubled on every further failure")
+	httpProxyCmd.Flags().Duration("max-reconnect-delay", api.DefaultMaxReconnectDelay, "Maximum delay between reconnect attempts, also used after errors retrying won't fix")
 	httpProxyCmd.Flags().Bool("always-reconnect", false, "Always reconnect after tunnel loss, even when idle")
 	httpProxyCmd.Flags().Bool("http2", false, "Use HTTP/2 over TCP+TLS instead of HTTP/3 over QUIC."+config.EndpointHelpSuffixH2)
+	httpProxyCmd.Flags().Bool("http2-fallback", false, "Fall back to HTTP/2 when HTTP/3 keeps failing, e.g. because UDP is blocked."+config.EndpointHelpSuffixH2)
+	httpProxyCmd.Flags().Duration("http3-probe-interval", api.DefaultH3ProbeInterval, "How often to retry HTTP/3 while the HTTP/2 fallback is in use")
 	httpProxyCmd.Flags().Bool("insecure", false, "Disable endpoint certificate pinning and trust any certificate")
+	httpProxyCmd.Flags().Bool("pq", false, "Only use the post-quantum hybrid X25519MLKEM768 key exchange, over HTTP/3 and HTTP/2")
 	httpProxyCmd.Flags().BoolP("local-dns", "l", false, "Do not send proxy DNS through the tunnel; use -d over the host instead. Add --system-dns to use the OS resolver instead of -d")
 	httpProxyCmd.Flags().Bool("system-dns", false, "With -l, resolve names via the OS (e.g. /etc/resolv.conf) instead of -d")
 	httpProxyCmd.Flags().String("on-connect", "", "Path to an executable to run after each successful tunnel connect (no args; context via USQUE_* env vars)")
 	httpProxyCmd.Flags().String("on-disconnect", "", "Path to an executable to run after each tunnel disconnect (no args; context via USQUE_* env vars)")
+	httpProxyCmd.Flags().String("rules", "", rulesHelp)
+	httpProxyCmd.Flags().Bool("no-migrate", false, "Linux only: Do not migrate the HTTP/3 connection to a new socket when addresses or routes change")
+	addLivenessFlags(httpProxyCmd, true)
+	addClientKeyFlags(httpProxyCmd)
 	rootCmd.AddCommand(httpProxyCmd)
 }
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
@@ -23,23 +24,28 @@ type l4ProxyOptions struct {
 	dnsServers        []string
 	dnsTimeout        time.Duration
 	useIPv6           bool
+	noHappyEyeballs   bool
 	keepalivePeriod   time.Duration
 	initialPacketSize uint16
 	insecure          bool
+	pq                bool
 	localDNS          bool
 	systemDNS         bool
 	onConnect         string
 	onDisconnect      string
+	useHTTP2          bool
+	http2Fallback     bool
+	h3ProbeInterval   time.Duration
+	connections       int
+	prewarm           bool
 }
 
-func buildL4Proxy(cmd *cobra.Command, mode string) (l4ProxyOptions, *api.L4Proxy, error) {
+// buildL4Proxy reads the listener flags of an L4 proxy mode and creates its
+// L4Proxy, see buildL4Dialer.
+func buildL4Proxy(cmd *cobra.Command, mode string, enableUDP bool) (l4ProxyOptions, *api.L4Proxy, error) {
 	var opts l4ProxyOptions
 	var err error
 
-	if !config.ConfigLoaded {
-		return opts, nil, fmt.Errorf("config not loaded: please register first")
-	}
-
 	if opts.bind, err = cmd.Flags().GetString("bind"); err != nil {
 		return opts, nil, fmt.Errorf("failed to get bind address: %v", err)
 	}
@@ -52,38 +58,85 @@ func buildL4Proxy(cmd *cobra.Command, mode string) (l4ProxyOptions, *api.L4Proxy
 	if opts.password, err = cmd.Flags().GetString("password"); err != nil {
 		return opts, nil, fmt.Errorf("failed to get password: %v", err)
 	}
+	proxy, err := buildL4Dialer(cmd, mode, enableUDP, &opts)
+	return opts, proxy, err
+}
+
+// buildL4Dialer creates an L4Proxy from the flags of addL4DialerFlags,
+// which are stored in opts. Its hooks get USQUE_MODE set to mode.
+func buildL4Dialer(cmd *cobra.Command, mode string, enableUDP bool, opts *l4ProxyOptions) (*api.L4Proxy, error) {
+	var err error
+
+	if !config.ConfigLoaded {
+		return nil, fmt.Errorf("config not loaded: please register first")
+	}
+
 	if opts.connectPort, err = cmd.Flags().GetInt("connect-port"); err != nil {
-		return opts, nil, fmt.Errorf("failed to get connect port: %v", err)
+		return nil, fmt.Errorf("failed to get connect port: %v", err)
 	}
 	if opts.dnsServers, err = cmd.Flags().GetStringArray("dns"); err != nil {
-		return opts, nil, fmt.Errorf("failed to get DNS servers: %v", err)
+		return nil, fmt.Errorf("failed to get DNS servers: %v", err)
 	}
 	if opts.dnsTimeout, err = cmd.Flags().GetDuration("dns-timeout"); err != nil {
-		return opts, nil, fmt.Errorf("failed to get DNS timeout: %v", err)
+		return nil, fmt.Errorf("failed to get DNS timeout: %v", err)
 	}
 	if opts.useIPv6, err = cmd.Flags().GetBool("ipv6"); err != nil {
-		return opts, nil, fmt.Errorf("failed to get ipv6 flag: %v", err)
+		return nil, fmt.Errorf("failed to get ipv6 flag: %v", err)
+	}
+	if opts.noHappyEyeballs, err = cmd.Flags().GetBool("no-happy-eyeballs"); err != nil {
+		return nil, fmt.Errorf("failed to get no-happy-eyeballs flag: %v", err)
 	}
 	if opts.keepalivePeriod, err = cmd.Flags().GetDuration("keepalive-period"); err != nil {
-		return opts, nil, fmt.Errorf("failed to get keepalive period: %v", err)
+		return nil, fmt.Errorf("failed to get keepalive period: %v", err)
 	}
 	if opts.initialPacketSize, err = cmd.Flags().GetUint16("initial-packet-size"); err != nil {
-		return opts, nil, fmt.Errorf("failed to get initial packet size: %v", err)
+		return nil, fmt.Errorf("failed to get initial packet size: %v", err)
 	}
 	if opts.insecure, err = cmd.Flags().GetBool("insecure"); err != nil {
-		return opts, nil, fmt.Errorf("failed to get insecure flag: %v", err)
+		return nil, fmt.Errorf("failed to get insecure flag: %v", err)
+	}
+	if opts.pq, err = cmd.Flags().GetBool("pq"); err != nil {
+		return nil, fmt.Errorf("failed to get pq flag: %v", err)
 	}
 	if opts.localDNS, err = cmd.Flags().GetBool("local-dns"); err != nil {
-		return opts, nil, fmt.Errorf("failed to get local-dns flag: %v", err)
+		return nil, fmt.Errorf("failed to get local-dns flag: %v", err)
 	}
 	if opts.systemDNS, err = cmd.Flags().GetBool("system-dns"); err != nil {
-		return opts, nil, fmt.Errorf("failed to get system-dns flag: %v", err)
+		return nil, fmt.Errorf("failed to get system-dns flag: %v", err)
 	}
 	if opts.onConnect, err = cmd.Flags().GetString("on-connect"); err != nil {
-		return opts, nil, fmt.Errorf("failed to get on-connect flag: %v", err)
+		return nil, fmt.Errorf("failed to get on-connect flag: %v", err)
 	}
 	if opts.onDisconnect, err = cmd.Flags().GetString("on-disconnect"); err != nil {
-		return opts, nil, fmt.Errorf("failed to get on-disconnect flag: %v", err)
+		return nil, fmt.Errorf("failed to get on-disconnect flag: %v", err)
+	}
+	if opts.useHTTP2, err = cmd.Flags().GetBool("http2"); err != nil {
+		return nil, fmt.Errorf("failed to get HTTP/2 flag: %v", err)
+	}
+	if opts.http2Fallback, err = cmd.Flags().GetBool("http2-fallback"); err != nil {
+		return nil, fmt.Errorf("failed to get HTTP/2 fallback flag: %v", err)
+	}
+	if opts.h3ProbeInterval, err = cmd.Flags().GetDuration("http3-probe-interval"); err != nil {
+		return nil, fmt.Errorf("failed to get HTTP/3 probe interval: %v", err)
+	}
+	if opts.connections, err = cmd.Flags().GetInt("connections"); err != nil {
+		return nil, fmt.Errorf("failed to get connections: %v", err)
+	}
+	if opts.prewarm, err = cmd.Flags().GetBool("prewarm"); err != nil {
+		return nil, fmt.Errorf("failed to get prewarm flag: %v", err)
+	}
+	sni, err := masqueSNI(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get SNI address: %v", err)
+	}
+	split, err := splitTunnel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply split tunnel policy: %v", err)
+	}
+	logZeroTrust(mode)
+	rules, err := loadRules(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load routing rules: %v", err)
 	}
 	if opts.systemDNS && !opts.localDNS {
 		log.Println("Warning: --system-dns only applies with -l; ignoring")
@@ -92,36 +145,67 @@ func buildL4Proxy(cmd *cobra.Command, mode string) (l4ProxyOptions, *api.L4Proxy
 
 	privKey, err := config.AppConfig.GetEcPrivateKey()
 	if err != nil {
-		return opts, nil, fmt.Errorf("failed to get private key: %v", err)
+		return nil, fmt.Errorf("failed to get private key: %v", err)
 	}
 	peerPubKey, err := config.AppConfig.GetEcEndpointPublicKey()
 	if err != nil {
-		return opts, nil, fmt.Errorf("failed to get public key: %v", err)
+		return nil, fmt.Errorf("failed to get public key: %v", err)
 	}
-	cert, err := internal.GenerateCert(privKey, &privKey.PublicKey)
+	minter, err := certMinter(cmd, privKey)
 	if err != nil {
-		return opts, nil, fmt.Errorf("failed to generate cert: %v", err)
+		return nil, fmt.Errorf("failed to prepare client certificates: %v", err)
 	}
-	tlsConfig, err := api.PrepareTlsConfig(privKey, peerPubKey, cert, internal.L4ConnectSNI, opts.insecure)
+	tlsConfig, err := api.PrepareTlsConfig(privKey, peerPubKey, nil, sni, opts.insecure)
 	if err != nil {
-		return opts, nil, fmt.Errorf("failed to prepare TLS config: %v", err)
+		return nil, fmt.Errorf("failed to prepare TLS config: %v", err)
+	}
+	minter.Attach(tlsConfig)
+	if opts.pq {
+		api.EnablePostQuantum(tlsConfig)
+	}
+	if err := startKeyRotation(cmd, minter, tlsConfig, nil); err != nil {
+		return nil, fmt.Errorf("failed to start key rotation: %v", err)
 	}
 	if opts.insecure {
 		config.WarnInsecure()
 	}
 
-	endpointAddr, err := config.SelectEndpointFromConfig(false, opts.useIPv6, opts.connectPort)
-	if err != nil {
-		return opts, nil, fmt.Errorf("failed to select endpoint: %v", err)
+	var endpoint, altEndpoint *net.UDPAddr
+	if !opts.useHTTP2 {
+		endpointAddr, altEndpointAddr, err := config.SelectEndpointsFromConfig(false, opts.useIPv6, opts.connectPort)
+		if err != nil {
+			return nil, fmt.Errorf("failed to select endpoint: %v", err)
+		}
+		var ok bool
+		if endpoint, ok = endpointAddr.(*net.UDPAddr); !ok {
+			return nil, fmt.Errorf("l4 proxy requires an HTTP/3 UDP endpoint")
+		}
+		if !opts.noHappyEyeballs && altEndpointAddr != nil {
+			altEndpoint = altEndpointAddr.(*net.UDPAddr)
+		}
 	}
-	endpoint, ok := endpointAddr.(*net.UDPAddr)
-	if !ok {
-		return opts, nil, fmt.Errorf("l4 proxy requires an HTTP/3 UDP endpoint")
+
+	var h2Endpoint *net.TCPAddr
+	if opts.useHTTP2 || opts.http2Fallback {
+		endpointAddr, err := config.SelectEndpointFromConfig(true, opts.useIPv6, opts.connectPort)
+		if err != nil {
+			return nil, fmt.Errorf("failed to select HTTP/2 endpoint: %v", err)
+		}
+		h2Endpoint = endpointAddr.(*net.TCPAddr)
+		if opts.useHTTP2 {
+			config.LogHTTP2Endpoint(h2Endpoint)
+		} else {
+			log.Printf("HTTP/2 fallback enabled using endpoint %s", h2Endpoint)
+		}
+	}
+	if opts.useHTTP2 && enableUDP {
+		log.Println("Warning: UDP is only proxied over HTTP/3; serving TCP only")
+		enableUDP = false
 	}
 
 	dnsAddrs, err := parseDNSAddrs(opts.dnsServers)
 	if err != nil {
-		return opts, nil, fmt.Errorf("failed to parse DNS server: %v", err)
+		return nil, fmt.Errorf("failed to parse DNS server: %v", err)
 	}
 
 	hookEnv := map[string]string{
@@ -129,6 +213,7 @@ func buildL4Proxy(cmd *cobra.Command, mode string) (l4ProxyOptions, *api.L4Proxy
 		"USQUE_IPV4": config.AppConfig.IPv4,
 		"USQUE_IPV6": config.AppConfig.IPv6,
 	}
+	splitTunnelHookEnv(hookEnv)
 
 	resolver := &internal.TunnelDNSResolver{
 		DNSAddrs:      dnsAddrs,
@@ -137,11 +222,20 @@ func buildL4Proxy(cmd *cobra.Command, mode string) (l4ProxyOptions, *api.L4Proxy
 	}
 
 	proxy, err := api.NewL4Proxy(api.L4ProxyConfig{
-		TLSConfig:      tlsConfig,
-		QUICConfig:     l4QUICConfig(opts.keepalivePeriod, opts.initialPacketSize),
-		Endpoint:       endpoint,
-		DNSResolver:    resolver,
-		ResolveLocally: opts.localDNS,
+		TLSConfig:       tlsConfig,
+		QUICConfig:      l4QUICConfig(opts.keepalivePeriod, opts.initialPacketSize),
+		Endpoint:        endpoint,
+		AltEndpoint:     altEndpoint,
+		Ports:           config.AppConfig.Ports,
+		DNSResolver:     resolver,
+		ResolveLocally:  opts.localDNS,
+		EnableUDP:       enableUDP,
+		H2Endpoint:      h2Endpoint,
+		UseHTTP2:        opts.useHTTP2,
+		H3ProbeInterval: opts.h3ProbeInterval,
+		Connections:     opts.connections,
+		Rules:           rules,
+		SplitTunnel:     split,
 		OnConnect: func(target string) {
 			env := cloneHookEnv(hookEnv)
 			env["USQUE_EVENT"] = "connect"
@@ -156,10 +250,17 @@ func buildL4Proxy(cmd *cobra.Command, mode string) (l4ProxyOptions, *api.L4Proxy
 		},
 	})
 	if err != nil {
-		return opts, nil, fmt.Errorf("failed to create l4 proxy: %v", err)
+		return nil, fmt.Errorf("failed to create l4 proxy: %v", err)
+	}
+	if opts.prewarm {
+		go func() {
+			if err := proxy.Prewarm(context.Background()); err != nil {
+				log.Printf("Failed to prewarm connections: %v", err)
+			}
+		}()
 	}
 
-	return opts, proxy, nil
+	return proxy, nil
 }
 
 func l4QUICConfig(keepalivePeriod time.Duration, initialPacketSize uint16) *quic.Config {
@@ -205,15 +306,31 @@ func addL4ProxyFlags(cmd *cobra.Command, defaultPort, proxyName string) {
 	cmd.Flags().StringP("port", "p", defaultPort, "Port to listen on for "+proxyName+" proxy")
 	cmd.Flags().StringP("username", "u", "", "Username for proxy authentication (specify both username and password to enable)")
 	cmd.Flags().StringP("password", "w", "", "Password for proxy authentication (specify both username and password to enable)")
+	addL4DialerFlags(cmd, true)
+}
+
+// addL4DialerFlags adds the flags of buildL4Dialer to cmd. localDNS is the
+// default of --local-dns.
+func addL4DialerFlags(cmd *cobra.Command, localDNS bool) {
 	cmd.Flags().IntP("connect-port", "P", 443, "Used port for MASQUE connection")
+	cmd.Flags().StringP("sni-address", "s", internal.L4ConnectSNI, sniHelp)
 	cmd.Flags().StringArrayP("dns", "d", []string{"9.9.9.9", "149.112.112.112", "2620:fe::fe", "2620:fe::9"}, "DNS servers for local proxy name lookups with -l (unless --system-dns)")
 	cmd.Flags().DurationP("dns-timeout", "t", 2*time.Second, "Timeout for DNS queries")
-	cmd.Flags().BoolP("ipv6", "6", false, "Use IPv6 for MASQUE connection")
+	cmd.Flags().BoolP("ipv6", "6", false, "Prefer IPv6 for MASQUE connection")
+	cmd.Flags().Bool("no-happy-eyeballs", false, "Only use the address family chosen by --ipv6 instead of racing IPv4 and IPv6")
 	cmd.Flags().DurationP("keepalive-period", "k", 30*time.Second, "Keepalive period for MASQUE connection")
 	cmd.Flags().Uint16P("initial-packet-size", "i", 0, "Custom initial packet size for MASQUE connection (default: auto with PMTU discovery)")
 	cmd.Flags().Bool("insecure", false, "Disable endpoint certificate pinning and trust any certificate")
-	cmd.Flags().BoolP("local-dns", "l", true, "Resolve proxy target names locally before opening L4 CONNECT streams (required for hostname targets)")
+	cmd.Flags().Bool("pq", false, "Only use the post-quantum hybrid X25519MLKEM768 key exchange")
+	cmd.Flags().BoolP("local-dns", "l", localDNS, "Resolve target names locally with -d before opening L4 CONNECT streams, instead of letting the endpoint resolve them")
 	cmd.Flags().Bool("system-dns", false, "Resolve names via the OS (e.g. /etc/resolv.conf) instead of -d")
 	cmd.Flags().String("on-connect", "", "Path to an executable to run after each successful L4 CONNECT stream (no args; context via USQUE_* env vars)")
 	cmd.Flags().String("on-disconnect", "", "Path to an executable to run after each L4 CONNECT stream closes (no args; context via USQUE_* env vars)")
+	cmd.Flags().Bool("http2", false, "Use HTTP/2 CONNECT streams over TCP+TLS instead of HTTP/3 over QUIC."+config.EndpointHelpSuffixH2)
+	cmd.Flags().Bool("http2-fallback", false, "Fall back to HTTP/2 when HTTP/3 keeps failing, e.g. because UDP is blocked."+config.EndpointHelpSuffixH2)
+	cmd.Flags().Duration("http3-probe-interval", api.DefaultH3ProbeInterval, "How often to retry HTTP/3 while the HTTP/2 fallback is in use")
+	cmd.Flags().Int("connections", 1, "Number of QUIC connections to spread L4 streams over, each new stream uses the least loaded one")
+	cmd.Flags().Bool("prewarm", false, "Open all --connections at startup instead of when first needed")
+	cmd.Flags().String("rules", "", rulesHelp)
+	addClientKeyFlags(cmd)
 }
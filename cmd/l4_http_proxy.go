@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -19,7 +20,7 @@ var l4HTTPProxyCmd = &cobra.Command{
 	Short: "Expose Warp as an L4 TCP-only HTTP proxy with CONNECT support",
 	Long:  "TCP-only HTTP proxy using direct HTTP/3 CONNECT streams. Doesn't require elevated privileges.",
 	Run: func(cmd *cobra.Command, args []string) {
-		opts, proxy, err := buildL4Proxy(cmd, "l4-http-proxy")
+		opts, proxy, err := buildL4Proxy(cmd, "l4-http-proxy", false)
 		if err != nil {
 			cmd.Println(err)
 			return
@@ -38,6 +39,7 @@ var l4HTTPProxyCmd = &cobra.Command{
 					http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
 					return
 				}
+				r = withClientAddr(r)
 				if r.Method == http.MethodConnect {
 					handleL4HTTPConnect(w, r, proxy)
 					return
@@ -61,6 +63,10 @@ func handleL4HTTPConnect(w http.ResponseWriter, r *http.Request, proxy *api.L4Pr
 	}
 
 	destConn, err := proxy.DialContext(r.Context(), target)
+	if errors.Is(err, api.ErrBlocked) {
+		http.Error(w, "Destination blocked", http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		log.Printf("l4 http proxy: connect %s failed: %v", target, err)
 		http.Error(w, "Unable to connect to destination", http.StatusServiceUnavailable)
@@ -110,6 +116,10 @@ func handleL4HTTPForward(w http.ResponseWriter, r *http.Request, proxy *api.L4Pr
 	req.Header.Del("Proxy-Connection")
 
 	resp, err := transport.RoundTrip(req)
+	if errors.Is(err, api.ErrBlocked) {
+		http.Error(w, "Destination blocked", http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		log.Printf("l4 http proxy: request to %s failed: %v", req.URL, err)
 		http.Error(w, "Failed to reach destination", http.StatusServiceUnavailable)
@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/spf13/cobra"
+)
+
+var l4PortFwCmd = &cobra.Command{
+	Use:   "l4-portfw",
+	Short: "Forward local ports through L4 CONNECT streams",
+	Long: "Forwards local ports like portfw -L, but opens a direct HTTP/3 CONNECT stream per connection instead of running a virtual TUN device." +
+		" Remote hosts may be names, which are resolved by the endpoint unless --local-dns is set. TCP only. Doesn't require elevated privileges.",
+	Run: func(cmd *cobra.Command, args []string) {
+		localPorts, err := cmd.Flags().GetStringArray("local-ports")
+		if err != nil {
+			cmd.Printf("Failed to get local ports: %v\n", err)
+			return
+		}
+		if len(localPorts) == 0 {
+			cmd.Println("No port mappings given. Use -L to forward local ports.")
+			return
+		}
+
+		var portMappings []internal.PortMapping
+		for _, port := range localPorts {
+			portMapping, err := internal.ParseUnresolvedPortMapping(port)
+			if err != nil {
+				cmd.Printf("Failed to parse local port mapping: %v\n", err)
+				return
+			}
+			portMappings = append(portMappings, portMapping)
+		}
+
+		var opts l4ProxyOptions
+		proxy, err := buildL4Dialer(cmd, "l4-portfw", false, &opts)
+		if err != nil {
+			cmd.Println(err)
+			return
+		}
+
+		errs := make(chan error, len(portMappings))
+		for _, pm := range portMappings {
+			go func(pm internal.PortMapping) {
+				errs <- forwardL4Port(proxy, pm)
+			}(pm)
+		}
+		for range portMappings {
+			if err := <-errs; err != nil {
+				cmd.Printf("Error in local forwarding: %v\n", err)
+			}
+		}
+	},
+}
+
+// forwardL4Port listens on the local side of pm and forwards every accepted
+// connection to its remote side over an L4 CONNECT stream.
+//
+// Parameters:
+//   - proxy: *api.L4Proxy - The proxy opening the CONNECT streams.
+//   - pm: internal.PortMapping - The port mapping, with the remote host left unresolved.
+//
+// Returns:
+//   - error: An error if listening fails.
+func forwardL4Port(proxy *api.L4Proxy, pm internal.PortMapping) error {
+	localAddr := net.JoinHostPort(pm.BindAddress, strconv.Itoa(pm.LocalPort))
+	remoteAddr := net.JoinHostPort(pm.RemoteHost, strconv.Itoa(pm.RemotePort))
+
+	listener, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", localAddr, err)
+	}
+	defer func() { _ = listener.Close() }()
+
+	log.Printf("Local forwarding: Listening on %s, forwarding to remote %s", localAddr, remoteAddr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Accept error on %s: %v", localAddr, err)
+			continue
+		}
+
+		go func() {
+			ctx := context.Background()
+			if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+				ctx = internal.WithClientAddr(ctx, addr.AddrPort().Addr())
+			}
+			remoteConn, err := proxy.DialContext(ctx, remoteAddr)
+			if err != nil {
+				log.Printf("Failed to connect to remote %s: %v", remoteAddr, err)
+				_ = conn.Close()
+				return
+			}
+			api.RelayTCP(conn, remoteConn)
+		}()
+	}
+}
+
+func init() {
+	l4PortFwCmd.Flags().StringArrayP("local-ports", "L", []string{}, "List of port mappings to forward, remote hosts may be names (SSH like e.g. localhost:8080:example.com:80)")
+	// the remote hosts may be names only known to the endpoint
+	addL4DialerFlags(l4PortFwCmd, false)
+	rootCmd.AddCommand(l4PortFwCmd)
+}
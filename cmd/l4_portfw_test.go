@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/internal"
+)
+
+func TestL4PortFwResolvesRemotely(t *testing.T) {
+	if def := l4PortFwCmd.Flags().Lookup("local-dns").DefValue; def != "false" {
+		t.Errorf("l4-portfw resolves locally by default (--local-dns=%s)", def)
+	}
+	if def := l4SocksCmd.Flags().Lookup("local-dns").DefValue; def != "true" {
+		t.Errorf("l4-socks resolves remotely by default (--local-dns=%s)", def)
+	}
+
+	// an endpoint reporting the targets of its CONNECT streams
+	targets := make(chan string, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		targets <- r.Host
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := api.PrepareTlsConfig(key, nil, nil, internal.L4ConnectSNI, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := api.NewL4Proxy(api.L4ProxyConfig{
+		TLSConfig:  tlsConfig,
+		H2Endpoint: server.Listener.Addr().(*net.TCPAddr),
+		UseHTTP2:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	localPort := ln.Addr().(*net.TCPAddr).Port
+	_ = ln.Close()
+	pm, err := internal.ParseUnresolvedPortMapping("127.0.0.1:" + strconv.Itoa(localPort) + ":intranet.invalid:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = forwardL4Port(proxy, pm) }()
+
+	var conn net.Conn
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort)))
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("forward is not listening: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	defer func() { _ = conn.Close() }()
+
+	select {
+	case target := <-targets:
+		if target != "intranet.invalid:443" {
+			t.Errorf("requested %s, want the unresolved name", target)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no CONNECT stream was opened")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"log"
 	"net"
+	"time"
 
 	"github.com/Diniboy1123/usque/internal"
 	"github.com/spf13/cobra"
@@ -11,10 +12,21 @@ import (
 
 var l4SocksCmd = &cobra.Command{
 	Use:   "l4-socks",
-	Short: "Expose Warp as an L4 TCP-only SOCKS5 proxy",
-	Long:  "TCP-only SOCKS5 proxy using direct HTTP/3 CONNECT streams. Doesn't require elevated privileges.",
+	Short: "Expose Warp as an L4 SOCKS5 proxy",
+	Long:  "SOCKS5 proxy using direct HTTP/3 CONNECT streams for TCP and CONNECT-UDP streams for UDP ASSOCIATE. Doesn't require elevated privileges.",
 	Run: func(cmd *cobra.Command, args []string) {
-		opts, proxy, err := buildL4Proxy(cmd, "l4-socks")
+		tcpOnly, err := cmd.Flags().GetBool("tcp-only")
+		if err != nil {
+			cmd.Printf("Failed to get tcp-only flag: %v\n", err)
+			return
+		}
+		udpTimeout, err := cmd.Flags().GetDuration("udp-timeout")
+		if err != nil {
+			cmd.Printf("Failed to get UDP timeout: %v\n", err)
+			return
+		}
+
+		opts, proxy, err := buildL4Proxy(cmd, "l4-socks", !tcpOnly)
 		if err != nil {
 			cmd.Println(err)
 			return
@@ -28,8 +40,12 @@ var l4SocksCmd = &cobra.Command{
 			DialTCP: func(ctx context.Context, network, address string) (net.Conn, error) {
 				return proxy.DialContext(ctx, address)
 			},
-			TCPOnly: true,
-			Logger:  log.Default(),
+			DialUDP: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return proxy.DialUDP(ctx, address)
+			},
+			TCPOnly:    tcpOnly || opts.useHTTP2,
+			UDPTimeout: udpTimeout,
+			Logger:     log.Default(),
 		})
 		if err != nil {
 			cmd.Printf("Failed to create SOCKS proxy: %v\n", err)
@@ -45,5 +61,7 @@ var l4SocksCmd = &cobra.Command{
 
 func init() {
 	addL4ProxyFlags(l4SocksCmd, "1080", "SOCKS")
+	l4SocksCmd.Flags().Bool("tcp-only", false, "Refuse UDP ASSOCIATE instead of proxying UDP over CONNECT-UDP")
+	l4SocksCmd.Flags().Duration("udp-timeout", 60*time.Second, "Idle read deadline for each remote UDP relay (SOCKS5 ASSOCIATE), closing its CONNECT-UDP stream. 0 disables the deadline")
 	rootCmd.AddCommand(l4SocksCmd)
 }
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/spf13/cobra"
+)
+
+// addLivenessFlags registers the liveness flags. --liveness-url is only
+// offered by modes with a netstack to send the request through.
+func addLivenessFlags(cmd *cobra.Command, withURL bool) {
+	cmd.Flags().String("liveness-target", "", "Ping this IP address through the tunnel and reconnect when it stops answering, e.g. 1.1.1.1")
+	if withURL {
+		cmd.Flags().String("liveness-url", "", "Request this URL through the tunnel instead of pinging and reconnect when it stops answering")
+	}
+	cmd.Flags().Duration("liveness-interval", api.DefaultLivenessInterval, "Time between liveness probes")
+	cmd.Flags().Int("liveness-max-missed", api.DefaultLivenessMaxMissed, "Failed liveness probes in a row after which the tunnel reconnects")
+	cmd.Flags().Duration("clock-jump-threshold", 0, fmt.Sprintf("Reconnect at once when the wall clock jumps by more than this, e.g. after suspend (default %s with liveness probes, disabled without; negative disables)", api.DefaultClockJumpThreshold))
+}
+
+// livenessConfig reads the flags registered by addLivenessFlags. dial
+// connects through the tunnel for --liveness-url.
+func livenessConfig(cmd *cobra.Command, dial func(ctx context.Context, network, addr string) (net.Conn, error)) (api.LivenessConfig, error) {
+	var liveness api.LivenessConfig
+
+	target, err := cmd.Flags().GetString("liveness-target")
+	if err != nil {
+		return liveness, fmt.Errorf("failed to get liveness target: %v", err)
+	}
+	if target != "" {
+		liveness.Target, err = netip.ParseAddr(target)
+		if err != nil {
+			return liveness, fmt.Errorf("invalid liveness target: %v", err)
+		}
+		source := config.AppConfig.IPv4
+		if liveness.Target.Is6() {
+			source = config.AppConfig.IPv6
+		}
+		liveness.Source, err = netip.ParseAddr(source)
+		if err != nil {
+			return liveness, fmt.Errorf("no tunnel address to ping %s from: %v", target, err)
+		}
+	}
+
+	if cmd.Flags().Lookup("liveness-url") != nil {
+		url, err := cmd.Flags().GetString("liveness-url")
+		if err != nil {
+			return liveness, fmt.Errorf("failed to get liveness URL: %v", err)
+		}
+		if url != "" {
+			liveness.Probe = api.HTTPLivenessProbe(url, dial)
+		}
+	}
+
+	liveness.Interval, err = cmd.Flags().GetDuration("liveness-interval")
+	if err != nil {
+		return liveness, fmt.Errorf("failed to get liveness interval: %v", err)
+	}
+	liveness.MaxMissed, err = cmd.Flags().GetInt("liveness-max-missed")
+	if err != nil {
+		return liveness, fmt.Errorf("failed to get liveness max missed: %v", err)
+	}
+	liveness.ClockJumpThreshold, err = cmd.Flags().GetDuration("clock-jump-threshold")
+	if err != nil {
+		return liveness, fmt.Errorf("failed to get clock jump threshold: %v", err)
+	}
+	return liveness, nil
+}
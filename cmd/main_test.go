@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/Diniboy1123/usque/api/apitest"
+	"github.com/Diniboy1123/usque/config"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// runAsUsqueEnv makes the test binary behave like the usque binary, so that
+// commands calling log.Fatal or reading stdin can be tested in a subprocess.
+const runAsUsqueEnv = "USQUE_TEST_RUN_AS_USQUE"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runAsUsqueEnv) == "1" {
+		if err := Execute(); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// cliEnv is a scratch directory with a config path and a fake API.
+type cliEnv struct {
+	t      *testing.T
+	dir    string
+	config string
+	api    *apitest.Server
+}
+
+func newCLIEnv(t *testing.T) *cliEnv {
+	t.Helper()
+	api := apitest.NewServer()
+	t.Cleanup(api.Close)
+	dir := t.TempDir()
+	return &cliEnv{t: t, dir: dir, config: filepath.Join(dir, "config.json"), api: api}
+}
+
+// run executes usque with args, the config path and API URL prepended, and
+// returns its combined output and exit code.
+func (e *cliEnv) run(stdin string, args ...string) (string, int) {
+	e.t.Helper()
+	cmd := exec.Command(os.Args[0], append([]string{"-c", e.config, "--api-url", e.api.URL}, args...)...)
+	cmd.Env = append(os.Environ(), runAsUsqueEnv+"=1", "TZ=UTC")
+	cmd.Stdin = strings.NewReader(stdin)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		e.t.Fatalf("failed to run usque: %v", err)
+	}
+	return e.normalize(out.String()), cmd.ProcessState.ExitCode()
+}
+
+// mustRun is run that fails the test on a non-zero exit code.
+func (e *cliEnv) mustRun(stdin string, args ...string) string {
+	e.t.Helper()
+	out, code := e.run(stdin, args...)
+	if code != 0 {
+		e.t.Fatalf("usque %s exited with %d:\n%s", strings.Join(args, " "), code, out)
+	}
+	return out
+}
+
+// loadConfig reads the config written by the last command.
+func (e *cliEnv) loadConfig() config.Config {
+	e.t.Helper()
+	if err := config.LoadConfig(e.config); err != nil {
+		e.t.Fatalf("failed to load config: %v", err)
+	}
+	return config.AppConfig
+}
+
+// logStamp matches the log prefix, which also follows prompts mid-line.
+var logStamp = regexp.MustCompile(`\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} [A-Z]+ `)
+
+// normalize strips log timestamps and replaces run specific values.
+func (e *cliEnv) normalize(out string) string {
+	out = logStamp.ReplaceAllString(out, "")
+	out = strings.ReplaceAll(out, e.api.URL, "$API")
+	return strings.ReplaceAll(out, e.dir, "$DIR")
+}
+
+// assertGolden compares got with testdata/<name>.golden, rewriting the file
+// when the -update flag is set.
+func assertGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *updateGolden {
+		if err := os.MkdirAll("testdata", 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read golden file (run with -update to create it): %v", err)
+	}
+	if got != string(want) {
+		t.Errorf("output does not match %s\n--- got ---\n%s\n--- want ---\n%s", path, got, want)
+	}
+}
@@ -3,6 +3,11 @@ package cmd
 import (
 	"context"
 	"log"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/Diniboy1123/usque/api"
@@ -18,6 +23,10 @@ type tunDevice struct {
 	ipv4     bool
 	ipv6     bool
 	persist  bool
+	// addresses are the addresses set up on the device
+	addresses []netip.Prefix
+	// undo removes what was set up outside the device on exit
+	undo []func()
 }
 
 var nativeTunCmd = &cobra.Command{
@@ -30,84 +39,12 @@ var nativeTunCmd = &cobra.Command{
 			return
 		}
 
-		sni, err := cmd.Flags().GetString("sni-address")
+		tunnelConfig, err := buildTunnelConfig(cmd, "nativetun")
 		if err != nil {
-			cmd.Printf("Failed to get SNI address: %v\n", err)
+			cmd.Println(err)
 			return
 		}
 
-		privKey, err := config.AppConfig.GetEcPrivateKey()
-		if err != nil {
-			cmd.Printf("Failed to get private key: %v\n", err)
-			return
-		}
-		peerPubKey, err := config.AppConfig.GetEcEndpointPublicKey()
-		if err != nil {
-			cmd.Printf("Failed to get public key: %v\n", err)
-			return
-		}
-
-		cert, err := internal.GenerateCert(privKey, &privKey.PublicKey)
-		if err != nil {
-			cmd.Printf("Failed to generate cert: %v\n", err)
-			return
-		}
-
-		insecure, err := cmd.Flags().GetBool("insecure")
-		if err != nil {
-			cmd.Printf("Failed to get insecure flag: %v\n", err)
-			return
-		}
-
-		tlsConfig, err := api.PrepareTlsConfig(privKey, peerPubKey, cert, sni, insecure)
-		if err != nil {
-			cmd.Printf("Failed to prepare TLS config: %v\n", err)
-			return
-		}
-
-		keepalivePeriod, err := cmd.Flags().GetDuration("keepalive-period")
-		if err != nil {
-			cmd.Printf("Failed to get keepalive period: %v\n", err)
-			return
-		}
-		initialPacketSize, err := cmd.Flags().GetUint16("initial-packet-size")
-		if err != nil {
-			cmd.Printf("Failed to get initial packet size: %v\n", err)
-			return
-		}
-
-		connectPort, err := cmd.Flags().GetInt("connect-port")
-		if err != nil {
-			cmd.Printf("Failed to get connect port: %v\n", err)
-			return
-		}
-
-		useHTTP2, err := cmd.Flags().GetBool("http2")
-		if err != nil {
-			cmd.Printf("Failed to get HTTP/2 flag: %v\n", err)
-			return
-		}
-
-		useIPv6, err := cmd.Flags().GetBool("ipv6")
-		if err != nil {
-			cmd.Printf("Failed to get ipv6 flag: %v\n", err)
-			return
-		}
-
-		endpoint, err := config.SelectEndpointFromConfig(useHTTP2, useIPv6, connectPort)
-		if err != nil {
-			cmd.Printf("Failed to select endpoint: %v\n", err)
-			return
-		}
-
-		if insecure {
-			config.WarnInsecure()
-		}
-
-		if useHTTP2 {
-			config.LogHTTP2Endpoint(endpoint)
-		}
-
 		tunnelIPv4, err := cmd.Flags().GetBool("no-tunnel-ipv4")
 		if err != nil {
 			cmd.Printf("Failed to get no tunnel IPv4: %v\n", err)
@@ -120,27 +57,12 @@ var nativeTunCmd = &cobra.Command{
 			return
 		}
 
-		mtu, err := cmd.Flags().GetInt("mtu")
-		if err != nil {
-			cmd.Printf("Failed to get MTU: %v\n", err)
-			return
-		}
-		if mtu != 1280 {
-			log.Println("Warning: MTU is not the default 1280. This is not supported. Packet loss and other issues may occur.")
-		}
-
 		setIproute2, err := cmd.Flags().GetBool("no-iproute2")
 		if err != nil {
 			cmd.Printf("Failed to get no set address: %v\n", err)
 			return
 		}
 
-		reconnectDelay, err := cmd.Flags().GetDuration("reconnect-delay")
-		if err != nil {
-			cmd.Printf("Failed to get reconnect delay: %v\n", err)
-			return
-		}
-
 		alwaysReconnect, err := cmd.Flags().GetBool("always-reconnect")
 		if err != nil {
 			cmd.Printf("Failed to get always-reconnect flag: %v\n", err)
@@ -167,21 +89,22 @@ var nativeTunCmd = &cobra.Command{
 			return
 		}
 
-		onConnect, err := cmd.Flags().GetString("on-connect")
+		liveness, err := livenessConfig(cmd, nil)
 		if err != nil {
-			cmd.Printf("Failed to get on-connect flag: %v\n", err)
+			cmd.Printf("Failed to configure liveness probes: %v\n", err)
 			return
 		}
 
-		onDisconnect, err := cmd.Flags().GetString("on-disconnect")
+		split, err := splitTunnel()
 		if err != nil {
-			cmd.Printf("Failed to get on-disconnect flag: %v\n", err)
+			cmd.Printf("Failed to apply split tunnel policy: %v\n", err)
 			return
 		}
+		logZeroTrust("nativetun")
 
 		t := &tunDevice{
 			name:     interfaceName,
-			mtu:      mtu,
+			mtu:      tunnelConfig.MTU,
 			iproute2: !setIproute2,
 			ipv4:     !tunnelIPv4,
 			ipv6:     !tunnelIPv6,
@@ -196,51 +119,65 @@ var nativeTunCmd = &cobra.Command{
 
 		log.Printf("Created TUN device: %s", t.name)
 
-		hookEnv := map[string]string{
-			"USQUE_MODE":  "nativetun",
-			"USQUE_IFACE": t.name,
-			"USQUE_IPV4":  config.AppConfig.IPv4,
-			"USQUE_IPV6":  config.AppConfig.IPv6,
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		if split != nil {
+			endpoints := []net.Addr{tunnelConfig.Endpoint}
+			if tunnelConfig.AltEndpoint != nil {
+				endpoints = append(endpoints, tunnelConfig.AltEndpoint)
+			}
+			if err := t.applySplitTunnel(split, endpoints); err != nil {
+				log.Printf("Failed to set up split tunnel routes: %v", err)
+			}
+			defer func() {
+				for _, undo := range t.undo {
+					undo()
+				}
+			}()
 		}
 
-		go api.MaintainTunnel(context.Background(), api.MaintainTunnelConfig{
-			TLSConfig:         tlsConfig,
-			KeepalivePeriod:   keepalivePeriod,
-			InitialPacketSize: initialPacketSize,
-			Endpoint:          endpoint,
-			Device:            dev,
-			MTU:               mtu,
-			ReconnectDelay:    reconnectDelay,
-			AlwaysReconnect:   alwaysReconnect,
-			UseHTTP2:          useHTTP2,
-			OnConnect:         onConnect,
-			OnDisconnect:      onDisconnect,
-			HookEnv:           hookEnv,
-		})
+		tunnelConfig.HookEnv["USQUE_IFACE"] = t.name
+		splitTunnelHookEnv(tunnelConfig.HookEnv)
+
+		tunnelConfig.Device = dev
+		tunnelConfig.AlwaysReconnect = alwaysReconnect
+		tunnelConfig.Liveness = liveness
+		tunnelConfig.OnEvent = onAddressesAssigned(t.assigner())
+		tunnelConfig.NetworkChanges = networkChanges(cmd, tunnelConfig.UseHTTP2)
+		go api.MaintainTunnel(ctx, tunnelConfig)
 
 		log.Println("Tunnel established, you may now set up routing and DNS")
 
-		select {}
+		<-ctx.Done()
 	},
 }
 
 func init() {
 	nativeTunCmd.Flags().IntP("connect-port", "P", 443, "Used port for MASQUE connection")
-	nativeTunCmd.Flags().BoolP("ipv6", "6", false, "Use IPv6 for MASQUE connection")
+	nativeTunCmd.Flags().BoolP("ipv6", "6", false, "Prefer IPv6 for MASQUE connection")
+	nativeTunCmd.Flags().Bool("no-happy-eyeballs", false, "Only use the address family chosen by --ipv6 instead of racing IPv4 and IPv6")
 	nativeTunCmd.Flags().BoolP("no-tunnel-ipv4", "F", false, "Disable IPv4 inside the MASQUE tunnel")
 	nativeTunCmd.Flags().BoolP("no-tunnel-ipv6", "S", false, "Disable IPv6 inside the MASQUE tunnel")
-	nativeTunCmd.Flags().StringP("sni-address", "s", internal.ConnectSNI, "SNI address to use for MASQUE connection")
+	nativeTunCmd.Flags().StringP("sni-address", "s", internal.ConnectSNI, sniHelp)
 	nativeTunCmd.Flags().DurationP("keepalive-period", "k", 30*time.Second, "Keepalive period for MASQUE connection")
 	nativeTunCmd.Flags().IntP("mtu", "m", 1280, "MTU for MASQUE connection")
 	nativeTunCmd.Flags().Uint16P("initial-packet-size", "i", 0, "Custom initial packet size for MASQUE connection (default: auto with PMTU discovery)")
 	nativeTunCmd.Flags().BoolP("no-iproute2", "I", false, "Linux only: Do not set up IP addresses and do not set the link up")
-	nativeTunCmd.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Delay between reconnect attempts")
+	nativeTunCmd.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Initial delay between reconnect attempts, doubled on every further failure")
+	nativeTunCmd.Flags().Duration("max-reconnect-delay", api.DefaultMaxReconnectDelay, "Maximum delay between reconnect attempts, also used after errors retrying won't fix")
 	nativeTunCmd.Flags().Bool("always-reconnect", false, "Always reconnect after tunnel loss, even when idle")
 	nativeTunCmd.Flags().Bool("http2", false, "Use HTTP/2 over TCP+TLS instead of HTTP/3 over QUIC."+config.EndpointHelpSuffixH2)
+	nativeTunCmd.Flags().Bool("http2-fallback", false, "Fall back to HTTP/2 when HTTP/3 keeps failing, e.g. because UDP is blocked."+config.EndpointHelpSuffixH2)
+	nativeTunCmd.Flags().Duration("http3-probe-interval", api.DefaultH3ProbeInterval, "How often to retry HTTP/3 while the HTTP/2 fallback is in use")
 	nativeTunCmd.Flags().Bool("insecure", false, "Disable endpoint certificate pinning and trust any certificate")
+	nativeTunCmd.Flags().Bool("pq", false, "Only use the post-quantum hybrid X25519MLKEM768 key exchange, over HTTP/3 and HTTP/2")
 	nativeTunCmd.Flags().StringP("interface-name", "n", "", "Custom interface name for the TUN interface")
 	nativeTunCmd.Flags().Bool("persist", false, "Linux only: Keep the TUN interface after exit")
 	nativeTunCmd.Flags().String("on-connect", "", "Path to an executable to run after each successful tunnel connect (no args; context via USQUE_* env vars)")
 	nativeTunCmd.Flags().String("on-disconnect", "", "Path to an executable to run after each tunnel disconnect (no args; context via USQUE_* env vars)")
+	nativeTunCmd.Flags().Bool("no-migrate", false, "Linux only: Do not migrate the HTTP/3 connection to a new socket when addresses or routes change")
+	addLivenessFlags(nativeTunCmd, false)
+	addClientKeyFlags(nativeTunCmd)
 	rootCmd.AddCommand(nativeTunCmd)
 }
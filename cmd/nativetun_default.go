@@ -4,6 +4,9 @@ package cmd
 
 import (
 	"errors"
+	"log"
+	"net"
+	"net/netip"
 
 	"github.com/Diniboy1123/usque/api"
 )
@@ -14,3 +17,15 @@ var longDescription = "Expose Warp as a native TUN device that accepts any IP tr
 func (tun *tunDevice) create() (api.TunnelDevice, error) {
 	return nil, errors.New("nativetun is not supported on this platform")
 }
+
+// assigner returns nil, as reconfiguring the addresses is only supported on
+// Linux.
+func (t *tunDevice) assigner() func(addresses []netip.Prefix) error {
+	return nil
+}
+
+// applySplitTunnel only logs, as routing is only supported on Linux.
+func (t *tunDevice) applySplitTunnel(split *api.SplitTunnel, endpoints []net.Addr) error {
+	log.Println("Split tunnel routes are only set up on Linux, set them up with a hook using USQUE_SPLIT_INCLUDE or USQUE_SPLIT_EXCLUDE.")
+	return nil
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/netip"
+	"slices"
 
 	"github.com/Diniboy1123/usque/api"
 	"github.com/Diniboy1123/usque/config"
@@ -46,6 +48,9 @@ func (t *tunDevice) create() (api.TunnelDevice, error) {
 				}}); err != nil {
 				return nil, fmt.Errorf("failed to add IPv4 address: %v", err)
 			}
+			if addr, err := netip.ParseAddr(config.AppConfig.IPv4); err == nil {
+				t.addresses = append(t.addresses, netip.PrefixFrom(addr, 32))
+			}
 		}
 		if t.ipv6 {
 			if err := netlink.AddrAdd(link, &netlink.Addr{
@@ -55,6 +60,9 @@ func (t *tunDevice) create() (api.TunnelDevice, error) {
 				}}); err != nil {
 				return nil, fmt.Errorf("failed to add IPv6 address: %v", err)
 			}
+			if addr, err := netip.ParseAddr(config.AppConfig.IPv6); err == nil {
+				t.addresses = append(t.addresses, netip.PrefixFrom(addr, 128))
+			}
 		}
 		if err := netlink.LinkSetUp(link); err != nil {
 			return nil, fmt.Errorf("failed to set link up: %v", err)
@@ -68,3 +76,129 @@ func (t *tunDevice) create() (api.TunnelDevice, error) {
 
 	return api.NewWaterAdapter(dev), nil
 }
+
+// assigner returns t.assign, or nil if addresses are not set up by usque.
+func (t *tunDevice) assigner() func(addresses []netip.Prefix) error {
+	if !t.iproute2 {
+		return nil
+	}
+	return t.assign
+}
+
+// assign replaces the addresses of the device with those assigned by the
+// server, skipping disabled address families.
+func (t *tunDevice) assign(addresses []netip.Prefix) error {
+	link, err := netlink.LinkByName(t.name)
+	if err != nil {
+		return fmt.Errorf("failed to get link: %v", err)
+	}
+
+	var next []netip.Prefix
+	for _, p := range addresses {
+		if p.Addr().Is4() && t.ipv4 || p.Addr().Is6() && t.ipv6 {
+			next = append(next, p)
+		}
+	}
+	for _, p := range next {
+		if slices.Contains(t.addresses, p) {
+			continue
+		}
+		if err := netlink.AddrReplace(link, &netlink.Addr{IPNet: prefixIPNet(p)}); err != nil {
+			return fmt.Errorf("failed to add address %s: %v", p, err)
+		}
+		log.Printf("Added assigned address %s to %s", p, t.name)
+	}
+	for _, p := range t.addresses {
+		if slices.Contains(next, p) {
+			continue
+		}
+		if err := netlink.AddrDel(link, &netlink.Addr{IPNet: prefixIPNet(p)}); err != nil {
+			log.Printf("Failed to remove address %s from %s: %v", p, t.name, err)
+			continue
+		}
+		log.Printf("Removed address %s from %s", p, t.name)
+	}
+	t.addresses = next
+	return nil
+}
+
+// prefixIPNet converts p to a *net.IPNet.
+func prefixIPNet(p netip.Prefix) *net.IPNet {
+	return &net.IPNet{
+		IP:   p.Addr().AsSlice(),
+		Mask: net.CIDRMask(p.Bits(), p.Addr().BitLen()),
+	}
+}
+
+// applySplitTunnel routes the prefixes of split: included ones through the
+// device, excluded ones through the gateway the MASQUE endpoints are reached
+// by. Hosts cannot be routed and are skipped.
+func (t *tunDevice) applySplitTunnel(split *api.SplitTunnel, endpoints []net.Addr) error {
+	if !t.iproute2 {
+		log.Println("Skipping split tunnel routes, set them up with a hook using USQUE_SPLIT_INCLUDE or USQUE_SPLIT_EXCLUDE.")
+		return nil
+	}
+	if len(split.Domains) > 0 {
+		log.Printf("Skipping %d split tunnel hosts, they only apply in the proxy modes", len(split.Domains))
+	}
+
+	link, err := netlink.LinkByName(t.name)
+	if err != nil {
+		return fmt.Errorf("failed to get link: %v", err)
+	}
+
+	// excluded prefixes take the path of the endpoint of their family
+	var gateways [2]*netlink.Route
+	if !split.Include {
+		for _, endpoint := range endpoints {
+			addr, err := netip.ParseAddrPort(endpoint.String())
+			if err != nil {
+				continue
+			}
+			routes, err := netlink.RouteGet(addr.Addr().AsSlice())
+			if err != nil || len(routes) == 0 || routes[0].LinkIndex == link.Attrs().Index {
+				continue
+			}
+			gateways[familyIndex(addr.Addr())] = &routes[0]
+		}
+	}
+
+	routed := 0
+	for _, p := range split.Prefixes {
+		route := &netlink.Route{Dst: prefixIPNet(p), LinkIndex: link.Attrs().Index}
+		if !split.Include {
+			gateway := gateways[familyIndex(p.Addr())]
+			if gateway == nil {
+				log.Printf("Skipping excluded %s, no endpoint of its address family to route it like", p)
+				continue
+			}
+			route = &netlink.Route{Dst: prefixIPNet(p), Gw: gateway.Gw, LinkIndex: gateway.LinkIndex}
+		}
+		if err := netlink.RouteReplace(route); err != nil {
+			return fmt.Errorf("failed to add route to %s: %v", p, err)
+		}
+		routed++
+		if !split.Include {
+			// included routes go away with the device, excluded ones not
+			t.undo = append(t.undo, func() {
+				if err := netlink.RouteDel(route); err != nil {
+					log.Printf("Failed to remove route to %s: %v", p, err)
+				}
+			})
+		}
+	}
+	if split.Include {
+		log.Printf("Routed %d included prefixes through %s", routed, t.name)
+	} else {
+		log.Printf("Routed %d excluded prefixes around %s", routed, t.name)
+	}
+	return nil
+}
+
+// familyIndex returns 0 for IPv4 and 1 for IPv6 addresses.
+func familyIndex(addr netip.Addr) int {
+	if addr.Unmap().Is4() {
+		return 0
+	}
+	return 1
+}
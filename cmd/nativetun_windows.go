@@ -4,6 +4,9 @@ package cmd
 
 import (
 	"fmt"
+	"log"
+	"net"
+	"net/netip"
 
 	"github.com/Diniboy1123/usque/api"
 	"github.com/Diniboy1123/usque/config"
@@ -55,3 +58,15 @@ func (t *tunDevice) create() (api.TunnelDevice, error) {
 
 	return api.NewNetstackAdapter(dev), nil
 }
+
+// assigner returns nil, as reconfiguring the addresses is only supported on
+// Linux.
+func (t *tunDevice) assigner() func(addresses []netip.Prefix) error {
+	return nil
+}
+
+// applySplitTunnel only logs, as routing is only supported on Linux.
+func (t *tunDevice) applySplitTunnel(split *api.SplitTunnel, endpoints []net.Addr) error {
+	log.Println("Split tunnel routes are only set up on Linux, set them up with a hook using USQUE_SPLIT_INCLUDE or USQUE_SPLIT_EXCLUDE.")
+	return nil
+}
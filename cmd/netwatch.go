@@ -0,0 +1,28 @@
+package cmd
+
+import (
+	"context"
+	"log"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/spf13/cobra"
+)
+
+// networkChanges watches the host's network so HTTP/3 connections can be
+// migrated, unless --no-migrate is given. It returns nil if not watching.
+func networkChanges(cmd *cobra.Command, useHTTP2 bool) <-chan struct{} {
+	noMigrate, err := cmd.Flags().GetBool("no-migrate")
+	if err != nil {
+		log.Printf("Failed to get no-migrate flag: %v", err)
+		return nil
+	}
+	if noMigrate || useHTTP2 {
+		return nil
+	}
+	changes, err := api.WatchNetworkChanges(context.Background())
+	if err != nil {
+		log.Printf("Connection migration disabled: %v", err)
+		return nil
+	}
+	return changes
+}
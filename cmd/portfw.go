@@ -29,84 +29,12 @@ var portFwCmd = &cobra.Command{
 			return
 		}
 
-		sni, err := cmd.Flags().GetString("sni-address")
+		tunnelConfig, err := buildTunnelConfig(cmd, "portfw")
 		if err != nil {
-			cmd.Printf("Failed to get SNI address: %v\n", err)
+			cmd.Println(err)
 			return
 		}
 
-		privKey, err := config.AppConfig.GetEcPrivateKey()
-		if err != nil {
-			cmd.Printf("Failed to get private key: %v\n", err)
-			return
-		}
-		peerPubKey, err := config.AppConfig.GetEcEndpointPublicKey()
-		if err != nil {
-			cmd.Printf("Failed to get public key: %v\n", err)
-			return
-		}
-
-		cert, err := internal.GenerateCert(privKey, &privKey.PublicKey)
-		if err != nil {
-			cmd.Printf("Failed to generate cert: %v\n", err)
-			return
-		}
-
-		insecure, err := cmd.Flags().GetBool("insecure")
-		if err != nil {
-			cmd.Printf("Failed to get insecure flag: %v\n", err)
-			return
-		}
-
-		tlsConfig, err := api.PrepareTlsConfig(privKey, peerPubKey, cert, sni, insecure)
-		if err != nil {
-			cmd.Printf("Failed to prepare TLS config: %v\n", err)
-			return
-		}
-
-		keepalivePeriod, err := cmd.Flags().GetDuration("keepalive-period")
-		if err != nil {
-			cmd.Printf("Failed to get keepalive period: %v\n", err)
-			return
-		}
-		initialPacketSize, err := cmd.Flags().GetUint16("initial-packet-size")
-		if err != nil {
-			cmd.Printf("Failed to get initial packet size: %v\n", err)
-			return
-		}
-
-		connectPort, err := cmd.Flags().GetInt("connect-port")
-		if err != nil {
-			cmd.Printf("Failed to get connect port: %v\n", err)
-			return
-		}
-
-		useHTTP2, err := cmd.Flags().GetBool("http2")
-		if err != nil {
-			cmd.Printf("Failed to get HTTP/2 flag: %v\n", err)
-			return
-		}
-
-		useIPv6, err := cmd.Flags().GetBool("ipv6")
-		if err != nil {
-			cmd.Printf("Failed to get ipv6 flag: %v\n", err)
-			return
-		}
-
-		endpoint, err := config.SelectEndpointFromConfig(useHTTP2, useIPv6, connectPort)
-		if err != nil {
-			cmd.Printf("Failed to select endpoint: %v\n", err)
-			return
-		}
-
-		if insecure {
-			config.WarnInsecure()
-		}
-
-		if useHTTP2 {
-			config.LogHTTP2Endpoint(endpoint)
-		}
-
 		tunnelIPv4, err := cmd.Flags().GetBool("no-tunnel-ipv4")
 		if err != nil {
 			cmd.Printf("Failed to get no tunnel IPv4: %v\n", err)
@@ -153,15 +81,6 @@ var portFwCmd = &cobra.Command{
 			dnsAddrs = append(dnsAddrs, addr)
 		}
 
-		mtu, err := cmd.Flags().GetInt("mtu")
-		if err != nil {
-			cmd.Printf("Failed to get MTU: %v\n", err)
-			return
-		}
-		if mtu != 1280 {
-			log.Println("Warning: MTU is not the default 1280. This is not supported. Packet loss and other issues may occur.")
-		}
-
 		localPorts, err := cmd.Flags().GetStringArray("local-ports")
 		if err != nil {
 			cmd.Printf("Failed to get local ports: %v\n", err)
@@ -195,12 +114,6 @@ var portFwCmd = &cobra.Command{
 			remotePortMappings = append(remotePortMappings, portMapping)
 		}
 
-		reconnectDelay, err := cmd.Flags().GetDuration("reconnect-delay")
-		if err != nil {
-			cmd.Printf("Failed to get reconnect delay: %v\n", err)
-			return
-		}
-
 		alwaysReconnect := true
 		alwaysChanged := cmd.Flags().Changed("always-reconnect")
 		dontAlwaysChanged := cmd.Flags().Changed("dont-always-reconnect")
@@ -224,45 +137,25 @@ var portFwCmd = &cobra.Command{
 			alwaysReconnect = !dontAlwaysReconnect
 		}
 
-		onConnect, err := cmd.Flags().GetString("on-connect")
-		if err != nil {
-			cmd.Printf("Failed to get on-connect flag: %v\n", err)
-			return
-		}
-
-		onDisconnect, err := cmd.Flags().GetString("on-disconnect")
+		tunDev, tunNet, err := netstack.CreateNetTUN(localAddresses, dnsAddrs, tunnelConfig.MTU)
 		if err != nil {
-			cmd.Printf("Failed to get on-disconnect flag: %v\n", err)
+			cmd.Printf("Failed to create virtual TUN device: %v\n", err)
 			return
 		}
+		defer func() { _ = tunDev.Close() }()
 
-		hookEnv := map[string]string{
-			"USQUE_MODE": "portfw",
-			"USQUE_IPV4": config.AppConfig.IPv4,
-			"USQUE_IPV6": config.AppConfig.IPv6,
-		}
-
-		tunDev, tunNet, err := netstack.CreateNetTUN(localAddresses, dnsAddrs, mtu)
+		liveness, err := livenessConfig(cmd, tunNet.DialContext)
 		if err != nil {
-			cmd.Printf("Failed to create virtual TUN device: %v\n", err)
+			cmd.Printf("Failed to configure liveness probes: %v\n", err)
 			return
 		}
-		defer func() { _ = tunDev.Close() }()
 
-		go api.MaintainTunnel(context.Background(), api.MaintainTunnelConfig{
-			TLSConfig:         tlsConfig,
-			KeepalivePeriod:   keepalivePeriod,
-			InitialPacketSize: initialPacketSize,
-			Endpoint:          endpoint,
-			Device:            api.NewNetstackAdapter(tunDev),
-			MTU:               mtu,
-			ReconnectDelay:    reconnectDelay,
-			AlwaysReconnect:   alwaysReconnect,
-			UseHTTP2:          useHTTP2,
-			OnConnect:         onConnect,
-			OnDisconnect:      onDisconnect,
-			HookEnv:           hookEnv,
-		})
+		tunnelConfig.Device = api.NewNetstackAdapter(tunDev)
+		tunnelConfig.AlwaysReconnect = alwaysReconnect
+		tunnelConfig.Liveness = liveness
+		tunnelConfig.OnEvent = onAddressesAssigned(nil)
+		tunnelConfig.NetworkChanges = networkChanges(cmd, tunnelConfig.UseHTTP2)
+		go api.MaintainTunnel(context.Background(), tunnelConfig)
 
 		log.Printf("Virtual tunnel created, forwarding ports")
 
@@ -405,19 +298,27 @@ func init() {
 	portFwCmd.Flags().StringArrayP("remote-ports", "R", []string{}, "List of port mappings to forward (SSH like e.g. 100.96.0.3:8080:localhost:8080)")
 	portFwCmd.Flags().IntP("connect-port", "P", 443, "Used port for MASQUE connection")
 	portFwCmd.Flags().StringArrayP("dns", "d", []string{"9.9.9.9", "149.112.112.112", "2620:fe::fe", "2620:fe::9"}, "DNS servers to use inside the MASQUE tunnel")
-	portFwCmd.Flags().BoolP("ipv6", "6", false, "Use IPv6 for MASQUE connection")
+	portFwCmd.Flags().BoolP("ipv6", "6", false, "Prefer IPv6 for MASQUE connection")
+	portFwCmd.Flags().Bool("no-happy-eyeballs", false, "Only use the address family chosen by --ipv6 instead of racing IPv4 and IPv6")
 	portFwCmd.Flags().BoolP("no-tunnel-ipv4", "F", false, "Disable IPv4 inside the MASQUE tunnel")
 	portFwCmd.Flags().BoolP("no-tunnel-ipv6", "S", false, "Disable IPv6 inside the MASQUE tunnel")
-	portFwCmd.Flags().StringP("sni-address", "s", internal.ConnectSNI, "SNI address to use for MASQUE connection")
+	portFwCmd.Flags().StringP("sni-address", "s", internal.ConnectSNI, sniHelp)
 	portFwCmd.Flags().DurationP("keepalive-period", "k", 30*time.Second, "Keepalive period for MASQUE connection")
 	portFwCmd.Flags().IntP("mtu", "m", 1280, "MTU for MASQUE connection")
 	portFwCmd.Flags().Uint16P("initial-packet-size", "i", 0, "Custom initial packet size for MASQUE connection (default: auto with PMTU discovery)")
-	portFwCmd.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Delay between reconnect attempts")
+	portFwCmd.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Initial delay between reconnect attempts, doubled on every further failure")
+	portFwCmd.Flags().Duration("max-reconnect-delay", api.DefaultMaxReconnectDelay, "Maximum delay between reconnect attempts, also used after errors retrying won't fix")
 	portFwCmd.Flags().Bool("http2", false, "Use HTTP/2 over TCP+TLS instead of HTTP/3 over QUIC."+config.EndpointHelpSuffixH2)
+	portFwCmd.Flags().Bool("http2-fallback", false, "Fall back to HTTP/2 when HTTP/3 keeps failing, e.g. because UDP is blocked."+config.EndpointHelpSuffixH2)
+	portFwCmd.Flags().Duration("http3-probe-interval", api.DefaultH3ProbeInterval, "How often to retry HTTP/3 while the HTTP/2 fallback is in use")
 	portFwCmd.Flags().Bool("insecure", false, "Disable endpoint certificate pinning and trust any certificate")
+	portFwCmd.Flags().Bool("pq", false, "Only use the post-quantum hybrid X25519MLKEM768 key exchange, over HTTP/3 and HTTP/2")
 	portFwCmd.Flags().Bool("always-reconnect", false, "Always reconnect after tunnel loss, even when idle (default behavior in portfw)")
 	portFwCmd.Flags().Bool("dont-always-reconnect", false, "Disable always reconnect in portfw; reconnect only when new activity arrives")
 	portFwCmd.Flags().String("on-connect", "", "Path to an executable to run after each successful tunnel connect (no args; context via USQUE_* env vars)")
 	portFwCmd.Flags().String("on-disconnect", "", "Path to an executable to run after each tunnel disconnect (no args; context via USQUE_* env vars)")
+	portFwCmd.Flags().Bool("no-migrate", false, "Linux only: Do not migrate the HTTP/3 connection to a new socket when addresses or routes change")
+	addLivenessFlags(portFwCmd, true)
+	addClientKeyFlags(portFwCmd)
 	rootCmd.AddCommand(portFwCmd)
 }
@@ -1,9 +1,14 @@
 package cmd
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/Diniboy1123/usque/api"
 	"github.com/Diniboy1123/usque/config"
@@ -56,9 +61,57 @@ var registerCmd = &cobra.Command{
 			log.Fatalf("Failed to get jwt: %v", err)
 		}
 
-		if jwt != "" {
+		clientID, err := cmd.Flags().GetString("client-id")
+		if err != nil {
+			log.Fatalf("Failed to get client ID: %v", err)
+		}
+
+		clientSecret, err := cmd.Flags().GetString("client-secret")
+		if err != nil {
+			log.Fatalf("Failed to get client secret: %v", err)
+		}
+
+		team, err := cmd.Flags().GetString("team")
+		if err != nil {
+			log.Fatalf("Failed to get team: %v", err)
+		}
+
+		callbackAddr, err := cmd.Flags().GetString("callback-address")
+		if err != nil {
+			log.Fatalf("Failed to get callback address: %v", err)
+		}
+
+		noLinkHandler, err := cmd.Flags().GetBool("no-link-handler")
+		if err != nil {
+			log.Fatalf("Failed to get no-link-handler flag: %v", err)
+		}
+
+		methods := 0
+		for _, set := range []bool{jwt != "", clientID != "", team != ""} {
+			if set {
+				methods++
+			}
+		}
+		if methods > 1 {
+			log.Fatalf("Only one of --jwt, --client-id and --team can be used")
+		}
+		if (clientID == "") != (clientSecret == "") {
+			log.Fatalf("--client-id and --client-secret must be used together")
+		}
+
+		if team != "" {
+			jwt, err = teamLogin(team, callbackAddr, !noLinkHandler)
+			if err != nil {
+				log.Fatalf("Failed to log in: %v", err)
+			}
+		}
+
+		switch {
+		case jwt != "":
 			log.Printf("Registering with locale %s and model %s using jwt authentication", locale, model)
-		} else {
+		case clientID != "":
+			log.Printf("Registering with locale %s and model %s using service token %s", locale, model, clientID)
+		default:
 			log.Printf("Registering with locale %s and model %s", locale, model)
 		}
 
@@ -67,7 +120,8 @@ var registerCmd = &cobra.Command{
 			log.Fatalf("Failed to get accept-tos flag: %v", err)
 		}
 
-		accountData, err := api.Register(model, locale, jwt, acceptTos)
+		auth := api.TeamAuth{JWT: jwt, ClientID: clientID, ClientSecret: clientSecret}
+		accountData, err := api.RegisterTeam(model, locale, auth, acceptTos)
 		if err != nil {
 			log.Fatalf("Failed to register: %v", err)
 		}
@@ -84,22 +138,35 @@ var registerCmd = &cobra.Command{
 			log.Fatalf("Failed to enroll key: %v", err)
 		}
 
+		zeroTrust := config.ZeroTrustFromAccount(updatedAccountData)
+		switch {
+		case zeroTrust != nil:
+			log.Printf("Registered a Zero Trust device of organization %q", zeroTrust.Organization)
+		case jwt != "" || clientID != "":
+			log.Printf("Warning: registered with team credentials, but the API returned a consumer device")
+		}
+
 		log.Printf("Successful registration. Saving config...")
 
+		primary, endpoints, err := config.EndpointsFromPeers(updatedAccountData.Config.Peers)
+		if err != nil {
+			log.Fatalf("Failed to parse endpoints: %v", err)
+		}
+
 		config.AppConfig = config.Config{
-			PrivateKey: base64.StdEncoding.EncodeToString(privKey),
-			// TODO: proper endpoint parsing in utils
-			// strip :0
-			EndpointV4: updatedAccountData.Config.Peers[0].Endpoint.V4[:len(updatedAccountData.Config.Peers[0].Endpoint.V4)-2],
-			// strip [ from beginning and ]:0 from end
-			EndpointV6:     updatedAccountData.Config.Peers[0].Endpoint.V6[1 : len(updatedAccountData.Config.Peers[0].Endpoint.V6)-3],
+			PrivateKey:     base64.StdEncoding.EncodeToString(privKey),
+			EndpointV4:     primary.V4,
+			EndpointV6:     primary.V6,
 			EndpointH2V4:   config.DefaultEndpointH2V4,
 			EndpointH2V6:   config.DefaultEndpointH2V6,
-			EndpointPubKey: updatedAccountData.Config.Peers[0].PublicKey,
+			EndpointPubKey: primary.PubKey,
+			Ports:          primary.Ports,
+			Endpoints:      endpoints,
 			ID:             updatedAccountData.ID,
 			AccessToken:    accountData.Token,
 			IPv4:           updatedAccountData.Config.Interface.Addresses.V4,
 			IPv6:           updatedAccountData.Config.Interface.Addresses.V6,
+			ZeroTrust:      zeroTrust,
 		}
 
 		if err := config.AppConfig.SaveConfig(configPath); err != nil {
@@ -110,11 +177,51 @@ var registerCmd = &cobra.Command{
 	},
 }
 
+// teamLogin waits for the user to log in to team in a browser and returns
+// their token. With linkHandler, the browser passes the link of the success
+// page on to the callback by itself, see captureTeamLogin. Otherwise, or if
+// that fails, the user passes it on.
+func teamLogin(team, callbackAddr string, linkHandler bool) (string, error) {
+	login, err := api.ListenTeamLogin(team, callbackAddr)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = login.Close() }()
+
+	log.Printf("Log in to your organization at %s", login.URL)
+	manual := "Open the link of the success page with %s in place of com.cloudflare.warp://%s.cloudflareaccess.com, or paste it at %s"
+	if linkHandler {
+		restore, err := captureTeamLogin(login.CallbackURL)
+		if err != nil {
+			log.Printf("The browser cannot pass the login on by itself: %v", err)
+		} else {
+			defer restore()
+			log.Printf("When the browser asks to open the com.cloudflare.warp link of the success page, allow it to pass the login on to usque")
+			manual = "If it does not, open the link of the success page with %s in place of com.cloudflare.warp://%s.cloudflareaccess.com, or paste it at %s"
+		}
+	}
+	log.Printf(manual, login.CallbackURL, strings.TrimSuffix(team, ".cloudflareaccess.com"), login.CallbackURL)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	jwt, err := login.Token(ctx)
+	if err != nil {
+		return "", fmt.Errorf("login aborted: %v", err)
+	}
+	log.Printf("Login received")
+	return jwt, nil
+}
+
 func init() {
 	registerCmd.Flags().StringP("locale", "l", internal.DefaultLocale, "locale")
 	registerCmd.Flags().StringP("model", "m", internal.DefaultModel, "model")
 	registerCmd.Flags().StringP("name", "n", "", "device name")
 	registerCmd.Flags().String("jwt", "", "team token")
+	registerCmd.Flags().String("client-id", "", "client ID of an Access service token of a Zero Trust organization")
+	registerCmd.Flags().String("client-secret", "", "client secret of the Access service token")
+	registerCmd.Flags().String("team", "", "team name of a Zero Trust organization to log in to in a browser")
+	registerCmd.Flags().String("callback-address", "127.0.0.1:0", "local address receiving the browser login of --team")
+	registerCmd.Flags().Bool("no-link-handler", false, "with --team, do not make usque the handler of com.cloudflare.warp links during the login, e.g. to leave them to the official client; pass the login on by hand instead")
 	registerCmd.Flags().BoolP("accept-tos", "a", false, "accept Cloudflare TOS (not interactive setup)")
 	rootCmd.AddCommand(registerCmd)
 }
@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/Diniboy1123/usque/api/apitest"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/models"
+)
+
+// register creates a device on the fake API and saves its config,
+// overwriting an existing one.
+func (e *cliEnv) register(args ...string) {
+	e.t.Helper()
+	e.mustRun("y\n", append([]string{"register", "-a"}, args...)...)
+}
+
+// assertEnrolledKey checks that the key in the config is the one the API knows.
+func (e *cliEnv) assertEnrolledKey() {
+	e.t.Helper()
+	cfg := e.loadConfig()
+	privKey, err := cfg.GetEcPrivateKey()
+	if err != nil {
+		e.t.Fatalf("config has no usable private key: %v", err)
+	}
+	pubKey, err := x509.MarshalPKIXPublicKey(&privKey.PublicKey)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	device, ok := e.api.Device(cfg.ID)
+	if !ok {
+		e.t.Fatalf("device %s unknown to the API", cfg.ID)
+	}
+	if device.Key != base64.StdEncoding.EncodeToString(pubKey) {
+		e.t.Fatalf("API has key %s enrolled, config holds a different one", device.Key)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	e := newCLIEnv(t)
+	out := e.mustRun("", "register", "-a", "-n", "laptop")
+	assertGolden(t, "register", out)
+
+	cfg := e.loadConfig()
+	if cfg.ID != "device-2" || cfg.AccessToken != "token-2" {
+		t.Errorf("got ID %q and token %q, want device-2 and token-2", cfg.ID, cfg.AccessToken)
+	}
+	if cfg.EndpointV4 != "162.159.198.1" || cfg.EndpointV6 != "2606:4700:103::1" {
+		t.Errorf("got endpoints %q and %q", cfg.EndpointV4, cfg.EndpointV6)
+	}
+	if cfg.EndpointPubKey != e.api.PeerPublicKey() {
+		t.Errorf("endpoint public key was not saved")
+	}
+	if cfg.IPv4 != "172.16.0.2" || cfg.IPv6 != "2606:4700:110:8000::2" {
+		t.Errorf("got addresses %q and %q", cfg.IPv4, cfg.IPv6)
+	}
+	e.assertEnrolledKey()
+	if device, _ := e.api.Device(cfg.ID); device.Name != "laptop" {
+		t.Errorf("got device name %q, want laptop", device.Name)
+	}
+}
+
+func TestRegisterZeroTrust(t *testing.T) {
+	e := newCLIEnv(t)
+	out := e.mustRun("", "register", "-a", "--jwt", "team-token")
+	assertGolden(t, "register_zero_trust", out)
+
+	want := &config.ZeroTrust{
+		Organization: apitest.TeamOrganization,
+		ServiceMode:  config.ServiceModeWarp,
+		Exclude:      []string{"10.0.0.0/8", "192.168.0.0/16", "intranet.example.com"},
+		FallbackDomains: []config.FallbackDomain{
+			{Suffix: "corp.example.com", DNSServers: []string{"10.0.0.53"}},
+		},
+	}
+	if got := e.loadConfig().ZeroTrust; !reflect.DeepEqual(got, want) {
+		t.Errorf("got Zero Trust policy %+v, want %+v", got, want)
+	}
+
+	// enroll refreshes the policy
+	e.mustRun("", "enroll")
+	if got := e.loadConfig().ZeroTrust; !reflect.DeepEqual(got, want) {
+		t.Errorf("enroll changed the Zero Trust policy to %+v", got)
+	}
+}
+
+func TestRegisterServiceToken(t *testing.T) {
+	e := newCLIEnv(t)
+	out := e.mustRun("", "register", "-a", "--client-id", apitest.ServiceTokenID, "--client-secret", apitest.ServiceTokenSecret)
+	assertGolden(t, "register_service_token", out)
+	if zt := e.loadConfig().ZeroTrust; zt == nil || zt.Organization != apitest.TeamOrganization {
+		t.Errorf("got Zero Trust policy %+v, want one of %s", zt, apitest.TeamOrganization)
+	}
+
+	out, code := e.run("y\n", "register", "-a", "--client-id", apitest.ServiceTokenID, "--client-secret", "wrong")
+	if code != 1 {
+		t.Errorf("got exit code %d with a wrong secret, want 1", code)
+	}
+	assertGolden(t, "register_service_token_invalid", out)
+}
+
+func TestRegisterTosPrompt(t *testing.T) {
+	e := newCLIEnv(t)
+	out, code := e.run("n\n", "register")
+	if code != 1 {
+		t.Errorf("got exit code %d, want 1", code)
+	}
+	assertGolden(t, "register_tos_declined", out)
+	if _, err := os.Stat(e.config); err == nil {
+		t.Errorf("config written although the TOS were declined")
+	}
+
+	out = e.mustRun("y\n", "register")
+	assertGolden(t, "register_tos_accepted", out)
+}
+
+func TestRegisterAPIError(t *testing.T) {
+	e := newCLIEnv(t)
+	e.api.QueueError(http.MethodPost, http.StatusBadRequest,
+		models.ErrorInfo{Code: apitest.CodeBadRequest, Message: "Too many registrations"})
+	out, code := e.run("", "register", "-a")
+	if code != 1 {
+		t.Errorf("got exit code %d, want 1", code)
+	}
+	assertGolden(t, "register_api_error", out)
+}
+
+func TestRegisterExistingConfig(t *testing.T) {
+	e := newCLIEnv(t)
+	e.register()
+	before := e.loadConfig()
+
+	out := e.mustRun("n\n", "register", "-a")
+	assertGolden(t, "register_existing_declined", out)
+	if after := e.loadConfig(); !reflect.DeepEqual(after, before) {
+		t.Errorf("config changed although overwriting was declined")
+	}
+
+	e.mustRun("y\n", "register", "-a")
+	if after := e.loadConfig(); after.ID == before.ID {
+		t.Errorf("config was not overwritten")
+	}
+}
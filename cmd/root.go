@@ -2,7 +2,9 @@ package cmd
 
 import (
 	"log"
+	"strings"
 
+	"github.com/Diniboy1123/usque/api"
 	"github.com/Diniboy1123/usque/config"
 	"github.com/Diniboy1123/usque/internal"
 	"github.com/spf13/cobra"
@@ -13,6 +15,12 @@ var rootCmd = &cobra.Command{
 	Short: "Usque Warp CLI",
 	Long:  "An unofficial Cloudflare Warp CLI that uses the MASQUE protocol and exposes the tunnel as various different services.",
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		apiURL, err := cmd.Flags().GetString("api-url")
+		if err != nil {
+			log.Fatalf("Failed to get API URL: %v", err)
+		}
+		api.APIURL = strings.TrimSuffix(apiURL, "/")
+
 		configPath, err := cmd.Flags().GetString("config")
 		if err != nil {
 			log.Fatalf("Failed to get config path: %v", err)
@@ -34,4 +42,5 @@ func Execute() error {
 func init() {
 	internal.InstallDefaultLogTZStamp()
 	rootCmd.PersistentFlags().StringP("config", "c", "config.json", "config file (default is config.json)")
+	rootCmd.PersistentFlags().String("api-url", internal.ApiUrl, "Cloudflare client API base URL")
 }
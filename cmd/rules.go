@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/spf13/cobra"
+)
+
+// rulesHelp is the usage of --rules in the proxy modes.
+const rulesHelp = "Path to a rules file routing connections through the tunnel, directly, to a profile or blocking them (default: tunnel everything)"
+
+// loadRules returns the rules of --rules, nil if it is not set.
+func loadRules(cmd *cobra.Command) (*api.Rules, error) {
+	path, err := cmd.Flags().GetString("rules")
+	if err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return nil, nil
+	}
+	rules, err := api.LoadRules(path)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Loaded %d routing rules and %d profiles from %s", len(rules.Rules), len(rules.Profiles), path)
+	return rules, nil
+}
+
+// withClientAddr returns r with a context carrying the address of its
+// client, for rules matching on it.
+func withClientAddr(r *http.Request) *http.Request {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return r
+	}
+	return r.WithContext(internal.WithClientAddr(r.Context(), addrPort.Addr()))
+}
+
+// resolvingDialer wraps dial so that host names are resolved with resolver
+// first, which the HTTP proxy handlers do themselves without rules.
+func resolvingDialer(dial api.DialFunc, resolver *net.Resolver) api.DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := netip.ParseAddr(host); err != nil {
+			ips, err := resolver.LookupIP(ctx, "ip", host)
+			if err == nil && len(ips) == 0 {
+				err = fmt.Errorf("no address")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("DNS resolution failed for %s: %v", host, err)
+			}
+			addr = net.JoinHostPort(ips[0].String(), port)
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// resolverLookup returns a lookup resolving host names with resolver, for
+// the split tunnel and the rules.
+func resolverLookup(resolver *net.Resolver) func(ctx context.Context, host string) (netip.Addr, error) {
+	return func(ctx context.Context, host string) (netip.Addr, error) {
+		addrs, err := resolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		if len(addrs) == 0 {
+			return netip.Addr{}, fmt.Errorf("no address for %s", host)
+		}
+		return addrs[0].Unmap(), nil
+	}
+}
+
+// dnsResolverLookup returns a lookup resolving host names with resolver, for
+// the split tunnel and the rules.
+func dnsResolverLookup(resolver api.DNSResolver) func(ctx context.Context, host string) (netip.Addr, error) {
+	return func(ctx context.Context, host string) (netip.Addr, error) {
+		ip, err := resolver.Resolve(ctx, host)
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			return netip.Addr{}, fmt.Errorf("invalid address %v for %s", ip, host)
+		}
+		return addr.Unmap(), nil
+	}
+}
@@ -0,0 +1,25 @@
+package cmd
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// fixedResolver answers every name with ip.
+type fixedResolver net.IP
+
+func (r fixedResolver) Resolve(context.Context, string) (net.IP, error) {
+	return net.IP(r), nil
+}
+
+func TestDNSResolverLookup(t *testing.T) {
+	addr, err := dnsResolverLookup(fixedResolver(net.ParseIP("10.1.2.3")))(context.Background(), "db.corp.invalid")
+	if err != nil || addr.String() != "10.1.2.3" {
+		t.Errorf("resolved %v, %v, want 10.1.2.3", addr, err)
+	}
+	// a malformed answer must not become the zero address
+	if addr, err := dnsResolverLookup(fixedResolver{10, 1, 2})(context.Background(), "db.corp.invalid"); err == nil {
+		t.Errorf("malformed answer resolved to %v", addr)
+	}
+}
@@ -0,0 +1,380 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/spf13/cobra"
+)
+
+var serverCmd = &cobra.Command{
+	Use:   "server",
+	Short: "Run a self-hosted MASQUE (CONNECT-IP) server",
+	Long: "Accepts CONNECT-IP over HTTP/3 (and optionally HTTP/2) from usque clients, authenticates them by their" +
+		" pinned ECDSA keys and forwards their traffic to a native TUN device or a userspace NAT." +
+		" Create a server config with 'server init' and clients with 'server add-client'.",
+	Run: func(cmd *cobra.Command, args []string) {
+		serverConfigPath, err := cmd.Flags().GetString("server-config")
+		if err != nil {
+			cmd.Printf("Failed to get server config path: %v\n", err)
+			return
+		}
+
+		serverConfig, err := config.LoadServerConfig(serverConfigPath)
+		if err != nil {
+			cmd.Printf("Failed to load server config: %v\n", err)
+			cmd.Println("You may create one with 'usque server init'.")
+			return
+		}
+
+		bindAddress, err := cmd.Flags().GetString("bind")
+		if err != nil {
+			cmd.Printf("Failed to get bind address: %v\n", err)
+			return
+		}
+
+		port, err := cmd.Flags().GetString("port")
+		if err != nil {
+			cmd.Printf("Failed to get port: %v\n", err)
+			return
+		}
+
+		useHTTP2, err := cmd.Flags().GetBool("http2")
+		if err != nil {
+			cmd.Printf("Failed to get HTTP/2 flag: %v\n", err)
+			return
+		}
+
+		useNetstack, err := cmd.Flags().GetBool("netstack")
+		if err != nil {
+			cmd.Printf("Failed to get netstack flag: %v\n", err)
+			return
+		}
+
+		interfaceName, err := cmd.Flags().GetString("interface-name")
+		if err != nil {
+			cmd.Printf("Failed to get interface name: %v\n", err)
+			return
+		}
+
+		mtu, err := cmd.Flags().GetInt("mtu")
+		if err != nil {
+			cmd.Printf("Failed to get MTU: %v\n", err)
+			return
+		}
+
+		keepalivePeriod, err := cmd.Flags().GetDuration("keepalive-period")
+		if err != nil {
+			cmd.Printf("Failed to get keepalive period: %v\n", err)
+			return
+		}
+
+		udpTimeout, err := cmd.Flags().GetDuration("udp-timeout")
+		if err != nil {
+			cmd.Printf("Failed to get UDP timeout: %v\n", err)
+			return
+		}
+
+		privKey, err := serverConfig.GetEcPrivateKey()
+		if err != nil {
+			cmd.Printf("Failed to get server private key: %v\n", err)
+			return
+		}
+
+		var clients []api.ServerClient
+		for _, c := range serverConfig.Clients {
+			pubKey, err := c.GetEcPublicKey()
+			if err != nil {
+				cmd.Printf("Failed to load client: %v\n", err)
+				return
+			}
+			client := api.ServerClient{Name: c.Name, PublicKey: pubKey}
+			for _, addr := range []string{c.IPv4, c.IPv6} {
+				if addr == "" {
+					continue
+				}
+				ip, err := netip.ParseAddr(addr)
+				if err != nil {
+					cmd.Printf("Invalid address %q of client %q: %v\n", addr, c.Name, err)
+					return
+				}
+				client.Addresses = append(client.Addresses, netip.PrefixFrom(ip, ip.BitLen()))
+			}
+			clients = append(clients, client)
+		}
+		if len(clients) == 0 {
+			log.Println("Warning: no clients configured, nobody will be able to connect. Add one with 'usque server add-client'.")
+		}
+
+		var device api.TunnelDevice
+		if useNetstack {
+			natStack, err := internal.NewNATStack(mtu, udpTimeout)
+			if err != nil {
+				cmd.Printf("Failed to create NAT netstack: %v\n", err)
+				return
+			}
+			defer func() { _ = natStack.Close() }()
+			device = natStack
+			log.Println("Forwarding client traffic through the userspace NAT (TCP and UDP only)")
+		} else {
+			v4Pool, v6Pool, err := serverConfig.GetPools()
+			if err != nil {
+				cmd.Printf("Failed to parse address pools: %v\n", err)
+				return
+			}
+			gwV4, gwV6, err := serverConfig.GatewayAddresses()
+			if err != nil {
+				cmd.Printf("Failed to get gateway addresses: %v\n", err)
+				return
+			}
+			t := &serverTunDevice{
+				name: interfaceName,
+				mtu:  mtu,
+				v4:   netip.PrefixFrom(gwV4, v4Pool.Bits()),
+				v6:   netip.PrefixFrom(gwV6, v6Pool.Bits()),
+			}
+			device, err = t.create()
+			if err != nil {
+				log.Println("Are you root/administrator? TUN device creation usually requires elevated privileges. Use --netstack otherwise.")
+				cmd.Printf("Failed to create TUN device: %v\n", err)
+				return
+			}
+			log.Printf("Created TUN device %s, enable forwarding and NAT for %s and %s to give clients internet access", t.name, v4Pool, v6Pool)
+		}
+
+		server, err := api.NewServer(api.ServerConfig{
+			TLSConfig: &tls.Config{
+				// clients pin the key, the certificate is minted for every
+				// handshake so that it never expires
+				GetCertificate: api.NewCertMinter(privKey, 0, -1).GetCertificate,
+			},
+			QUICConfig: internal.DefaultQuicConfig(keepalivePeriod, 0),
+			Clients:    clients,
+			Device:     device,
+			MTU:        mtu,
+		})
+		if err != nil {
+			cmd.Printf("Failed to create server: %v\n", err)
+			return
+		}
+		defer func() { _ = server.Close() }()
+
+		addr := net.JoinHostPort(bindAddress, port)
+		errChan := make(chan error, 3)
+
+		udpConn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			cmd.Printf("Failed to listen on UDP %s: %v\n", addr, err)
+			return
+		}
+		log.Printf("MASQUE server listening on %s (HTTP/3)", addr)
+		go func() { errChan <- fmt.Errorf("HTTP/3 server: %w", server.ServeHTTP3(udpConn)) }()
+
+		if useHTTP2 {
+			tcpListener, err := net.Listen("tcp", addr)
+			if err != nil {
+				cmd.Printf("Failed to listen on TCP %s: %v\n", addr, err)
+				return
+			}
+			log.Printf("MASQUE server listening on %s (HTTP/2)", addr)
+			go func() { errChan <- fmt.Errorf("HTTP/2 server: %w", server.ServeHTTP2(tcpListener)) }()
+		}
+
+		go func() { errChan <- fmt.Errorf("packet forwarder: %w", server.Run(context.Background())) }()
+
+		cmd.Printf("Server stopped: %v\n", <-errChan)
+	},
+}
+
+// serverTunDevice describes the TUN device the server forwards client
+// traffic to. The gateway addresses are assigned with the pool prefix length
+// so that the kernel routes the whole pool into the device.
+type serverTunDevice struct {
+	name string
+	mtu  int
+	v4   netip.Prefix
+	v6   netip.Prefix
+}
+
+var serverInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Create a new server config with a fresh key pair",
+	Run: func(cmd *cobra.Command, args []string) {
+		serverConfigPath, err := cmd.Flags().GetString("server-config")
+		if err != nil {
+			log.Fatalf("Failed to get server config path: %v", err)
+		}
+
+		force, err := cmd.Flags().GetBool("force")
+		if err != nil {
+			log.Fatalf("Failed to get force flag: %v", err)
+		}
+		if _, err := os.Stat(serverConfigPath); err == nil && !force {
+			log.Fatalf("%s already exists, use --force to overwrite it", serverConfigPath)
+		}
+
+		ipv4Pool, err := cmd.Flags().GetString("ipv4-pool")
+		if err != nil {
+			log.Fatalf("Failed to get IPv4 pool: %v", err)
+		}
+
+		ipv6Pool, err := cmd.Flags().GetString("ipv6-pool")
+		if err != nil {
+			log.Fatalf("Failed to get IPv6 pool: %v", err)
+		}
+
+		privKey, _, err := internal.GenerateEcKeyPair()
+		if err != nil {
+			log.Fatalf("Failed to generate key pair: %v", err)
+		}
+
+		serverConfig := &config.ServerConfig{
+			PrivateKey: base64.StdEncoding.EncodeToString(privKey),
+			IPv4Pool:   ipv4Pool,
+			IPv6Pool:   ipv6Pool,
+			Clients:    []config.ServerClient{},
+		}
+		if _, _, err := serverConfig.GetPools(); err != nil {
+			log.Fatalf("Invalid address pool: %v", err)
+		}
+
+		if err := serverConfig.SaveServerConfig(serverConfigPath); err != nil {
+			log.Fatalf("Failed to save server config: %v", err)
+		}
+
+		log.Printf("Server config saved to %s", serverConfigPath)
+	},
+}
+
+var serverAddClientCmd = &cobra.Command{
+	Use:   "add-client",
+	Short: "Authorize a new client and write its usque config",
+	Long: "Generates a key pair for a new client, allocates its tunnel addresses, adds it to the server config" +
+		" and writes a client config that the other usque modes can use directly.",
+	Run: func(cmd *cobra.Command, args []string) {
+		serverConfigPath, err := cmd.Flags().GetString("server-config")
+		if err != nil {
+			log.Fatalf("Failed to get server config path: %v", err)
+		}
+
+		serverConfig, err := config.LoadServerConfig(serverConfigPath)
+		if err != nil {
+			log.Fatalf("Failed to load server config: %v", err)
+		}
+
+		name, err := cmd.Flags().GetString("name")
+		if err != nil {
+			log.Fatalf("Failed to get client name: %v", err)
+		}
+		if name == "" {
+			log.Fatalf("Client name is required")
+		}
+		for _, c := range serverConfig.Clients {
+			if c.Name == name {
+				log.Fatalf("Client %q already exists", name)
+			}
+		}
+
+		endpointV4, err := cmd.Flags().GetString("endpoint-v4")
+		if err != nil {
+			log.Fatalf("Failed to get IPv4 endpoint: %v", err)
+		}
+
+		endpointV6, err := cmd.Flags().GetString("endpoint-v6")
+		if err != nil {
+			log.Fatalf("Failed to get IPv6 endpoint: %v", err)
+		}
+		if endpointV4 == "" && endpointV6 == "" {
+			log.Fatalf("At least one of --endpoint-v4 or --endpoint-v6 is required")
+		}
+
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			log.Fatalf("Failed to get output path: %v", err)
+		}
+
+		serverPrivKey, err := serverConfig.GetEcPrivateKey()
+		if err != nil {
+			log.Fatalf("Failed to get server private key: %v", err)
+		}
+		serverPubKey, err := x509.MarshalPKIXPublicKey(&serverPrivKey.PublicKey)
+		if err != nil {
+			log.Fatalf("Failed to marshal server public key: %v", err)
+		}
+
+		ipv4, ipv6, err := serverConfig.NextClientAddresses()
+		if err != nil {
+			log.Fatalf("Failed to allocate client addresses: %v", err)
+		}
+
+		privKey, pubKey, err := internal.GenerateEcKeyPair()
+		if err != nil {
+			log.Fatalf("Failed to generate key pair: %v", err)
+		}
+
+		serverConfig.Clients = append(serverConfig.Clients, config.ServerClient{
+			Name:      name,
+			PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubKey})),
+			IPv4:      ipv4.String(),
+			IPv6:      ipv6.String(),
+		})
+
+		config.AppConfig = config.Config{
+			PrivateKey:     base64.StdEncoding.EncodeToString(privKey),
+			EndpointV4:     endpointV4,
+			EndpointV6:     endpointV6,
+			EndpointH2V4:   endpointV4,
+			EndpointH2V6:   endpointV6,
+			EndpointPubKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: serverPubKey})),
+			ID:             name,
+			IPv4:           ipv4.String(),
+			IPv6:           ipv6.String(),
+		}
+
+		if err := config.AppConfig.SaveConfig(output); err != nil {
+			log.Fatalf("Failed to save client config: %v", err)
+		}
+		if err := serverConfig.SaveServerConfig(serverConfigPath); err != nil {
+			log.Fatalf("Failed to save server config: %v", err)
+		}
+
+		log.Printf("Client %s added with addresses %s and %s, config saved to %s", name, ipv4, ipv6, output)
+	},
+}
+
+func init() {
+	serverCmd.PersistentFlags().String("server-config", "server.json", "Server config file")
+	serverCmd.Flags().StringP("bind", "b", "0.0.0.0", "Address to bind the server to")
+	serverCmd.Flags().StringP("port", "p", "443", "Port to listen on")
+	serverCmd.Flags().Bool("http2", false, "Also accept CONNECT-IP over HTTP/2 on the same TCP port")
+	serverCmd.Flags().Bool("netstack", false, "Forward client traffic through a userspace NAT instead of a TUN device (no privileges needed, TCP and UDP only)")
+	serverCmd.Flags().StringP("interface-name", "n", "", "Custom interface name for the TUN interface")
+	serverCmd.Flags().IntP("mtu", "m", 1280, "MTU of the forwarding device")
+	serverCmd.Flags().DurationP("keepalive-period", "k", 30*time.Second, "Keepalive period for MASQUE connections")
+	serverCmd.Flags().Duration("udp-timeout", 60*time.Second, "Idle timeout of UDP flows in --netstack mode (0 = never expire)")
+
+	serverInitCmd.Flags().String("ipv4-pool", "172.16.0.0/24", "IPv4 prefix to allocate client addresses from")
+	serverInitCmd.Flags().String("ipv6-pool", "fd00:5553:5155::/64", "IPv6 prefix to allocate client addresses from")
+	serverInitCmd.Flags().Bool("force", false, "Overwrite an existing server config")
+
+	serverAddClientCmd.Flags().StringP("name", "n", "", "Name of the client")
+	serverAddClientCmd.Flags().String("endpoint-v4", "", "Public IPv4 address of this server, written into the client config")
+	serverAddClientCmd.Flags().String("endpoint-v6", "", "Public IPv6 address of this server, written into the client config")
+	serverAddClientCmd.Flags().StringP("output", "o", "client.json", "Path to write the client config to")
+
+	serverCmd.AddCommand(serverInitCmd)
+	serverCmd.AddCommand(serverAddClientCmd)
+	rootCmd.AddCommand(serverCmd)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package cmd
+
+import (
+	"errors"
+
+	"github.com/Diniboy1123/usque/api"
+)
+
+func (t *serverTunDevice) create() (api.TunnelDevice, error) {
+	return nil, errors.New("server TUN mode is not supported on this platform, use --netstack")
+}
@@ -0,0 +1,45 @@
+//go:build linux
+
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/songgao/water"
+	"github.com/vishvananda/netlink"
+)
+
+func (t *serverTunDevice) create() (api.TunnelDevice, error) {
+	dev, err := water.New(water.Config{DeviceType: water.TUN, PlatformSpecificParams: water.PlatformSpecificParams{Name: t.name}})
+	if err != nil {
+		return nil, err
+	}
+
+	t.name = dev.Name()
+
+	link, err := netlink.LinkByName(dev.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get link: %v", err)
+	}
+
+	if err := netlink.LinkSetMTU(link, t.mtu); err != nil {
+		return nil, fmt.Errorf("failed to set MTU: %v", err)
+	}
+	for _, prefix := range []netip.Prefix{t.v4, t.v6} {
+		if err := netlink.AddrAdd(link, &netlink.Addr{
+			IPNet: &net.IPNet{
+				IP:   prefix.Addr().AsSlice(),
+				Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+			}}); err != nil {
+			return nil, fmt.Errorf("failed to add address %s: %v", prefix, err)
+		}
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, fmt.Errorf("failed to set link up: %v", err)
+	}
+
+	return api.NewWaterAdapter(dev), nil
+}
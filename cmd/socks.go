@@ -26,49 +26,9 @@ var socksCmd = &cobra.Command{
 		}
 		log.Println("Hint: l4-socks is faster for TCP-only SOCKS use cases.")
 
-		sni, err := cmd.Flags().GetString("sni-address")
+		tunnelConfig, err := buildTunnelConfig(cmd, "socks")
 		if err != nil {
-			cmd.Printf("Failed to get SNI address: %v\n", err)
-			return
-		}
-
-		privKey, err := config.AppConfig.GetEcPrivateKey()
-		if err != nil {
-			cmd.Printf("Failed to get private key: %v\n", err)
-			return
-		}
-		peerPubKey, err := config.AppConfig.GetEcEndpointPublicKey()
-		if err != nil {
-			cmd.Printf("Failed to get public key: %v\n", err)
-			return
-		}
-
-		cert, err := internal.GenerateCert(privKey, &privKey.PublicKey)
-		if err != nil {
-			cmd.Printf("Failed to generate cert: %v\n", err)
-			return
-		}
-
-		insecure, err := cmd.Flags().GetBool("insecure")
-		if err != nil {
-			cmd.Printf("Failed to get insecure flag: %v\n", err)
-			return
-		}
-
-		tlsConfig, err := api.PrepareTlsConfig(privKey, peerPubKey, cert, sni, insecure)
-		if err != nil {
-			cmd.Printf("Failed to prepare TLS config: %v\n", err)
-			return
-		}
-
-		keepalivePeriod, err := cmd.Flags().GetDuration("keepalive-period")
-		if err != nil {
-			cmd.Printf("Failed to get keepalive period: %v\n", err)
-			return
-		}
-		initialPacketSize, err := cmd.Flags().GetUint16("initial-packet-size")
-		if err != nil {
-			cmd.Printf("Failed to get initial packet size: %v\n", err)
+			cmd.Println(err)
 			return
 		}
 
@@ -78,44 +38,12 @@ var socksCmd = &cobra.Command{
 			return
 		}
 
-		port, err := cmd.Flags().GetString("port")
+		port, err := proxyPort(cmd)
 		if err != nil {
 			cmd.Printf("Failed to get port: %v\n", err)
 			return
 		}
 
-		connectPort, err := cmd.Flags().GetInt("connect-port")
-		if err != nil {
-			cmd.Printf("Failed to get connect port: %v\n", err)
-			return
-		}
-
-		useHTTP2, err := cmd.Flags().GetBool("http2")
-		if err != nil {
-			cmd.Printf("Failed to get HTTP/2 flag: %v\n", err)
-			return
-		}
-
-		useIPv6, err := cmd.Flags().GetBool("ipv6")
-		if err != nil {
-			cmd.Printf("Failed to get ipv6 flag: %v\n", err)
-			return
-		}
-
-		endpoint, err := config.SelectEndpointFromConfig(useHTTP2, useIPv6, connectPort)
-		if err != nil {
-			cmd.Printf("Failed to select endpoint: %v\n", err)
-			return
-		}
-
-		if insecure {
-			config.WarnInsecure()
-		}
-
-		if useHTTP2 {
-			config.LogHTTP2Endpoint(endpoint)
-		}
-
 		tunnelIPv4, err := cmd.Flags().GetBool("no-tunnel-ipv4")
 		if err != nil {
 			cmd.Printf("Failed to get no tunnel IPv4: %v\n", err)
@@ -184,15 +112,6 @@ var socksCmd = &cobra.Command{
 			systemDNS = false
 		}
 
-		mtu, err := cmd.Flags().GetInt("mtu")
-		if err != nil {
-			cmd.Printf("Failed to get MTU: %v\n", err)
-			return
-		}
-		if mtu != 1280 {
-			log.Println("Warning: MTU is not the default 1280. This is not supported. Packet loss and other issues may occur.")
-		}
-
 		var username string
 		var password string
 		if u, err := cmd.Flags().GetString("username"); err == nil && u != "" {
@@ -202,12 +121,6 @@ var socksCmd = &cobra.Command{
 			password = p
 		}
 
-		reconnectDelay, err := cmd.Flags().GetDuration("reconnect-delay")
-		if err != nil {
-			cmd.Printf("Failed to get reconnect delay: %v\n", err)
-			return
-		}
-
 		udpTimeout, err := cmd.Flags().GetDuration("udp-timeout")
 		if err != nil {
 			cmd.Printf("Failed to get UDP timeout: %v\n", err)
@@ -223,45 +136,40 @@ var socksCmd = &cobra.Command{
 			return
 		}
 
-		onConnect, err := cmd.Flags().GetString("on-connect")
+		split, err := splitTunnel()
 		if err != nil {
-			cmd.Printf("Failed to get on-connect flag: %v\n", err)
+			cmd.Printf("Failed to apply split tunnel policy: %v\n", err)
 			return
 		}
+		logZeroTrust("socks")
 
-		onDisconnect, err := cmd.Flags().GetString("on-disconnect")
+		rules, err := loadRules(cmd)
 		if err != nil {
-			cmd.Printf("Failed to get on-disconnect flag: %v\n", err)
+			cmd.Printf("Failed to load routing rules: %v\n", err)
 			return
 		}
 
-		hookEnv := map[string]string{
-			"USQUE_MODE": "socks",
-			"USQUE_IPV4": config.AppConfig.IPv4,
-			"USQUE_IPV6": config.AppConfig.IPv6,
-		}
+		splitTunnelHookEnv(tunnelConfig.HookEnv)
 
-		tunDev, tunNet, err := netstack.CreateNetTUN(localAddresses, dnsAddrs, mtu)
+		tunDev, tunNet, err := netstack.CreateNetTUN(localAddresses, dnsAddrs, tunnelConfig.MTU)
 		if err != nil {
 			cmd.Printf("Failed to create virtual TUN device: %v\n", err)
 			return
 		}
 		defer func() { _ = tunDev.Close() }()
 
-		go api.MaintainTunnel(context.Background(), api.MaintainTunnelConfig{
-			TLSConfig:         tlsConfig,
-			KeepalivePeriod:   keepalivePeriod,
-			InitialPacketSize: initialPacketSize,
-			Endpoint:          endpoint,
-			Device:            api.NewNetstackAdapter(tunDev),
-			MTU:               mtu,
-			ReconnectDelay:    reconnectDelay,
-			AlwaysReconnect:   alwaysReconnect,
-			UseHTTP2:          useHTTP2,
-			OnConnect:         onConnect,
-			OnDisconnect:      onDisconnect,
-			HookEnv:           hookEnv,
-		})
+		liveness, err := livenessConfig(cmd, tunNet.DialContext)
+		if err != nil {
+			cmd.Printf("Failed to configure liveness probes: %v\n", err)
+			return
+		}
+
+		tunnelConfig.Device = api.NewNetstackAdapter(tunDev)
+		tunnelConfig.AlwaysReconnect = alwaysReconnect
+		tunnelConfig.Liveness = liveness
+		tunnelConfig.OnEvent = onAddressesAssigned(nil)
+		tunnelConfig.NetworkChanges = networkChanges(cmd, tunnelConfig.UseHTTP2)
+		go api.MaintainTunnel(context.Background(), tunnelConfig)
 
 		resolver := &internal.TunnelDNSResolver{
 			DNSAddrs:      dnsAddrs,
@@ -272,7 +180,7 @@ var socksCmd = &cobra.Command{
 			resolver.TunNet = tunNet
 		}
 
-		server, err := internal.NewSOCKS5Server(internal.SOCKS5Config{
+		socksConfig := internal.SOCKS5Config{
 			Addr:       net.JoinHostPort(bindAddress, port),
 			Username:   username,
 			Password:   password,
@@ -280,7 +188,20 @@ var socksCmd = &cobra.Command{
 			TunNet:     tunNet,
 			UDPTimeout: udpTimeout,
 			Logger:     log.New(internal.NewTZStampWriter(os.Stderr), "socks5: ", 0),
-		})
+		}
+		lookup := dnsResolverLookup(resolver)
+		if split != nil {
+			dial := split.Dialer(tunNet.DialContext, lookup)
+			socksConfig.DialTCP = dial
+			socksConfig.DialUDP = dial
+		}
+		if rules != nil {
+			socksConfig.Route = func(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+				return rules.Dialer(dial, lookup)
+			}
+		}
+
+		server, err := internal.NewSOCKS5Server(socksConfig)
 		if err != nil {
 			cmd.Printf("Failed to create SOCKS proxy: %v\n", err)
 			return
@@ -302,21 +223,30 @@ func init() {
 	socksCmd.Flags().IntP("connect-port", "P", 443, "Used port for MASQUE connection")
 	socksCmd.Flags().StringArrayP("dns", "d", []string{"9.9.9.9", "149.112.112.112", "2620:fe::fe", "2620:fe::9"}, "DNS servers for the tunnel stack; with -l also used for SOCKS name lookups (unless --system-dns)")
 	socksCmd.Flags().DurationP("dns-timeout", "t", 2*time.Second, "Timeout for DNS queries")
-	socksCmd.Flags().BoolP("ipv6", "6", false, "Use IPv6 for MASQUE connection")
+	socksCmd.Flags().BoolP("ipv6", "6", false, "Prefer IPv6 for MASQUE connection")
+	socksCmd.Flags().Bool("no-happy-eyeballs", false, "Only use the address family chosen by --ipv6 instead of racing IPv4 and IPv6")
 	socksCmd.Flags().BoolP("no-tunnel-ipv4", "F", false, "Disable IPv4 inside the MASQUE tunnel")
 	socksCmd.Flags().BoolP("no-tunnel-ipv6", "S", false, "Disable IPv6 inside the MASQUE tunnel")
-	socksCmd.Flags().StringP("sni-address", "s", internal.ConnectSNI, "SNI address to use for MASQUE connection")
+	socksCmd.Flags().StringP("sni-address", "s", internal.ConnectSNI, sniHelp)
 	socksCmd.Flags().DurationP("keepalive-period", "k", 30*time.Second, "Keepalive period for MASQUE connection")
 	socksCmd.Flags().IntP("mtu", "m", 1280, "MTU for MASQUE connection")
 	socksCmd.Flags().Uint16P("initial-packet-size", "i", 0, "Custom initial packet size for MASQUE connection (default: auto with PMTU discovery)")
-	socksCmd.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Delay between reconnect attempts")
+	socksCmd.Flags().DurationP("reconnect-delay", "r", 1*time.Second, "Initial delay between reconnect attempts, doubled on every further failure")
+	socksCmd.Flags().Duration("max-reconnect-delay", api.DefaultMaxReconnectDelay, "Maximum delay between reconnect attempts, also used after errors retrying won't fix")
 	socksCmd.Flags().Duration("udp-timeout", 60*time.Second, "Idle read deadline for each remote UDP relay (SOCKS5 ASSOCIATE). Shorter frees memory sooner; raise (e.g. 300s) if a quiet peer needs longer silence. 0 disables the deadline and risks unbounded growth under DHT/uTP")
 	socksCmd.Flags().Bool("always-reconnect", false, "Always reconnect after tunnel loss, even when idle")
 	socksCmd.Flags().Bool("http2", false, "Use HTTP/2 over TCP+TLS instead of HTTP/3 over QUIC."+config.EndpointHelpSuffixH2)
+	socksCmd.Flags().Bool("http2-fallback", false, "Fall back to HTTP/2 when HTTP/3 keeps failing, e.g. because UDP is blocked."+config.EndpointHelpSuffixH2)
+	socksCmd.Flags().Duration("http3-probe-interval", api.DefaultH3ProbeInterval, "How often to retry HTTP/3 while the HTTP/2 fallback is in use")
 	socksCmd.Flags().Bool("insecure", false, "Disable endpoint certificate pinning and trust any certificate")
+	socksCmd.Flags().Bool("pq", false, "Only use the post-quantum hybrid X25519MLKEM768 key exchange, over HTTP/3 and HTTP/2")
 	socksCmd.Flags().BoolP("local-dns", "l", false, "Do not send proxy DNS through the tunnel; use -d over the host instead. Add --system-dns to use the OS resolver instead of -d")
 	socksCmd.Flags().Bool("system-dns", false, "With -l, resolve names via the OS (e.g. /etc/resolv.conf) instead of -d")
 	socksCmd.Flags().String("on-connect", "", "Path to an executable to run after each successful tunnel connect (no args; context via USQUE_* env vars)")
 	socksCmd.Flags().String("on-disconnect", "", "Path to an executable to run after each tunnel disconnect (no args; context via USQUE_* env vars)")
+	socksCmd.Flags().String("rules", "", rulesHelp)
+	socksCmd.Flags().Bool("no-migrate", false, "Linux only: Do not migrate the HTTP/3 connection to a new socket when addresses or routes change")
+	addLivenessFlags(socksCmd, true)
+	addClientKeyFlags(socksCmd)
 	rootCmd.AddCommand(socksCmd)
 }
@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/spf13/cobra"
+)
+
+// teamLoginScheme is the scheme of the link the success page of a browser
+// login opens.
+const teamLoginScheme = "com.cloudflare.warp"
+
+var teamLoginCallbackCmd = &cobra.Command{
+	Use:   "team-login-callback <link>",
+	Short: "Pass the link of a browser login on to register --team",
+	Long: "Handles the " + teamLoginScheme + " links of browser logins. register --team makes it their handler" +
+		" while it waits for the login, so there is no need to run it by hand.",
+	Hidden: true,
+	Args:   cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := forwardTeamLoginLink(args[0]); err != nil {
+			log.Fatalf("Failed to pass the login on: %v", err)
+		}
+		log.Printf("Login passed on to usque register")
+	},
+}
+
+// teamLoginCallbackPath returns the file announcing the callback URL of the
+// pending browser login to team-login-callback.
+func teamLoginCallbackPath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "usque", "team-login"), nil
+}
+
+// captureTeamLogin makes the browser pass the link of the success page on to
+// callbackURL: it announces callbackURL to team-login-callback and makes that
+// the handler of teamLoginScheme links. The returned function undoes both.
+func captureTeamLogin(callbackURL string) (func(), error) {
+	path, err := teamLoginCallbackPath()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the cache directory: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create the cache directory: %v", err)
+	}
+	// the callback URL holds the state, so only the user may read it
+	_ = os.Remove(path)
+	if err := os.WriteFile(path, []byte(callbackURL+"\n"), 0o600); err != nil {
+		return nil, fmt.Errorf("failed to announce the login: %v", err)
+	}
+
+	restore, err := installTeamLoginHandler()
+	if err != nil {
+		_ = os.Remove(path)
+		return nil, err
+	}
+	return func() {
+		restore()
+		_ = os.Remove(path)
+	}, nil
+}
+
+// forwardTeamLoginLink passes link on to the login announced by
+// captureTeamLogin.
+func forwardTeamLoginLink(link string) error {
+	path, err := teamLoginCallbackPath()
+	if err != nil {
+		return fmt.Errorf("failed to find the cache directory: %v", err)
+	}
+	callbackURL, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("no login is waiting, run usque register --team first")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read the waiting login: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return api.ForwardTeamLogin(ctx, strings.TrimSpace(string(callbackURL)), link)
+}
+
+func init() {
+	rootCmd.AddCommand(teamLoginCallbackCmd)
+}
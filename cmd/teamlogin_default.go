@@ -0,0 +1,11 @@
+//go:build !linux && !windows
+
+package cmd
+
+import "errors"
+
+// installTeamLoginHandler is not supported on this platform, where the link
+// of the success page has to be passed on by hand.
+func installTeamLoginHandler() (func(), error) {
+	return nil, errors.New("handling " + teamLoginScheme + " links is not supported on this platform")
+}
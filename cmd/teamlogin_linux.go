@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// teamLoginDesktopEntry is the desktop entry handling teamLoginScheme links
+// during a browser login.
+const teamLoginDesktopEntry = "usque-team-login.desktop"
+
+// installTeamLoginHandler makes team-login-callback the handler of
+// teamLoginScheme links with a desktop entry of the user, set as the default
+// with xdg-mime. The returned function restores the previous default.
+func installTeamLoginHandler() (func(), error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the usque binary: %v", err)
+	}
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to find the home directory: %v", err)
+		}
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+
+	mimeType := "x-scheme-handler/" + teamLoginScheme
+	previous, err := exec.Command("xdg-mime", "query", "default", mimeType).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the handler of %s links: %v", teamLoginScheme, err)
+	}
+
+	dir := filepath.Join(dataHome, "applications")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	entry := filepath.Join(dir, teamLoginDesktopEntry)
+	content := "[Desktop Entry]\n" +
+		"Type=Application\n" +
+		"Name=usque login\n" +
+		"Exec=" + desktopExecQuote(exe) + " team-login-callback %u\n" +
+		"MimeType=" + mimeType + ";\n" +
+		"NoDisplay=true\n"
+	if err := os.WriteFile(entry, []byte(content), 0o644); err != nil {
+		return nil, fmt.Errorf("failed to write %s: %v", entry, err)
+	}
+	if out, err := exec.Command("xdg-mime", "default", teamLoginDesktopEntry, mimeType).CombinedOutput(); err != nil {
+		_ = os.Remove(entry)
+		return nil, fmt.Errorf("failed to handle %s links: %v: %s", teamLoginScheme, err, out)
+	}
+
+	return func() {
+		if previous := strings.TrimSpace(string(previous)); previous != "" && previous != teamLoginDesktopEntry {
+			_ = exec.Command("xdg-mime", "default", previous, mimeType).Run()
+		}
+		_ = os.Remove(entry)
+	}, nil
+}
+
+// desktopExecQuote quotes s as an argument of the Exec key of a desktop
+// entry.
+func desktopExecQuote(s string) string {
+	s = strings.NewReplacer(`\`, `\\\\`, `"`, `\\"`, "`", "\\\\`", "$", `\\$`, "%", "%%").Replace(s)
+	return `"` + s + `"`
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Diniboy1123/usque/api"
+)
+
+func TestCaptureTeamLogin(t *testing.T) {
+	// an xdg-mime recording how it is called, with the official client as
+	// the current handler
+	bin := t.TempDir()
+	calls := filepath.Join(t.TempDir(), "calls")
+	script := "#!/bin/sh\necho \"$@\" >> " + calls + "\n[ \"$1\" = query ] && echo com.cloudflare.warp.desktop\nexit 0\n"
+	if err := os.WriteFile(filepath.Join(bin, "xdg-mime"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	login, err := api.ListenTeamLogin("example-org", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = login.Close() }()
+
+	restore, err := captureTeamLogin(login.CallbackURL)
+	if err != nil {
+		t.Fatalf("failed to capture the login: %v", err)
+	}
+	entry := filepath.Join(os.Getenv("XDG_DATA_HOME"), "applications", teamLoginDesktopEntry)
+	content, err := os.ReadFile(entry)
+	if err != nil {
+		t.Fatalf("no desktop entry: %v", err)
+	}
+	if !strings.Contains(string(content), " team-login-callback %u\n") || !strings.Contains(string(content), "MimeType=x-scheme-handler/com.cloudflare.warp;\n") {
+		t.Errorf("desktop entry does not handle the links:\n%s", content)
+	}
+
+	// what the browser runs for the link of the success page
+	if err := forwardTeamLoginLink("com.cloudflare.warp://example-org.cloudflareaccess.com/auth?token=user-token"); err != nil {
+		t.Fatalf("failed to forward the link: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if token, err := login.Token(ctx); err != nil || token != "user-token" {
+		t.Errorf("got token %q and error %v, want user-token", token, err)
+	}
+
+	restore()
+	if _, err := os.Stat(entry); !os.IsNotExist(err) {
+		t.Errorf("desktop entry left behind: %v", err)
+	}
+	if err := forwardTeamLoginLink("com.cloudflare.warp://example-org.cloudflareaccess.com/auth?token=late"); err == nil {
+		t.Errorf("forwarded a link after the login ended")
+	}
+	got, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "query default x-scheme-handler/com.cloudflare.warp\n" +
+		"default usque-team-login.desktop x-scheme-handler/com.cloudflare.warp\n" +
+		"default com.cloudflare.warp.desktop x-scheme-handler/com.cloudflare.warp\n"
+	if string(got) != want {
+		t.Errorf("xdg-mime called with:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestDesktopExecQuote(t *testing.T) {
+	if got, want := desktopExecQuote(`/opt/my "usque"/$bin%`), `"/opt/my \\"usque\\"/\\$bin%%"`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// teamLoginKey is the registry key of the handler of teamLoginScheme links.
+const teamLoginKey = `HKCU\Software\Classes\` + teamLoginScheme
+
+// installTeamLoginHandler makes team-login-callback the handler of
+// teamLoginScheme links in the registry of the user. The returned function
+// restores the previous handler, e.g. the one of the official client.
+func installTeamLoginHandler() (func(), error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the usque binary: %v", err)
+	}
+
+	var backup string
+	if exec.Command("reg", "query", teamLoginKey).Run() == nil {
+		f, err := os.CreateTemp("", "usque-team-login-*.reg")
+		if err != nil {
+			return nil, fmt.Errorf("failed to back up the handler of %s links: %v", teamLoginScheme, err)
+		}
+		backup = f.Name()
+		_ = f.Close()
+		if out, err := exec.Command("reg", "export", teamLoginKey, backup, "/y").CombinedOutput(); err != nil {
+			_ = os.Remove(backup)
+			return nil, fmt.Errorf("failed to back up the handler of %s links: %v: %s", teamLoginScheme, err, out)
+		}
+	}
+	restore := func() {
+		_ = exec.Command("reg", "delete", teamLoginKey, "/f").Run()
+		if backup != "" {
+			_ = exec.Command("reg", "import", backup).Run()
+			_ = os.Remove(backup)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"add", teamLoginKey, "/ve", "/d", "URL:usque login", "/f"},
+		{"add", teamLoginKey, "/v", "URL Protocol", "/d", "", "/f"},
+		{"add", teamLoginKey + `\shell\open\command`, "/ve", "/d", `"` + exe + `" team-login-callback "%1"`, "/f"},
+	} {
+		if out, err := exec.Command("reg", args...).CombinedOutput(); err != nil {
+			restore()
+			return nil, fmt.Errorf("failed to handle %s links: %v: %s", teamLoginScheme, err, out)
+		}
+	}
+	return restore, nil
+}
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/spf13/cobra"
+)
+
+// buildTunnelConfig reads the MASQUE connection flags shared by the tunnel
+// modes and returns the configuration of their tunnel. It starts the key
+// rotation asked for by the client key flags. The caller sets the Device,
+// AlwaysReconnect, Liveness and OnEvent, which differ between the modes,
+// and NetworkChanges once its device is set up, as the watch would see that
+// as a change. It may add to HookEnv, whose USQUE_MODE is mode.
+func buildTunnelConfig(cmd *cobra.Command, mode string) (api.MaintainTunnelConfig, error) {
+	var cfg api.MaintainTunnelConfig
+
+	sni, err := masqueSNI(cmd)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to get SNI address: %v", err)
+	}
+	privKey, err := config.AppConfig.GetEcPrivateKey()
+	if err != nil {
+		return cfg, fmt.Errorf("failed to get private key: %v", err)
+	}
+	peerPubKey, err := config.AppConfig.GetEcEndpointPublicKey()
+	if err != nil {
+		return cfg, fmt.Errorf("failed to get public key: %v", err)
+	}
+	minter, err := certMinter(cmd, privKey)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to prepare client certificates: %v", err)
+	}
+	insecure, err := cmd.Flags().GetBool("insecure")
+	if err != nil {
+		return cfg, fmt.Errorf("failed to get insecure flag: %v", err)
+	}
+	if cfg.TLSConfig, err = api.PrepareTlsConfig(privKey, peerPubKey, nil, sni, insecure); err != nil {
+		return cfg, fmt.Errorf("failed to prepare TLS config: %v", err)
+	}
+	minter.Attach(cfg.TLSConfig)
+	pq, err := cmd.Flags().GetBool("pq")
+	if err != nil {
+		return cfg, fmt.Errorf("failed to get pq flag: %v", err)
+	}
+	if pq {
+		api.EnablePostQuantum(cfg.TLSConfig)
+	}
+
+	if cfg.KeepalivePeriod, err = cmd.Flags().GetDuration("keepalive-period"); err != nil {
+		return cfg, fmt.Errorf("failed to get keepalive period: %v", err)
+	}
+	if cfg.InitialPacketSize, err = cmd.Flags().GetUint16("initial-packet-size"); err != nil {
+		return cfg, fmt.Errorf("failed to get initial packet size: %v", err)
+	}
+	connectPort, err := cmd.Flags().GetInt("connect-port")
+	if err != nil {
+		return cfg, fmt.Errorf("failed to get connect port: %v", err)
+	}
+	if cfg.UseHTTP2, err = cmd.Flags().GetBool("http2"); err != nil {
+		return cfg, fmt.Errorf("failed to get HTTP/2 flag: %v", err)
+	}
+	http2Fallback, err := cmd.Flags().GetBool("http2-fallback")
+	if err != nil {
+		return cfg, fmt.Errorf("failed to get HTTP/2 fallback flag: %v", err)
+	}
+	if cfg.H3ProbeInterval, err = cmd.Flags().GetDuration("http3-probe-interval"); err != nil {
+		return cfg, fmt.Errorf("failed to get HTTP/3 probe interval: %v", err)
+	}
+	useIPv6, err := cmd.Flags().GetBool("ipv6")
+	if err != nil {
+		return cfg, fmt.Errorf("failed to get ipv6 flag: %v", err)
+	}
+	noHappyEyeballs, err := cmd.Flags().GetBool("no-happy-eyeballs")
+	if err != nil {
+		return cfg, fmt.Errorf("failed to get no-happy-eyeballs flag: %v", err)
+	}
+
+	if cfg.Endpoint, cfg.AltEndpoint, err = config.SelectEndpointsFromConfig(cfg.UseHTTP2, useIPv6, connectPort); err != nil {
+		return cfg, fmt.Errorf("failed to select endpoint: %v", err)
+	}
+	if http2Fallback && !cfg.UseHTTP2 {
+		if cfg.H2FallbackEndpoint, cfg.H2FallbackAltEndpoint, err = config.SelectEndpointsFromConfig(true, useIPv6, connectPort); err != nil {
+			return cfg, fmt.Errorf("failed to select HTTP/2 fallback endpoint: %v", err)
+		}
+		log.Printf("HTTP/2 fallback enabled using endpoint %s", cfg.H2FallbackEndpoint)
+	}
+	if noHappyEyeballs {
+		cfg.AltEndpoint, cfg.H2FallbackAltEndpoint = nil, nil
+	}
+
+	if !cfg.UseHTTP2 {
+		cfg.Ports = config.AppConfig.Ports
+		if cfg.FailoverEndpoints, err = failoverEndpoints(minter, sni, insecure, pq, useIPv6, noHappyEyeballs, connectPort); err != nil {
+			return cfg, fmt.Errorf("failed to prepare failover endpoints: %v", err)
+		}
+	}
+	cfg.StartEndpoint, cfg.OnEndpointUp = endpointState(cmd)
+
+	if err := startKeyRotation(cmd, minter, cfg.TLSConfig, cfg.FailoverEndpoints); err != nil {
+		return cfg, fmt.Errorf("failed to start key rotation: %v", err)
+	}
+	if insecure {
+		config.WarnInsecure()
+	}
+	if cfg.UseHTTP2 {
+		config.LogHTTP2Endpoint(cfg.Endpoint)
+	}
+
+	if cfg.MTU, err = cmd.Flags().GetInt("mtu"); err != nil {
+		return cfg, fmt.Errorf("failed to get MTU: %v", err)
+	}
+	if cfg.MTU != 1280 {
+		log.Println("Warning: MTU is not the default 1280. This is not supported. Packet loss and other issues may occur.")
+	}
+	if cfg.ReconnectDelay, err = cmd.Flags().GetDuration("reconnect-delay"); err != nil {
+		return cfg, fmt.Errorf("failed to get reconnect delay: %v", err)
+	}
+	if cfg.MaxReconnectDelay, err = cmd.Flags().GetDuration("max-reconnect-delay"); err != nil {
+		return cfg, fmt.Errorf("failed to get max reconnect delay: %v", err)
+	}
+	if cfg.OnConnect, err = cmd.Flags().GetString("on-connect"); err != nil {
+		return cfg, fmt.Errorf("failed to get on-connect flag: %v", err)
+	}
+	if cfg.OnDisconnect, err = cmd.Flags().GetString("on-disconnect"); err != nil {
+		return cfg, fmt.Errorf("failed to get on-disconnect flag: %v", err)
+	}
+	cfg.HookEnv = map[string]string{
+		"USQUE_MODE": mode,
+		"USQUE_IPV4": config.AppConfig.IPv4,
+		"USQUE_IPV6": config.AppConfig.IPv6,
+	}
+	return cfg, nil
+}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Diniboy1123/usque/config"
+	"github.com/spf13/cobra"
+)
+
+func TestBuildTunnelConfig(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := config.AppConfig
+	t.Cleanup(func() { config.AppConfig = saved })
+	config.AppConfig = config.Config{
+		PrivateKey:     base64.StdEncoding.EncodeToString(der),
+		EndpointV4:     "192.0.2.1",
+		EndpointV6:     "2001:db8::1",
+		EndpointH2V4:   "192.0.2.2",
+		EndpointH2V6:   "2001:db8::2",
+		EndpointPubKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})),
+		IPv4:           "172.16.0.2",
+		IPv6:           "2606:4700:110:8a36::2",
+	}
+
+	flags := map[string]string{
+		"pq":                  "true",
+		"no-happy-eyeballs":   "true",
+		"http2-fallback":      "true",
+		"max-reconnect-delay": "5m",
+		"mtu":                 "1400",
+	}
+	for _, c := range []*cobra.Command{socksCmd, httpProxyCmd, portFwCmd, nativeTunCmd} {
+		t.Run(c.Name(), func(t *testing.T) {
+			for name, value := range flags {
+				flag := c.Flags().Lookup(name)
+				if err := flag.Value.Set(value); err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { _ = flag.Value.Set(flag.DefValue) })
+			}
+
+			cfg, err := buildTunnelConfig(c, c.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(cfg.TLSConfig.CurvePreferences, []tls.CurveID{tls.X25519MLKEM768}) {
+				t.Errorf("curves %v, want only the post-quantum one", cfg.TLSConfig.CurvePreferences)
+			}
+			if cfg.AltEndpoint != nil || cfg.H2FallbackAltEndpoint != nil {
+				t.Errorf("alternative endpoints %v and %v are raced", cfg.AltEndpoint, cfg.H2FallbackAltEndpoint)
+			}
+			if got := cfg.H2FallbackEndpoint; got == nil || got.String() != "192.0.2.2:443" {
+				t.Errorf("HTTP/2 fallback endpoint %v, want 192.0.2.2:443", got)
+			}
+			if cfg.MaxReconnectDelay != 5*time.Minute || cfg.MTU != 1400 {
+				t.Errorf("max reconnect delay %s and MTU %d, want 5m and 1400", cfg.MaxReconnectDelay, cfg.MTU)
+			}
+			if got := cfg.HookEnv["USQUE_MODE"]; got != c.Name() {
+				t.Errorf("USQUE_MODE %q, want %q", got, c.Name())
+			}
+		})
+	}
+}
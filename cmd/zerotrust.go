@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/Diniboy1123/usque/api"
+	"github.com/Diniboy1123/usque/config"
+	"github.com/Diniboy1123/usque/internal"
+	"github.com/spf13/cobra"
+)
+
+// sniHelp is the usage of --sni-address in the modes connecting to MASQUE
+// endpoints.
+const sniHelp = "SNI address to use for MASQUE connection (default for Zero Trust devices: " + internal.ZeroTierSNI + ")"
+
+// masqueSNI returns --sni-address, which defaults to the Zero Trust SNI for
+// Zero Trust devices.
+func masqueSNI(cmd *cobra.Command) (string, error) {
+	sni, err := cmd.Flags().GetString("sni-address")
+	if err != nil {
+		return "", err
+	}
+	if config.AppConfig.ZeroTrust != nil && !cmd.Flags().Changed("sni-address") {
+		return internal.ZeroTierSNI, nil
+	}
+	return sni, nil
+}
+
+// splitTunnel returns the split tunnel of the Zero Trust policy, nil for
+// consumer devices.
+func splitTunnel() (*api.SplitTunnel, error) {
+	zt := config.AppConfig.ZeroTrust
+	if zt == nil {
+		return nil, nil
+	}
+
+	var fallbackDomains []api.FallbackDomain
+	for _, domain := range zt.FallbackDomains {
+		fallback := api.FallbackDomain{Suffix: domain.Suffix}
+		for _, server := range domain.DNSServers {
+			addr, err := netip.ParseAddr(server)
+			if err != nil {
+				return nil, fmt.Errorf("invalid DNS server %q of fallback domain %s: %v", server, domain.Suffix, err)
+			}
+			fallback.Servers = append(fallback.Servers, addr)
+		}
+		fallbackDomains = append(fallbackDomains, fallback)
+	}
+
+	if len(zt.Include) > 0 {
+		return api.NewSplitTunnel(true, zt.Include, fallbackDomains)
+	}
+	return api.NewSplitTunnel(false, zt.Exclude, fallbackDomains)
+}
+
+// logZeroTrust describes the Zero Trust policy applied by mode and warns if
+// its service mode does not fit.
+func logZeroTrust(mode string) {
+	zt := config.AppConfig.ZeroTrust
+	if zt == nil {
+		return
+	}
+	switch {
+	case len(zt.Include) > 0:
+		log.Printf("Zero Trust device of %q: only %d included destinations use the tunnel", zt.Organization, len(zt.Include))
+	default:
+		log.Printf("Zero Trust device of %q: %d excluded destinations bypass the tunnel", zt.Organization, len(zt.Exclude))
+	}
+	if zt.ServiceMode == config.ServiceModeProxy && mode == "nativetun" {
+		log.Printf("Warning: the policy of your organization uses the local proxy service mode, consider the socks or http-proxy mode instead")
+	} else if zt.ServiceMode != config.ServiceModeWarp && zt.ServiceMode != config.ServiceModeProxy {
+		log.Printf("Warning: the policy of your organization uses the %q service mode, which usque does not support; tunnelling anyway", zt.ServiceMode)
+	}
+}
+
+// proxyPort returns --port, which defaults to the proxy port of the policy in
+// the proxy service mode.
+func proxyPort(cmd *cobra.Command) (string, error) {
+	port, err := cmd.Flags().GetString("port")
+	if err != nil {
+		return "", err
+	}
+	zt := config.AppConfig.ZeroTrust
+	if zt != nil && zt.ServiceMode == config.ServiceModeProxy && zt.ProxyPort != 0 && !cmd.Flags().Changed("port") {
+		return strconv.Itoa(zt.ProxyPort), nil
+	}
+	return port, nil
+}
+
+// splitTunnelHookEnv adds the split tunnel lists to hook environments as
+// space separated USQUE_SPLIT_INCLUDE or USQUE_SPLIT_EXCLUDE.
+func splitTunnelHookEnv(env map[string]string) {
+	zt := config.AppConfig.ZeroTrust
+	if zt == nil {
+		return
+	}
+	if len(zt.Include) > 0 {
+		env["USQUE_SPLIT_INCLUDE"] = strings.Join(zt.Include, " ")
+	} else {
+		env["USQUE_SPLIT_EXCLUDE"] = strings.Join(zt.Exclude, " ")
+	}
+}
@@ -12,16 +12,19 @@ import (
 
 // Config represents the application configuration structure, containing essential details such as keys, endpoints, and access tokens.
 type Config struct {
-	PrivateKey     string `json:"private_key"`      // Base64-encoded ECDSA private key
-	EndpointV4     string `json:"endpoint_v4"`      // IPv4 address of the endpoint
-	EndpointV6     string `json:"endpoint_v6"`      // IPv6 address of the endpoint
-	EndpointH2V4   string `json:"endpoint_h2_v4"`   // IPv4 address used in HTTP/2 mode
-	EndpointH2V6   string `json:"endpoint_h2_v6"`   // IPv6 address used in HTTP/2 mode
-	EndpointPubKey string `json:"endpoint_pub_key"` // PEM-encoded ECDSA public key of the endpoint to verify against
-	ID             string `json:"id"`               // Device unique identifier
-	AccessToken    string `json:"access_token"`     // Authentication token for API access
-	IPv4           string `json:"ipv4"`             // Assigned IPv4 address
-	IPv6           string `json:"ipv6"`             // Assigned IPv6 address
+	PrivateKey     string     `json:"private_key"`          // Base64-encoded ECDSA private key
+	EndpointV4     string     `json:"endpoint_v4"`          // IPv4 address of the endpoint
+	EndpointV6     string     `json:"endpoint_v6"`          // IPv6 address of the endpoint
+	EndpointH2V4   string     `json:"endpoint_h2_v4"`       // IPv4 address used in HTTP/2 mode
+	EndpointH2V6   string     `json:"endpoint_h2_v6"`       // IPv6 address used in HTTP/2 mode
+	EndpointPubKey string     `json:"endpoint_pub_key"`     // PEM-encoded ECDSA public key of the endpoint to verify against
+	ID             string     `json:"id"`                   // Device unique identifier
+	AccessToken    string     `json:"access_token"`         // Authentication token for API access
+	IPv4           string     `json:"ipv4"`                 // Assigned IPv4 address
+	IPv6           string     `json:"ipv6"`                 // Assigned IPv6 address
+	Ports          []int      `json:"ports,omitempty"`      // Further ports the endpoint accepts, tried when a handshake times out
+	Endpoints      []Endpoint `json:"endpoints,omitempty"`  // Further endpoints to fail over to, in order
+	ZeroTrust      *ZeroTrust `json:"zero_trust,omitempty"` // Policy of Zero Trust devices, nil for consumer ones
 }
 
 // AppConfig holds the global application configuration.
@@ -54,25 +57,25 @@ func LoadConfig(configPath string) error {
 	return nil
 }
 
-// SaveConfig writes the current application configuration to a prettified JSON file.
+// SaveConfig writes the configuration to a prettified JSON file.
+// The file is replaced atomically, so a crash or a concurrent reader never
+// sees a partially written config. If configPath is a symlink, its target is
+// replaced. An existing file keeps its mode, a new one is only accessible by
+// its owner, as it holds the private key.
 //
 // Parameters:
 //   - configPath: string - The path to save the configuration JSON file.
 //
 // Returns:
 //   - error: An error if the configuration file cannot be written.
-func (*Config) SaveConfig(configPath string) error {
-	file, err := os.Create(configPath)
+func (c *Config) SaveConfig(configPath string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
 	if err != nil {
-		return fmt.Errorf("failed to create config file: %v", err)
-	}
-	defer func() { _ = file.Close() }()
-
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(AppConfig); err != nil {
 		return fmt.Errorf("failed to encode config file: %v", err)
 	}
+	if err := writeFileAtomic(configPath, append(data, '\n'), 0o600); err != nil {
+		return fmt.Errorf("failed to write config file: %v", err)
+	}
 
 	return nil
 }
@@ -102,7 +105,19 @@ func (*Config) GetEcPrivateKey() (*ecdsa.PrivateKey, error) {
 //   - *ecdsa.PublicKey: The parsed ECDSA public key.
 //   - error: An error if decoding or parsing the public key fails.
 func (*Config) GetEcEndpointPublicKey() (*ecdsa.PublicKey, error) {
-	endpointPubKeyB64, _ := pem.Decode([]byte(AppConfig.EndpointPubKey))
+	return ParseEcPublicKey(AppConfig.EndpointPubKey)
+}
+
+// ParseEcPublicKey parses a PEM-encoded ECDSA public key as stored in the config.
+//
+// Parameters:
+//   - pemKey: string - The PEM-encoded public key.
+//
+// Returns:
+//   - *ecdsa.PublicKey: The parsed ECDSA public key.
+//   - error: An error if decoding or parsing the public key fails.
+func ParseEcPublicKey(pemKey string) (*ecdsa.PublicKey, error) {
+	endpointPubKeyB64, _ := pem.Decode([]byte(pemKey))
 	if endpointPubKeyB64 == nil {
 		return nil, fmt.Errorf("failed to decode endpoint public key")
 	}
@@ -1,9 +1,12 @@
 package config
 
 import (
+	"crypto/ecdsa"
 	"fmt"
 	"log"
 	"net"
+
+	"github.com/Diniboy1123/usque/models"
 )
 
 const (
@@ -68,3 +71,157 @@ func SelectEndpointFromConfig(useHTTP2 bool, useIPv6 bool, port int) (net.Addr,
 	}
 	return &net.UDPAddr{IP: ip, Port: port}, nil
 }
+
+// SelectEndpointsFromConfig returns the endpoint SelectEndpointFromConfig
+// picks together with the endpoint of the other address family, which is
+// raced against it (happy eyeballs). The second endpoint is nil when the
+// config has no usable one for the mode.
+func SelectEndpointsFromConfig(useHTTP2 bool, preferIPv6 bool, port int) (net.Addr, net.Addr, error) {
+	endpoint, err := SelectEndpointFromConfig(useHTTP2, preferIPv6, port)
+	if err != nil {
+		return nil, nil, err
+	}
+	alt, err := SelectEndpointFromConfig(useHTTP2, !preferIPv6, port)
+	if err != nil {
+		// the other address family is optional
+		return endpoint, nil, nil
+	}
+	return endpoint, alt, nil
+}
+
+// Endpoint is a further MASQUE endpoint to fail over to when the configured
+// one stops working.
+type Endpoint struct {
+	V4     string `json:"v4,omitempty"`      // IPv4 address of the endpoint
+	V6     string `json:"v6,omitempty"`      // IPv6 address of the endpoint
+	Ports  []int  `json:"ports,omitempty"`   // Ports to try, the connect port if empty
+	PubKey string `json:"pub_key,omitempty"` // PEM-encoded ECDSA public key, endpoint_pub_key if empty
+}
+
+// FailoverEndpoint is a parsed Endpoint.
+type FailoverEndpoint struct {
+	Endpoint    net.Addr
+	AltEndpoint net.Addr // endpoint of the other address family, nil if none
+	Ports       []int    // further ports to try when a handshake times out
+	PubKey      *ecdsa.PublicKey
+}
+
+// EndpointsFromPeers converts the peers of a registration response into the
+// primary endpoint and the endpoints to fail over to. The first peer is the
+// primary endpoint.
+//
+// Parameters:
+//   - peers: []models.Peer - The peers of the device config.
+//
+// Returns:
+//   - Endpoint: The primary endpoint.
+//   - []Endpoint: The endpoints to fail over to, in order.
+//   - error: An error if there are no peers or an address cannot be parsed.
+func EndpointsFromPeers(peers []models.Peer) (Endpoint, []Endpoint, error) {
+	if len(peers) == 0 {
+		return Endpoint{}, nil, fmt.Errorf("no peers in device config")
+	}
+
+	var endpoints []Endpoint
+	for i, peer := range peers {
+		v4, err := stripPort(peer.Endpoint.V4)
+		if err != nil {
+			return Endpoint{}, nil, fmt.Errorf("invalid IPv4 endpoint of peer %d: %v", i, err)
+		}
+		v6, err := stripPort(peer.Endpoint.V6)
+		if err != nil {
+			return Endpoint{}, nil, fmt.Errorf("invalid IPv6 endpoint of peer %d: %v", i, err)
+		}
+		endpoints = append(endpoints, Endpoint{V4: v4, V6: v6, Ports: peer.Endpoint.Ports, PubKey: peer.PublicKey})
+	}
+
+	return endpoints[0], endpoints[1:], nil
+}
+
+// stripPort returns the IP of an "ip:port" or "[ip]:port" endpoint as sent
+// by the API. Bare IPs are returned unchanged.
+func stripPort(endpoint string) (string, error) {
+	if endpoint == "" {
+		return "", nil
+	}
+	if ip := net.ParseIP(endpoint); ip != nil {
+		return endpoint, nil
+	}
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("%q is not an IP address", host)
+	}
+	return host, nil
+}
+
+// FailoverEndpointsFromConfig parses AppConfig.Endpoints into HTTP/3
+// endpoints on their first port, skipping ports of the primary endpoint
+// SelectEndpointFromConfig returns for port.
+//
+// Parameters:
+//   - preferIPv6: bool - Whether to prefer the IPv6 address of each endpoint.
+//   - port: int - The port of endpoints without ports.
+//
+// Returns:
+//   - []FailoverEndpoint: The endpoints in order.
+//   - error: An error if an address or public key cannot be parsed.
+func FailoverEndpointsFromConfig(preferIPv6 bool, port int) ([]FailoverEndpoint, error) {
+	primary, _ := SelectEndpointFromConfig(false, preferIPv6, port)
+
+	var endpoints []FailoverEndpoint
+	for i, e := range AppConfig.Endpoints {
+		pubKey, err := ParseEcPublicKey(AppConfig.EndpointPubKey)
+		if e.PubKey != "" {
+			pubKey, err = ParseEcPublicKey(e.PubKey)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("endpoint %d: %v", i, err)
+		}
+
+		var v4, v6 net.IP
+		if e.V4 != "" {
+			if v4 = net.ParseIP(e.V4); v4 == nil {
+				return nil, fmt.Errorf("endpoint %d: invalid v4 value %q", i, e.V4)
+			}
+		}
+		if e.V6 != "" {
+			if v6 = net.ParseIP(e.V6); v6 == nil {
+				return nil, fmt.Errorf("endpoint %d: invalid v6 value %q", i, e.V6)
+			}
+		}
+		first, second := v4, v6
+		if preferIPv6 {
+			first, second = v6, v4
+		}
+		if first == nil {
+			first, second = second, nil
+		}
+		if first == nil {
+			return nil, fmt.Errorf("endpoint %d has no address", i)
+		}
+
+		candidatePorts := e.Ports
+		if len(candidatePorts) == 0 {
+			candidatePorts = []int{port}
+		}
+		var ports []int
+		for _, p := range candidatePorts {
+			if primary == nil || (&net.UDPAddr{IP: first, Port: p}).String() != primary.String() {
+				ports = append(ports, p)
+			}
+		}
+		if len(ports) == 0 {
+			continue
+		}
+
+		f := FailoverEndpoint{Endpoint: &net.UDPAddr{IP: first, Port: ports[0]}, Ports: ports[1:], PubKey: pubKey}
+		if second != nil {
+			f.AltEndpoint = &net.UDPAddr{IP: second, Port: ports[0]}
+		}
+		endpoints = append(endpoints, f)
+	}
+	return endpoints, nil
+}
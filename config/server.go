@@ -0,0 +1,194 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/netip"
+	"os"
+)
+
+// ServerConfig represents the configuration of the built-in MASQUE server.
+type ServerConfig struct {
+	PrivateKey string         `json:"private_key"` // Base64-encoded ECDSA private key of the server
+	IPv4Pool   string         `json:"ipv4_pool"`   // IPv4 prefix client addresses are allocated from
+	IPv6Pool   string         `json:"ipv6_pool"`   // IPv6 prefix client addresses are allocated from
+	Clients    []ServerClient `json:"clients"`     // Clients allowed to connect
+}
+
+// ServerClient represents a client entry of the server configuration.
+type ServerClient struct {
+	Name      string `json:"name"`       // Human readable client name
+	PublicKey string `json:"public_key"` // PEM-encoded ECDSA public key of the client
+	IPv4      string `json:"ipv4"`       // Tunnel IPv4 address of the client
+	IPv6      string `json:"ipv6"`       // Tunnel IPv6 address of the client
+}
+
+// LoadServerConfig loads the server configuration from a JSON file.
+//
+// Parameters:
+//   - configPath: string - The path to the server configuration JSON file.
+//
+// Returns:
+//   - *ServerConfig: The parsed server configuration.
+//   - error: An error if the configuration file cannot be loaded or parsed.
+func LoadServerConfig(configPath string) (*ServerConfig, error) {
+	file, err := os.Open(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open server config file: %v", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	var cfg ServerConfig
+	if err := json.NewDecoder(file).Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to decode server config file: %v", err)
+	}
+
+	return &cfg, nil
+}
+
+// SaveServerConfig writes the server configuration to a prettified JSON file.
+//
+// Parameters:
+//   - configPath: string - The path to save the server configuration JSON file.
+//
+// Returns:
+//   - error: An error if the configuration file cannot be written.
+func (c *ServerConfig) SaveServerConfig(configPath string) error {
+	file, err := os.OpenFile(configPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create server config file: %v", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(c); err != nil {
+		return fmt.Errorf("failed to encode server config file: %v", err)
+	}
+
+	return nil
+}
+
+// GetEcPrivateKey retrieves the server's ECDSA private key from the stored Base64-encoded string.
+//
+// Returns:
+//   - *ecdsa.PrivateKey: The parsed ECDSA private key.
+//   - error: An error if decoding or parsing the private key fails.
+func (c *ServerConfig) GetEcPrivateKey() (*ecdsa.PrivateKey, error) {
+	privKeyDER, err := base64.StdEncoding.DecodeString(c.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode private key: %v", err)
+	}
+
+	privKey, err := x509.ParseECPrivateKey(privKeyDER)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %v", err)
+	}
+
+	return privKey, nil
+}
+
+// GetPools parses the configured IPv4 and IPv6 address pools.
+//
+// Returns:
+//   - netip.Prefix: The IPv4 pool.
+//   - netip.Prefix: The IPv6 pool.
+//   - error: An error if either pool is invalid.
+func (c *ServerConfig) GetPools() (netip.Prefix, netip.Prefix, error) {
+	v4, err := netip.ParsePrefix(c.IPv4Pool)
+	if err != nil || !v4.Addr().Is4() {
+		return netip.Prefix{}, netip.Prefix{}, fmt.Errorf("invalid ipv4_pool value %q", c.IPv4Pool)
+	}
+	v6, err := netip.ParsePrefix(c.IPv6Pool)
+	if err != nil || !v6.Addr().Is6() {
+		return netip.Prefix{}, netip.Prefix{}, fmt.Errorf("invalid ipv6_pool value %q", c.IPv6Pool)
+	}
+	return v4.Masked(), v6.Masked(), nil
+}
+
+// GatewayAddresses returns the server side addresses of the pools, which are
+// the first usable address of each pool. They are never handed out to clients.
+//
+// Returns:
+//   - netip.Addr: The IPv4 gateway address.
+//   - netip.Addr: The IPv6 gateway address.
+//   - error: An error if the pools are invalid.
+func (c *ServerConfig) GatewayAddresses() (netip.Addr, netip.Addr, error) {
+	v4, v6, err := c.GetPools()
+	if err != nil {
+		return netip.Addr{}, netip.Addr{}, err
+	}
+	return v4.Addr().Next(), v6.Addr().Next(), nil
+}
+
+// NextClientAddresses returns the lowest free IPv4 and IPv6 addresses in the
+// pools, skipping the network and gateway addresses.
+//
+// Returns:
+//   - netip.Addr: A free IPv4 address.
+//   - netip.Addr: A free IPv6 address.
+//   - error: An error if the pools are invalid or exhausted.
+func (c *ServerConfig) NextClientAddresses() (netip.Addr, netip.Addr, error) {
+	v4Pool, v6Pool, err := c.GetPools()
+	if err != nil {
+		return netip.Addr{}, netip.Addr{}, err
+	}
+
+	used := make(map[netip.Addr]bool, 2*len(c.Clients))
+	for _, client := range c.Clients {
+		if addr, err := netip.ParseAddr(client.IPv4); err == nil {
+			used[addr] = true
+		}
+		if addr, err := netip.ParseAddr(client.IPv6); err == nil {
+			used[addr] = true
+		}
+	}
+
+	next := func(pool netip.Prefix) (netip.Addr, error) {
+		// skip the network address and the gateway
+		for addr := pool.Addr().Next().Next(); pool.Contains(addr); addr = addr.Next() {
+			if !used[addr] {
+				return addr, nil
+			}
+		}
+		return netip.Addr{}, fmt.Errorf("address pool %s is exhausted", pool)
+	}
+
+	v4, err := next(v4Pool)
+	if err != nil {
+		return netip.Addr{}, netip.Addr{}, err
+	}
+	v6, err := next(v6Pool)
+	if err != nil {
+		return netip.Addr{}, netip.Addr{}, err
+	}
+	return v4, v6, nil
+}
+
+// GetEcPublicKey retrieves the client's ECDSA public key from the stored PEM-encoded string.
+//
+// Returns:
+//   - *ecdsa.PublicKey: The parsed ECDSA public key.
+//   - error: An error if decoding or parsing the public key fails.
+func (c *ServerClient) GetEcPublicKey() (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(c.PublicKey))
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode public key of client %q", c.Name)
+	}
+
+	pubKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key of client %q: %v", c.Name, err)
+	}
+
+	ecPubKey, ok := pubKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key of client %q is not ECDSA", c.Name)
+	}
+
+	return ecPubKey, nil
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// State is runtime state kept across restarts next to the config file.
+type State struct {
+	LastEndpoint string `json:"last_endpoint,omitempty"` // Last endpoint a tunnel was established with
+}
+
+// StatePath returns the path of the state file belonging to a config file,
+// e.g. config.state.json for config.json.
+//
+// Parameters:
+//   - configPath: string - The path to the configuration JSON file.
+//
+// Returns:
+//   - string: The path of the state file.
+func StatePath(configPath string) string {
+	return strings.TrimSuffix(configPath, filepath.Ext(configPath)) + ".state.json"
+}
+
+// LoadState loads the state from a JSON file. A missing file yields an empty
+// state.
+//
+// Parameters:
+//   - statePath: string - The path to the state JSON file.
+//
+// Returns:
+//   - State: The loaded state.
+//   - error: An error if the state file cannot be read or parsed.
+func LoadState(statePath string) (State, error) {
+	var state State
+	data, err := os.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("failed to read state file: %v", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("failed to decode state file: %v", err)
+	}
+	return state, nil
+}
+
+// SaveState atomically writes the state to a JSON file.
+//
+// Parameters:
+//   - statePath: string - The path to save the state JSON file.
+//   - state: State - The state to save.
+//
+// Returns:
+//   - error: An error if the state file cannot be written.
+func SaveState(statePath string, state State) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state file: %v", err)
+	}
+
+	if err := writeFileAtomic(statePath, append(data, '\n'), 0o600); err != nil {
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"github.com/Diniboy1123/usque/models"
+)
+
+// Service modes of a Zero Trust policy that matter to usque.
+const (
+	ServiceModeWarp  = "warp"
+	ServiceModeProxy = "proxy"
+)
+
+// ZeroTrust is the policy of a Zero Trust (Teams) device, saved at
+// registration and refreshed by enroll.
+type ZeroTrust struct {
+	Organization    string           `json:"organization,omitempty"`     // Name of the organization the device belongs to
+	ServiceMode     string           `json:"service_mode,omitempty"`     // Service mode of the policy, e.g. "warp" or "proxy"
+	ProxyPort       int              `json:"proxy_port,omitempty"`       // Local proxy port in "proxy" service mode
+	Include         []string         `json:"include,omitempty"`          // Addresses, CIDRs or hosts that are the only ones using the tunnel
+	Exclude         []string         `json:"exclude,omitempty"`          // Addresses, CIDRs or hosts bypassing the tunnel, if Include is empty
+	FallbackDomains []FallbackDomain `json:"fallback_domains,omitempty"` // Domains resolved outside the tunnel
+}
+
+// FallbackDomain is a domain suffix resolved by other DNS servers than the
+// tunnel's.
+type FallbackDomain struct {
+	Suffix     string   `json:"suffix"`                // Domain suffix, matching itself and its subdomains
+	DNSServers []string `json:"dns_servers,omitempty"` // DNS servers to use, the system's if empty
+}
+
+// ZeroTrustFromAccount extracts the Zero Trust policy of a registration
+// response.
+//
+// Parameters:
+//   - data: *models.AccountData - The device data returned by registration or enrollment.
+//
+// Returns:
+//   - *ZeroTrust: The policy, or nil if the device is a consumer one.
+func ZeroTrustFromAccount(data *models.AccountData) *ZeroTrust {
+	if data.Account.AccountType != "team" && data.Account.Organization == "" {
+		return nil
+	}
+
+	zt := &ZeroTrust{
+		Organization: data.Account.Organization,
+		ServiceMode:  ServiceModeWarp,
+	}
+	if mode := data.Policy.ServiceMode; mode != nil && mode.Mode != "" {
+		zt.ServiceMode = mode.Mode
+		zt.ProxyPort = mode.Port
+	}
+	zt.Include = splitTunnelEntries(data.Policy.Include)
+	zt.Exclude = splitTunnelEntries(data.Policy.Exclude)
+	for _, domain := range data.Policy.FallbackDomains {
+		zt.FallbackDomains = append(zt.FallbackDomains, FallbackDomain{
+			Suffix:     domain.Suffix,
+			DNSServers: domain.DNSServer,
+		})
+	}
+	return zt
+}
+
+// splitTunnelEntries flattens entries into their address or host.
+func splitTunnelEntries(entries []models.SplitTunnelEntry) []string {
+	var out []string
+	for _, entry := range entries {
+		switch {
+		case entry.Address != "":
+			out = append(out, entry.Address)
+		case entry.Host != "":
+			out = append(out, entry.Host)
+		}
+	}
+	return out
+}
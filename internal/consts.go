@@ -5,9 +5,11 @@ const (
 	ApiVersion = "v0a4471"
 	ConnectSNI   = "consumer-masque.cloudflareclient.com"
 	L4ConnectSNI = "consumer-masque-proxy.cloudflareclient.com"
-	// unused for now
+	// ZeroTierSNI is the SNI of Zero Trust devices
 	ZeroTierSNI   = "zt-masque.cloudflareclient.com"
 	ConnectURI    = "https://cloudflareaccess.com"
+	// ConnectUDPURI is the CONNECT-UDP (RFC 9298) URI template of the L4 proxy
+	ConnectUDPURI = "https://cloudflareaccess.com/.well-known/masque/udp/{target_host}/{target_port}/"
 	DefaultModel  = "PC"
 	KeyTypeWg     = "curve25519"
 	TunTypeWg     = "wireguard"
@@ -0,0 +1,259 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	natNICID            = 1
+	natTCPReceiveWindow = 0 // 0 lets gVisor pick its default receive window
+	natTCPMaxInFlight   = 1024
+	natDialTimeout      = 10 * time.Second
+)
+
+// NATStack is a user-space NAT built on top of a gVisor netstack.
+//
+// Packets written with WritePacket are parsed by the netstack, which
+// terminates every TCP connection and UDP flow regardless of its destination
+// address. Each flow is then re-originated from the host network with a
+// regular net.Dialer, and replies travel back out through ReadPacket with
+// the original destination as their source. ICMP is not forwarded.
+//
+// NATStack satisfies the api.TunnelDevice interface, so it can sit behind
+// the MASQUE server in place of a kernel TUN device when no privileges are
+// available.
+type NATStack struct {
+	ep         *channel.Endpoint
+	stack      *stack.Stack
+	udpTimeout time.Duration
+	dialer     net.Dialer
+	ctx        context.Context
+	cancel     context.CancelFunc
+	closeOnce  sync.Once
+}
+
+// NewNATStack creates a NATStack with the given MTU.
+//
+// Parameters:
+//   - mtu: int - The MTU of the virtual link.
+//   - udpTimeout: time.Duration - Idle timeout of forwarded UDP flows (0 = never expire).
+//
+// Returns:
+//   - *NATStack: The NAT stack, ready to accept packets.
+//   - error: An error if the netstack could not be set up.
+func NewNATStack(mtu int, udpTimeout time.Duration) (*NATStack, error) {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+
+	sackEnabledOpt := tcpip.TCPSACKEnabled(true)
+	if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &sackEnabledOpt); err != nil {
+		return nil, fmt.Errorf("could not enable TCP SACK: %v", err)
+	}
+
+	ep := channel.New(1024, uint32(mtu), "")
+	if err := s.CreateNIC(natNICID, ep); err != nil {
+		return nil, fmt.Errorf("CreateNIC: %v", err)
+	}
+	// Promiscuous mode makes the stack accept packets for any destination,
+	// spoofing lets it answer from those destinations.
+	if err := s.SetPromiscuousMode(natNICID, true); err != nil {
+		return nil, fmt.Errorf("SetPromiscuousMode: %v", err)
+	}
+	if err := s.SetSpoofing(natNICID, true); err != nil {
+		return nil, fmt.Errorf("SetSpoofing: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: natNICID},
+		{Destination: header.IPv6EmptySubnet, NIC: natNICID},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &NATStack{
+		ep:         ep,
+		stack:      s,
+		udpTimeout: udpTimeout,
+		dialer:     net.Dialer{Timeout: natDialTimeout},
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+
+	tcpForwarder := tcp.NewForwarder(s, natTCPReceiveWindow, natTCPMaxInFlight, n.handleTCP)
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+	udpForwarder := udp.NewForwarder(s, n.handleUDP)
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+
+	return n, nil
+}
+
+// ReadPacket blocks until the netstack emits a packet and copies it into buf.
+func (n *NATStack) ReadPacket(buf []byte) (int, error) {
+	pkt := n.ep.ReadContext(n.ctx)
+	if pkt == nil {
+		return 0, os.ErrClosed
+	}
+	view := pkt.ToView()
+	pkt.DecRef()
+	defer view.Release()
+
+	if view.Size() > len(buf) {
+		return 0, io.ErrShortBuffer
+	}
+	return view.Read(buf)
+}
+
+// WritePacket injects a packet received from a client into the netstack.
+func (n *NATStack) WritePacket(pkt []byte) error {
+	if n.ctx.Err() != nil {
+		return os.ErrClosed
+	}
+	if len(pkt) == 0 {
+		return nil
+	}
+
+	var proto tcpip.NetworkProtocolNumber
+	switch pkt[0] >> 4 {
+	case 4:
+		proto = header.IPv4ProtocolNumber
+	case 6:
+		proto = header.IPv6ProtocolNumber
+	default:
+		return fmt.Errorf("unknown IP version %d", pkt[0]>>4)
+	}
+
+	// the netstack takes ownership of the payload, so hand it a private copy
+	pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(append([]byte(nil), pkt...))})
+	n.ep.InjectInbound(proto, pkb)
+	pkb.DecRef()
+	return nil
+}
+
+// Close tears down the netstack. Pending ReadPacket calls return os.ErrClosed.
+func (n *NATStack) Close() error {
+	n.closeOnce.Do(func() {
+		n.cancel()
+		n.stack.RemoveNIC(natNICID)
+		n.stack.Close()
+		n.ep.Close()
+	})
+	return nil
+}
+
+func (n *NATStack) handleTCP(r *tcp.ForwarderRequest) {
+	id := r.ID()
+	target := net.JoinHostPort(id.LocalAddress.String(), fmt.Sprint(id.LocalPort))
+
+	// Dial first so that an unreachable target is reported to the client as a
+	// reset instead of an accepted connection that immediately closes.
+	remote, err := n.dialer.DialContext(n.ctx, "tcp", target)
+	if err != nil {
+		r.Complete(true)
+		return
+	}
+
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		r.Complete(true)
+		_ = remote.Close()
+		return
+	}
+	r.Complete(false)
+	ep.SocketOptions().SetKeepAlive(true)
+
+	relayNATConns(gonet.NewTCPConn(&wq, ep), remote)
+}
+
+func (n *NATStack) handleUDP(r *udp.ForwarderRequest) bool {
+	id := r.ID()
+	target := net.JoinHostPort(id.LocalAddress.String(), fmt.Sprint(id.LocalPort))
+
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		return true
+	}
+	local := gonet.NewUDPConn(&wq, ep)
+
+	go func() {
+		defer func() { _ = local.Close() }()
+
+		remote, err := n.dialer.DialContext(n.ctx, "udp", target)
+		if err != nil {
+			log.Printf("nat: failed to dial UDP %s: %v", target, err)
+			return
+		}
+		defer func() { _ = remote.Close() }()
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		copyUDP := func(dst, src net.Conn) {
+			defer wg.Done()
+			buf := make([]byte, 65535)
+			for {
+				if n.udpTimeout > 0 {
+					if err := src.SetReadDeadline(time.Now().Add(n.udpTimeout)); err != nil {
+						break
+					}
+				}
+				nr, err := src.Read(buf)
+				if err != nil {
+					break
+				}
+				if _, err := dst.Write(buf[:nr]); err != nil {
+					break
+				}
+			}
+			// unblock the opposite direction
+			_ = local.SetReadDeadline(time.Now())
+			_ = remote.SetReadDeadline(time.Now())
+		}
+		go copyUDP(remote, local)
+		go copyUDP(local, remote)
+		wg.Wait()
+	}()
+
+	return true
+}
+
+// relayNATConns copies bytes between a and b until both directions finish.
+func relayNATConns(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	relay := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, err := io.Copy(dst, src)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			_ = dst.Close()
+		}
+		if cw, ok := dst.(closeWriter); ok {
+			_ = cw.CloseWrite()
+		}
+	}
+	go relay(a, b)
+	go relay(b, a)
+	wg.Wait()
+	_ = a.Close()
+	_ = b.Close()
+}
@@ -0,0 +1,40 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+)
+
+// ErrBlocked is returned by dialers for destinations that routing rules
+// block.
+var ErrBlocked = errors.New("blocked by routing rules")
+
+// clientAddrKey is the context key of the client address.
+type clientAddrKey struct{}
+
+// WithClientAddr returns a copy of ctx carrying the address of the proxy
+// client a connection is dialed for, which routing rules can match on.
+//
+// Parameters:
+//   - ctx: context.Context - The parent context.
+//   - addr: netip.Addr - The address of the client.
+//
+// Returns:
+//   - context.Context: The context carrying addr.
+func WithClientAddr(ctx context.Context, addr netip.Addr) context.Context {
+	return context.WithValue(ctx, clientAddrKey{}, addr.Unmap())
+}
+
+// ClientAddr returns the client address carried by ctx, if any.
+//
+// Parameters:
+//   - ctx: context.Context - The context of the dial.
+//
+// Returns:
+//   - netip.Addr: The address of the client.
+//   - bool: Whether ctx carries one.
+func ClientAddr(ctx context.Context) (netip.Addr, bool) {
+	addr, ok := ctx.Value(clientAddrKey{}).(netip.Addr)
+	return addr, ok
+}
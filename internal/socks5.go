@@ -24,10 +24,12 @@ type SOCKS5Config struct {
 	Resolver   *TunnelDNSResolver
 	TunNet     *netstack.Net
 	DialTCP    func(ctx context.Context, network, address string) (net.Conn, error)
+	DialUDP    func(ctx context.Context, network, address string) (net.Conn, error) // used instead of TunNet for UDP ASSOCIATE if set
 	TCPOnly    bool
 	TCPTimeout time.Duration // 0 = no deadline on TCP CONNECT relay
 	UDPTimeout time.Duration // 0 = no deadline on remote UDP reads
 	Logger     *log.Logger
+	Route      func(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) // wraps the TCP and UDP dialers if set, e.g. to route by rules; dial contexts carry the client address (see WithClientAddr)
 }
 
 // SOCKS5Server wraps txthinking/socks5; DialTCP/DialUDP are package globals (last NewSOCKS5Server wins).
@@ -36,6 +38,14 @@ type SOCKS5Server struct {
 	server *socks5.Server
 }
 
+// routed returns dial wrapped by the Route of the config, if any.
+func (s *SOCKS5Server) routed(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	if s.cfg.Route == nil {
+		return dial
+	}
+	return s.cfg.Route(dial)
+}
+
 func NewSOCKS5Server(cfg SOCKS5Config) (*SOCKS5Server, error) {
 	if cfg.DialTCP == nil {
 		if cfg.Resolver == nil {
@@ -227,12 +237,22 @@ func logSOCKSError(stage string, addr net.Addr, err error) {
 }
 
 func (s *SOCKS5Server) dialTCP(network, _, raddr string) (net.Conn, error) {
+	return s.dialTCPContext(context.Background(), network, raddr)
+}
+
+func (s *SOCKS5Server) dialTCPContext(ctx context.Context, network, raddr string) (net.Conn, error) {
+	dial := s.tunnelDialTCP
 	if s.cfg.DialTCP != nil {
-		return s.cfg.DialTCP(context.Background(), network, raddr)
+		dial = s.cfg.DialTCP
 	}
+	return s.routed(dial)(ctx, network, raddr)
+}
+
+// tunnelDialTCP dials raddr through TunNet, resolving names with Resolver.
+func (s *SOCKS5Server) tunnelDialTCP(ctx context.Context, network, raddr string) (net.Conn, error) {
 	// Default (tunnel DNS): one netstack lookup + dial, same as the old things-go WithDial path.
 	if s.cfg.Resolver.TunNet != nil {
-		return s.cfg.TunNet.DialContext(context.Background(), network, raddr)
+		return s.cfg.TunNet.DialContext(ctx, network, raddr)
 	}
 	host, port, err := net.SplitHostPort(raddr)
 	if err != nil {
@@ -243,9 +263,9 @@ func (s *SOCKS5Server) dialTCP(network, _, raddr string) (net.Conn, error) {
 		if err != nil {
 			return nil, err
 		}
-		return s.cfg.TunNet.DialContextTCP(context.Background(), addr)
+		return s.cfg.TunNet.DialContextTCP(ctx, addr)
 	}
-	resIP, err := s.cfg.Resolver.Resolve(context.Background(), host)
+	resIP, err := s.cfg.Resolver.Resolve(ctx, host)
 	if err != nil {
 		return nil, err
 	}
@@ -253,19 +273,32 @@ func (s *SOCKS5Server) dialTCP(network, _, raddr string) (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	return s.cfg.TunNet.DialContextTCP(context.Background(), addr)
+	return s.cfg.TunNet.DialContextTCP(ctx, addr)
 }
 
 func (s *SOCKS5Server) dialUDP(network, laddr, raddr string) (net.Conn, error) {
-	if s.cfg.Resolver.TunNet != nil {
-		c, err := s.cfg.TunNet.DialContext(context.Background(), network, raddr)
-		if err != nil {
-			if strings.Contains(err.Error(), "port is in use") {
-				return nil, &net.AddrError{Err: "address already in use", Addr: laddr}
-			}
-			return nil, err
+	return s.dialUDPContext(context.Background(), network, laddr, raddr)
+}
+
+func (s *SOCKS5Server) dialUDPContext(ctx context.Context, network, laddr, raddr string) (net.Conn, error) {
+	dial := s.tunnelDialUDP
+	if s.cfg.DialUDP != nil {
+		dial = s.cfg.DialUDP
+	}
+	c, err := s.routed(dial)(ctx, network, raddr)
+	if err != nil {
+		if strings.Contains(err.Error(), "port is in use") {
+			return nil, &net.AddrError{Err: "address already in use", Addr: laddr}
 		}
-		return c, nil
+		return nil, err
+	}
+	return c, nil
+}
+
+// tunnelDialUDP dials raddr through TunNet, resolving names with Resolver.
+func (s *SOCKS5Server) tunnelDialUDP(ctx context.Context, network, raddr string) (net.Conn, error) {
+	if s.cfg.Resolver.TunNet != nil {
+		return s.cfg.TunNet.DialContext(ctx, network, raddr)
 	}
 	host, port, err := net.SplitHostPort(raddr)
 	if err != nil {
@@ -278,7 +311,7 @@ func (s *SOCKS5Server) dialUDP(network, laddr, raddr string) (net.Conn, error) {
 		}
 		return s.cfg.TunNet.DialUDP(nil, addr)
 	}
-	resIP, err := s.cfg.Resolver.Resolve(context.Background(), host)
+	resIP, err := s.cfg.Resolver.Resolve(ctx, host)
 	if err != nil {
 		return nil, err
 	}
@@ -286,20 +319,13 @@ func (s *SOCKS5Server) dialUDP(network, laddr, raddr string) (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	rc, err := s.cfg.TunNet.DialUDP(nil, addr)
-	if err != nil {
-		if strings.Contains(err.Error(), "port is in use") {
-			return nil, &net.AddrError{Err: "address already in use", Addr: laddr}
-		}
-		return nil, err
-	}
-	return rc, nil
+	return s.cfg.TunNet.DialUDP(nil, addr)
 }
 
 func (s *SOCKS5Server) TCPHandle(srv *socks5.Server, c *net.TCPConn, r *socks5.Request) error {
 	switch r.Cmd {
 	case socks5.CmdConnect:
-		rc, err := r.Connect(c)
+		rc, err := s.connect(clientContext(c.RemoteAddr()), c, r)
 		if err != nil {
 			return err
 		}
@@ -323,6 +349,59 @@ func (s *SOCKS5Server) TCPHandle(srv *socks5.Server, c *net.TCPConn, r *socks5.R
 	return socks5.ErrUnsupportCmd
 }
 
+// clientContext returns a context carrying the address of the client at
+// addr, see WithClientAddr.
+func clientContext(addr net.Addr) context.Context {
+	ctx := context.Background()
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return WithClientAddr(ctx, addr.AddrPort().Addr())
+	case *net.UDPAddr:
+		return WithClientAddr(ctx, addr.AddrPort().Addr())
+	}
+	return ctx
+}
+
+// connect is like socks5.Request.Connect, but dials with ctx and refuses
+// destinations blocked by routing rules as not allowed.
+func (s *SOCKS5Server) connect(ctx context.Context, w io.Writer, r *socks5.Request) (net.Conn, error) {
+	failure := func(rep byte, err error) (net.Conn, error) {
+		var p *socks5.Reply
+		if r.Atyp == socks5.ATYPIPv4 || r.Atyp == socks5.ATYPDomain {
+			p = socks5.NewReply(rep, socks5.ATYPIPv4, []byte{0x00, 0x00, 0x00, 0x00}, []byte{0x00, 0x00})
+		} else {
+			p = socks5.NewReply(rep, socks5.ATYPIPv6, []byte(net.IPv6zero), []byte{0x00, 0x00})
+		}
+		if _, err := p.WriteTo(w); err != nil {
+			return nil, err
+		}
+		return nil, err
+	}
+
+	rc, err := s.dialTCPContext(ctx, "tcp", r.Address())
+	if err != nil {
+		if errors.Is(err, ErrBlocked) {
+			return failure(socks5.RepNotAllowed, err)
+		}
+		return failure(socks5.RepHostUnreachable, err)
+	}
+
+	a, addr, port, err := socks5.ParseAddress(rc.LocalAddr().String())
+	if err != nil {
+		_ = rc.Close()
+		return failure(socks5.RepHostUnreachable, err)
+	}
+	if a == socks5.ATYPDomain {
+		addr = addr[1:]
+	}
+	p := socks5.NewReply(socks5.RepSuccess, a, addr, port)
+	if _, err := p.WriteTo(w); err != nil {
+		_ = rc.Close()
+		return nil, err
+	}
+	return rc, nil
+}
+
 type closeWriter interface {
 	CloseWrite() error
 }
@@ -392,7 +471,7 @@ func (s *SOCKS5Server) UDPHandle(srv *socks5.Server, addr *net.UDPAddr, d *socks
 		return fmt.Errorf("too many active UDP relay exchanges")
 	}
 
-	rc, err := socks5.DialUDP("udp", "", dst)
+	rc, err := s.dialUDPContext(clientContext(addr), "udp", "", dst)
 	if err != nil {
 		<-udpRelaySem
 		return err
@@ -24,6 +24,7 @@ type PortMapping struct {
 	LocalPort   int    // The local port number.
 	RemoteIP    string // The remote destination IP address.
 	RemotePort  int    // The remote destination port number.
+	RemoteHost  string // The remote destination hostname or IP address, unresolved by ParseUnresolvedPortMapping.
 }
 
 // GenerateRandomAndroidSerial generates a random 8-byte Android-like device identifier
@@ -104,10 +105,26 @@ func GenerateEcKeyPair() ([]byte, []byte, error) {
 //   - [][]byte: A slice containing the certificate in DER format.
 //   - error:    An error if certificate generation fails.
 func GenerateCert(privKey *ecdsa.PrivateKey, pubKey *ecdsa.PublicKey) ([][]byte, error) {
+	now := time.Now()
+	return GenerateCertValidity(privKey, now, now.Add(1*24*time.Hour))
+}
+
+// GenerateCertValidity creates a self-signed certificate of privKey valid
+// from notBefore until notAfter.
+//
+// Parameters:
+//   - privKey: *ecdsa.PrivateKey - The private key to sign the certificate, whose public key it contains.
+//   - notBefore: time.Time - The start of the validity period.
+//   - notAfter: time.Time - The end of the validity period.
+//
+// Returns:
+//   - [][]byte: A slice containing the certificate in DER format.
+//   - error:    An error if certificate generation fails.
+func GenerateCertValidity(privKey *ecdsa.PrivateKey, notBefore, notAfter time.Time) ([][]byte, error) {
 	cert, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
 		SerialNumber: big.NewInt(0),
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().Add(1 * 24 * time.Hour),
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
 	}, &x509.Certificate{}, &privKey.PublicKey, privKey)
 	if err != nil {
 		return nil, err
@@ -146,14 +163,15 @@ func DefaultQuicConfig(keepalivePeriod time.Duration, initialPacketSize uint16)
 //
 // Parameters:
 //   - port: string - The port mapping string.
+//   - resolveRemote: bool - Whether to resolve the remote hostname to an IP.
 //
 // Returns:
 //   - string: The bind address.
 //   - int: The local port.
-//   - string: The remote hostname/IP.
+//   - string: The remote hostname/IP, resolved if resolveRemote is set.
 //   - int: The remote port.
 //   - error: An error if parsing fails.
-func parsePortMapping(port string) (bindAddress string, localPort int, remoteHost string, remotePort int, err error) {
+func parsePortMapping(port string, resolveRemote bool) (bindAddress string, localPort int, remoteHost string, remotePort int, err error) {
 	parts := strings.Split(port, ":")
 
 	// Handle IPv6 addresses (which are enclosed in brackets)
@@ -203,9 +221,11 @@ func parsePortMapping(port string) (bindAddress string, localPort int, remoteHos
 		return "", 0, "", 0, errors.New("invalid local address: " + err.Error())
 	}
 
-	remoteHost, err = resolveBindAddress(remoteHost)
-	if err != nil {
-		return "", 0, "", 0, errors.New("invalid remote address: " + err.Error())
+	if resolveRemote {
+		remoteHost, err = resolveBindAddress(remoteHost)
+		if err != nil {
+			return "", 0, "", 0, errors.New("invalid remote address: " + err.Error())
+		}
 	}
 
 	return bindAddress, localPort, remoteHost, remotePort, nil
@@ -222,7 +242,7 @@ func parsePortMapping(port string) (bindAddress string, localPort int, remoteHos
 //   - PortMapping: A structured representation of the parsed port mapping.
 //   - error:       An error if the parsing fails.
 func ParsePortMapping(port string) (PortMapping, error) {
-	bindAddress, localPort, remoteHost, remotePort, err := parsePortMapping(port)
+	bindAddress, localPort, remoteIP, remotePort, err := parsePortMapping(port, true)
 	if err != nil {
 		return PortMapping{}, err
 	}
@@ -230,11 +250,41 @@ func ParsePortMapping(port string) (PortMapping, error) {
 	return PortMapping{
 		BindAddress: bindAddress,
 		LocalPort:   localPort,
-		RemoteIP:    remoteHost,
+		RemoteIP:    remoteIP,
 		RemotePort:  remotePort,
+		RemoteHost:  remoteIP,
 	}, nil
 }
 
+// ParseUnresolvedPortMapping parses a port mapping string like
+// ParsePortMapping, but leaves the remote host as given, so that hostnames
+// can be resolved on the far side of the tunnel. RemoteIP is only set if the
+// remote host is an IP address.
+//
+// Parameters:
+//   - port: string - The port mapping string.
+//
+// Returns:
+//   - PortMapping: A structured representation of the parsed port mapping.
+//   - error:       An error if the parsing fails.
+func ParseUnresolvedPortMapping(port string) (PortMapping, error) {
+	bindAddress, localPort, remoteHost, remotePort, err := parsePortMapping(port, false)
+	if err != nil {
+		return PortMapping{}, err
+	}
+
+	pm := PortMapping{
+		BindAddress: bindAddress,
+		LocalPort:   localPort,
+		RemotePort:  remotePort,
+		RemoteHost:  remoteHost,
+	}
+	if ip := net.ParseIP(remoteHost); ip != nil {
+		pm.RemoteIP = ip.String()
+	}
+	return pm, nil
+}
+
 // resolveBindAddress resolves a hostname or IP to its string representation.
 //
 // Parameters:
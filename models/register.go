@@ -98,7 +98,38 @@ type Peer struct {
 
 type Policy struct {
 	TunnelProtocol string `json:"tunnel_protocol"`
-	// TODO: add ZeroTier fields
+	// ServiceMode only set for ZeroTier
+	ServiceMode *ServiceMode `json:"service_mode_v2,omitempty"`
+	// Include only set for ZeroTier, when only these destinations use the tunnel
+	Include []SplitTunnelEntry `json:"include,omitempty"`
+	// Exclude only set for ZeroTier, when these destinations bypass the tunnel
+	Exclude []SplitTunnelEntry `json:"exclude,omitempty"`
+	// FallbackDomains only set for ZeroTier
+	FallbackDomains []FallbackDomain `json:"fallback_domains,omitempty"`
+	// GatewayUniqueID only set for ZeroTier
+	GatewayUniqueID string `json:"gateway_unique_id,omitempty"`
+}
+
+type ServiceMode struct {
+	// Mode is e.g. "warp", "proxy", "1dot1" or "posture_only"
+	Mode string `json:"mode"`
+	// Port is the local proxy port in "proxy" mode
+	Port int `json:"port,omitempty"`
+}
+
+type SplitTunnelEntry struct {
+	// Address is an IP address or CIDR, unset for hosts
+	Address string `json:"address,omitempty"`
+	// Host is a domain, unset for addresses
+	Host        string `json:"host,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+type FallbackDomain struct {
+	Suffix string `json:"suffix"`
+	// DNSServer are the resolvers for the suffix, the system's if empty
+	DNSServer   []string `json:"dns_server,omitempty"`
+	Description string   `json:"description,omitempty"`
 }
 
 type Devices []Device